@@ -21,7 +21,6 @@ import (
 	"fmt"
 	"net"
 	"sort"
-	"sync"
 )
 
 const (
@@ -30,17 +29,31 @@ const (
 	// is removed from the map all together. This ensures broadcasts are
 	// emitted briefly, but retained long enough to not be received twice.
 	broadcastRemoveValue int8 = int8(-100)
+
+	// MaxTopicLength is the maximum length of a broadcast topic, in bytes.
+	MaxTopicLength = 255
 )
 
-// The index counter value for the next broadcast message
-var indexCounter uint32 = 1
+// broadcastKind distinguishes user broadcasts from those used internally by
+// Smudge itself. Only user broadcasts are passed to BroadcastListeners.
+type broadcastKind byte
+
+const (
+	// A broadcast emitted by BroadcastBytes() or BroadcastString().
+	broadcastUser broadcastKind = iota
+
+	// A keyring operation request; see keymanager.go.
+	broadcastKeyRequest
 
-// Emitted broadcasts. Once they are added here, the membership machinery will
-// pick them up and piggyback them onto standard messages.
-var broadcasts = struct {
-	sync.RWMutex
-	m map[string]*Broadcast
-}{m: make(map[string]*Broadcast)}
+	// A response to a keyring operation request.
+	broadcastKeyResponse
+
+	// An announcement of a reliable broadcast; see reliable.go.
+	broadcastReliable
+
+	// A query; see query.go.
+	broadcastQuery
+)
 
 // Broadcast represents a packet of bytes emitted across the cluster on top of
 // the status update infrastructure. Although useful, its payload is limited
@@ -50,7 +63,9 @@ type Broadcast struct {
 	origin      *Node
 	index       uint32
 	label       string
+	topic       string
 	emitCounter int8
+	kind        broadcastKind
 }
 
 // Bytes returns a copy of this broadcast's bytes. Manipulating the contents
@@ -71,11 +86,11 @@ func (b *Broadcast) Index() uint32 {
 }
 
 // Label returns a unique label string composed of originIP:originPort:Index.
+// IPv6 origins are bracketed, as in [originIP]:originPort:Index.
 func (b *Broadcast) Label() string {
 	if b.label == "" {
-		b.label = fmt.Sprintf("%s:%d:%d",
-			b.origin.ip.String(),
-			b.origin.port,
+		b.label = fmt.Sprintf("%s:%d",
+			nodeAddressString(b.origin.ip, b.origin.port),
 			b.index)
 	}
 
@@ -87,145 +102,215 @@ func (b *Broadcast) Origin() *Node {
 	return b.origin
 }
 
+// Topic returns the topic this broadcast was emitted on with
+// BroadcastToTopic(), or an empty string if it has none.
+func (b *Broadcast) Topic() string {
+	return b.topic
+}
+
+// BroadcastBytes allows a user to emit a short broadcast in the form of a byte
+// slice on the default cluster. See Cluster.BroadcastBytes().
+func BroadcastBytes(bytes []byte) error {
+	return defaultCluster.BroadcastBytes(bytes)
+}
+
 // BroadcastBytes allows a user to emit a short broadcast in the form of a byte
 // slice, which will be transmitted at most once to all other healthy current
 // members. Members that join after the broadcast has already propagated
 // through the cluster will not receive the message. The maximum broadcast
 // length is 256 bytes.
-func BroadcastBytes(bytes []byte) error {
-	if len(bytes) > GetMaxBroadcastBytes() {
+func (c *Cluster) BroadcastBytes(bytes []byte) error {
+	if len(bytes) > c.MaxBroadcastBytes() {
 		emsg := fmt.Sprintf(
 			"broadcast payload length exceeds %d bytes",
-			GetMaxBroadcastBytes())
+			c.MaxBroadcastBytes())
 
 		return errors.New(emsg)
 	}
 
-	broadcasts.Lock()
+	c.queueBroadcast(broadcastUser, bytes)
 
-	bcast := Broadcast{
-		origin:      thisHost,
-		index:       indexCounter,
-		bytes:       bytes,
-		emitCounter: int8(emitCount())}
+	return nil
+}
+
+// BroadcastToTopic emits a short broadcast on a topic from the default
+// cluster. See Cluster.BroadcastToTopic().
+func BroadcastToTopic(topic string, bytes []byte) error {
+	return defaultCluster.BroadcastToTopic(topic, bytes)
+}
 
-	broadcasts.m[bcast.Label()] = &bcast
+// BroadcastToTopic emits a short broadcast like BroadcastBytes(), but tagged
+// with a topic of up to MaxTopicLength bytes. It's delivered only to the
+// listeners added for that topic with AddTopicListener(), so that several
+// subsystems can share one cluster without having to inspect each other's
+// payloads. An empty topic is equivalent to BroadcastBytes().
+func (c *Cluster) BroadcastToTopic(topic string, bytes []byte) error {
+	if len(topic) > MaxTopicLength {
+		return fmt.Errorf("broadcast topic length exceeds %d bytes", MaxTopicLength)
+	}
 
-	indexCounter++
+	if len(bytes) > c.MaxBroadcastBytes() {
+		return fmt.Errorf("broadcast payload length exceeds %d bytes",
+			c.MaxBroadcastBytes())
+	}
 
-	broadcasts.Unlock()
+	c.queueTopicBroadcast(broadcastUser, topic, bytes)
 
 	return nil
 }
 
+// BroadcastString allows a user to emit a short broadcast in the form of a
+// string on the default cluster. See Cluster.BroadcastString().
+func BroadcastString(str string) error {
+	return defaultCluster.BroadcastString(str)
+}
+
 // BroadcastString allows a user to emit a short broadcast in the form of a
 // string, which will be transmitted at most once to all other healthy current
 // members. Members that join after the broadcast has already propagated
 // through the cluster will not receive the message. The maximum broadcast
 // length is 256 bytes.
-func BroadcastString(str string) error {
-	return BroadcastBytes([]byte(str))
+func (c *Cluster) BroadcastString(str string) error {
+	return c.BroadcastBytes([]byte(str))
 }
 
 // Message contents
 // Bytes       Content
 // ------------------------
-// Bytes 00-03 Origin IP
-// Bytes 04-05 Origin response port
-// Bytes 06-09 Origin broadcast counter
-// Bytes 10-11 Payload length (bytes)
-// Bytes 12-NN Payload
+// Bytes 00    Broadcast kind
+// Bytes 01-XX Origin address (family byte + 4 or 16 bytes)
+// Bytes +0-1  Origin response port
+// Bytes +2-5  Origin broadcast counter
+// Bytes +6    Topic length (T bytes)
+// Bytes +7-TT Topic
+// Bytes +0-1  Payload length (bytes)
+// Bytes +2-NN Payload
 func (b *Broadcast) encode() []byte {
-	size := 12 + len(b.bytes)
+	size := b.encodedLength()
 	bytes := make([]byte, size, size)
 
+	if b.origin.ip == nil || b.origin.ip.IsUnspecified() {
+		panic("Sending empty broadcast")
+	}
+
 	// Index pointer
 	p := 0
 
-	// Bytes 00-03: Origin IP
-	ip := b.origin.IP()
-	for i := 0; i < 4; i++ {
-		bytes[p+i] = ip[i]
-	}
-	p += 4
+	// Broadcast kind
+	p += encodeByte(byte(b.kind), bytes, p)
+
+	// Origin address
+	p += encodeIP(b.origin.IP(), bytes, p)
 
-	// Bytes 04-05 Origin response port
+	// Origin response port
 	p += encodeUint16(b.origin.Port(), bytes, p)
 
-	// Bytes 06-09 Origin broadcast counter
+	// Origin broadcast counter
 	p += encodeUint32(b.index, bytes, p)
 
-	// Bytes 10-11 Payload length (bytes)
+	// Topic length and topic
+	p += encodeByte(byte(len(b.topic)), bytes, p)
+	p += copy(bytes[p:], b.topic)
+
+	// Payload length (bytes)
 	p += encodeUint16(uint16(len(b.bytes)), bytes, p)
 
-	// Bytes 12-NN Payload
+	// Payload
 	for i, by := range b.bytes {
 		bytes[i+p] = by
 	}
 
-	if bytes[0] == 0 {
-		panic("Sending empty broadcast")
-	}
-
 	return bytes
 }
 
+// encodedLength returns the number of bytes that encode() will produce.
+func (b *Broadcast) encodedLength() int {
+	return 10 + encodedIPLength(b.origin.ip) + len(b.topic) + len(b.bytes)
+}
+
 // Message contents
 // Bytes       Content
 // ------------------------
-// Bytes 00-03 Origin IP
-// Bytes 04-05 Origin response port
-// Bytes 06-09 Origin broadcast counter
-// Bytes 10-11 Payload length (bytes)
-// Bytes 12-NN Payload
-func decodeBroadcast(bytes []byte) (*Broadcast, error) {
+// Bytes 00    Broadcast kind
+// Bytes 01-XX Origin address (family byte + 4 or 16 bytes)
+// Bytes +0-1  Origin response port
+// Bytes +2-5  Origin broadcast counter
+// Bytes +6    Topic length (T bytes)
+// Bytes +7-TT Topic
+// Bytes +0-1  Payload length (bytes)
+// Bytes +2-NN Payload
+func (c *Cluster) decodeBroadcast(bytes []byte) (*Broadcast, error) {
+	var kind byte
 	var index uint32
 	var port uint16
 	var ip net.IP
 	var length uint16
+	var topicLength byte
 
 	// An index pointer
 	p := 0
 
-	// Bytes 00-03 Origin IP
-	ip = net.IPv4(
-		bytes[p+0],
-		bytes[p+1],
-		bytes[p+2],
-		bytes[p+3]).To4()
-	p += 4
+	// Broadcast kind
+	if !hasBytes(bytes, p, 1) {
+		return nil, errors.New("broadcast is truncated")
+	}
+
+	kind, p = decodeByte(bytes, p)
 
-	// Bytes 04-05 Origin response port
+	// Origin address, followed by its port, the broadcast counter and the
+	// topic length
+	var err error
+	if ip, p, err = decodeIP(bytes, p); err != nil || !hasBytes(bytes, p, 7) {
+		return nil, errors.New("broadcast origin is truncated")
+	}
+
+	// Origin response port
 	port, p = decodeUint16(bytes, p)
 
-	// Bytes 06-09 Origin broadcast counter
+	// Origin broadcast counter
 	index, p = decodeUint32(bytes, p)
 
-	// Bytes 10-11 Payload length (bytes)
+	// Topic length and topic
+	topicLength, p = decodeByte(bytes, p)
+	if !hasBytes(bytes, p, int(topicLength)+2) {
+		return nil, errors.New("broadcast topic is truncated")
+	}
+
+	topic := string(bytes[p : p+int(topicLength)])
+	p += int(topicLength)
+
+	// Payload length (bytes)
 	length, p = decodeUint16(bytes, p)
 
 	// Now that we have the IP and port, we can find the Node.
-	origin := knownNodes.getByIP(ip.To4(), port)
+	origin := c.knownNodes.getByIP(ip, port)
 
 	// We don't know this node, so create a new one!
 	if origin == nil {
-		origin, _ = CreateNodeByIP(ip.To4(), port)
+		origin = c.createNodeByIP(ip, port)
+	}
+
+	if !hasBytes(bytes, p, int(length)) {
+		return &Broadcast{origin: origin, index: index, topic: topic, kind: broadcastKind(kind)},
+			errors.New("broadcast payload is truncated")
 	}
 
 	bcast := Broadcast{
 		origin:      origin,
 		index:       index,
 		bytes:       bytes[p : p+int(length)],
-		emitCounter: int8(emitCount())}
+		topic:       topic,
+		emitCounter: int8(c.emitCount()),
+		kind:        broadcastKind(kind)}
 
-	if origin.IP()[0] == 0 || origin.Port() == 0 {
+	if origin.IP() == nil || origin.IP().IsUnspecified() || origin.Port() == 0 {
 		logWarn("Received originless broadcast")
 
 		return &bcast,
 			errors.New("received originless broadcast")
 	}
 
-	if int(length) > GetMaxBroadcastBytes() {
+	if int(length) > c.MaxBroadcastBytes() {
 		return &bcast,
 			errors.New("message length exceeds maximum length")
 	}
@@ -233,70 +318,115 @@ func decodeBroadcast(bytes []byte) (*Broadcast, error) {
 	return &bcast, nil
 }
 
-// getBroadcastToEmit identifies the single known broadcast with the highest
-// emitCounter value (which can be negative), and returns it. If multiple
-// broadcasts have the same value, one is arbitrarily chosen.
-func getBroadcastToEmit() *Broadcast {
+// getBroadcastsToEmit returns all known broadcasts, sorted by their
+// emitCounter values (which can be negative), highest first. Broadcasts that
+// have been emitted enough times are removed along the way.
+func (c *Cluster) getBroadcastsToEmit() []*Broadcast {
 	// Get all broadcast messages.
 	values := make([]*Broadcast, 0, 0)
-	broadcasts.RLock()
-	for _, v := range broadcasts.m {
+	c.broadcasts.RLock()
+	for _, v := range c.broadcasts.m {
 		values = append(values, v)
 	}
-	broadcasts.RUnlock()
+	c.broadcasts.RUnlock()
 
 	// Remove all overly-emitted messages from the list
 	broadcastSlice := make([]*Broadcast, 0, 0)
-	broadcasts.Lock()
+	c.broadcasts.Lock()
 	for _, b := range values {
 		if b.emitCounter <= broadcastRemoveValue {
 			logDebug("Removing", b.Label(), "from recently updated list")
-			delete(broadcasts.m, b.Label())
+			delete(c.broadcasts.m, b.Label())
 		} else {
 			broadcastSlice = append(broadcastSlice, b)
 		}
 	}
-	broadcasts.Unlock()
+	c.Metrics().SetGauge(MetricBroadcastQueueDepth, nil, float64(len(c.broadcasts.m)))
 
-	if len(broadcastSlice) > 0 {
-		// Put the newest nodes on top.
-		sort.Sort(byBroadcastEmitCounter(broadcastSlice))
-		return broadcastSlice[0]
-	}
+	// Put the newest broadcasts on top.
+	sort.Sort(byBroadcastEmitCounter(broadcastSlice))
+	c.broadcasts.Unlock()
 
-	return nil
+	return broadcastSlice
 }
 
 // receiveBroadcast is called by receiveMessageUDP when a broadcast payload
 // is found in a message.
-func receiveBroadcast(broadcast *Broadcast) {
+func (c *Cluster) receiveBroadcast(broadcast *Broadcast) {
 	if broadcast == nil {
 		return
 	}
 
-	if broadcast.Origin().IP()[0] == 0 || broadcast.Origin().Port() == 0 {
+	if broadcast.Origin().IP() == nil ||
+		broadcast.Origin().IP().IsUnspecified() ||
+		broadcast.Origin().Port() == 0 {
 		logWarn("Received originless broadcast")
 		return
 	}
 
 	label := broadcast.Label()
 
-	broadcasts.Lock()
-	_, contains := broadcasts.m[label]
+	c.broadcasts.Lock()
+	_, contains := c.broadcasts.m[label]
 	if !contains {
-		broadcasts.m[label] = broadcast
+		c.broadcasts.m[label] = broadcast
 	}
-	broadcasts.Unlock()
+	c.broadcasts.Unlock()
 
-	if !contains {
+	if contains {
+		return
+	}
+
+	switch broadcast.kind {
+	case broadcastUser:
 		logfInfo("Broadcast [%s]=%s\n",
 			label,
 			string(broadcast.Bytes()))
 
-		doBroadcastUpdate(broadcast)
+		c.doBroadcastUpdate(broadcast)
+	case broadcastKeyRequest:
+		c.receiveKeyRequest(broadcast)
+	case broadcastKeyResponse:
+		c.receiveKeyResponse(broadcast)
+	case broadcastReliable:
+		c.receiveReliableAnnouncement(broadcast)
+	case broadcastQuery:
+		c.receiveQuery(broadcast)
+	default:
+		logWarn("Ignoring broadcast", label, "of unknown kind", broadcast.kind)
 	}
 }
 
+// queueBroadcast adds a new broadcast originating from this host to the
+// broadcasts map, from which the membership machinery will pick it up and
+// piggyback it onto standard messages.
+func (c *Cluster) queueBroadcast(kind broadcastKind, bytes []byte) *Broadcast {
+	return c.queueTopicBroadcast(kind, "", bytes)
+}
+
+// queueTopicBroadcast queues a broadcast like queueBroadcast(), tagged with
+// a topic.
+func (c *Cluster) queueTopicBroadcast(kind broadcastKind, topic string, bytes []byte) *Broadcast {
+	c.broadcasts.Lock()
+
+	bcast := Broadcast{
+		origin:      c.thisHost,
+		index:       c.indexCounter,
+		bytes:       bytes,
+		topic:       topic,
+		emitCounter: int8(c.emitCount()),
+		kind:        kind}
+
+	c.broadcasts.m[bcast.Label()] = &bcast
+
+	c.indexCounter++
+
+	c.Metrics().SetGauge(MetricBroadcastQueueDepth, nil, float64(len(c.broadcasts.m)))
+	c.broadcasts.Unlock()
+
+	return &bcast
+}
+
 // byBroadcastEmitCounter implements sort.Interface for []*Broadcast based on
 // the emitCounter field.
 type byBroadcastEmitCounter []*Broadcast
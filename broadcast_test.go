@@ -0,0 +1,81 @@
+/*
+Copyright 2016 The Smudge Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package smudge
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestEncodeDecodeTopicBroadcast(t *testing.T) {
+	origin, _ := CreateNodeByIP(net.ParseIP("10.0.0.1"), 9999)
+
+	broadcast := &Broadcast{
+		bytes:  []byte("payload"),
+		origin: origin,
+		index:  7,
+		topic:  "shards"}
+
+	bytes := broadcast.encode()
+	if len(bytes) != broadcast.encodedLength() {
+		t.Errorf("encoded %d bytes, expected %d", len(bytes), broadcast.encodedLength())
+	}
+
+	decoded, err := defaultCluster.decodeBroadcast(bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if decoded.Topic() != "shards" || string(decoded.Bytes()) != "payload" || decoded.Index() != 7 {
+		t.Errorf("unexpected broadcast: %q %q %d", decoded.Topic(), decoded.Bytes(), decoded.Index())
+	}
+
+	if _, err = defaultCluster.decodeBroadcast(bytes[:15]); err == nil {
+		t.Error("expected an error decoding a truncated topic")
+	}
+}
+
+// Broadcasts are only passed to the subscribers for their topic.
+func TestTopicSubscriptions(t *testing.T) {
+	c := newSyncTestCluster(19161)
+
+	untopiced := c.Subscribe(&SubscribeOptions{Topics: []string{""}})
+	shards := c.Subscribe(&SubscribeOptions{Topics: []string{"shards"}})
+
+	origin, _ := CreateNodeByIP(net.ParseIP("10.0.0.2"), 9999)
+
+	for i, topic := range []string{"", "shards", "other"} {
+		c.receiveBroadcast(&Broadcast{
+			bytes:  []byte(topic),
+			origin: origin,
+			index:  uint32(i),
+			topic:  topic})
+	}
+
+	if e := bufferedEvents(untopiced); len(e) != 1 || e[0].Broadcast.Topic() != "" {
+		t.Errorf("unexpected untopiced broadcasts: %+v", e)
+	}
+
+	if e := bufferedEvents(shards); len(e) != 1 || e[0].Broadcast.Topic() != "shards" {
+		t.Errorf("unexpected topic broadcasts: %+v", e)
+	}
+
+	if err := c.BroadcastToTopic(strings.Repeat("x", MaxTopicLength+1), nil); err == nil {
+		t.Error("expected an error for an oversized topic")
+	}
+}
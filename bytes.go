@@ -24,6 +24,25 @@ limitations under the License.
 
 package smudge
 
+import (
+	"errors"
+	"net"
+)
+
+// errTruncated is returned by decoders that run out of bytes.
+var errTruncated = errors.New("truncated")
+
+const (
+	// addressFamilyNone indicates that no address follows the family byte.
+	addressFamilyNone byte = 0
+
+	// addressFamilyIPv4 indicates that a 4-byte IPv4 address follows.
+	addressFamilyIPv4 byte = 4
+
+	// addressFamilyIPv6 indicates that a 16-byte IPv6 address follows.
+	addressFamilyIPv6 byte = 6
+)
+
 func decodeByte(bytes []byte, startIndex int) (byte, int) {
 	return bytes[startIndex], startIndex + 1
 }
@@ -34,6 +53,66 @@ func decodeUint8(bytes []byte, startIndex int) (uint8, int) {
 	return byte(n), i
 }
 
+// hasBytes returns true if bytes holds at least n bytes starting at index p.
+func hasBytes(bytes []byte, p int, n int) bool {
+	return p >= 0 && n >= 0 && len(bytes)-p >= n
+}
+
+// decodeIP reads an address family byte followed by a 4- or 16-byte address.
+// A family of addressFamilyNone yields a nil IP. Returns errTruncated if
+// bytes ends before the address does.
+func decodeIP(bytes []byte, startIndex int) (net.IP, int, error) {
+	if !hasBytes(bytes, startIndex, 1) {
+		return nil, startIndex, errTruncated
+	}
+
+	family, p := decodeByte(bytes, startIndex)
+
+	length := 0
+	switch family {
+	case addressFamilyIPv4:
+		length = net.IPv4len
+	case addressFamilyIPv6:
+		length = net.IPv6len
+	default:
+		return nil, p, nil
+	}
+
+	if !hasBytes(bytes, p, length) {
+		return nil, p, errTruncated
+	}
+
+	ip := make(net.IP, length)
+	copy(ip, bytes[p:p+length])
+
+	return ip, p + length, nil
+}
+
+// decodeShortStrings decodes count strings, each encoded as a 1-byte length
+// followed by its bytes, starting at index p. It returns the strings, the
+// index of the first byte after them, and false if bytes is too short.
+func decodeShortStrings(bytes []byte, p int, count int) ([]string, int, bool) {
+	strs := make([]string, count)
+
+	for i := range strs {
+		if p >= len(bytes) {
+			return nil, p, false
+		}
+
+		length := int(bytes[p])
+		p++
+
+		if p+length > len(bytes) {
+			return nil, p, false
+		}
+
+		strs[i] = string(bytes[p : p+length])
+		p += length
+	}
+
+	return strs, p, true
+}
+
 func decodeUint16(bytes []byte, startIndex int) (uint16, int) {
 	var number uint16
 
@@ -75,6 +154,38 @@ func encodeByte(number byte, bytes []byte, startIndex int) int {
 	return 1
 }
 
+// encodeIP writes an address family byte followed by the 4- or 16-byte form
+// of the IP. A nil IP is written as addressFamilyNone with no address bytes.
+func encodeIP(ip net.IP, bytes []byte, startIndex int) int {
+	if ip4 := ip.To4(); ip4 != nil {
+		encodeByte(addressFamilyIPv4, bytes, startIndex)
+		copy(bytes[startIndex+1:], ip4)
+		return 1 + net.IPv4len
+	}
+
+	if ip16 := ip.To16(); ip16 != nil {
+		encodeByte(addressFamilyIPv6, bytes, startIndex)
+		copy(bytes[startIndex+1:], ip16)
+		return 1 + net.IPv6len
+	}
+
+	encodeByte(addressFamilyNone, bytes, startIndex)
+	return 1
+}
+
+// encodedIPLength returns the number of bytes encodeIP() will use for ip.
+func encodedIPLength(ip net.IP) int {
+	if ip.To4() != nil {
+		return 1 + net.IPv4len
+	}
+
+	if ip.To16() != nil {
+		return 1 + net.IPv6len
+	}
+
+	return 1
+}
+
 func encodeUint8(number uint8, bytes []byte, startIndex int) int {
 	return encodeByte(byte(number), bytes, startIndex)
 }
@@ -17,6 +17,7 @@ limitations under the License.
 package smudge
 
 import (
+	"net"
 	"testing"
 )
 
@@ -223,3 +224,66 @@ func TestEncodeDecodeUint64D(t *testing.T) {
 		t.Errorf("%d != %d", initial, backAgain)
 	}
 }
+
+func TestEncodeDecodeIPv4(t *testing.T) {
+	bytes := make([]byte, 5, 5)
+	initial := net.IP([]byte{10, 0, 0, 42})
+
+	p := encodeIP(initial, bytes, 0)
+
+	backAgain, q, _ := decodeIP(bytes, 0)
+
+	if p != 5 || q != 5 || bytes[0] != addressFamilyIPv4 {
+		t.Errorf("p=%d q=%d family=%d", p, q, bytes[0])
+	}
+
+	if !initial.Equal(backAgain) || len(backAgain) != net.IPv4len {
+		t.Errorf("%v != %v", initial, backAgain)
+	}
+}
+
+func TestEncodeDecodeIPv4In16(t *testing.T) {
+	bytes := make([]byte, 5, 5)
+	initial := net.IPv4(10, 0, 0, 42)
+
+	p := encodeIP(initial, bytes, 0)
+
+	backAgain, _, _ := decodeIP(bytes, 0)
+
+	if p != 5 || bytes[0] != addressFamilyIPv4 {
+		t.Errorf("p=%d family=%d", p, bytes[0])
+	}
+
+	if !initial.Equal(backAgain) {
+		t.Errorf("%v != %v", initial, backAgain)
+	}
+}
+
+func TestEncodeDecodeIPv6(t *testing.T) {
+	bytes := make([]byte, 17, 17)
+	initial := net.ParseIP("2001:db8::1")
+
+	p := encodeIP(initial, bytes, 0)
+
+	backAgain, q, _ := decodeIP(bytes, 0)
+
+	if p != 17 || q != 17 || bytes[0] != addressFamilyIPv6 {
+		t.Errorf("p=%d q=%d family=%d", p, q, bytes[0])
+	}
+
+	if !initial.Equal(backAgain) {
+		t.Errorf("%v != %v", initial, backAgain)
+	}
+}
+
+func TestEncodeDecodeIPNil(t *testing.T) {
+	bytes := make([]byte, 1, 1)
+
+	p := encodeIP(nil, bytes, 0)
+
+	backAgain, q, _ := decodeIP(bytes, 0)
+
+	if p != 1 || q != 1 || backAgain != nil {
+		t.Errorf("p=%d q=%d ip=%v", p, q, backAgain)
+	}
+}
@@ -0,0 +1,249 @@
+/*
+Copyright 2016 The Smudge Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package smudge
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Clock is the source of time for a Cluster: every heartbeat, timeout and
+// retention decision reads it, and every periodic loop sleeps on it. Unless
+// Config.Clock is set, a Cluster uses SystemClock. Tests can use a FakeClock
+// instead, to drive that logic step by step.
+type Clock interface {
+	// Now returns the current time. Durations are measured by subtracting
+	// one reading from another, so SystemClock's are monotonic.
+	Now() time.Time
+
+	// Sleep blocks until the duration has elapsed.
+	Sleep(d time.Duration)
+
+	// After returns a channel that receives the time once the duration has
+	// elapsed.
+	After(d time.Duration) <-chan time.Time
+
+	// AfterFunc calls f once the duration has elapsed: from its own
+	// goroutine for SystemClock, or from Advance() for FakeClock.
+	AfterFunc(d time.Duration, f func()) Timer
+}
+
+// Timer is returned by Clock.AfterFunc().
+type Timer interface {
+	// Stop prevents the function from being called, and returns false if
+	// it already has been (or the timer was already stopped).
+	Stop() bool
+}
+
+// SystemClock is the Clock backed by the time package.
+type SystemClock struct{}
+
+// FakeClock is a Clock whose time only moves when Advance() is called. Sleeps
+// and timers due at or before the new time are then released in order.
+type FakeClock struct {
+	mutex   sync.Mutex
+	cond    *sync.Cond
+	now     time.Time
+	waiters []*fakeWaiter
+}
+
+// A pending Sleep(), After() or AfterFunc() on a FakeClock.
+type fakeWaiter struct {
+	clock    *FakeClock
+	deadline time.Time
+	ch       chan time.Time
+	f        func()
+}
+
+/******************************************************************************
+ * Exported functions (for public consumption)
+ *****************************************************************************/
+
+// Now returns time.Now().
+func (SystemClock) Now() time.Time {
+	return time.Now()
+}
+
+// Sleep calls time.Sleep().
+func (SystemClock) Sleep(d time.Duration) {
+	time.Sleep(d)
+}
+
+// After calls time.After().
+func (SystemClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+// AfterFunc calls time.AfterFunc().
+func (SystemClock) AfterFunc(d time.Duration, f func()) Timer {
+	return time.AfterFunc(d, f)
+}
+
+// NewFakeClock returns a FakeClock set to the specified time.
+func NewFakeClock(now time.Time) *FakeClock {
+	f := &FakeClock{now: now}
+	f.cond = sync.NewCond(&f.mutex)
+
+	return f
+}
+
+// Now returns the fake clock's current time.
+func (f *FakeClock) Now() time.Time {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	return f.now
+}
+
+// Sleep blocks until the fake clock has been advanced by the duration.
+func (f *FakeClock) Sleep(d time.Duration) {
+	<-f.After(d)
+}
+
+// After returns a channel that receives the fake time once the clock has
+// been advanced by the duration.
+func (f *FakeClock) After(d time.Duration) <-chan time.Time {
+	return f.wait(d, nil).ch
+}
+
+// AfterFunc calls f once the fake clock has been advanced by the duration.
+// It's called from the goroutine calling Advance(), before Advance() returns,
+// so tests know that it has run (or, if the duration isn't positive, from
+// AfterFunc() itself).
+func (f *FakeClock) AfterFunc(d time.Duration, fn func()) Timer {
+	return f.wait(d, fn)
+}
+
+// Advance moves the fake clock forward, releasing every sleep and timer that
+// has come due.
+func (f *FakeClock) Advance(d time.Duration) {
+	f.mutex.Lock()
+
+	f.now = f.now.Add(d)
+	now := f.now
+
+	due := make([]*fakeWaiter, 0)
+	pending := f.waiters[:0]
+
+	for _, w := range f.waiters {
+		if w.deadline.After(now) {
+			pending = append(pending, w)
+		} else {
+			due = append(due, w)
+		}
+	}
+
+	f.waiters = pending
+	f.mutex.Unlock()
+
+	sort.SliceStable(due, func(i, j int) bool {
+		return due[i].deadline.Before(due[j].deadline)
+	})
+
+	for _, w := range due {
+		w.fire(now)
+	}
+}
+
+// Waiters returns the number of sleeps and timers that haven't come due.
+func (f *FakeClock) Waiters() int {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	return len(f.waiters)
+}
+
+// BlockUntil blocks until at least n sleeps and timers are waiting on the
+// fake clock. Tests use it to know that the goroutines they're driving have
+// caught up before calling Advance().
+func (f *FakeClock) BlockUntil(n int) {
+	f.mutex.Lock()
+	for len(f.waiters) < n {
+		f.cond.Wait()
+	}
+	f.mutex.Unlock()
+}
+
+// Stop cancels a pending AfterFunc().
+func (w *fakeWaiter) Stop() bool {
+	f := w.clock
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	for i, pending := range f.waiters {
+		if pending == w {
+			f.waiters = append(f.waiters[:i], f.waiters[i+1:]...)
+			return true
+		}
+	}
+
+	return false
+}
+
+/******************************************************************************
+ * Private functions (for internal use only)
+ *****************************************************************************/
+
+// wait registers a sleep or timer, releasing it immediately if d isn't
+// positive.
+func (f *FakeClock) wait(d time.Duration, fn func()) *fakeWaiter {
+	f.mutex.Lock()
+
+	w := &fakeWaiter{
+		clock:    f,
+		deadline: f.now.Add(d),
+		ch:       make(chan time.Time, 1),
+		f:        fn,
+	}
+
+	if d <= 0 {
+		now := f.now
+		f.mutex.Unlock()
+		w.fire(now)
+
+		return w
+	}
+
+	f.waiters = append(f.waiters, w)
+	f.cond.Broadcast()
+	f.mutex.Unlock()
+
+	return w
+}
+
+func (w *fakeWaiter) fire(now time.Time) {
+	if w.f != nil {
+		w.f()
+	} else {
+		w.ch <- now
+	}
+}
+
+// nowMillis returns the number of milliseconds elapsed on the cluster's clock
+// since the cluster was created. Unlike GetNowInMillis(), this is monotonic
+// and doesn't wrap, so it's what all internal timing decisions use.
+func (c *Cluster) nowMillis() int64 {
+	return int64(c.clock.Now().Sub(c.epoch) / time.Millisecond)
+}
+
+// sinceMillis returns the number of milliseconds elapsed on the cluster's
+// clock since t.
+func (c *Cluster) sinceMillis(t time.Time) int64 {
+	return int64(c.clock.Now().Sub(t) / time.Millisecond)
+}
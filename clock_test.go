@@ -0,0 +1,159 @@
+/*
+Copyright 2016 The Smudge Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package smudge
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestFakeClock(t *testing.T) {
+	start := time.Unix(1000, 0)
+	clock := NewFakeClock(start)
+
+	early := clock.After(10 * time.Millisecond)
+	late := clock.After(20 * time.Millisecond)
+
+	fired := make(chan bool, 1)
+	clock.AfterFunc(15*time.Millisecond, func() { fired <- true })
+
+	stopped := clock.AfterFunc(15*time.Millisecond, func() {
+		t.Error("stopped timer fired")
+	})
+	if !stopped.Stop() {
+		t.Error("expected Stop() to cancel a pending timer")
+	}
+	if stopped.Stop() {
+		t.Error("expected Stop() to fail on a stopped timer")
+	}
+
+	if clock.Waiters() != 3 {
+		t.Fatalf("expected 3 waiters, got %d", clock.Waiters())
+	}
+
+	clock.Advance(10 * time.Millisecond)
+
+	select {
+	case now := <-early:
+		if !now.Equal(start.Add(10 * time.Millisecond)) {
+			t.Error("unexpected time", now)
+		}
+	default:
+		t.Fatal("After() not released when due")
+	}
+
+	select {
+	case <-late:
+		t.Fatal("After() released early")
+	default:
+	}
+
+	clock.Advance(10 * time.Millisecond)
+
+	select {
+	case <-late:
+	default:
+		t.Fatal("After() not released when due")
+	}
+
+	select {
+	case <-fired:
+	default:
+		t.Fatal("AfterFunc() not called when due")
+	}
+
+	if clock.Waiters() != 0 {
+		t.Errorf("expected no waiters, got %d", clock.Waiters())
+	}
+
+	if !clock.Now().Equal(start.Add(20 * time.Millisecond)) {
+		t.Error("unexpected time", clock.Now())
+	}
+}
+
+// The timeout check loop can be stepped through on a fake clock: an
+// unanswered PINGREQ gets its target suspected, and then declared dead once
+// the suspicion expires.
+func TestTimeoutCheckLoopWithFakeClock(t *testing.T) {
+	SetLogThreshold(LogWarn)
+	defer SetLogThreshold(LogInfo)
+
+	clock := NewFakeClock(time.Unix(1000, 0))
+	c, remote := newSuspicionTestClusterWithClock(clock)
+
+	helper, _ := CreateNodeByIP(net.IP([]byte{127, 0, 0, 3}), 9999)
+	c.pendingAcks.m["pingreq"] = &pendingAck{
+		node:      helper,
+		callback:  remote,
+		startTime: c.nowMillis(),
+		packType:  packPingReq,
+	}
+
+	c.lifecycle.stopping = make(chan struct{})
+	c.spawn(c.startTimeoutCheckLoop)
+
+	defer func() {
+		close(c.lifecycle.stopping)
+		c.lifecycle.wg.Wait()
+	}()
+
+	// The loop has made its first pass, and is sleeping.
+	clock.BlockUntil(1)
+
+	if remote.Status() != StatusAlive {
+		t.Fatal("node suspected too early:", remote.Status())
+	}
+
+	clock.Advance(time.Second)
+	clock.BlockUntil(1)
+
+	if remote.Status() != StatusSuspected {
+		t.Fatal("expected SUSPECTED, got", remote.Status())
+	}
+
+	clock.Advance(100 * time.Millisecond)
+	clock.BlockUntil(1)
+
+	if remote.Status() != StatusDead {
+		t.Error("expected DEAD, got", remote.Status())
+	}
+}
+
+// A node's age is measured on the clock of the cluster that knows it.
+func TestNodeAgeWithFakeClock(t *testing.T) {
+	SetLogThreshold(LogWarn)
+	defer SetLogThreshold(LogInfo)
+
+	clock := NewFakeClock(time.Unix(1000, 0))
+	c := NewCluster(&Config{Clock: clock})
+
+	node, _ := CreateNodeByIP(net.IP([]byte{127, 0, 0, 2}), 9999)
+	c.AddNode(node)
+
+	clock.Advance(1500 * time.Millisecond)
+
+	if node.Age() != 1500 {
+		t.Error("expected an age of 1500ms, got", node.Age())
+	}
+
+	node.Touch()
+
+	if node.Age() != 0 {
+		t.Error("expected an age of 0ms after Touch(), got", node.Age())
+	}
+}
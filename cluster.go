@@ -0,0 +1,522 @@
+/*
+Copyright 2016 The Smudge Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package smudge
+
+import (
+	"fmt"
+	"hash/fnv"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/tevino/abool"
+)
+
+// The cluster instance used by the package-level functions (Begin(),
+// AddNode(), BroadcastBytes(), etc).
+var defaultCluster = NewCluster(&Config{})
+
+// Config contains the options used to create a Cluster. Any field left at
+// its zero value falls back to the equivalent package property, which is in
+// turn read from its environment variable if it hasn't been set explicitly.
+type Config struct {
+	// ClusterName is the name of the cluster. Messages from members with a
+	// different cluster name are rejected.
+	ClusterName string
+
+	// HeartbeatMillis is the heartbeat frequency in milliseconds.
+	HeartbeatMillis int
+
+	// InitialHosts is a list of known members as IP or IP:PORT.
+	InitialHosts []string
+
+	// InitialRTTMillis is the round-trip time assumed for a member before
+	// any of its PINGs have been answered.
+	InitialRTTMillis int
+
+	// ListenIP is the IP to listen on. If nil, the local IP is used.
+	ListenIP net.IP
+
+	// ListenPort is the UDP port to listen on.
+	ListenPort int
+
+	// MaxBroadcastBytes is the maximum byte length for broadcast payloads.
+	MaxBroadcastBytes int
+
+	// MaxLocalHealth is the highest local health score, by which (plus one)
+	// probe and suspicion timeouts may be scaled; see health.go. A negative
+	// value disables this scaling.
+	MaxLocalHealth int
+
+	// MaxMessageBytes is the maximum byte length of each UDP message.
+	MaxMessageBytes int
+
+	// RTTHistorySize is the number of round-trip times (and probe outcomes)
+	// remembered for each member.
+	RTTHistorySize int
+
+	// SecretKeys are the AES keys (16, 24 or 32 bytes each) used to encrypt
+	// and authenticate all traffic. The first is the primary key, used for
+	// encryption; all are accepted for decryption. If empty, traffic is not
+	// encrypted.
+	SecretKeys [][]byte
+
+	// SuspicionMultiplier scales the time a suspected node is given to
+	// refute the suspicion before it's declared dead.
+	SuspicionMultiplier int
+
+	// SyncMillis is the interval between full state syncs with a random
+	// member over TCP. A negative value disables periodic syncs.
+	SyncMillis int
+
+	// Transport carries this member's traffic. If nil, a NetTransport
+	// (UDP and TCP on ListenPort) is used.
+	Transport Transport
+
+	// Clock is the source of time for all heartbeats, timeouts and
+	// retention decisions. If nil, SystemClock is used.
+	Clock Clock
+
+	// Metrics receives measurements of this member's activity. If nil, the
+	// sink set by SetMetrics() is used, if any.
+	Metrics Metrics
+}
+
+// resolvedConfig is a cluster's configuration with every unset property
+// resolved, along with the values derived from it.
+type resolvedConfig struct {
+	Config
+
+	// The hash of ClusterName that's carried in every message.
+	clusterHash uint32
+}
+
+// Cluster represents a single member of a cluster, along with everything it
+// knows about the other members. Each Cluster has its own socket, heartbeat,
+// registry and listeners, so several can be run in the same process.
+type Cluster struct {
+	// The number of received payloads that couldn't be authenticated. This
+	// is accessed atomically, so it must stay 64-bit aligned.
+	unauthenticatedPackets uint64
+
+	// The number of received payloads that were rejected because they came
+	// from a different cluster. Also accessed atomically.
+	foreignClusterPackets uint64
+
+	// The configuration the cluster was created with, and the same with
+	// every unset property resolved (a *resolvedConfig); see resolveConfig().
+	config   Config
+	resolved atomic.Value
+
+	// The source of time, and its reading when the cluster was created;
+	// see clock.go.
+	clock Clock
+	epoch time.Time
+
+	currentHeartbeat uint32
+
+	pendingAcks struct {
+		sync.RWMutex
+		m map[string]*pendingAck
+	}
+
+	thisHostAddress string
+
+	thisHost *Node
+
+	// This host's encoded metadata, as set by SetLocalMetadata()
+	localMetadata []byte
+
+	// This flag is set whenever a known node is added or removed.
+	knownNodesModifiedFlag *abool.AtomicBool
+
+	// Guards the lazy creation of each node's RTT history; see rtt().
+	rttMutex sync.Mutex
+
+	// This host's network coordinate; see coordinate.go.
+	coordinate struct {
+		sync.Mutex
+		c *Coordinate
+	}
+
+	// The transport carrying this member's packets and streams, set by
+	// Start(); see transport.go.
+	transport Transport
+
+	// The smudge running flag
+	runningFlag *abool.AtomicBool
+
+	// The channel closed by Shutdown() to stop the goroutines started by
+	// Start(), which are all tracked by the wait group, and the listeners
+	// added with the Add*Listener() functions, whose goroutines Shutdown()
+	// also stops; see lifecycle.go.
+	lifecycle struct {
+		sync.Mutex
+		stopping  chan struct{}
+		wg        sync.WaitGroup
+		listeners []*listener
+	}
+
+	// All known nodes, living and dead. Dead nodes are pinged (far) less
+	// often, and are eventually removed
+	knownNodes nodeMap
+
+	// All nodes that have been updated "recently", living and dead
+	updatedNodes nodeMap
+
+	deadNodeRetries struct {
+		sync.RWMutex
+		m map[string]*deadNodeCounter
+	}
+
+	// This host's local health score, from 0 (healthy) to MaxLocalHealth();
+	// see health.go.
+	localHealth struct {
+		sync.Mutex
+		score int
+	}
+
+	// The time (in millis, from nowMillis()) at which each currently
+	// suspected node was first suspected, keyed by address.
+	suspicions struct {
+		sync.RWMutex
+		m map[string]int64
+	}
+
+	// The keys used to encrypt and decrypt traffic; see getKeyring()
+	keyring     *keyring
+	keyringErr  error
+	keyringOnce sync.Once
+
+	// Key operations originated by this host that are awaiting responses,
+	// keyed by the label of the request broadcast
+	keyRequests struct {
+		sync.Mutex
+		m map[string]*keyRequest
+	}
+
+	// The ID of the last direct message sent, and channels awaiting
+	// acknowledgements, keyed by recipient address and message ID
+	directMessages struct {
+		sync.Mutex
+		sequence uint32
+		acks     map[string]chan struct{}
+	}
+
+	// Queries originated by this host that are collecting responses, keyed
+	// by the index of the query broadcast
+	queries struct {
+		sync.Mutex
+		m map[uint32]*QueryResponse
+	}
+
+	// Query handlers, keyed by query name
+	queryHandlers struct {
+		sync.RWMutex
+		m map[string][]QueryHandler
+	}
+
+	// Reliable broadcasts sent or being received, keyed by the label of
+	// their announcement, the sequence number of the last one delivered
+	// from each origin, keyed by address, the origins from which nothing
+	// has been delivered yet, and the generation of each origin's sequence
+	// numbers (see reliable.go)
+	reliable struct {
+		sync.Mutex
+		generation  uint64
+		sequence    uint32
+		m           map[string]*reliableBroadcast
+		delivered   map[string]uint32
+		tentative   map[string]bool
+		generations map[string]uint64
+	}
+
+	// The index counter value for the next broadcast message
+	indexCounter uint32
+
+	// Emitted broadcasts. Once they are added here, the membership machinery
+	// will pick them up and piggyback them onto standard messages.
+	broadcasts struct {
+		sync.RWMutex
+		m map[string]*Broadcast
+	}
+
+	// Event subscriptions; see events.go.
+	subscriptions struct {
+		sync.RWMutex
+		m map[*Subscription]struct{}
+	}
+
+	messageListeners struct {
+		sync.RWMutex
+		s []MessageListener
+	}
+}
+
+// NewCluster creates a new, unstarted Cluster from the supplied Config. A nil
+// config is equivalent to an empty one.
+func NewCluster(config *Config) *Cluster {
+	c := &Cluster{
+		indexCounter:           1,
+		runningFlag:            abool.New(),
+		knownNodesModifiedFlag: abool.New(),
+	}
+
+	if config != nil {
+		c.config = *config
+	}
+
+	c.invalidateConfig()
+
+	c.clock = c.config.Clock
+	if c.clock == nil {
+		c.clock = SystemClock{}
+	}
+
+	c.epoch = c.clock.Now()
+
+	c.pendingAcks.m = make(map[string]*pendingAck)
+	c.deadNodeRetries.m = make(map[string]*deadNodeCounter)
+	c.suspicions.m = make(map[string]int64)
+	c.broadcasts.m = make(map[string]*Broadcast)
+	c.keyRequests.m = make(map[string]*keyRequest)
+	c.directMessages.acks = make(map[string]chan struct{})
+	c.queries.m = make(map[uint32]*QueryResponse)
+	c.queryHandlers.m = make(map[string][]QueryHandler)
+	c.reliable.m = make(map[string]*reliableBroadcast)
+	c.reliable.delivered = make(map[string]uint32)
+	c.reliable.tentative = make(map[string]bool)
+	c.reliable.generations = make(map[string]uint64)
+	c.reliable.generation = uint64(c.epoch.UnixNano())
+	c.subscriptions.m = make(map[*Subscription]struct{})
+	c.messageListeners.s = make([]MessageListener, 0, 16)
+
+	c.knownNodes.init()
+	c.updatedNodes.init()
+
+	return c
+}
+
+// ClusterName returns the name of this cluster.
+func (c *Cluster) ClusterName() string {
+	return c.settings().ClusterName
+}
+
+// HeartbeatMillis returns this cluster's heartbeat frequency in milliseconds.
+func (c *Cluster) HeartbeatMillis() int {
+	return c.settings().HeartbeatMillis
+}
+
+// InitialHosts returns this cluster's list of initially known hosts.
+func (c *Cluster) InitialHosts() []string {
+	return c.settings().InitialHosts
+}
+
+// InitialRTTMillis returns the round-trip time, in millis, assumed for a
+// member before any of its PINGs have been answered.
+func (c *Cluster) InitialRTTMillis() int {
+	return c.settings().InitialRTTMillis
+}
+
+// ListenIP returns the IP that this cluster will listen on.
+func (c *Cluster) ListenIP() net.IP {
+	return c.settings().ListenIP
+}
+
+// ListenPort returns the port that this cluster will listen on.
+func (c *Cluster) ListenPort() int {
+	return c.settings().ListenPort
+}
+
+// MaxBroadcastBytes returns the maximum byte length for broadcast payloads.
+func (c *Cluster) MaxBroadcastBytes() int {
+	return c.settings().MaxBroadcastBytes
+}
+
+// MaxLocalHealth returns this cluster's maximum local health score.
+func (c *Cluster) MaxLocalHealth() int {
+	return c.settings().MaxLocalHealth
+}
+
+// MaxMessageBytes returns the maximum byte length of each UDP message.
+func (c *Cluster) MaxMessageBytes() int {
+	return c.settings().MaxMessageBytes
+}
+
+// RTTHistorySize returns the number of round-trip times remembered for each
+// member.
+func (c *Cluster) RTTHistorySize() int {
+	return c.settings().RTTHistorySize
+}
+
+// SecretKeys returns the keys this cluster uses to encrypt traffic, primary
+// key first.
+func (c *Cluster) SecretKeys() [][]byte {
+	return c.settings().SecretKeys
+}
+
+// SuspicionMultiplier returns this cluster's suspicion timeout multiplier.
+func (c *Cluster) SuspicionMultiplier() int {
+	return c.settings().SuspicionMultiplier
+}
+
+// SyncMillis returns the interval between full state syncs, in millis.
+func (c *Cluster) SyncMillis() int {
+	return c.settings().SyncMillis
+}
+
+// resolveConfig resolves every property that the cluster's configuration
+// leaves unset from the package properties (which default to the
+// environment), so that the cluster doesn't read them again until it's
+// started or its configuration is invalidated.
+func (c *Cluster) resolveConfig() {
+	resolved := resolvedConfig{Config: c.config}
+
+	if resolved.ClusterName == "" {
+		resolved.ClusterName = GetClusterName()
+	}
+
+	if resolved.HeartbeatMillis == 0 {
+		resolved.HeartbeatMillis = GetHeartbeatMillis()
+	}
+
+	if resolved.InitialHosts == nil {
+		resolved.InitialHosts = GetInitialHosts()
+	}
+
+	if resolved.InitialRTTMillis == 0 {
+		resolved.InitialRTTMillis = GetInitialRTTMillis()
+	}
+
+	if resolved.ListenIP == nil {
+		resolved.ListenIP = GetListenIP()
+	}
+
+	if resolved.ListenPort == 0 {
+		resolved.ListenPort = GetListenPort()
+	}
+
+	if resolved.MaxBroadcastBytes == 0 {
+		resolved.MaxBroadcastBytes = GetMaxBroadcastBytes()
+	}
+
+	if resolved.MaxLocalHealth == 0 {
+		resolved.MaxLocalHealth = GetMaxLocalHealth()
+	}
+
+	if resolved.MaxMessageBytes == 0 {
+		resolved.MaxMessageBytes = GetMaxMessageBytes()
+	}
+
+	if resolved.RTTHistorySize == 0 {
+		resolved.RTTHistorySize = GetRTTHistorySize()
+	}
+
+	if resolved.SecretKeys == nil {
+		resolved.SecretKeys = GetSecretKeys()
+	}
+
+	if resolved.SuspicionMultiplier == 0 {
+		resolved.SuspicionMultiplier = GetSuspicionMultiplier()
+	}
+
+	if resolved.SyncMillis == 0 {
+		resolved.SyncMillis = GetSyncMillis()
+	}
+
+	resolved.clusterHash = hashClusterName(resolved.ClusterName)
+
+	c.resolved.Store(&resolved)
+}
+
+// settings returns the cluster's resolved configuration. It must not be
+// modified.
+func (c *Cluster) settings() *resolvedConfig {
+	if resolved := c.resolved.Load().(*resolvedConfig); resolved != nil {
+		return resolved
+	}
+
+	c.resolveConfig()
+
+	return c.resolved.Load().(*resolvedConfig)
+}
+
+// invalidateConfig discards the cluster's resolved configuration, so that
+// it's resolved again when it's next used. Nothing is read from the package
+// properties (or the environment) until then.
+func (c *Cluster) invalidateConfig() {
+	c.resolved.Store((*resolvedConfig)(nil))
+}
+
+// clusterHash returns the hash of this cluster's name that's carried in every
+// message and state payload.
+func (c *Cluster) clusterHash() uint32 {
+	return c.settings().clusterHash
+}
+
+// hashClusterName returns the hash of a cluster name. An unnamed cluster's
+// hash is 0.
+func hashClusterName(name string) uint32 {
+	if name == "" {
+		return 0
+	}
+
+	h := fnv.New32a()
+	h.Write([]byte(name))
+
+	return h.Sum32()
+}
+
+// checkClusterHash returns an error, and counts the payload as foreign, if
+// hash doesn't match this cluster's name.
+func (c *Cluster) checkClusterHash(hash uint32, source string) error {
+	if hash == c.clusterHash() {
+		return nil
+	}
+
+	atomic.AddUint64(&c.foreignClusterPackets, 1)
+	logfWarn("Rejected payload from %s: it belongs to another cluster\n", source)
+
+	return fmt.Errorf("cluster name mismatch from %s", source)
+}
+
+// LocalNode returns the node representing the default cluster's member. See
+// Cluster.LocalNode().
+func LocalNode() *Node {
+	return defaultCluster.LocalNode()
+}
+
+// LocalNode returns the node representing this cluster member. It is nil
+// until Begin() has been called.
+func (c *Cluster) LocalNode() *Node {
+	return c.thisHost
+}
+
+// ForeignClusterPackets returns the number of received messages and state
+// payloads that were rejected because they came from a member of a cluster
+// with a different name.
+func (c *Cluster) ForeignClusterPackets() uint64 {
+	return atomic.LoadUint64(&c.foreignClusterPackets)
+}
+
+// UnauthenticatedPackets returns the number of received messages and state
+// payloads that were dropped because they couldn't be authenticated with any
+// of this cluster's secret keys.
+func (c *Cluster) UnauthenticatedPackets() uint64 {
+	return atomic.LoadUint64(&c.unauthenticatedPackets)
+}
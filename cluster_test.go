@@ -0,0 +1,188 @@
+/*
+Copyright 2016 The Smudge Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package smudge
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// Nodes added to one cluster must not be visible from another.
+func TestClusterIsolation(t *testing.T) {
+	a := NewCluster(&Config{ListenPort: 19001})
+	b := NewCluster(&Config{ListenPort: 19002})
+
+	node, _ := CreateNodeByIP(net.IP([]byte{127, 0, 0, 2}), 9000)
+	a.AddNode(node)
+
+	if len(a.AllNodes()) != 1 {
+		t.Errorf("expected 1 node in a, got %d", len(a.AllNodes()))
+	}
+
+	if len(b.AllNodes()) != 0 {
+		t.Errorf("expected 0 nodes in b, got %d", len(b.AllNodes()))
+	}
+}
+
+// Zero-valued config fields fall back to the package properties.
+func TestClusterConfigDefaults(t *testing.T) {
+	c := NewCluster(nil)
+
+	if c.ListenPort() != GetListenPort() {
+		t.Errorf("listen port %d != %d", c.ListenPort(), GetListenPort())
+	}
+
+	if c.HeartbeatMillis() != GetHeartbeatMillis() {
+		t.Errorf("heartbeat %d != %d", c.HeartbeatMillis(), GetHeartbeatMillis())
+	}
+
+	c = NewCluster(&Config{ListenPort: 12345, HeartbeatMillis: 10})
+
+	if c.ListenPort() != 12345 || c.HeartbeatMillis() != 10 {
+		t.Errorf("config not honored: port=%d heartbeat=%d",
+			c.ListenPort(), c.HeartbeatMillis())
+	}
+}
+
+// A cluster reads the environment when it's first used rather than when
+// it's created, so that variables set in between take effect.
+func TestClusterConfigResolvedLazily(t *testing.T) {
+	c := NewCluster(nil)
+
+	multiplier := intPropertyFromEnv(t, EnvVarSuspicionMultiplier, "9", &suspicionMultiplier, func() int {
+		return c.SuspicionMultiplier()
+	})
+
+	if multiplier != 9 {
+		t.Error("expected a suspicion multiplier of 9, got", multiplier)
+	}
+}
+
+// Start several members in-process over loopback and wait for them to see
+// each other.
+func TestClusterConvergence(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping network test in short mode")
+	}
+
+	SetLogThreshold(LogWarn)
+	defer SetLogThreshold(LogInfo)
+
+	loopback := net.IP([]byte{127, 0, 0, 1})
+	ports := []int{19101, 19102, 19103}
+	clusters := make([]*Cluster, len(ports))
+
+	for i, port := range ports {
+		clusters[i] = NewCluster(&Config{
+			ListenIP:        loopback,
+			ListenPort:      port,
+			HeartbeatMillis: 20,
+			InitialHosts:    []string{},
+		})
+
+		if i > 0 {
+			seed, _ := CreateNodeByIP(loopback, uint16(ports[0]))
+			clusters[i].AddNode(seed)
+		}
+
+		go clusters[i].Begin()
+	}
+
+	defer func() {
+		for _, c := range clusters {
+			c.Stop()
+		}
+	}()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		converged := true
+		for _, c := range clusters {
+			if len(c.HealthyNodes()) != len(ports) {
+				converged = false
+			}
+		}
+
+		if converged {
+			return
+		}
+
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	for i, c := range clusters {
+		t.Errorf("cluster %d sees %d healthy nodes", i, len(c.HealthyNodes()))
+	}
+}
+
+// A member that leaves is reported as LEFT by the others, rather than being
+// suspected and declared dead.
+func TestClusterLeave(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping network test in short mode")
+	}
+
+	SetLogThreshold(LogWarn)
+	defer SetLogThreshold(LogInfo)
+
+	loopback := net.IP([]byte{127, 0, 0, 1})
+
+	newLeaveTestCluster := func(port int) *Cluster {
+		return NewCluster(&Config{
+			ListenIP:            loopback,
+			ListenPort:          port,
+			HeartbeatMillis:     20,
+			SuspicionMultiplier: 1,
+			InitialHosts:        []string{},
+		})
+	}
+
+	a := newLeaveTestCluster(19111)
+	b := newLeaveTestCluster(19112)
+
+	seed, _ := CreateNodeByIP(loopback, 19111)
+	b.AddNode(seed)
+
+	go a.Begin()
+	go b.Begin()
+	defer b.Stop()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(a.HealthyNodes()) != 2 || len(b.HealthyNodes()) != 2 {
+		if time.Now().After(deadline) {
+			t.Fatal("members did not converge")
+		}
+
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	if err := a.Leave(time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	// Give b plenty of time in which it might wrongly suspect a.
+	time.Sleep(500 * time.Millisecond)
+
+	if status := seed.Status(); status != StatusLeft {
+		t.Error("expected LEFT, got", status)
+	}
+
+	if err := a.Leave(time.Second); err == nil {
+		t.Error("expected an error leaving a stopped cluster")
+	}
+}
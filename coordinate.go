@@ -0,0 +1,314 @@
+/*
+Copyright 2016 The Smudge Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package smudge
+
+import (
+	"errors"
+	"math"
+	"math/rand"
+	"sort"
+)
+
+// Each member maintains a Vivaldi network coordinate (Dabek, et al), which
+// places it in a synthetic space such that the distance between any two
+// members' coordinates approximates the round-trip time between them. Every
+// ACK carries its sender's coordinate, and each measured PING round trip
+// nudges our own coordinate towards where it ought to be relative to the
+// node that answered. Over time this lets any member estimate its latency
+// to any other, without ever having pinged it.
+
+// CoordinateDimensions is the number of dimensions of the Euclidean part of
+// a Coordinate.
+const CoordinateDimensions = 8
+
+// The tuning constants of the Vivaldi algorithm, as recommended by the paper
+// and used by Serf. Times are in milliseconds.
+const (
+	// The largest (and initial) error estimate.
+	vivaldiMaxError = 1.5
+
+	// How much a single sample may change the error estimate.
+	vivaldiErrorGain = 0.25
+
+	// How much a single sample may move the coordinate.
+	vivaldiForceGain = 0.25
+
+	// The smallest height, which keeps coordinates from collapsing.
+	vivaldiMinHeight = 0.01
+
+	// Distances and RTTs smaller than this are treated as zero.
+	vivaldiZero = 1.0e-3
+)
+
+// The number of bytes an encoded Coordinate occupies in an ACK.
+const coordinateLength = (CoordinateDimensions + 2) * 4
+
+// Coordinate is a member's position in the Vivaldi network coordinate space.
+// The estimated round-trip time between two members is the Euclidean
+// distance between their vectors, plus both of their heights, which model
+// the latency of each member's own access link. All values are in
+// milliseconds.
+type Coordinate struct {
+	// The position in Euclidean space.
+	Vec [CoordinateDimensions]float64
+
+	// The non-Euclidean component of the member's latency.
+	Height float64
+
+	// The member's confidence in its own coordinate: from 0 (certain) to
+	// 1.5 (no idea).
+	Error float64
+}
+
+/******************************************************************************
+ * Exported functions (for public consumption)
+ *****************************************************************************/
+
+// NewCoordinate returns a coordinate at the origin, with the largest error.
+func NewCoordinate() *Coordinate {
+	return &Coordinate{
+		Height: vivaldiMinHeight,
+		Error:  vivaldiMaxError,
+	}
+}
+
+// DistanceTo returns the estimated round-trip time, in milliseconds, between
+// members at this coordinate and the other.
+func (c *Coordinate) DistanceTo(other *Coordinate) float64 {
+	var sum float64
+	for i := range c.Vec {
+		diff := c.Vec[i] - other.Vec[i]
+		sum += diff * diff
+	}
+
+	return math.Sqrt(sum) + c.Height + other.Height
+}
+
+// EstimateRTT returns the estimated round-trip time, in milliseconds,
+// between two nodes, based on their network coordinates. An error is
+// returned if either node's coordinate isn't known yet.
+func EstimateRTT(a, b *Node) (float64, error) {
+	ca, cb := a.Coordinate(), b.Coordinate()
+	if ca == nil || cb == nil {
+		return 0, errors.New("network coordinate not known")
+	}
+
+	return ca.DistanceTo(cb), nil
+}
+
+// NearestNodes returns up to n healthy nodes of the default cluster, nearest
+// first. See Cluster.NearestNodes().
+func NearestNodes(n int) []*Node {
+	return defaultCluster.NearestNodes(n)
+}
+
+// NearestNodes returns up to n healthy nodes (other than this host), in
+// order of their estimated round-trip time from this host, nearest first.
+// Nodes whose network coordinates aren't known yet are left out. If n is 0,
+// all such nodes are returned.
+func (c *Cluster) NearestNodes(n int) []*Node {
+	self := c.localCoordinate()
+
+	nodes := make([]*Node, 0)
+	distances := make(map[*Node]float64)
+
+	for _, node := range c.HealthyNodes() {
+		if c.thisHost != nil && node.Address() == c.thisHost.Address() {
+			continue
+		}
+
+		coordinate := node.Coordinate()
+		if coordinate == nil {
+			continue
+		}
+
+		nodes = append(nodes, node)
+		distances[node] = self.DistanceTo(coordinate)
+	}
+
+	sort.SliceStable(nodes, func(i, j int) bool {
+		return distances[nodes[i]] < distances[nodes[j]]
+	})
+
+	if n > 0 && len(nodes) > n {
+		nodes = nodes[:n]
+	}
+
+	return nodes
+}
+
+/******************************************************************************
+ * Private functions (for internal use only)
+ *****************************************************************************/
+
+// localCoordinate returns a copy of this host's coordinate.
+func (c *Cluster) localCoordinate() *Coordinate {
+	c.coordinate.Lock()
+	defer c.coordinate.Unlock()
+
+	if c.coordinate.c == nil {
+		c.coordinate.c = NewCoordinate()
+	}
+
+	local := *c.coordinate.c
+
+	return &local
+}
+
+// updateCoordinate moves this host's coordinate to better reflect a
+// round-trip time measured to a node at the remote coordinate.
+func (c *Cluster) updateCoordinate(remote *Coordinate, rttMillis float64) {
+	local := c.localCoordinate()
+	local.update(remote, rttMillis)
+
+	// Start over if the coordinate has been ruined, by a bad sample or
+	// otherwise.
+	if !local.valid() {
+		logWarn("Network coordinate became invalid; resetting it")
+		local = NewCoordinate()
+	}
+
+	c.coordinate.Lock()
+	c.coordinate.c = local
+	c.coordinate.Unlock()
+
+	if c.thisHost != nil {
+		c.thisHost.setCoordinate(local)
+	}
+}
+
+// update applies a single Vivaldi observation: the remote node, at the
+// remote coordinate, was measured to be rttMillis away.
+func (c *Coordinate) update(remote *Coordinate, rttMillis float64) {
+	rttMillis = math.Max(rttMillis, vivaldiZero)
+	dist := c.DistanceTo(remote)
+
+	// Weigh the sample by how confident we are, relative to the remote
+	// node, and update our confidence by how wrong we turned out to be.
+	wrongness := math.Abs(dist-rttMillis) / rttMillis
+
+	totalError := math.Max(c.Error+remote.Error, vivaldiZero)
+	weight := c.Error / totalError
+
+	c.Error = vivaldiErrorGain*weight*wrongness + c.Error*(1.0-vivaldiErrorGain*weight)
+	c.Error = math.Min(c.Error, vivaldiMaxError)
+
+	// Then move towards (or away from) the remote coordinate, in proportion
+	// to the difference between the measured and estimated distances.
+	force := vivaldiForceGain * weight * (rttMillis - dist)
+
+	unit, magnitude := unitVectorAt(c.Vec, remote.Vec)
+	for i := range c.Vec {
+		c.Vec[i] += unit[i] * force
+	}
+
+	if magnitude > vivaldiZero {
+		c.Height = (c.Height+remote.Height)*force/magnitude + c.Height
+	}
+
+	c.Height = math.Max(c.Height, vivaldiMinHeight)
+}
+
+// valid returns false if any part of the coordinate is NaN or infinite.
+func (c *Coordinate) valid() bool {
+	for _, v := range c.Vec {
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			return false
+		}
+	}
+
+	return !math.IsNaN(c.Height) && !math.IsInf(c.Height, 0) &&
+		!math.IsNaN(c.Error) && !math.IsInf(c.Error, 0)
+}
+
+// unitVectorAt returns the unit vector pointing from b to a, along with the
+// distance between them. If they're too close together, a random unit
+// vector is returned, so that coincident coordinates can move apart.
+func unitVectorAt(a, b [CoordinateDimensions]float64) ([CoordinateDimensions]float64, float64) {
+	var unit [CoordinateDimensions]float64
+
+	var sum float64
+	for i := range a {
+		unit[i] = a[i] - b[i]
+		sum += unit[i] * unit[i]
+	}
+
+	if magnitude := math.Sqrt(sum); magnitude > vivaldiZero {
+		for i := range unit {
+			unit[i] /= magnitude
+		}
+
+		return unit, magnitude
+	}
+
+	sum = 0
+	for i := range unit {
+		unit[i] = rand.Float64() - 0.5
+		sum += unit[i] * unit[i]
+	}
+
+	if magnitude := math.Sqrt(sum); magnitude > vivaldiZero {
+		for i := range unit {
+			unit[i] /= magnitude
+		}
+	}
+
+	return unit, 0
+}
+
+// encode writes the coordinate into bytes starting at index p, as 32-bit
+// floats, and returns the number of bytes written.
+func (c *Coordinate) encode(bytes []byte, p int) int {
+	start := p
+
+	for _, v := range c.Vec {
+		p += encodeUint32(math.Float32bits(float32(v)), bytes, p)
+	}
+
+	p += encodeUint32(math.Float32bits(float32(c.Height)), bytes, p)
+	p += encodeUint32(math.Float32bits(float32(c.Error)), bytes, p)
+
+	return p - start
+}
+
+// decodeCoordinate reads a coordinate from bytes starting at index p. Returns
+// nil if there aren't enough bytes, or if the coordinate isn't valid.
+func decodeCoordinate(bytes []byte, p int) *Coordinate {
+	if len(bytes)-p < coordinateLength {
+		return nil
+	}
+
+	var c Coordinate
+	var v uint32
+
+	for i := range c.Vec {
+		v, p = decodeUint32(bytes, p)
+		c.Vec[i] = float64(math.Float32frombits(v))
+	}
+
+	v, p = decodeUint32(bytes, p)
+	c.Height = float64(math.Float32frombits(v))
+
+	v, _ = decodeUint32(bytes, p)
+	c.Error = float64(math.Float32frombits(v))
+
+	if !c.valid() {
+		return nil
+	}
+
+	return &c
+}
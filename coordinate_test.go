@@ -0,0 +1,154 @@
+/*
+Copyright 2016 The Smudge Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package smudge
+
+import (
+	"math"
+	"net"
+	"testing"
+)
+
+// Members spread along a line, repeatedly measuring the RTTs between each
+// other, settle on coordinates that predict those RTTs.
+func TestCoordinateConvergence(t *testing.T) {
+	positions := []float64{0, 10, 30, 60, 100}
+
+	coordinates := make([]*Coordinate, len(positions))
+	for i := range coordinates {
+		coordinates[i] = NewCoordinate()
+	}
+
+	for round := 0; round < 1000; round++ {
+		for i := range coordinates {
+			for j := range coordinates {
+				if i != j {
+					rtt := math.Abs(positions[i] - positions[j])
+					coordinates[i].update(coordinates[j], rtt)
+				}
+			}
+		}
+	}
+
+	for i := range coordinates {
+		for j := range coordinates {
+			if i == j {
+				continue
+			}
+
+			rtt := math.Abs(positions[i] - positions[j])
+			estimate := coordinates[i].DistanceTo(coordinates[j])
+
+			if math.Abs(estimate-rtt) > 0.2*rtt {
+				t.Errorf("%d to %d: estimated %.1fms, expected %.1fms", i, j, estimate, rtt)
+			}
+		}
+	}
+}
+
+// Coordinates are carried by ACKs, and only ACKs.
+func TestEncodeDecodeAckCoordinate(t *testing.T) {
+	sender, _ := CreateNodeByIP(net.IP([]byte{127, 0, 0, 1}), 1234)
+
+	coordinate := NewCoordinate()
+	coordinate.Vec[0] = 12.5
+	coordinate.Vec[7] = -3
+	coordinate.Height = 0.25
+	coordinate.Error = 0.5
+
+	msg := newMessage(verbAck, sender, 17)
+	msg.coordinate = coordinate
+
+	decoded, err := defaultCluster.decodeMessage(sender.IP(), msg.encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if decoded.coordinate == nil || *decoded.coordinate != *coordinate {
+		t.Errorf("coordinate mismatch: %+v", decoded.coordinate)
+	}
+
+	msg = newMessage(verbPing, sender, 17)
+	if decoded, _ := defaultCluster.decodeMessage(sender.IP(), msg.encode()); decoded.coordinate != nil {
+		t.Error("PING decoded with a coordinate")
+	}
+}
+
+// A measured RTT moves this host's coordinate, and improves its confidence.
+func TestCoordinateUpdatedByPing(t *testing.T) {
+	c, remote := newSuspicionTestCluster()
+
+	remote.coordinate = NewCoordinate()
+	remote.coordinate.Vec[0] = 20
+
+	c.notePingResponseTime(&pendingAck{node: remote, startTime: c.nowMillis() - 50})
+
+	// The remote node is further away than its coordinate suggests, so we
+	// move away from it.
+	local := c.localCoordinate()
+	if local.Vec[0] >= 0 {
+		t.Error("coordinate not moved away:", local.Vec)
+	}
+
+	if local.Error >= vivaldiMaxError {
+		t.Error("coordinate error not reduced:", local.Error)
+	}
+
+	if *c.thisHost.Coordinate() != *local {
+		t.Error("this host's coordinate not updated")
+	}
+}
+
+func TestNearestNodes(t *testing.T) {
+	c, _ := newSuspicionTestCluster()
+
+	at := func(x float64) *Coordinate {
+		coordinate := NewCoordinate()
+		coordinate.Vec[0] = x
+		return coordinate
+	}
+
+	c.coordinate.c = at(0)
+
+	far, _ := CreateNodeByIP(net.IP([]byte{127, 0, 0, 3}), 9999)
+	near, _ := CreateNodeByIP(net.IP([]byte{127, 0, 0, 4}), 9999)
+	unknown, _ := CreateNodeByIP(net.IP([]byte{127, 0, 0, 5}), 9999)
+
+	far.coordinate = at(80)
+	near.coordinate = at(-5)
+
+	for _, node := range []*Node{far, near, unknown} {
+		c.updateNodeStatus(node, StatusAlive, 1, 0)
+		c.AddNode(node)
+	}
+
+	nearest := c.NearestNodes(0)
+	if len(nearest) != 2 || nearest[0] != near || nearest[1] != far {
+		t.Errorf("unexpected order: %v", nearest)
+	}
+
+	if nearest = c.NearestNodes(1); len(nearest) != 1 || nearest[0] != near {
+		t.Errorf("unexpected nearest node: %v", nearest)
+	}
+
+	if rtt, err := EstimateRTT(near, far); err != nil || math.Abs(rtt-85.02) > 0.001 {
+		t.Error("unexpected estimate", rtt, err)
+	}
+
+	if _, err := EstimateRTT(near, unknown); err == nil {
+		t.Error("expected an error estimating the RTT to an unknown coordinate")
+	}
+}
@@ -0,0 +1,400 @@
+/*
+Copyright 2016 The Smudge Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package smudge
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+)
+
+// Direct messages carry an application payload from one member to exactly
+// one other, rather than to the whole cluster. A payload that fits into a
+// single UDP message is sent as a USER message, which (unlike other
+// messages) carries no member updates or broadcasts, so that its length is
+// known in advance. Anything larger is sent over TCP instead. Either way the sender can ask for an
+// acknowledgement, which the recipient sends once its MessageListeners have
+// been called.
+
+// MaxDirectMessageBytes is the maximum payload length of a direct message.
+const MaxDirectMessageBytes = 8 * 1024 * 1024
+
+// DefaultDirectAckTimeout is how long SendToNodeWithAck() waits for an
+// acknowledgement if it's given a timeout of 0.
+const DefaultDirectAckTimeout = 10 * time.Second
+
+// Direct message flags
+const (
+	// Set if the sender wants an acknowledgement.
+	directAckRequested byte = 1 << iota
+
+	// Set if the message is a response to a query; see query.go.
+	directQueryResponse
+
+	// Set if the message acknowledges receipt of a query.
+	directQueryAck
+)
+
+// The direct message carried by a USER or USERACK message. An acknowledgement
+// has the ID of the message it acknowledges, and no payload. Query responses
+// and acknowledgements have the index of the query's broadcast as their ID.
+type directMessage struct {
+	id      uint32
+	flags   byte
+	payload []byte
+}
+
+/******************************************************************************
+ * Exported functions (for public consumption)
+ *****************************************************************************/
+
+// SendToNode sends a direct message from the default cluster. See
+// Cluster.SendToNode().
+func SendToNode(node *Node, payload []byte) error {
+	return defaultCluster.SendToNode(node, payload)
+}
+
+// SendToNode sends a payload of up to MaxDirectMessageBytes to a single
+// member, whose MessageListeners will be called with it. Payloads that fit
+// into a UDP message are sent without any guarantee of delivery; larger ones
+// are sent over TCP. Use SendToNodeWithAck() to confirm delivery.
+func (c *Cluster) SendToNode(node *Node, payload []byte) error {
+	return c.sendToNode(node, payload, false, 0)
+}
+
+// SendToNodeWithAck sends a direct message from the default cluster and waits
+// for it to be acknowledged. See Cluster.SendToNodeWithAck().
+func SendToNodeWithAck(node *Node, payload []byte, timeout time.Duration) error {
+	return defaultCluster.SendToNodeWithAck(node, payload, timeout)
+}
+
+// SendToNodeWithAck sends a direct message like SendToNode(), then waits up
+// to timeout (or DefaultDirectAckTimeout, if it's 0) for the recipient to
+// acknowledge that its MessageListeners have been called. The message isn't
+// retransmitted: if an error is returned, it may or may not have been
+// delivered.
+func (c *Cluster) SendToNodeWithAck(node *Node, payload []byte, timeout time.Duration) error {
+	return c.sendToNode(node, payload, true, timeout)
+}
+
+/******************************************************************************
+ * Private functions (for internal use only)
+ *****************************************************************************/
+
+func (c *Cluster) sendToNode(node *Node, payload []byte, ack bool, timeout time.Duration) error {
+	if len(payload) > MaxDirectMessageBytes {
+		return fmt.Errorf("direct message payload length exceeds %d bytes",
+			MaxDirectMessageBytes)
+	}
+
+	if node == nil {
+		return errors.New("no recipient specified")
+	}
+
+	if !c.runningFlag.IsSet() {
+		return errors.New("cluster is not running")
+	}
+
+	direct := &directMessage{payload: payload}
+	if ack {
+		direct.flags |= directAckRequested
+	}
+
+	c.directMessages.Lock()
+	c.directMessages.sequence++
+	direct.id = c.directMessages.sequence
+	c.directMessages.Unlock()
+
+	return c.sendDirect(node, direct, timeout)
+}
+
+// sendDirect sends a direct message over UDP if it fits into a single
+// message, or over TCP otherwise. If the message requests an acknowledgement,
+// it waits up to timeout (or DefaultDirectAckTimeout, if it's 0) for it.
+func (c *Cluster) sendDirect(node *Node, direct *directMessage, timeout time.Duration) error {
+	if timeout <= 0 {
+		timeout = DefaultDirectAckTimeout
+	}
+
+	// Messages too large for UDP go over TCP, which acknowledges them on the
+	// same connection. Nothing else is packed into a USER message, so this
+	// is its whole length.
+	if 22+encodedIPLength(c.thisHost.ip)+direct.encodedLength() > c.messageBudget() {
+		return c.sendDirectTCP(node, direct, timeout)
+	}
+
+	if !direct.ackRequested() {
+		return c.transmitMessageUDP(node, nil, verbUser, c.heartbeat(), direct)
+	}
+
+	key := directAckKey(node, direct.id)
+	acked := make(chan struct{})
+
+	c.directMessages.Lock()
+	c.directMessages.acks[key] = acked
+	c.directMessages.Unlock()
+
+	defer func() {
+		c.directMessages.Lock()
+		delete(c.directMessages.acks, key)
+		c.directMessages.Unlock()
+	}()
+
+	err := c.transmitMessageUDP(node, nil, verbUser, c.heartbeat(), direct)
+	if err != nil {
+		return err
+	}
+
+	select {
+	case <-acked:
+		return nil
+	case <-c.clock.After(timeout):
+		return fmt.Errorf("direct message to %s was not acknowledged", node.Address())
+	}
+}
+
+// Returns the key under which an awaited acknowledgement is registered.
+func directAckKey(node *Node, id uint32) string {
+	return node.Address() + ":" + strconv.FormatUint(uint64(id), 10)
+}
+
+// ackRequested returns true if the sender wants an acknowledgement.
+func (d *directMessage) ackRequested() bool {
+	return d.flags&directAckRequested != 0
+}
+
+// deliverDirect hands a received direct message to the query machinery, if
+// it's a query response or acknowledgement, or to the MessageListeners.
+func (c *Cluster) deliverDirect(sender *Node, direct *directMessage) {
+	switch {
+	case direct.flags&directQueryResponse != 0:
+		c.receiveQueryResponse(sender, direct.id, direct.payload)
+	case direct.flags&directQueryAck != 0:
+		c.receiveQueryAck(sender, direct.id)
+	default:
+		c.doMessageUpdate(sender, direct.payload)
+	}
+}
+
+// receiveVerbUserUDP delivers a direct message received over UDP, then
+// acknowledges it if asked to.
+func (c *Cluster) receiveVerbUserUDP(msg message) error {
+	logfDebug("Direct message from %s (%d bytes)\n",
+		msg.sender.Address(),
+		len(msg.direct.payload))
+
+	c.deliverDirect(msg.sender, msg.direct)
+
+	if msg.direct.ackRequested() {
+		return c.transmitMessageUDP(msg.sender, nil, verbUserAck, c.heartbeat(),
+			&directMessage{id: msg.direct.id})
+	}
+
+	return nil
+}
+
+// receiveVerbUserAckUDP notifies the sender of a direct message, if it's
+// still waiting, that the message was acknowledged.
+func (c *Cluster) receiveVerbUserAckUDP(msg message) {
+	key := directAckKey(msg.sender, msg.direct.id)
+
+	c.directMessages.Lock()
+	if acked, ok := c.directMessages.acks[key]; ok {
+		close(acked)
+		delete(c.directMessages.acks, key)
+	}
+	c.directMessages.Unlock()
+}
+
+// encodedLength returns the number of bytes that encode() will write.
+func (d *directMessage) encodedLength() int {
+	return 7 + len(d.payload)
+}
+
+// Encodes the direct message into bytes starting at index p. Returns the
+// number of bytes written. See message.go for the layout.
+func (d *directMessage) encode(bytes []byte, p int) int {
+	start := p
+
+	p += encodeUint32(d.id, bytes, p)
+	p += encodeByte(d.flags, bytes, p)
+	p += encodeUint16(uint16(len(d.payload)), bytes, p)
+	p += copy(bytes[p:], d.payload)
+
+	return p - start
+}
+
+// Decodes a direct message starting at index p of bytes.
+func decodeDirectMessage(bytes []byte, p int) (*directMessage, error) {
+	if p+7 > len(bytes) {
+		return nil, errors.New("direct message is truncated")
+	}
+
+	d := &directMessage{}
+
+	var length uint16
+
+	d.id, p = decodeUint32(bytes, p)
+	d.flags, p = decodeByte(bytes, p)
+	length, p = decodeUint16(bytes, p)
+
+	if p+int(length) > len(bytes) {
+		return nil, errors.New("direct message payload is truncated")
+	}
+
+	d.payload = bytes[p : p+int(length)]
+
+	return d, nil
+}
+
+// Direct message contents over TCP (sent as a single frame; see pushpull.go)
+// Bytes 00-03 Cluster name hash
+// Bytes 04-XX Sender address (A)
+// Bytes +0-1  Sender response port
+// Bytes +2-5  Message ID
+// Bytes +6    Flags
+// Bytes +7-NN Payload
+//
+// If an acknowledgement was requested, the recipient replies with a frame
+// containing the single byte 1 once the message has been delivered.
+
+// sendDirectTCP sends a direct message over TCP, waiting for the
+// acknowledgement if one was requested.
+func (c *Cluster) sendDirectTCP(node *Node, direct *directMessage, timeout time.Duration) error {
+	request := make([]byte, 11+encodedIPLength(c.thisHost.ip)+len(direct.payload))
+
+	p := 0
+	p += encodeUint32(c.clusterHash(), request, p)
+	p += encodeIP(c.thisHost.ip, request, p)
+	p += encodeUint16(c.thisHost.port, request, p)
+	p += encodeUint32(direct.id, request, p)
+	p += encodeByte(direct.flags, request, p)
+	p += copy(request[p:], direct.payload)
+
+	frame, err := c.encodeFrame(request)
+	if err != nil {
+		return err
+	}
+
+	conn, err := c.dialStream(node, stateExchangeTimeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if direct.ackRequested() {
+		conn.SetDeadline(time.Now().Add(timeout))
+	} else {
+		conn.SetDeadline(time.Now().Add(stateExchangeTimeout))
+	}
+
+	if _, err = conn.Write(append([]byte{tcpStreamDirect}, frame...)); err != nil {
+		return err
+	}
+
+	if !direct.ackRequested() {
+		return nil
+	}
+
+	response, err := readFrame(conn)
+	if err == nil {
+		response, err = c.openPayload(response)
+	}
+
+	if err != nil {
+		return fmt.Errorf("direct message to %s was not acknowledged: %v", node.Address(), err)
+	}
+
+	if len(response) != 1 || response[0] != 1 {
+		return fmt.Errorf("direct message to %s got a malformed acknowledgement", node.Address())
+	}
+
+	return nil
+}
+
+// handleDirectConn receives a direct message sent over TCP, delivers it, and
+// acknowledges it if asked to.
+func (c *Cluster) handleDirectConn(conn net.Conn) {
+	bytes, err := readFrame(conn)
+	if err == nil {
+		bytes, err = c.openPayload(bytes)
+	}
+
+	if err != nil {
+		logError("Failed to read direct message from", conn.RemoteAddr(), "->", err)
+		return
+	}
+
+	if len(bytes) < 5 {
+		logWarn("Malformed direct message from", conn.RemoteAddr())
+		return
+	}
+
+	hash, p := decodeUint32(bytes, 0)
+	if err = c.checkClusterHash(hash, conn.RemoteAddr().String()); err != nil {
+		return
+	}
+
+	ipLength := 1
+	switch bytes[p] {
+	case addressFamilyIPv4:
+		ipLength += net.IPv4len
+	case addressFamilyIPv6:
+		ipLength += net.IPv6len
+	}
+
+	if len(bytes) < p+ipLength+7 {
+		logWarn("Malformed direct message from", conn.RemoteAddr())
+		return
+	}
+
+	var ip net.IP
+	var port uint16
+
+	direct := &directMessage{}
+
+	ip, p, _ = decodeIP(bytes, p)
+	port, p = decodeUint16(bytes, p)
+	direct.id, p = decodeUint32(bytes, p)
+	direct.flags, p = decodeByte(bytes, p)
+	direct.payload = bytes[p:]
+
+	sender := c.knownNodes.getByIP(ip, port)
+	if sender == nil {
+		sender = c.createNodeByIP(ip, port)
+	}
+
+	logfDebug("Direct message %d from %s over TCP (%d bytes)\n",
+		direct.id, sender.Address(), len(direct.payload))
+
+	c.deliverDirect(sender, direct)
+
+	if !direct.ackRequested() {
+		return
+	}
+
+	frame, err := c.encodeFrame([]byte{1})
+	if err == nil {
+		_, err = conn.Write(frame)
+	}
+
+	if err != nil {
+		logError("Failed to acknowledge direct message from", sender.Address(), "->", err)
+	}
+}
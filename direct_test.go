@@ -0,0 +1,183 @@
+/*
+Copyright 2016 The Smudge Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package smudge
+
+import (
+	"bytes"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+type recordingMessageListener struct {
+	sync.Mutex
+	senders  []*Node
+	payloads [][]byte
+}
+
+func (l *recordingMessageListener) OnMessage(sender *Node, payload []byte) {
+	l.Lock()
+	l.senders = append(l.senders, sender)
+	l.payloads = append(l.payloads, payload)
+	l.Unlock()
+}
+
+func (l *recordingMessageListener) received() [][]byte {
+	l.Lock()
+	defer l.Unlock()
+
+	return append([][]byte(nil), l.payloads...)
+}
+
+func TestEncodeDecodeDirectMessage(t *testing.T) {
+	sender, _ := CreateNodeByIP(net.ParseIP("10.0.0.1"), 9999)
+
+	msg := newMessage(verbUser, sender, 3)
+	msg.direct = &directMessage{id: 12, flags: directAckRequested, payload: []byte("hello")}
+
+	decoded, err := defaultCluster.decodeMessage(sender.IP(), msg.encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if decoded.verb != verbUser || decoded.direct == nil ||
+		decoded.direct.id != 12 || !decoded.direct.ackRequested() ||
+		string(decoded.direct.payload) != "hello" {
+		t.Errorf("unexpected direct message: %v %+v", decoded.verb, decoded.direct)
+	}
+
+	// A USER message without its direct message is rejected.
+	msg.direct = nil
+
+	if _, err = defaultCluster.decodeMessage(sender.IP(), msg.encode()); err == nil {
+		t.Error("expected an error decoding a truncated direct message")
+	}
+}
+
+// Send direct messages both ways between two members: small ones over UDP,
+// with and without acknowledgement, and a large one over TCP.
+func TestSendToNode(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping network test in short mode")
+	}
+
+	SetLogThreshold(LogWarn)
+	defer SetLogThreshold(LogInfo)
+
+	loopback := net.IP([]byte{127, 0, 0, 1})
+
+	newDirectTestCluster := func(port int) *Cluster {
+		return NewCluster(&Config{
+			ListenIP:        loopback,
+			ListenPort:      port,
+			HeartbeatMillis: 20,
+			InitialHosts:    []string{},
+			SecretKeys:      [][]byte{testKey1},
+		})
+	}
+
+	a := newDirectTestCluster(19141)
+	b := newDirectTestCluster(19142)
+
+	listener := &recordingMessageListener{}
+	b.AddMessageListener(listener)
+
+	go a.Begin()
+	go b.Begin()
+	defer a.Stop()
+	defer b.Stop()
+
+	for !a.runningFlag.IsSet() || !b.runningFlag.IsSet() {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	to, _ := CreateNodeByIP(loopback, 19142)
+	large := bytes.Repeat([]byte("smudge"), 100000)
+
+	if err := a.SendToNodeWithAck(to, []byte("acked"), 5*time.Second); err != nil {
+		t.Fatal("udp:", err)
+	}
+
+	if err := a.SendToNodeWithAck(to, large, 5*time.Second); err != nil {
+		t.Fatal("tcp:", err)
+	}
+
+	if err := a.SendToNode(to, []byte("unacked")); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(listener.received()) < 3 {
+		if time.Now().After(deadline) {
+			t.Fatal("direct messages were not delivered")
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	received := listener.received()
+	if string(received[0]) != "acked" || !bytes.Equal(received[1], large) ||
+		string(received[2]) != "unacked" {
+		t.Error("direct messages were corrupted or out of order")
+	}
+
+	listener.Lock()
+	sender := listener.senders[1]
+	listener.Unlock()
+
+	if sender.Address() != "127.0.0.1:19141" {
+		t.Error("unexpected sender:", sender.Address())
+	}
+
+	// A timeout of 0 waits for the default, whichever way the message goes.
+	if err := a.SendToNodeWithAck(to, []byte("default"), 0); err != nil {
+		t.Error("udp with the default timeout:", err)
+	}
+
+	if err := a.SendToNodeWithAck(to, large, 0); err != nil {
+		t.Error("tcp with the default timeout:", err)
+	}
+}
+
+func TestDirectMessageFillingBudget(t *testing.T) {
+	c, _, requester, requesterTransport, _ := newNackTestCluster(t)
+
+	// A pending broadcast mustn't be packed in alongside a direct message
+	// that already fills the whole message budget.
+	if err := c.BroadcastString("pending"); err != nil {
+		t.Fatal(err)
+	}
+
+	direct := &directMessage{id: 1}
+	direct.payload = bytes.Repeat([]byte{'x'},
+		c.messageBudget()-22-encodedIPLength(c.thisHost.ip)-direct.encodedLength())
+
+	if err := c.sendDirect(requester, direct, time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case packet := <-requesterTransport.Packets():
+		if len(packet.Bytes) > c.messageBudget() {
+			t.Errorf("%d byte message exceeds the %d byte budget",
+				len(packet.Bytes), c.messageBudget())
+		}
+	default:
+		t.Fatal("the direct message was not sent over UDP")
+	}
+}
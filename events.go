@@ -16,17 +16,226 @@ limitations under the License.
 
 package smudge
 
-import "sync"
+import (
+	"sync"
+	"sync/atomic"
+)
 
-var broadcastListeners = struct {
-	sync.RWMutex
-	s []BroadcastListener
-}{s: make([]BroadcastListener, 0, 16)}
+// Membership changes, received broadcasts and metadata changes are published
+// as Events to every Subscription. Publishing never calls into user code:
+// each event is put into the subscription's buffered channel, and what
+// happens when that buffer is full is up to the subscription's
+// OverflowPolicy. The listener interfaces below are implemented on top of
+// subscriptions, each listener being called from its own goroutine, so a
+// slow listener can't stall the gossip loop.
 
-var statusListeners = struct {
-	sync.RWMutex
-	s []StatusListener
-}{s: make([]StatusListener, 0, 16)}
+// EventType identifies the kind of an Event.
+type EventType byte
+
+const (
+	// NodeJoined is published when a member becomes alive that wasn't
+	// previously part of the cluster (its status was unknown, dead or left).
+	NodeJoined EventType = iota + 1
+
+	// NodeStatusChanged is published when a member's status changes in any
+	// way not covered by NodeJoined or NodeLeft, such as becoming suspected
+	// or refuting a suspicion.
+	NodeStatusChanged
+
+	// NodeLeft is published when a member is declared dead, or announces
+	// that it has left the cluster.
+	NodeLeft
+
+	// BroadcastReceived is published when a broadcast is received.
+	BroadcastReceived
+
+	// MetadataChanged is published when new metadata is learned for a
+	// member, including this host.
+	MetadataChanged
+)
+
+func (t EventType) String() string {
+	switch t {
+	case NodeJoined:
+		return "NODE_JOINED"
+	case NodeStatusChanged:
+		return "NODE_STATUS_CHANGED"
+	case NodeLeft:
+		return "NODE_LEFT"
+	case BroadcastReceived:
+		return "BROADCAST_RECEIVED"
+	case MetadataChanged:
+		return "METADATA_CHANGED"
+	default:
+		return "UNDEFINED"
+	}
+}
+
+// Event describes a change observed by this member. Which fields are set
+// depends on its Type.
+type Event struct {
+	Type EventType
+
+	// The member the event is about; for a BroadcastReceived event, the
+	// broadcast's origin.
+	Node *Node
+
+	// For NodeJoined, NodeStatusChanged and NodeLeft events, the member's
+	// new and previous statuses.
+	Status         NodeStatus
+	PreviousStatus NodeStatus
+
+	// For BroadcastReceived events, the broadcast.
+	Broadcast *Broadcast
+
+	// For MetadataChanged events, the member's new metadata.
+	Metadata map[string]string
+}
+
+// OverflowPolicy determines what happens when an event is published to a
+// subscription whose buffer is full.
+type OverflowPolicy byte
+
+const (
+	// DropNewest discards the event being published. This is the default.
+	DropNewest OverflowPolicy = iota
+
+	// DropOldest discards the oldest buffered event to make room for the
+	// one being published.
+	DropOldest
+
+	// Block waits until the subscriber makes room. This applies backpressure
+	// to the code publishing the event, which is usually the gossip loop
+	// itself, so a subscriber that stops reading will stall the member.
+	Block
+)
+
+// DefaultEventBufferSize is the buffer size of subscriptions that don't
+// specify one.
+const DefaultEventBufferSize = 64
+
+// The buffer size of the subscriptions behind listeners. Listeners use the
+// DropOldest policy, so that a stuck listener can never stall the gossip
+// loop; the large buffer means that only one that falls far behind misses
+// events, and then only the oldest.
+const listenerEventBufferSize = 1024
+
+// A listener added with one of the Add*Listener() functions, and the
+// subscription that currently feeds it, if any.
+type listener struct {
+	options SubscribeOptions
+	handle  func(Event)
+	sub     *Subscription
+}
+
+// SubscribeOptions configure a Subscription. A nil *SubscribeOptions is
+// equivalent to an empty one.
+type SubscribeOptions struct {
+	// The number of events buffered for the subscriber. 0 means
+	// DefaultEventBufferSize.
+	BufferSize int
+
+	// What to do with events published while the buffer is full.
+	Policy OverflowPolicy
+
+	// If not empty, only events of these types are delivered.
+	Types []EventType
+
+	// If not nil, only BroadcastReceived events for broadcasts on these
+	// topics are delivered. Use "" for broadcasts without a topic.
+	Topics []string
+}
+
+// Subscription is a stream of Events returned by Subscribe().
+type Subscription struct {
+	cluster *Cluster
+	events  chan Event
+	done    chan struct{}
+	once    sync.Once
+	policy  OverflowPolicy
+	types   map[EventType]bool
+	topics  map[string]bool
+	dropped uint64
+}
+
+/******************************************************************************
+ * Exported functions (for public consumption)
+ *****************************************************************************/
+
+// Subscribe returns a new Subscription to the default cluster's events. See
+// Cluster.Subscribe().
+func Subscribe(options *SubscribeOptions) *Subscription {
+	return defaultCluster.Subscribe(options)
+}
+
+// Subscribe returns a new Subscription, whose Events() channel receives every
+// subsequent event that matches the options, until Unsubscribe() is called.
+func (c *Cluster) Subscribe(options *SubscribeOptions) *Subscription {
+	if options == nil {
+		options = &SubscribeOptions{}
+	}
+
+	size := options.BufferSize
+	if size <= 0 {
+		size = DefaultEventBufferSize
+	}
+
+	sub := &Subscription{
+		cluster: c,
+		events:  make(chan Event, size),
+		done:    make(chan struct{}),
+		policy:  options.Policy,
+	}
+
+	if len(options.Types) > 0 {
+		sub.types = make(map[EventType]bool)
+		for _, t := range options.Types {
+			sub.types[t] = true
+		}
+	}
+
+	if options.Topics != nil {
+		sub.topics = make(map[string]bool)
+		for _, topic := range options.Topics {
+			sub.topics[topic] = true
+		}
+	}
+
+	c.subscriptions.Lock()
+	c.subscriptions.m[sub] = struct{}{}
+	c.subscriptions.Unlock()
+
+	return sub
+}
+
+// Events returns the channel on which events are delivered. It's closed by
+// Unsubscribe().
+func (s *Subscription) Events() <-chan Event {
+	return s.events
+}
+
+// Dropped returns the number of events that have been discarded because the
+// subscription's buffer was full.
+func (s *Subscription) Dropped() uint64 {
+	return atomic.LoadUint64(&s.dropped)
+}
+
+// Unsubscribe stops delivery of events and closes the Events() channel.
+// Events already buffered can still be received from it. It's safe to call
+// more than once.
+func (s *Subscription) Unsubscribe() {
+	s.once.Do(func() {
+		// Release any publisher blocked on a full buffer, which holds the
+		// read lock we need.
+		close(s.done)
+
+		s.cluster.subscriptions.Lock()
+		delete(s.cluster.subscriptions.m, s)
+		s.cluster.subscriptions.Unlock()
+
+		close(s.events)
+	})
+}
 
 // BroadcastListener is the interface that must be implemented to take advantage
 // of the cluster member status update notification functionality provided by
@@ -37,21 +246,88 @@ type BroadcastListener interface {
 	OnBroadcast(broadcast *Broadcast)
 }
 
-// AddBroadcastListener allows the submission of a BroadcastListener implementation
-// whose OnChange() function will be called whenever the node is notified of any
-// change in the status of a cluster member.
+// AddBroadcastListener allows the submission of a BroadcastListener
+// implementation to the default cluster. See Cluster.AddBroadcastListener().
 func AddBroadcastListener(listener BroadcastListener) {
-	broadcastListeners.Lock()
-	broadcastListeners.s = append(broadcastListeners.s, listener)
-	broadcastListeners.Unlock()
+	defaultCluster.AddBroadcastListener(listener)
 }
 
-func doBroadcastUpdate(broadcast *Broadcast) {
-	broadcastListeners.RLock()
-	for _, sl := range broadcastListeners.s {
-		sl.OnBroadcast(broadcast)
-	}
-	broadcastListeners.RUnlock()
+// AddBroadcastListener allows the submission of a BroadcastListener implementation
+// whose OnBroadcast() function will be called whenever the node receives a
+// broadcast that has no topic.
+func (c *Cluster) AddBroadcastListener(listener BroadcastListener) {
+	c.AddTopicListener("", listener)
+}
+
+// AddTopicListener allows the submission of a BroadcastListener
+// implementation for a topic to the default cluster. See
+// Cluster.AddTopicListener().
+func AddTopicListener(topic string, listener BroadcastListener) {
+	defaultCluster.AddTopicListener(topic, listener)
+}
+
+// AddTopicListener allows the submission of a BroadcastListener
+// implementation whose OnBroadcast() function will be called whenever the
+// node receives a broadcast emitted on topic with BroadcastToTopic().
+func (c *Cluster) AddTopicListener(topic string, listener BroadcastListener) {
+	c.addListener(&SubscribeOptions{
+		Types:  []EventType{BroadcastReceived},
+		Topics: []string{topic},
+	}, func(e Event) {
+		listener.OnBroadcast(e.Broadcast)
+	})
+}
+
+// MessageListener is the interface that must be implemented to receive
+// direct messages sent with SendToNode() via the AddMessageListener()
+// function.
+type MessageListener interface {
+	// The OnMessage() function is called whenever the node receives a
+	// direct message from another member.
+	OnMessage(sender *Node, payload []byte)
+}
+
+// AddMessageListener allows the submission of a MessageListener
+// implementation to the default cluster. See Cluster.AddMessageListener().
+func AddMessageListener(listener MessageListener) {
+	defaultCluster.AddMessageListener(listener)
+}
+
+// AddMessageListener allows the submission of a MessageListener
+// implementation whose OnMessage() function will be called whenever the node
+// receives a direct message. Unlike the other listeners, MessageListeners are
+// called synchronously, since a direct message is only acknowledged once
+// they've returned.
+func (c *Cluster) AddMessageListener(listener MessageListener) {
+	c.messageListeners.Lock()
+	c.messageListeners.s = append(c.messageListeners.s, listener)
+	c.messageListeners.Unlock()
+}
+
+// MetadataListener is the interface that must be implemented to be notified
+// of changes to cluster members' metadata via the AddMetadataListener()
+// function.
+type MetadataListener interface {
+	// The OnMetadataChange() function is called whenever the node learns of
+	// new metadata for a cluster member (including this host).
+	OnMetadataChange(node *Node, metadata map[string]string)
+}
+
+// AddMetadataListener allows the submission of a MetadataListener
+// implementation to the default cluster. See Cluster.AddMetadataListener().
+func AddMetadataListener(listener MetadataListener) {
+	defaultCluster.AddMetadataListener(listener)
+}
+
+// AddMetadataListener allows the submission of a MetadataListener
+// implementation whose OnMetadataChange() function will be called whenever
+// the node learns of new metadata for a cluster member.
+func (c *Cluster) AddMetadataListener(listener MetadataListener) {
+	c.addListener(&SubscribeOptions{
+		Types: []EventType{MetadataChanged},
+	}, func(e Event) {
+		listener.OnMetadataChange(e.Node, e.Metadata)
+	})
 }
 
 // StatusListener is the interface that must be implemented to take advantage
@@ -63,19 +339,181 @@ type StatusListener interface {
 	OnChange(node *Node, status NodeStatus)
 }
 
+// AddStatusListener allows the submission of a StatusListener implementation
+// to the default cluster. See Cluster.AddStatusListener().
+func AddStatusListener(listener StatusListener) {
+	defaultCluster.AddStatusListener(listener)
+}
+
 // AddStatusListener allows the submission of a StatusListener implementation
 // whose OnChange() function will be called whenever the node is notified of any
 // change in the status of a cluster member.
-func AddStatusListener(listener StatusListener) {
-	statusListeners.Lock()
-	statusListeners.s = append(statusListeners.s, listener)
-	statusListeners.Unlock()
+func (c *Cluster) AddStatusListener(listener StatusListener) {
+	c.addListener(&SubscribeOptions{
+		Types: []EventType{NodeJoined, NodeStatusChanged, NodeLeft},
+	}, func(e Event) {
+		listener.OnChange(e.Node, e.Status)
+	})
+}
+
+/******************************************************************************
+ * Private functions (for internal use only)
+ *****************************************************************************/
+
+// addListener subscribes on behalf of a listener, and calls handle with each
+// event from its own goroutine. The listener is unsubscribed by Shutdown(),
+// and subscribed again by Start().
+func (c *Cluster) addListener(options *SubscribeOptions, handle func(Event)) {
+	options.BufferSize = listenerEventBufferSize
+	options.Policy = DropOldest
+
+	c.lifecycle.Lock()
+	defer c.lifecycle.Unlock()
+
+	l := &listener{options: *options, handle: handle}
+	c.lifecycle.listeners = append(c.lifecycle.listeners, l)
+
+	c.startListener(l)
+}
+
+// startListener subscribes on behalf of a listener, and calls its handler
+// with each event from a spawned goroutine until the subscription is closed.
+// The caller must hold the lifecycle lock.
+func (c *Cluster) startListener(l *listener) {
+	options := l.options
+	l.sub = c.Subscribe(&options)
+
+	events := l.sub.Events()
+
+	c.spawn(func() {
+		for e := range events {
+			l.handle(e)
+		}
+	})
+}
+
+// startListeners subscribes every listener that was unsubscribed by
+// stopListeners(). The caller must hold the lifecycle lock.
+func (c *Cluster) startListeners() {
+	for _, l := range c.lifecycle.listeners {
+		if l.sub == nil {
+			c.startListener(l)
+		}
+	}
+}
+
+// stopListeners unsubscribes every listener, so that their goroutines finish
+// once they've handled the events already buffered. The caller must hold the
+// lifecycle lock.
+func (c *Cluster) stopListeners() {
+	for _, l := range c.lifecycle.listeners {
+		if l.sub != nil {
+			l.sub.Unsubscribe()
+			l.sub = nil
+		}
+	}
+}
+
+// publish delivers an event to every matching subscription.
+func (c *Cluster) publish(e Event) {
+	c.subscriptions.RLock()
+	for sub := range c.subscriptions.m {
+		if sub.matches(e) {
+			sub.deliver(e)
+		}
+	}
+	c.subscriptions.RUnlock()
+}
+
+// matches returns true if the subscription's options select the event.
+func (s *Subscription) matches(e Event) bool {
+	if s.types != nil && !s.types[e.Type] {
+		return false
+	}
+
+	if s.topics != nil && e.Type == BroadcastReceived && !s.topics[e.Broadcast.topic] {
+		return false
+	}
+
+	return true
+}
+
+// deliver puts an event into the subscription's buffer, applying its
+// overflow policy if the buffer is full. It must be called with the
+// cluster's subscriptions read lock held, which keeps the channel open.
+func (s *Subscription) deliver(e Event) {
+	select {
+	case <-s.done:
+		return
+	case s.events <- e:
+		return
+	default:
+	}
+
+	switch s.policy {
+	case Block:
+		select {
+		case <-s.done:
+		case s.events <- e:
+		}
+	case DropOldest:
+		for {
+			select {
+			case s.events <- e:
+				return
+			default:
+			}
+
+			select {
+			case <-s.events:
+				atomic.AddUint64(&s.dropped, 1)
+			default:
+			}
+		}
+	default:
+		atomic.AddUint64(&s.dropped, 1)
+	}
+}
+
+func (c *Cluster) doBroadcastUpdate(broadcast *Broadcast) {
+	c.publish(Event{
+		Type:      BroadcastReceived,
+		Node:      broadcast.origin,
+		Broadcast: broadcast,
+	})
 }
 
-func doStatusUpdate(node *Node, status NodeStatus) {
-	statusListeners.RLock()
-	for _, sl := range statusListeners.s {
-		sl.OnChange(node, status)
+func (c *Cluster) doMessageUpdate(sender *Node, payload []byte) {
+	c.messageListeners.RLock()
+	for _, ml := range c.messageListeners.s {
+		ml.OnMessage(sender, payload)
 	}
-	statusListeners.RUnlock()
+	c.messageListeners.RUnlock()
+}
+
+func (c *Cluster) doMetadataUpdate(node *Node) {
+	c.publish(Event{
+		Type:     MetadataChanged,
+		Node:     node,
+		Metadata: node.Metadata(),
+	})
+}
+
+func (c *Cluster) doStatusUpdate(node *Node, previous NodeStatus, status NodeStatus) {
+	e := Event{
+		Type:           NodeStatusChanged,
+		Node:           node,
+		Status:         status,
+		PreviousStatus: previous,
+	}
+
+	switch {
+	case status == StatusDead || status == StatusLeft:
+		e.Type = NodeLeft
+	case status == StatusAlive &&
+		(previous == StatusUnknown || previous == StatusDead || previous == StatusLeft):
+		e.Type = NodeJoined
+	}
+
+	c.publish(e)
 }
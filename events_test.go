@@ -0,0 +1,207 @@
+/*
+Copyright 2016 The Smudge Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package smudge
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// Returns the events currently buffered for a subscription. Events are
+// published synchronously, so this is everything published so far.
+func bufferedEvents(sub *Subscription) []Event {
+	var events []Event
+
+	for {
+		select {
+		case e, ok := <-sub.Events():
+			if !ok {
+				return events
+			}
+
+			events = append(events, e)
+		default:
+			return events
+		}
+	}
+}
+
+// Status changes are published as joined, changed and left events.
+func TestStatusEvents(t *testing.T) {
+	c := NewCluster(&Config{})
+	sub := c.Subscribe(&SubscribeOptions{Types: []EventType{NodeJoined, NodeLeft}})
+	defer sub.Unsubscribe()
+
+	node, _ := CreateNodeByIP(net.ParseIP("10.0.0.1"), 9999)
+
+	c.updateNodeStatus(node, StatusAlive, 1, 0)
+	c.updateNodeStatus(node, StatusSuspected, 1, 0)
+	c.updateNodeStatus(node, StatusDead, 1, 0)
+	c.updateNodeStatus(node, StatusAlive, 2, 1)
+
+	events := bufferedEvents(sub)
+
+	expected := []EventType{NodeJoined, NodeLeft, NodeJoined}
+	if len(events) != len(expected) {
+		t.Fatalf("expected %v, got %+v", expected, events)
+	}
+
+	for i, e := range events {
+		if e.Type != expected[i] || e.Node != node {
+			t.Errorf("event %d: expected %v, got %+v", i, expected[i], e)
+		}
+	}
+}
+
+func TestOverflowPolicies(t *testing.T) {
+	c := NewCluster(&Config{})
+	node, _ := CreateNodeByIP(net.ParseIP("10.0.0.1"), 9999)
+
+	newest := c.Subscribe(&SubscribeOptions{BufferSize: 2, Policy: DropNewest})
+	oldest := c.Subscribe(&SubscribeOptions{BufferSize: 2, Policy: DropOldest})
+
+	for i := 0; i < 4; i++ {
+		c.doMetadataUpdate(node)
+		c.doStatusUpdate(node, StatusUnknown, NodeStatus(i))
+	}
+
+	if newest.Dropped() != 6 || oldest.Dropped() != 6 {
+		t.Errorf("expected 6 drops, got %d and %d", newest.Dropped(), oldest.Dropped())
+	}
+
+	if e := bufferedEvents(newest); e[0].Type != MetadataChanged || e[1].Status != 0 {
+		t.Errorf("DropNewest kept the wrong events: %+v", e)
+	}
+
+	if e := bufferedEvents(oldest); e[0].Type != MetadataChanged || e[1].Status != 3 {
+		t.Errorf("DropOldest kept the wrong events: %+v", e)
+	}
+
+	// A blocked publisher is released by Unsubscribe().
+	blocking := c.Subscribe(&SubscribeOptions{BufferSize: 1, Policy: Block})
+
+	done := make(chan struct{})
+	go func() {
+		c.doMetadataUpdate(node)
+		c.doMetadataUpdate(node)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		t.Fatal("publisher didn't block")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	blocking.Unsubscribe()
+	blocking.Unsubscribe()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("publisher still blocked after Unsubscribe()")
+	}
+
+	if len(bufferedEvents(blocking)) != 1 {
+		t.Error("expected the buffered event to survive Unsubscribe()")
+	}
+
+	newest.Unsubscribe()
+	oldest.Unsubscribe()
+
+	if len(c.subscriptions.m) != 0 {
+		t.Error("subscriptions were not removed")
+	}
+}
+
+type slowStatusListener struct {
+	statuses chan NodeStatus
+}
+
+func (l slowStatusListener) OnChange(node *Node, status NodeStatus) {
+	time.Sleep(10 * time.Millisecond)
+	l.statuses <- status
+}
+
+// Listeners are called in order, without holding up the publisher.
+func TestStatusListener(t *testing.T) {
+	c := NewCluster(&Config{})
+	node, _ := CreateNodeByIP(net.ParseIP("10.0.0.1"), 9999)
+
+	listener := slowStatusListener{make(chan NodeStatus, 8)}
+	c.AddStatusListener(listener)
+
+	start := time.Now()
+
+	expected := []NodeStatus{StatusAlive, StatusSuspected, StatusDead}
+	for _, status := range expected {
+		c.updateNodeStatus(node, status, 1, 0)
+	}
+
+	if time.Since(start) >= 10*time.Millisecond {
+		t.Error("publishing waited for the listener")
+	}
+
+	for _, status := range expected {
+		select {
+		case s := <-listener.statuses:
+			if s != status {
+				t.Errorf("expected %v, got %v", status, s)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("listener was not called")
+		}
+	}
+}
+
+type stuckStatusListener struct {
+	release chan struct{}
+}
+
+func (l stuckStatusListener) OnChange(node *Node, status NodeStatus) {
+	<-l.release
+}
+
+// A listener that stops returning loses its oldest events rather than
+// stalling the publisher.
+func TestStuckListener(t *testing.T) {
+	c := NewCluster(&Config{})
+
+	listener := stuckStatusListener{make(chan struct{})}
+	c.AddStatusListener(listener)
+
+	published := make(chan struct{})
+	go func() {
+		for i := 0; i < 2*listenerEventBufferSize; i++ {
+			c.publish(Event{Type: NodeStatusChanged, Status: StatusAlive})
+		}
+		close(published)
+	}()
+
+	select {
+	case <-published:
+	case <-time.After(5 * time.Second):
+		t.Fatal("publishing was blocked by the listener")
+	}
+
+	if dropped := c.lifecycle.listeners[0].sub.Dropped(); dropped == 0 {
+		t.Error("expected events to be dropped")
+	}
+
+	close(listener.release)
+}
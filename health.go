@@ -0,0 +1,133 @@
+/*
+Copyright 2016 The Smudge Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package smudge
+
+import (
+	"time"
+)
+
+// A host that is itself slow (because it's overloaded, paused, or its
+// network is congested) misses ACKs from perfectly healthy members, and
+// without some awareness of that it would go on to suspect them. Following
+// Lifeguard (Dadgar, et al), each host keeps a local health score that rises
+// whenever it has evidence that it may be the problem:
+//
+//   - a direct probe goes unanswered;
+//   - a member asked to probe indirectly sends neither an ACK nor a NACK,
+//     since a healthy helper always answers one way or the other;
+//   - another member suspects this host, and it has to refute that.
+//
+// Each ACK to a probe, direct or indirect, lowers the score again. Probe and
+// suspicion timeouts are multiplied by (1 + score), so an unhealthy host
+// waits longer before blaming others.
+
+// The change in local health score for each kind of evidence.
+const (
+	healthProbeFailed  = 1
+	healthMissedNack   = 1
+	healthRefuted      = 1
+	healthProbeSuccess = -1
+)
+
+// The fraction of a requester's (unscaled) PINGREQ timeout after which a
+// helper that hasn't heard from the target sends its NACK, leaving the rest
+// for the NACK to reach the requester.
+const nackTimeoutFraction = 0.8
+
+/******************************************************************************
+ * Exported functions (for public consumption)
+ *****************************************************************************/
+
+// LocalHealth returns the default cluster's local health score. See
+// Cluster.LocalHealth().
+func LocalHealth() int {
+	return defaultCluster.LocalHealth()
+}
+
+// LocalHealth returns this host's local health score, from 0 (healthy) to
+// MaxLocalHealth(). Probe and suspicion timeouts are scaled by one more than
+// this.
+func (c *Cluster) LocalHealth() int {
+	c.localHealth.Lock()
+	defer c.localHealth.Unlock()
+
+	return c.localHealth.score
+}
+
+/******************************************************************************
+ * Private functions (for internal use only)
+ *****************************************************************************/
+
+// adjustLocalHealth adds delta to the local health score, keeping it between
+// 0 and MaxLocalHealth().
+func (c *Cluster) adjustLocalHealth(delta int) {
+	max := c.MaxLocalHealth()
+	if max < 0 {
+		max = 0
+	}
+
+	c.localHealth.Lock()
+	defer c.localHealth.Unlock()
+
+	previous := c.localHealth.score
+
+	score := previous + delta
+	if score > max {
+		score = max
+	} else if score < 0 {
+		score = 0
+	}
+
+	c.localHealth.score = score
+
+	if score != previous {
+		logfDebug("Local health score changed from %d to %d\n", previous, score)
+	}
+}
+
+// localHealthMultiplier returns the factor by which probe and suspicion
+// timeouts are scaled.
+func (c *Cluster) localHealthMultiplier() int64 {
+	return int64(c.LocalHealth() + 1)
+}
+
+// probeTimeoutMillis returns how long to wait for the ACK to a pending probe
+// before it's timed out. This is based on the round-trip times of the node
+// being probed; see rtt.go.
+func (c *Cluster) probeTimeoutMillis(pack *pendingAck) int64 {
+	timeout := int64(c.rtt(pack.node).nSigma(timeoutToleranceSigmas))
+
+	// Ping requests involve a round trip to the helper, and another from
+	// the helper to the target. A helper sends its NACK at a fixed fraction
+	// of this (see nackDelay()), so that it arrives before this.
+	if pack.packType == packPingReq && pack.callback != nil {
+		timeout += int64(c.rtt(pack.callback).nSigma(timeoutToleranceSigmas))
+	}
+
+	return timeout * c.localHealthMultiplier()
+}
+
+// nackDelay returns how long a helper waits for the target of an NFP to
+// answer before sending a NACK to the requester. The requester's timeout
+// covers the round trips to both, scaled by its own local health, so the
+// NACK is sent at a fixed fraction of the unscaled sum.
+func (c *Cluster) nackDelay(pack *pendingAck) time.Duration {
+	timeout := c.rtt(pack.node).nSigma(timeoutToleranceSigmas) +
+		c.rtt(pack.callback).nSigma(timeoutToleranceSigmas)
+
+	return time.Duration(timeout*nackTimeoutFraction) * time.Millisecond
+}
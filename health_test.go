@@ -0,0 +1,306 @@
+/*
+Copyright 2016 The Smudge Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package smudge
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// Starts a cluster's timeout check loop on a fake clock, and returns a
+// function that stops it.
+func startFakeTimeoutCheckLoop(c *Cluster, clock *FakeClock) func() {
+	c.lifecycle.stopping = make(chan struct{})
+	c.spawn(c.startTimeoutCheckLoop)
+	clock.BlockUntil(1)
+
+	return func() {
+		close(c.lifecycle.stopping)
+		c.lifecycle.wg.Wait()
+	}
+}
+
+func TestLocalHealthBounds(t *testing.T) {
+	c := NewCluster(&Config{MaxLocalHealth: 2})
+
+	c.adjustLocalHealth(healthProbeSuccess)
+	if c.LocalHealth() != 0 {
+		t.Error("expected score 0, got", c.LocalHealth())
+	}
+
+	for i := 0; i < 5; i++ {
+		c.adjustLocalHealth(healthProbeFailed)
+	}
+	if c.LocalHealth() != 2 {
+		t.Error("expected score 2, got", c.LocalHealth())
+	}
+
+	disabled := NewCluster(&Config{MaxLocalHealth: -1})
+	disabled.adjustLocalHealth(healthProbeFailed)
+	if disabled.LocalHealth() != 0 {
+		t.Error("expected score 0 with local health disabled, got", disabled.LocalHealth())
+	}
+}
+
+func TestTimeoutsScaleWithLocalHealth(t *testing.T) {
+	c, remote := newSuspicionTestCluster()
+
+	ping := &pendingAck{node: remote, packType: packPing}
+	probe := c.probeTimeoutMillis(ping)
+	suspicion := c.suspicionTimeoutMillis()
+
+	c.adjustLocalHealth(healthProbeFailed)
+	c.adjustLocalHealth(healthProbeFailed)
+
+	if got := c.probeTimeoutMillis(ping); got != 3*probe {
+		t.Errorf("expected probe timeout of %d, got %d", 3*probe, got)
+	}
+
+	if got := c.suspicionTimeoutMillis(); got != 3*suspicion {
+		t.Errorf("expected suspicion timeout of %d, got %d", 3*suspicion, got)
+	}
+}
+
+// A PINGREQ that times out only counts against local health if its helper
+// didn't send a NACK.
+func TestMissedNacks(t *testing.T) {
+	SetLogThreshold(LogWarn)
+	defer SetLogThreshold(LogInfo)
+
+	clock := NewFakeClock(time.Unix(1000, 0))
+	c, remote := newSuspicionTestClusterWithClock(clock)
+
+	nacking, _ := CreateNodeByIP(net.IP([]byte{127, 0, 0, 3}), 9999)
+	silent, _ := CreateNodeByIP(net.IP([]byte{127, 0, 0, 4}), 9999)
+
+	for _, helper := range []*Node{nacking, silent} {
+		c.pendingAcks.m[helper.Address()+":7"] = &pendingAck{
+			node:      helper,
+			callback:  remote,
+			startTime: c.nowMillis(),
+			packType:  packPingReq,
+		}
+	}
+
+	c.receiveVerbNackUDP(newMessage(verbNack, nacking, 7))
+
+	if !c.pendingAcks.m[nacking.Address()+":7"].nacked {
+		t.Fatal("NACK not recorded")
+	}
+
+	stop := startFakeTimeoutCheckLoop(c, clock)
+	defer stop()
+
+	clock.Advance(time.Second)
+	clock.BlockUntil(1)
+
+	if len(c.pendingAcks.m) != 0 {
+		t.Error("PINGREQs not timed out")
+	}
+
+	if c.LocalHealth() != healthMissedNack {
+		t.Errorf("expected score %d, got %d", healthMissedNack, c.LocalHealth())
+	}
+}
+
+// Returns a cluster on a fake clock that can send to a requester and a
+// target, both listening on the same network.
+func newNackTestCluster(t *testing.T) (*Cluster, *FakeClock, *Node, *chanTransport, *Node) {
+	network := &chanNetwork{members: make(map[string]*chanTransport)}
+
+	clock := NewFakeClock(time.Unix(1000, 0))
+	c, target := newSuspicionTestClusterWithClock(clock)
+	c.lifecycle.stopping = make(chan struct{})
+
+	c.transport = &chanTransport{network: network}
+	if err := c.transport.Listen(c.thisHost.IP(), int(c.thisHost.Port())); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := (&chanTransport{network: network}).Listen(target.IP(), int(target.Port())); err != nil {
+		t.Fatal(err)
+	}
+
+	requesterIP := net.IP([]byte{127, 0, 0, 5})
+	requesterTransport := &chanTransport{network: network}
+	if err := requesterTransport.Listen(requesterIP, 9999); err != nil {
+		t.Fatal(err)
+	}
+
+	requester, _ := CreateNodeByIP(requesterIP, 9999)
+
+	return c, clock, requester, requesterTransport, target
+}
+
+// Asks a cluster to probe the target on behalf of the requester, and returns
+// the delay before it will send its NACK.
+func requestForward(t *testing.T, c *Cluster, clock *FakeClock, requester *Node, target *Node) time.Duration {
+	msg := newMessage(verbPingRequest, requester, 42)
+	if err := msg.addMember(target, StatusForwardTo, 42); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.receiveVerbForwardUDP(msg); err != nil {
+		t.Fatal(err)
+	}
+
+	clock.BlockUntil(1)
+
+	return c.nackDelay(c.pendingAcks.m[target.Address()+":42"])
+}
+
+// A helper whose NFPING goes unanswered sends a NACK to the requester, in
+// time for it to arrive before the requester's own PINGREQ times out.
+func TestNackSentBeforeRequesterTimesOut(t *testing.T) {
+	SetLogThreshold(LogWarn)
+	defer SetLogThreshold(LogInfo)
+
+	c, clock, requester, requesterTransport, target := newNackTestCluster(t)
+	defer close(c.lifecycle.stopping)
+
+	delay := requestForward(t, c, clock, requester, target)
+
+	requesterTimeout := c.probeTimeoutMillis(&pendingAck{
+		node:     c.thisHost,
+		callback: target,
+		packType: packPingReq,
+	})
+
+	if delay <= 0 || delay >= time.Duration(requesterTimeout)*time.Millisecond {
+		t.Errorf("expected a NACK delay within the requester's timeout of %dms, got %v",
+			requesterTimeout, delay)
+	}
+
+	clock.Advance(delay - time.Millisecond)
+
+	select {
+	case <-requesterTransport.Packets():
+		t.Fatal("NACK sent early")
+	default:
+	}
+
+	clock.Advance(time.Millisecond)
+
+	select {
+	case packet := <-requesterTransport.Packets():
+		msg, err := c.decodeMessage(addressIP(packet.From), packet.Bytes)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if msg.verb != verbNack || msg.senderHeartbeat != 42 ||
+			msg.sender.Address() != c.thisHost.Address() {
+			t.Errorf("unexpected %v from %s with code %d",
+				msg.verb, msg.sender.Address(), msg.senderHeartbeat)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("NACK not sent")
+	}
+
+	c.lifecycle.wg.Wait()
+}
+
+// A helper whose NFPING is answered forwards the ACK, and sends no NACK.
+func TestNoNackAfterAck(t *testing.T) {
+	SetLogThreshold(LogWarn)
+	defer SetLogThreshold(LogInfo)
+
+	c, clock, requester, requesterTransport, target := newNackTestCluster(t)
+	defer close(c.lifecycle.stopping)
+
+	delay := requestForward(t, c, clock, requester, target)
+
+	if err := c.receiveVerbAckUDP(newMessage(verbAck, target, 42)); err != nil {
+		t.Fatal(err)
+	}
+
+	clock.Advance(delay)
+	c.lifecycle.wg.Wait()
+
+	verbs := []messageVerb{}
+	for len(requesterTransport.Packets()) > 0 {
+		packet := <-requesterTransport.Packets()
+
+		msg, err := c.decodeMessage(addressIP(packet.From), packet.Bytes)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		verbs = append(verbs, msg.verb)
+	}
+
+	if len(verbs) != 1 || verbs[0] != verbAck {
+		t.Error("expected only an ACK, got", verbs)
+	}
+}
+
+// An ACK that arrives through a helper lowers the local health score, just
+// as a direct one does.
+func TestIndirectAckImprovesLocalHealth(t *testing.T) {
+	SetLogThreshold(LogWarn)
+	defer SetLogThreshold(LogInfo)
+
+	c, _, helper, _, target := newNackTestCluster(t)
+	defer close(c.lifecycle.stopping)
+
+	c.adjustLocalHealth(healthProbeFailed)
+	c.adjustLocalHealth(healthProbeFailed)
+
+	c.pendingAcks.m[helper.Address()+":7"] = &pendingAck{
+		node:      helper,
+		callback:  target,
+		startTime: c.nowMillis(),
+		packType:  packPingReq,
+	}
+
+	if err := c.receiveVerbAckUDP(newMessage(verbAck, helper, 7)); err != nil {
+		t.Fatal(err)
+	}
+
+	c.lifecycle.wg.Wait()
+
+	if c.LocalHealth() != 1 {
+		t.Error("expected score 1, got", c.LocalHealth())
+	}
+}
+
+// A PINGREQ without a usable forward-to member is rejected, rather than
+// crashing the member that receives it.
+func TestPingReqWithoutForwardTo(t *testing.T) {
+	SetLogThreshold(LogWarn)
+	defer SetLogThreshold(LogInfo)
+
+	c, remote := newSuspicionTestCluster()
+
+	msg := newMessage(verbPingRequest, remote, 7)
+	msg.clusterHash = c.clusterHash()
+
+	if err := c.receiveMessageUDP(remote.IP(), msg.encode()); err == nil {
+		t.Error("expected an error for a PINGREQ without members")
+	}
+
+	msg.members = []*messageMember{{status: StatusForwardTo, heartbeat: 7}}
+
+	if err := c.receiveVerbForwardUDP(msg); err == nil {
+		t.Error("expected an error for a forward-to member without an address")
+	}
+
+	if len(c.pendingAcks.m) != 0 {
+		t.Error("unexpected pending ACKs:", c.pendingAcks.m)
+	}
+}
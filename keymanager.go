@@ -0,0 +1,407 @@
+/*
+Copyright 2016 The Smudge Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package smudge
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+// Keys are rotated online by applying an operation (install, use or remove)
+// locally, then sending it to every other member as an internal broadcast.
+// Each member applies the operation to its own keyring and replies with
+// another internal broadcast listing the fingerprints of the keys it now has
+// installed, which the originator collects into a KeyResponse.
+//
+// The usual rotation is: InstallKey(new), UseKey(new), RemoveKey(old). Since
+// the request itself is encrypted with the originator's primary key, each
+// step should be acknowledged by every member before moving on to the next.
+
+// keyOperation identifies the operation requested by a key request
+// broadcast.
+type keyOperation byte
+
+const (
+	keyOpList keyOperation = iota
+	keyOpInstall
+	keyOpUse
+	keyOpRemove
+)
+
+func (o keyOperation) String() string {
+	switch o {
+	case keyOpList:
+		return "LIST"
+	case keyOpInstall:
+		return "INSTALL"
+	case keyOpUse:
+		return "USE"
+	case keyOpRemove:
+		return "REMOVE"
+	default:
+		return "UNDEFINED"
+	}
+}
+
+// KeyResponse reports the outcome of a key operation across the cluster.
+type KeyResponse struct {
+	// NumNodes is the number of healthy members (including this one) when
+	// the operation was started.
+	NumNodes int
+
+	// Keys maps the address of each member that applied the operation to the
+	// fingerprints of the keys it has installed, primary key first. See
+	// KeyFingerprint().
+	Keys map[string][]string
+
+	// Errors maps the address of each member that failed to apply the
+	// operation to the reason it gave.
+	Errors map[string]string
+}
+
+// A key operation that this host originated and is collecting responses to.
+type keyRequest struct {
+	response *KeyResponse
+	done     chan struct{}
+}
+
+/******************************************************************************
+ * Exported functions (for public consumption)
+ *****************************************************************************/
+
+// KeyFingerprint returns a short identifier for a key which doesn't reveal
+// the key itself: the hex-encoded first 8 bytes of its SHA-256 hash.
+func KeyFingerprint(key []byte) string {
+	sum := sha256.Sum256(key)
+
+	return hex.EncodeToString(sum[:8])
+}
+
+// InstallKey installs a secondary key on every member of the default
+// cluster. See Cluster.InstallKey().
+func InstallKey(key []byte, timeout time.Duration) (*KeyResponse, error) {
+	return defaultCluster.InstallKey(key, timeout)
+}
+
+// InstallKey installs a key as a secondary key on this host, then on every
+// other member, waiting up to timeout for them to acknowledge it. Once a key
+// is installed everywhere it can be made the primary key with UseKey().
+// Encryption must already be enabled. An error is returned if any member
+// failed to install the key or didn't respond in time; the response
+// describes which.
+func (c *Cluster) InstallKey(key []byte, timeout time.Duration) (*KeyResponse, error) {
+	return c.doKeyOperation(keyOpInstall, key, timeout)
+}
+
+// UseKey makes an installed key the primary key on every member of the
+// default cluster. See Cluster.UseKey().
+func UseKey(key []byte, timeout time.Duration) (*KeyResponse, error) {
+	return defaultCluster.UseKey(key, timeout)
+}
+
+// UseKey makes a previously installed key the primary key, used for
+// encryption, on this host and then on every other member, waiting up to
+// timeout for them to acknowledge it.
+func (c *Cluster) UseKey(key []byte, timeout time.Duration) (*KeyResponse, error) {
+	return c.doKeyOperation(keyOpUse, key, timeout)
+}
+
+// RemoveKey removes a secondary key from every member of the default
+// cluster. See Cluster.RemoveKey().
+func RemoveKey(key []byte, timeout time.Duration) (*KeyResponse, error) {
+	return defaultCluster.RemoveKey(key, timeout)
+}
+
+// RemoveKey removes a secondary key from this host and then from every other
+// member, waiting up to timeout for them to acknowledge it. The primary key
+// can't be removed.
+func (c *Cluster) RemoveKey(key []byte, timeout time.Duration) (*KeyResponse, error) {
+	return c.doKeyOperation(keyOpRemove, key, timeout)
+}
+
+// ListKeys asks every member of the default cluster which keys it has
+// installed. See Cluster.ListKeys().
+func ListKeys(timeout time.Duration) (*KeyResponse, error) {
+	return defaultCluster.ListKeys(timeout)
+}
+
+// ListKeys asks every member which keys it has installed, waiting up to
+// timeout for them to respond.
+func (c *Cluster) ListKeys(timeout time.Duration) (*KeyResponse, error) {
+	return c.doKeyOperation(keyOpList, nil, timeout)
+}
+
+/******************************************************************************
+ * Private functions (for internal use only)
+ *****************************************************************************/
+
+// applyKeyOperation applies a key operation to a keyring.
+func applyKeyOperation(k *keyring, op keyOperation, key []byte) error {
+	switch op {
+	case keyOpList:
+		return nil
+	case keyOpInstall:
+		return k.install(key)
+	case keyOpUse:
+		return k.use(key)
+	case keyOpRemove:
+		return k.remove(key)
+	default:
+		return fmt.Errorf("unknown key operation %d", op)
+	}
+}
+
+// doKeyOperation applies a key operation locally, then broadcasts it to the
+// rest of the cluster and collects the responses.
+func (c *Cluster) doKeyOperation(op keyOperation, key []byte, timeout time.Duration) (*KeyResponse, error) {
+	if !c.runningFlag.IsSet() {
+		return nil, errors.New("cluster is not running")
+	}
+
+	keyring, err := c.getKeyring()
+	if err != nil {
+		return nil, err
+	}
+
+	if !keyring.enabled() {
+		return nil, errors.New("encryption is not enabled")
+	}
+
+	// If it doesn't work here, don't bother anybody else.
+	if err = applyKeyOperation(keyring, op, key); err != nil {
+		return nil, err
+	}
+
+	request := &keyRequest{
+		response: &KeyResponse{
+			NumNodes: len(c.HealthyNodes()),
+			Keys:     map[string][]string{c.thisHost.Address(): keyring.fingerprints()},
+			Errors:   make(map[string]string),
+		},
+		done: make(chan struct{}),
+	}
+
+	payload := make([]byte, 2+len(key))
+	payload[0] = byte(op)
+	payload[1] = byte(len(key))
+	copy(payload[2:], key)
+
+	// Register the request before queueing it so that no response can
+	// arrive before we're ready for it.
+	c.keyRequests.Lock()
+	label := c.queueBroadcast(broadcastKeyRequest, payload).Label()
+	c.keyRequests.m[label] = request
+	request.checkDone()
+	c.keyRequests.Unlock()
+
+	logfInfo("Sent key operation %s as %s\n", op, label)
+
+	select {
+	case <-request.done:
+	case <-c.clock.After(timeout):
+	}
+
+	c.keyRequests.Lock()
+	delete(c.keyRequests.m, label)
+	response := request.response
+	c.keyRequests.Unlock()
+
+	responded := len(response.Keys) + len(response.Errors)
+
+	if len(response.Errors) > 0 {
+		return response, fmt.Errorf("%d of %d members failed to apply the key operation",
+			len(response.Errors), response.NumNodes)
+	} else if responded < response.NumNodes {
+		return response, fmt.Errorf("only %d of %d members responded to the key operation",
+			responded, response.NumNodes)
+	}
+
+	return response, nil
+}
+
+// checkDone closes the request's done channel once every member has
+// responded. The caller must hold the keyRequests lock.
+func (r *keyRequest) checkDone() {
+	select {
+	case <-r.done:
+		return
+	default:
+	}
+
+	if len(r.response.Keys)+len(r.response.Errors) >= r.response.NumNodes {
+		close(r.done)
+	}
+}
+
+// receiveKeyRequest applies a key operation requested by another member and
+// broadcasts a response.
+func (c *Cluster) receiveKeyRequest(broadcast *Broadcast) {
+	bytes := broadcast.bytes
+
+	if len(bytes) < 2 || len(bytes) < 2+int(bytes[1]) {
+		logWarn("Ignoring malformed key request", broadcast.Label())
+		return
+	}
+
+	op := keyOperation(bytes[0])
+	key := bytes[2 : 2+int(bytes[1])]
+
+	var fingerprints []string
+
+	keyring, err := c.getKeyring()
+	if err == nil {
+		err = applyKeyOperation(keyring, op, key)
+		fingerprints = keyring.fingerprints()
+	}
+
+	if err != nil {
+		logfWarn("Failed key operation %s from %s: %v\n", op, broadcast.Label(), err)
+	} else {
+		logfInfo("Applied key operation %s from %s\n", op, broadcast.Label())
+	}
+
+	c.queueBroadcast(broadcastKeyResponse,
+		encodeKeyResponse(broadcast.origin, broadcast.index, fingerprints, err))
+}
+
+// receiveKeyResponse records another member's response to a key operation,
+// if it's one that this host originated.
+func (c *Cluster) receiveKeyResponse(broadcast *Broadcast) {
+	label, fingerprints, errMessage, err := decodeKeyResponse(broadcast.bytes)
+	if err != nil {
+		logWarn("Ignoring malformed key response", broadcast.Label(), "->", err)
+		return
+	}
+
+	c.keyRequests.Lock()
+	defer c.keyRequests.Unlock()
+
+	request, ok := c.keyRequests.m[label]
+	if !ok {
+		return
+	}
+
+	address := broadcast.origin.Address()
+
+	if errMessage != "" {
+		request.response.Errors[address] = errMessage
+	} else {
+		request.response.Keys[address] = fingerprints
+	}
+
+	request.checkDone()
+}
+
+// Key response contents
+// Bytes 00-XX Request origin address (family byte + 4 or 16 bytes)
+// Bytes +0-1  Request origin response port
+// Bytes +2-5  Request origin broadcast counter
+// Bytes +6    Error message length (0 on success)
+// Bytes +7-EE Error message
+// Bytes +0    Key fingerprint count
+// Bytes +1-NN Key fingerprints, each a 1-byte length followed by its bytes
+func encodeKeyResponse(origin *Node, index uint32, fingerprints []string, err error) []byte {
+	var errMessage string
+	if err != nil {
+		errMessage = err.Error()
+		if len(errMessage) > 255 {
+			errMessage = errMessage[:255]
+		}
+	}
+
+	size := encodedIPLength(origin.ip) + 8 + len(errMessage)
+	for _, f := range fingerprints {
+		size += 1 + len(f)
+	}
+
+	bytes := make([]byte, size, size)
+
+	// An index pointer
+	p := 0
+
+	p += encodeIP(origin.ip, bytes, p)
+	p += encodeUint16(origin.port, bytes, p)
+	p += encodeUint32(index, bytes, p)
+
+	p += encodeByte(byte(len(errMessage)), bytes, p)
+	p += copy(bytes[p:], errMessage)
+
+	p += encodeByte(byte(len(fingerprints)), bytes, p)
+	for _, f := range fingerprints {
+		p += encodeByte(byte(len(f)), bytes, p)
+		p += copy(bytes[p:], f)
+	}
+
+	return bytes
+}
+
+// decodeKeyResponse decodes a key response, returning the label of the
+// request it responds to, the responder's key fingerprints and its error
+// message (if any).
+func decodeKeyResponse(bytes []byte) (string, []string, string, error) {
+	truncated := errors.New("key response is truncated")
+
+	if len(bytes) < 1 {
+		return "", nil, "", truncated
+	}
+
+	ipLength := 1
+	switch bytes[0] {
+	case addressFamilyIPv4:
+		ipLength += net.IPv4len
+	case addressFamilyIPv6:
+		ipLength += net.IPv6len
+	}
+
+	if len(bytes) < ipLength+7 {
+		return "", nil, "", truncated
+	}
+
+	// An index pointer
+	p := 0
+
+	ip, p, _ := decodeIP(bytes, p)
+	port, p := decodeUint16(bytes, p)
+	index, p := decodeUint32(bytes, p)
+
+	label := fmt.Sprintf("%s:%d", nodeAddressString(ip, port), index)
+
+	strs, p, ok := decodeShortStrings(bytes, p, 1)
+	if !ok {
+		return "", nil, "", truncated
+	}
+
+	errMessage := strs[0]
+
+	if p >= len(bytes) {
+		return "", nil, "", truncated
+	}
+
+	count := int(bytes[p])
+	p++
+
+	fingerprints, _, ok := decodeShortStrings(bytes, p, count)
+	if !ok {
+		return "", nil, "", truncated
+	}
+
+	return label, fingerprints, errMessage, nil
+}
@@ -0,0 +1,160 @@
+/*
+Copyright 2016 The Smudge Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package smudge
+
+import (
+	"errors"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestKeyringOperations(t *testing.T) {
+	k, _ := newKeyring([][]byte{testKey1})
+
+	if err := applyKeyOperation(k, keyOpInstall, testKey2); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := applyKeyOperation(k, keyOpUse, testKey3); err == nil {
+		t.Error("expected an error using an uninstalled key")
+	}
+
+	if err := applyKeyOperation(k, keyOpUse, testKey2); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := applyKeyOperation(k, keyOpRemove, testKey2); err == nil {
+		t.Error("expected an error removing the primary key")
+	}
+
+	if err := applyKeyOperation(k, keyOpRemove, testKey1); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{KeyFingerprint(testKey2)}
+	if !reflect.DeepEqual(k.fingerprints(), expected) {
+		t.Errorf("expected %v, got %v", expected, k.fingerprints())
+	}
+
+	empty, _ := newKeyring(nil)
+	if err := applyKeyOperation(empty, keyOpInstall, testKey1); err == nil {
+		t.Error("expected an error installing into a disabled keyring")
+	}
+}
+
+func TestEncodeDecodeKeyResponse(t *testing.T) {
+	origin, _ := CreateNodeByIP(net.ParseIP("2001:db8::1"), 9999)
+	fingerprints := []string{KeyFingerprint(testKey1), KeyFingerprint(testKey2)}
+
+	bytes := encodeKeyResponse(origin, 7, fingerprints, nil)
+
+	label, decoded, errMessage, err := decodeKeyResponse(bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if label != "[2001:db8::1]:9999:7" {
+		t.Error("unexpected label:", label)
+	}
+
+	if !reflect.DeepEqual(fingerprints, decoded) || errMessage != "" {
+		t.Errorf("unexpected response: %v %q", decoded, errMessage)
+	}
+
+	bytes = encodeKeyResponse(origin, 8, nil, errors.New("nope"))
+
+	if _, _, errMessage, _ = decodeKeyResponse(bytes); errMessage != "nope" {
+		t.Errorf("expected error message, got %q", errMessage)
+	}
+
+	if _, _, _, err = decodeKeyResponse(bytes[:len(bytes)-2]); err == nil {
+		t.Error("expected an error decoding a truncated response")
+	}
+}
+
+// Rotate the key on a two-member cluster, checking that both acknowledge
+// each step and keep talking to each other throughout.
+func TestKeyRotation(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping network test in short mode")
+	}
+
+	SetLogThreshold(LogWarn)
+	defer SetLogThreshold(LogInfo)
+
+	loopback := net.IP([]byte{127, 0, 0, 1})
+
+	newKeyTestCluster := func(port int) *Cluster {
+		return NewCluster(&Config{
+			ListenIP:        loopback,
+			ListenPort:      port,
+			HeartbeatMillis: 20,
+			InitialHosts:    []string{},
+			SecretKeys:      [][]byte{testKey1},
+		})
+	}
+
+	a := newKeyTestCluster(19121)
+	b := newKeyTestCluster(19122)
+
+	seed, _ := CreateNodeByIP(loopback, 19121)
+	b.AddNode(seed)
+
+	go a.Begin()
+	go b.Begin()
+	defer a.Stop()
+	defer b.Stop()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(a.HealthyNodes()) != 2 || len(b.HealthyNodes()) != 2 {
+		if time.Now().After(deadline) {
+			t.Fatal("members did not converge")
+		}
+
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	if _, err := a.InstallKey(testKey2, 5*time.Second); err != nil {
+		t.Fatal("install:", err)
+	}
+
+	if _, err := a.UseKey(testKey2, 5*time.Second); err != nil {
+		t.Fatal("use:", err)
+	}
+
+	if _, err := a.RemoveKey(testKey1, 5*time.Second); err != nil {
+		t.Fatal("remove:", err)
+	}
+
+	response, err := b.ListKeys(5 * time.Second)
+	if err != nil {
+		t.Fatal("list:", err)
+	}
+
+	expected := []string{KeyFingerprint(testKey2)}
+	for address, keys := range response.Keys {
+		if !reflect.DeepEqual(keys, expected) {
+			t.Errorf("%s has keys %v, expected %v", address, keys, expected)
+		}
+	}
+
+	if len(response.Keys) != 2 {
+		t.Errorf("expected 2 responses, got %d", len(response.Keys))
+	}
+}
@@ -0,0 +1,281 @@
+/*
+Copyright 2016 The Smudge Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package smudge
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+)
+
+// If the cluster is configured with one or more secret keys, every UDP
+// message and TCP state payload is encrypted and authenticated with AES-GCM.
+// The keyring's primary key is used to encrypt; any of its keys is accepted
+// when decrypting, which allows keys to be rotated without splitting the
+// cluster. Payloads that can't be authenticated with any key are dropped.
+
+// The version of the encrypted payload layout described below. It's also
+// used as the additional authenticated data.
+const encryptionVersion byte = 1
+
+// Encrypted payload contents
+// Bytes 00    Encryption layout version
+// Bytes 01-12 Nonce (96-bit)
+// Bytes 13-NN Ciphertext, followed by the 16-byte GCM tag
+
+const nonceBytes = 12
+
+// encryptionOverhead is the number of bytes that encryption adds to a
+// payload.
+const encryptionOverhead = 1 + nonceBytes + 16
+
+// A keyring holds the AES keys used to encrypt and decrypt payloads. The
+// first key is the primary key. An empty keyring disables encryption.
+type keyring struct {
+	sync.RWMutex
+	keys  [][]byte
+	aeads []cipher.AEAD
+}
+
+// newKeyring returns a keyring holding the specified keys, the first of which
+// becomes the primary key. Each key must be 16, 24 or 32 bytes long, to
+// select AES-128, AES-192 or AES-256.
+func newKeyring(keys [][]byte) (*keyring, error) {
+	k := &keyring{}
+
+	for _, key := range keys {
+		aead, err := newAEAD(key)
+		if err != nil {
+			return nil, err
+		}
+
+		k.keys = append(k.keys, key)
+		k.aeads = append(k.aeads, aead)
+	}
+
+	return k, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	switch len(key) {
+	case 16, 24, 32:
+	default:
+		return nil, fmt.Errorf("secret key must be 16, 24 or 32 bytes, not %d", len(key))
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+// enabled returns true if the keyring holds at least one key. It's safe to
+// call on a nil keyring.
+func (k *keyring) enabled() bool {
+	if k == nil {
+		return false
+	}
+
+	k.RLock()
+	defer k.RUnlock()
+
+	return len(k.keys) > 0
+}
+
+// encrypt encrypts and authenticates plaintext with the primary key.
+func (k *keyring) encrypt(plaintext []byte) ([]byte, error) {
+	k.RLock()
+	defer k.RUnlock()
+
+	if len(k.aeads) == 0 {
+		return nil, errors.New("keyring is empty")
+	}
+
+	bytes := make([]byte, 1+nonceBytes, len(plaintext)+encryptionOverhead)
+	bytes[0] = encryptionVersion
+
+	if _, err := rand.Read(bytes[1:]); err != nil {
+		return nil, err
+	}
+
+	return k.aeads[0].Seal(bytes, bytes[1:], plaintext, bytes[:1]), nil
+}
+
+// decrypt authenticates and decrypts a payload produced by encrypt(), trying
+// each key in turn.
+func (k *keyring) decrypt(bytes []byte) ([]byte, error) {
+	if len(bytes) < encryptionOverhead {
+		return nil, errors.New("encrypted payload is too short")
+	}
+
+	if bytes[0] != encryptionVersion {
+		return nil, fmt.Errorf("unsupported encryption version %d", bytes[0])
+	}
+
+	k.RLock()
+	defer k.RUnlock()
+
+	nonce := bytes[1 : 1+nonceBytes]
+	ciphertext := bytes[1+nonceBytes:]
+
+	for _, aead := range k.aeads {
+		plaintext, err := aead.Open(nil, nonce, ciphertext, bytes[:1])
+		if err == nil {
+			return plaintext, nil
+		}
+	}
+
+	return nil, errors.New("no key could authenticate payload")
+}
+
+// install adds a key to the keyring as a secondary key. Installing a key
+// that's already present has no effect.
+func (k *keyring) install(key []byte) error {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return err
+	}
+
+	k.Lock()
+	defer k.Unlock()
+
+	if len(k.keys) == 0 {
+		return errors.New("encryption is not enabled")
+	}
+
+	if k.indexOf(key) >= 0 {
+		return nil
+	}
+
+	k.keys = append(k.keys, key)
+	k.aeads = append(k.aeads, aead)
+
+	return nil
+}
+
+// use makes an installed key the primary key.
+func (k *keyring) use(key []byte) error {
+	k.Lock()
+	defer k.Unlock()
+
+	i := k.indexOf(key)
+	if i < 0 {
+		return errors.New("key is not installed")
+	}
+
+	k.keys[0], k.keys[i] = k.keys[i], k.keys[0]
+	k.aeads[0], k.aeads[i] = k.aeads[i], k.aeads[0]
+
+	return nil
+}
+
+// remove removes a secondary key from the keyring. The primary key can't be
+// removed. Removing a key that isn't present has no effect.
+func (k *keyring) remove(key []byte) error {
+	k.Lock()
+	defer k.Unlock()
+
+	i := k.indexOf(key)
+	if i == 0 {
+		return errors.New("the primary key can't be removed")
+	} else if i < 0 {
+		return nil
+	}
+
+	k.keys = append(k.keys[:i], k.keys[i+1:]...)
+	k.aeads = append(k.aeads[:i], k.aeads[i+1:]...)
+
+	return nil
+}
+
+// fingerprints returns the fingerprints of the installed keys, primary key
+// first.
+func (k *keyring) fingerprints() []string {
+	k.RLock()
+	defer k.RUnlock()
+
+	prints := make([]string, len(k.keys))
+	for i, key := range k.keys {
+		prints[i] = KeyFingerprint(key)
+	}
+
+	return prints
+}
+
+// indexOf returns the index of key in the keyring, or -1 if it isn't
+// present. The caller must hold the lock.
+func (k *keyring) indexOf(key []byte) int {
+	for i, kk := range k.keys {
+		if subtle.ConstantTimeCompare(kk, key) == 1 {
+			return i
+		}
+	}
+
+	return -1
+}
+
+// getKeyring returns this cluster's keyring, creating it from the configured
+// secret keys the first time it's called.
+func (c *Cluster) getKeyring() (*keyring, error) {
+	c.keyringOnce.Do(func() {
+		c.keyring, c.keyringErr = newKeyring(c.SecretKeys())
+	})
+
+	return c.keyring, c.keyringErr
+}
+
+// sealPayload encrypts bytes if encryption is enabled; otherwise it returns
+// them unchanged.
+func (c *Cluster) sealPayload(bytes []byte) ([]byte, error) {
+	keyring, err := c.getKeyring()
+	if err != nil {
+		return nil, err
+	}
+
+	if !keyring.enabled() {
+		return bytes, nil
+	}
+
+	return keyring.encrypt(bytes)
+}
+
+// openPayload decrypts bytes if encryption is enabled; otherwise it returns
+// them unchanged. Payloads that can't be authenticated are counted.
+func (c *Cluster) openPayload(bytes []byte) ([]byte, error) {
+	keyring, err := c.getKeyring()
+	if err != nil {
+		return nil, err
+	}
+
+	if !keyring.enabled() {
+		return bytes, nil
+	}
+
+	plaintext, err := keyring.decrypt(bytes)
+	if err != nil {
+		atomic.AddUint64(&c.unauthenticatedPackets, 1)
+	}
+
+	return plaintext, err
+}
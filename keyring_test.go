@@ -0,0 +1,111 @@
+/*
+Copyright 2016 The Smudge Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package smudge
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+var (
+	testKey1 = []byte("0123456789abcdef")
+	testKey2 = []byte("fedcba9876543210fedcba9876543210")
+	testKey3 = []byte("abcdefghijklmnopqrstuvwx")
+)
+
+func TestKeyringEncryptDecrypt(t *testing.T) {
+	sender, err := newKeyring([][]byte{testKey1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The receiver accepts testKey1 as a secondary key.
+	receiver, _ := newKeyring([][]byte{testKey2, testKey1})
+	stranger, _ := newKeyring([][]byte{testKey3})
+
+	plaintext := []byte("the quick brown fox")
+
+	ciphertext, err := sender.encrypt(plaintext)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(ciphertext) != len(plaintext)+encryptionOverhead {
+		t.Errorf("unexpected ciphertext length %d", len(ciphertext))
+	}
+
+	decrypted, err := receiver.decrypt(ciphertext)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(plaintext, decrypted) {
+		t.Errorf("expected %q, got %q", plaintext, decrypted)
+	}
+
+	if _, err = stranger.decrypt(ciphertext); err == nil {
+		t.Error("expected an error decrypting with the wrong key")
+	}
+
+	ciphertext[len(ciphertext)-1]++
+	if _, err = receiver.decrypt(ciphertext); err == nil {
+		t.Error("expected an error decrypting a tampered payload")
+	}
+}
+
+func TestKeyringBadKey(t *testing.T) {
+	if _, err := newKeyring([][]byte{[]byte("too short")}); err == nil {
+		t.Error("expected an error for a bad key length")
+	}
+
+	k, err := newKeyring(nil)
+	if err != nil || k.enabled() {
+		t.Error("an empty keyring should be valid and disabled")
+	}
+}
+
+// Messages from members without a matching key are dropped and counted.
+func TestDecodeMessageUnauthenticated(t *testing.T) {
+	sender, _ := CreateNodeByIP(net.ParseIP("10.0.0.1"), 9999)
+	msg := newMessage(verbPing, sender, 1)
+
+	encrypted := NewCluster(&Config{SecretKeys: [][]byte{testKey1}})
+	plain := NewCluster(&Config{SecretKeys: [][]byte{}})
+	rotated := NewCluster(&Config{SecretKeys: [][]byte{testKey2, testKey1}})
+
+	sealed, err := encrypted.sealPayload(msg.encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = rotated.decodeMessage(sender.IP(), sealed); err != nil {
+		t.Error("secondary key not accepted:", err)
+	}
+
+	if _, err = encrypted.decodeMessage(sender.IP(), msg.encode()); err == nil {
+		t.Error("expected an unencrypted message to be dropped")
+	}
+
+	if _, err = plain.decodeMessage(sender.IP(), sealed); err == nil {
+		t.Error("expected an encrypted message to be rejected")
+	}
+
+	if n := encrypted.UnauthenticatedPackets(); n != 1 {
+		t.Errorf("expected 1 unauthenticated packet, got %d", n)
+	}
+}
@@ -0,0 +1,247 @@
+/*
+Copyright 2016 The Smudge Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package smudge
+
+import (
+	"context"
+	"errors"
+	"net"
+	"time"
+)
+
+/******************************************************************************
+ * Exported functions (for public consumption)
+ *****************************************************************************/
+
+// Start starts the default cluster. See Cluster.Start().
+func Start(ctx context.Context) error {
+	return defaultCluster.Start(ctx)
+}
+
+// Start starts the server: it binds the transport and, once that has
+// succeeded, starts the heartbeat and the other background goroutines in
+// the background, and returns. If the server can't be started, an error is
+// returned and nothing is left running. The context only bounds starting
+// up: if it's done before the server has started, the server is stopped
+// again and the context's error is returned. A server that has been shut
+// down may be started again. Properties left unset by the cluster's Config
+// are read again as it starts.
+func (c *Cluster) Start(ctx context.Context) error {
+	c.lifecycle.Lock()
+	defer c.lifecycle.Unlock()
+
+	if c.runningFlag.IsSet() {
+		return errors.New("cluster is already running")
+	}
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	// Pick up any properties (or environment variables) set since the
+	// configuration was last resolved.
+	c.resolveConfig()
+
+	// Refuse to start (rather than silently running unencrypted) if the
+	// secret keys are bad.
+	if _, err := c.getKeyring(); err != nil {
+		return errors.New("invalid secret key: " + err.Error())
+	}
+
+	// Add this host.
+	ip := c.ListenIP()
+	if ip == nil {
+		var err error
+		if ip, err = GetLocalIP(); err != nil {
+			return errors.New("could not get local IP: " + err.Error())
+		}
+	}
+
+	if ip == nil {
+		logWarn("Warning: Could not resolve host IP. Using 127.0.0.1")
+		ip = net.IP([]byte{127, 0, 0, 1})
+	}
+
+	transport := c.config.Transport
+	if transport == nil {
+		transport = NewNetTransport()
+	}
+
+	if err := transport.Listen(c.ListenIP(), c.ListenPort()); err != nil {
+		return err
+	}
+
+	if err := ctx.Err(); err != nil {
+		transport.Shutdown()
+		return err
+	}
+
+	me := &Node{
+		ip:              ip,
+		port:            uint16(c.ListenPort()),
+		address:         nodeAddressString(ip, uint16(c.ListenPort())),
+		timestamp:       c.clock.Now(),
+		clock:           c.clock,
+		pingMillis:      PingNoData,
+		metadata:        c.localMetadata,
+		metadataVersion: 1,
+		coordinate:      c.localCoordinate(),
+	}
+
+	// If we're being restarted, the cluster may still remember us as dead
+	// or departed, so refute that with a higher incarnation.
+	if previous := c.thisHost; previous != nil {
+		previous.mutex.RLock()
+		me.heartbeat = previous.heartbeat
+		me.incarnation = previous.incarnation + 1
+		me.metadataVersion = previous.metadataVersion
+		previous.mutex.RUnlock()
+
+		c.knownNodes.delete(previous)
+		c.updatedNodes.delete(previous)
+	}
+
+	c.thisHostAddress = me.Address()
+	c.thisHost = me
+	c.transport = transport
+
+	logInfo("My host address:", c.thisHostAddress)
+
+	c.pendingAcks.Lock()
+	c.pendingAcks.m = make(map[string]*pendingAck)
+	c.pendingAcks.Unlock()
+
+	// Listeners stopped by a previous Shutdown() hear about this run.
+	c.startListeners()
+
+	// Add this node's status. Don't update any other node's statuses: they'll
+	// report those back to us.
+	c.updateNodeStatus(c.thisHost, StatusAlive, me.heartbeat, me.incarnation)
+	c.AddNode(c.thisHost)
+
+	// Add initial hosts as specified by the SMUDGE_INITIAL_HOSTS property
+	for _, address := range c.InitialHosts() {
+		n, err := c.CreateNodeByAddress(address)
+		if err != nil {
+			logfError("Could not create node %s: %v\n", address, err)
+		} else {
+			c.AddNode(n)
+		}
+	}
+
+	c.lifecycle.stopping = make(chan struct{})
+	c.runningFlag.Set()
+
+	c.spawn(func() { c.receivePackets(transport) })
+	c.spawn(func() { c.acceptStreams(transport) })
+	c.spawn(c.startTimeoutCheckLoop)
+
+	// Exchange full state with the nodes we already know about so that we
+	// learn about the rest of the cluster quickly, then keep doing so
+	// periodically with random members.
+	c.spawn(c.syncWithKnownNodes)
+	c.spawn(c.startPushPullLoop)
+
+	c.spawn(c.startHeartbeatLoop)
+
+	return nil
+}
+
+// Shutdown stops the default cluster. See Cluster.Shutdown().
+func Shutdown(ctx context.Context) error {
+	return defaultCluster.Shutdown(ctx)
+}
+
+// Shutdown stops the server without announcing that it's leaving (for that,
+// see Leave()): it shuts down the transport, stops the heartbeat, the other
+// background goroutines and the goroutines calling listeners, and waits for
+// them, and for any messages still being handled, to finish. Listeners are
+// called again once the server is restarted. If the context is done first, its error
+// is returned, and the remaining goroutines finish in the background. An
+// error is also returned if the server isn't running.
+func (c *Cluster) Shutdown(ctx context.Context) error {
+	c.lifecycle.Lock()
+	defer c.lifecycle.Unlock()
+
+	if !c.runningFlag.SetToIf(true, false) {
+		return errors.New("cluster is not running")
+	}
+
+	close(c.lifecycle.stopping)
+	c.stopListeners()
+
+	err := c.transport.Shutdown()
+
+	done := make(chan struct{})
+	go func() {
+		c.lifecycle.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	return err
+}
+
+// Running returns true if the default cluster is running. See
+// Cluster.Running().
+func Running() bool {
+	return defaultCluster.Running()
+}
+
+// Running returns true if the server has been started and not yet shut down
+// (or left the cluster).
+func (c *Cluster) Running() bool {
+	return c.runningFlag.IsSet()
+}
+
+/******************************************************************************
+ * Private functions (for internal use only)
+ *****************************************************************************/
+
+// spawn runs f in a goroutine that Shutdown() waits for. It may only be
+// called with the lifecycle lock held (as by Start()), or by a goroutine
+// that was itself spawned.
+func (c *Cluster) spawn(f func()) {
+	c.lifecycle.wg.Add(1)
+
+	go func() {
+		defer c.lifecycle.wg.Done()
+		f()
+	}()
+}
+
+// sleep sleeps on the cluster's clock for the specified duration, returning
+// early (and false) if the cluster is shut down in the meantime. The timer
+// is stopped in that case, so that a stopped cluster leaves nothing waiting
+// on its clock.
+func (c *Cluster) sleep(d time.Duration) bool {
+	wake := make(chan struct{})
+	timer := c.clock.AfterFunc(d, func() { close(wake) })
+
+	select {
+	case <-wake:
+		return true
+	case <-c.lifecycle.stopping:
+		timer.Stop()
+		return false
+	}
+}
@@ -0,0 +1,171 @@
+/*
+Copyright 2016 The Smudge Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package smudge
+
+import (
+	"context"
+	"net"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func newLifecycleTestCluster() *Cluster {
+	return NewCluster(&Config{
+		ListenIP:        net.IP([]byte{127, 0, 0, 1}),
+		ListenPort:      19181,
+		HeartbeatMillis: 20,
+		InitialHosts:    []string{},
+		SyncMillis:      -1,
+	})
+}
+
+type countingStatusListener struct {
+	changes chan NodeStatus
+}
+
+func (l countingStatusListener) OnChange(node *Node, status NodeStatus) {
+	l.changes <- status
+}
+
+// Returns true once the number of goroutines has fallen to at most n, or
+// false if it hasn't within a second.
+func waitForGoroutines(n int) bool {
+	deadline := time.Now().Add(time.Second)
+
+	for runtime.NumGoroutine() > n {
+		if time.Now().After(deadline) {
+			return false
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	return true
+}
+
+// A cluster can be started, shut down and started again in the same process,
+// and neither can be done twice in a row. Shutting down leaves no goroutines
+// behind, and listeners are called again after a restart.
+func TestStartShutdownRestart(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping network test in short mode")
+	}
+
+	SetLogThreshold(LogFatal)
+	defer SetLogThreshold(LogInfo)
+
+	before := runtime.NumGoroutine()
+
+	c := newLifecycleTestCluster()
+
+	listener := countingStatusListener{make(chan NodeStatus, 64)}
+	c.AddStatusListener(listener)
+
+	if err := c.Shutdown(context.Background()); err == nil {
+		t.Error("expected an error shutting down an unstarted cluster")
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := c.Start(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := c.Start(context.Background()); err == nil {
+			t.Error("expected an error starting a running cluster")
+		}
+
+		// A restarted member refutes whatever the cluster last heard about
+		// it.
+		if c.thisHost.Incarnation() != uint32(i) {
+			t.Errorf("expected incarnation %d, got %d", i, c.thisHost.Incarnation())
+		}
+
+		if n := c.knownNodes.getByAddress(c.thisHost.Address()); n != c.thisHost {
+			t.Error("this host not known")
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		err := c.Shutdown(ctx)
+		cancel()
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if c.runningFlag.IsSet() {
+			t.Error("cluster still running after Shutdown()")
+		}
+
+		select {
+		case <-listener.changes:
+		default:
+			t.Error("listener not called for run", i)
+		}
+
+		if !waitForGoroutines(before) {
+			t.Errorf("%d goroutines left running after Shutdown(), expected at most %d",
+				runtime.NumGoroutine(), before)
+		}
+	}
+}
+
+// A cluster that can't bind its port returns an error, and leaves nothing
+// running behind it.
+func TestStartListenFailure(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping network test in short mode")
+	}
+
+	SetLogThreshold(LogFatal)
+	defer SetLogThreshold(LogInfo)
+
+	a := newLifecycleTestCluster()
+	if err := a.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer a.Shutdown(context.Background())
+
+	b := newLifecycleTestCluster()
+	if err := b.Start(context.Background()); err == nil {
+		b.Shutdown(context.Background())
+		t.Fatal("expected an error binding a port in use")
+	}
+
+	if b.runningFlag.IsSet() || b.thisHost != nil {
+		t.Error("failed cluster left running")
+	}
+
+	if err := b.Shutdown(context.Background()); err == nil {
+		t.Error("expected an error shutting down a failed cluster")
+	}
+}
+
+// Start() doesn't bind anything if its context is already done.
+func TestStartCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	c := NewCluster(&Config{Transport: &chanTransport{}})
+	if err := c.Start(ctx); err != context.Canceled {
+		t.Error("expected context.Canceled, got", err)
+	}
+
+	if c.runningFlag.IsSet() {
+		t.Error("cluster running after canceled start")
+	}
+}
@@ -17,191 +17,141 @@ limitations under the License.
 package smudge
 
 import (
+	"context"
+	"errors"
 	"math"
 	"net"
 	"strconv"
-	"sync"
+	"strings"
+	"sync/atomic"
 	"time"
-
-	"github.com/tevino/abool"
 )
 
 // A scalar value used to calculate a variety of limits
 const lambda = 2.5
 
+// The size of the buffer into which each UDP message is read: the largest
+// possible UDP payload, since senders may be configured with a larger
+// MaxMessageBytes than ours.
+const maxUDPMessageBytes = 65535
+
+// The minimum number of times a leaving host announces its departure.
+const minLeaveAnnouncements = 3
+
 // How many standard deviations beyond the mean PING/ACK response time we
 // allow before timing out an ACK.
 const timeoutToleranceSigmas = 3.0
 
-var currentHeartbeat uint32
-
-var pendingAcks = struct {
-	sync.RWMutex
-	m map[string]*pendingAck
-}{m: make(map[string]*pendingAck)}
-
-var thisHostAddress string
-
-var thisHost *Node
-
-// This flag is set whenever a known node is added or removed.
-var knownNodesModifiedFlag = false
-
-var pingdata = newPingData(150, 50)
-
-// The smudge udp listen conn
-var udpConn *net.UDPConn
-
-// The smudge running flag
-var runningFlag *abool.AtomicBool
-
 /******************************************************************************
  * Exported functions (for public consumption)
  *****************************************************************************/
 
-// Begin starts the server by opening a UDP port and beginning the heartbeat.
-// Note that this is a blocking function, so act appropriately.
+// Begin starts the default cluster by opening a UDP port and beginning the
+// heartbeat. Note that this is a blocking function, so act appropriately.
 func Begin() {
-	// Add this host.
-	var ip net.IP
-	var err error
-	if GetListenIP() == nil {
-		ip, err = GetLocalIP()
-		if err != nil {
-			logFatal("Could not get local ip:", err)
-			return
-		}
-	} else {
-		ip = GetListenIP()
-	}
-
-	if ip == nil {
-		logWarn("Warning: Could not resolve host IP. Using 127.0.0.1")
-		ip = []byte{127, 0, 0, 1}
-	}
+	defaultCluster.Begin()
+}
 
-	me := Node{
-		ip:         ip,
-		port:       uint16(GetListenPort()),
-		timestamp:  GetNowInMillis(),
-		pingMillis: PingNoData,
+// Begin starts the server by opening a UDP port and beginning the heartbeat.
+// Note that this is a blocking function, so act appropriately: it returns
+// once the server is stopped. Start() should be preferred, since it returns
+// an error if the server can't be started, rather than logging it as fatal.
+func (c *Cluster) Begin() {
+	if err := c.Start(context.Background()); err != nil {
+		logFatal("Could not start:", err)
+		return
 	}
 
-	thisHostAddress = me.Address()
-	thisHost = &me
+	c.lifecycle.Lock()
+	stopping := c.lifecycle.stopping
+	c.lifecycle.Unlock()
 
-	logInfo("My host address:", thisHostAddress)
-
-	go listenUDP(GetListenIP(), GetListenPort())
+	<-stopping
+}
 
-	// Add this node's status. Don't update any other node's statuses: they'll
-	// report those back to us.
-	updateNodeStatus(thisHost, StatusAlive, 0)
-	AddNode(thisHost)
+// Leave gracefully removes this host from the default cluster. See
+// Cluster.Leave().
+func Leave(timeout time.Duration) error {
+	return defaultCluster.Leave(timeout)
+}
 
-	runningFlag = abool.NewBool(true)
-	// Add initial hosts as specified by the SMUDGE_INITIAL_HOSTS property
-	for _, address := range GetInitialHosts() {
-		n, err := CreateNodeByAddress(address)
-		if err != nil {
-			logfError("Could not create node %s: %v\n", address, err)
-		} else {
-			AddNode(n)
-		}
+// Leave gracefully removes this host from the cluster: it marks itself as
+// LEFT, announces that to several healthy members, and waits for the
+// announcement to be sent its full number of times (or for the timeout to
+// elapse) before stopping the server. Other members will report this host as
+// StatusLeft, rather than suspecting it and declaring it dead. An error is
+// returned if the server isn't running or if the timeout elapsed before the
+// announcement finished propagating; the server is stopped either way.
+func (c *Cluster) Leave(timeout time.Duration) error {
+	if !c.runningFlag.IsSet() {
+		return errors.New("cluster is not running")
 	}
 
-	go startTimeoutCheckLoop()
-
-	// Loop over a randomized list of all known nodes (except for this host
-	// node), pinging one at a time. If the knownNodesModifiedFlag is set to
-	// true by AddNode() or RemoveNode(), the we get a fresh list and start
-	// again.
-
-	for {
-		var randomAllNodes = knownNodes.getRandomNodes(0, thisHost)
-		var pingCounter int
-
-		// Exponential backoff of dead nodes, until such time as they are removed.
-		for _, node := range randomAllNodes {
-			if !runningFlag.IsSet() {
-				break
-			}
-			// Exponential backoff of dead nodes, until such time as they are removed.
-			if node.status == StatusDead {
-				var dnc *deadNodeCounter
-				var ok bool
+	logInfo("Leaving the cluster")
 
-				deadNodeRetries.Lock()
-				if dnc, ok = deadNodeRetries.m[node.Address()]; !ok {
-					dnc = &deadNodeCounter{retry: 1, retryCountdown: 2}
-					deadNodeRetries.m[node.Address()] = dnc
-				}
-				deadNodeRetries.Unlock()
+	c.setNodeStatus(c.thisHost, StatusLeft, c.thisHost.Heartbeat(), c.thisHost.Incarnation())
 
-				dnc.retryCountdown--
+	// Small clusters have an emit count of 0 or 1, but we want everybody to
+	// hear that we're going.
+	c.thisHost.mutex.Lock()
+	if c.thisHost.emitCounter < minLeaveAnnouncements {
+		c.thisHost.emitCounter = minLeaveAnnouncements
+	}
+	c.thisHost.mutex.Unlock()
 
-				if dnc.retryCountdown <= 0 {
-					dnc.retry++
-					dnc.retryCountdown = int(math.Pow(2.0, float64(dnc.retry)))
+	var err error
+	deadline := c.clock.Now().Add(timeout)
 
-					if dnc.retry > maxDeadNodeRetries {
-						logDebug("Forgetting dead node", node.Address())
+	for c.thisHost.EmitCounter() > 0 {
+		targets := c.getTargetNodes(c.pingRequestCount()+1, c.thisHost)
+		if len(targets) == 0 {
+			break
+		}
 
-						deadNodeRetries.Lock()
-						delete(deadNodeRetries.m, node.Address())
-						deadNodeRetries.Unlock()
+		if c.clock.Now().After(deadline) {
+			err = errors.New("timed out waiting for leave to propagate")
+			break
+		}
 
-						RemoveNode(node)
-						continue
-					}
-				} else {
-					continue
-				}
+		// These pings aren't tracked as pending, so nobody is suspected if
+		// their ACKs don't arrive before we stop.
+		for _, node := range targets {
+			if terr := c.transmitVerbGenericUDP(node, nil, verbPing, c.heartbeat()); terr != nil {
+				logDebug("Failed to announce leave to", node.Address(), "->", terr)
 			}
+		}
 
-			currentHeartbeat++
-
-			logfDebug("%d - hosts=%d (announce=%d forward=%d)\n",
-				currentHeartbeat,
-				len(randomAllNodes),
-				emitCount(),
-				pingRequestCount())
+		c.clock.Sleep(time.Millisecond * time.Duration(c.HeartbeatMillis()))
+	}
 
-			PingNode(node)
-			pingCounter++
+	c.Stop()
 
-			time.Sleep(time.Millisecond * time.Duration(GetHeartbeatMillis()))
+	return err
+}
 
-			if knownNodesModifiedFlag {
-				knownNodesModifiedFlag = false
-				break
-			}
-		}
-		if !runningFlag.IsSet() {
-			break
-		}
+// Stop the default cluster. close the udp lesten and stop the heartbeat.
+func Stop() {
+	defaultCluster.Stop()
+}
 
-		if pingCounter == 0 {
-			logDebug("No nodes to ping. So lonely. :(")
-			time.Sleep(time.Millisecond * time.Duration(GetHeartbeatMillis()))
-		}
+// Stop the server: close the transport and stop the heartbeat, waiting for
+// every goroutine to finish. Shutdown() should be preferred, since it can be
+// given a deadline and returns any error.
+func (c *Cluster) Stop() {
+	if err := c.Shutdown(context.Background()); err != nil {
+		logError("Shutdown failed:", err)
 	}
 }
 
-// Stop the server. close the udp lesten and stop the heartbeat.
-func Stop() {
-	if udpConn != nil {
-		udpConn.SetDeadline(time.Now())
-	} else {
-		logError("udp Listen conn is nil")
-	}
-	runningFlag.UnSet()
+// PingNode can be used to explicitly ping a node in the default cluster.
+func PingNode(node *Node) error {
+	return defaultCluster.PingNode(node)
 }
 
 // PingNode can be used to explicitly ping a node. Calls the low-level
 // doPingNode(), and outputs a message (and returns an error) if it fails.
-func PingNode(node *Node) error {
-	err := transmitVerbPingUDP(node, currentHeartbeat)
+func (c *Cluster) PingNode(node *Node) error {
+	err := c.transmitVerbPingUDP(node, c.heartbeat())
 	if err != nil {
 		logInfo("Failure to ping", node, "->", err)
 	}
@@ -213,22 +163,38 @@ func PingNode(node *Node) error {
  * Private functions (for internal use only)
  *****************************************************************************/
 
+// heartbeat returns this host's current heartbeat.
+func (c *Cluster) heartbeat() uint32 {
+	return atomic.LoadUint32(&c.currentHeartbeat)
+}
+
+// advanceHeartbeat moves this host's heartbeat forward to the given value, if
+// it's behind it.
+func (c *Cluster) advanceHeartbeat(heartbeat uint32) {
+	for current := c.heartbeat(); heartbeat > current; current = c.heartbeat() {
+		if atomic.CompareAndSwapUint32(&c.currentHeartbeat, current, heartbeat) {
+			logfTrace("Heartbeat advanced from %d to %d\n", current, heartbeat)
+			return
+		}
+	}
+}
+
 // The number of times any node's new status should be emitted after changes.
 // Currently set to (lambda * log(node count)).
-func emitCount() int {
-	logn := math.Log(float64(knownNodes.length()))
+func (c *Cluster) emitCount() int {
+	logn := math.Log(float64(c.knownNodes.length()))
 	mult := (lambda * logn) + 0.5
 
 	return int(mult)
 }
 
-func doForwardOnTimeout(pack *pendingAck) {
-	filteredNodes := getTargetNodes(pingRequestCount(), thisHost, pack.node)
+func (c *Cluster) doForwardOnTimeout(pack *pendingAck) {
+	filteredNodes := c.getTargetNodes(c.pingRequestCount(), c.thisHost, pack.node)
 
 	if len(filteredNodes) == 0 {
-		logDebug(thisHost.Address(), "Cannot forward ping request: no more nodes")
+		logDebug(c.thisHost.Address(), "Cannot forward ping request: no more nodes")
 
-		updateNodeStatus(pack.node, StatusDead, currentHeartbeat)
+		c.updateNodeStatus(pack.node, StatusSuspected, pack.node.Heartbeat(), pack.node.Incarnation())
 	} else {
 		for i, n := range filteredNodes {
 			logfDebug("(%d/%d) Requesting indirect ping of %s via %s\n",
@@ -237,15 +203,16 @@ func doForwardOnTimeout(pack *pendingAck) {
 				pack.node.Address(),
 				n.Address())
 
-			transmitVerbForwardUDP(n, pack.node, currentHeartbeat)
+			c.transmitVerbForwardUDP(n, pack.node, c.heartbeat())
+			c.Metrics().IncrCounter(MetricIndirectProbes, nil, 1)
 		}
 	}
 }
 
 // Returns a random slice of valid ping/forward request targets; i.e., not
-// this node, and not dead.
-func getTargetNodes(count int, exclude ...*Node) []*Node {
-	randomNodes := knownNodes.getRandomNodes(0, exclude...)
+// this node, and not dead, suspected or departed.
+func (c *Cluster) getTargetNodes(count int, exclude ...*Node) []*Node {
+	randomNodes := c.knownNodes.getRandomNodes(0, exclude...)
 	filteredNodes := make([]*Node, 0, count)
 
 	for _, n := range randomNodes {
@@ -253,7 +220,7 @@ func getTargetNodes(count int, exclude ...*Node) []*Node {
 			break
 		}
 
-		if n.status == StatusDead {
+		if status := n.Status(); status == StatusDead || status == StatusSuspected || status == StatusLeft {
 			continue
 		}
 
@@ -263,89 +230,57 @@ func getTargetNodes(count int, exclude ...*Node) []*Node {
 	return filteredNodes
 }
 
-func listenUDP(ip net.IP, port int) error {
-	var err error
-	var addr string
-	if ip == nil {
-		addr = ":" + strconv.FormatInt(int64(port), 10)
-	} else {
-		addr = ip.String() + ":" + strconv.FormatInt(int64(port), 10)
-	}
-	listenAddress, err := net.ResolveUDPAddr("udp", addr)
-	if err != nil {
-		return err
-	}
-
-	/* Now listen at selected port */
-	udpConn, err = net.ListenUDP("udp", listenAddress)
-	if err != nil {
-		return err
-	}
-	defer udpConn.Close()
-
-	for {
-		buf := make([]byte, 512)
-		n, addr, err := udpConn.ReadFromUDP(buf)
-		if err != nil {
-			if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
-				logError("UDP Listen closes")
-				return err
-			}
-			logError("UDP read error: ", err)
-		}
-
-		go func(addr *net.UDPAddr, msg []byte) {
-			err = receiveMessageUDP(addr, buf[0:n])
-			if err != nil {
-				logError(err)
-			}
-		}(addr, buf[0:n])
-	}
-}
-
 // The number of nodes to send a PINGREQ to when a PING times out.
 // Currently set to (lambda * log(node count)).
-func pingRequestCount() int {
-	logn := math.Log(float64(knownNodes.length()))
+func (c *Cluster) pingRequestCount() int {
+	logn := math.Log(float64(c.knownNodes.length()))
 	mult := (lambda * logn) + 0.5
 
 	return int(mult)
 }
 
-func receiveMessageUDP(addr *net.UDPAddr, msgBytes []byte) error {
-	msg, err := decodeMessage(addr.IP, msgBytes)
+func (c *Cluster) receiveMessageUDP(sourceIP net.IP, msgBytes []byte) error {
+	msg, err := c.decodeMessage(sourceIP, msgBytes)
 	if err != nil {
 		return err
 	}
 
+	verbLabels := []Label{{"verb", strings.ToLower(msg.verb.String())}}
+	c.Metrics().IncrCounter(MetricPacketsReceived, verbLabels, 1)
+	c.Metrics().IncrCounter(MetricBytesReceived, verbLabels, float64(len(msgBytes)))
+
 	logfTrace("Got %v from %v code=%d\n",
 		msg.verb,
 		msg.sender.Address(),
 		msg.senderHeartbeat)
 
 	// Synchronize heartbeats
-	if msg.senderHeartbeat > 0 && msg.senderHeartbeat-1 > currentHeartbeat {
-		logfTrace("Heartbeat advanced from %d to %d\n",
-			currentHeartbeat,
-			msg.senderHeartbeat-1)
-
-		currentHeartbeat = msg.senderHeartbeat - 1
+	if msg.senderHeartbeat > 0 {
+		c.advanceHeartbeat(msg.senderHeartbeat - 1)
 	}
 
-	updateStatusesFromMessage(msg)
+	c.updateStatusesFromMessage(msg)
 
-	receiveBroadcast(msg.broadcast)
+	for _, broadcast := range msg.broadcasts {
+		c.receiveBroadcast(broadcast)
+	}
 
 	// Handle the verb.
 	switch msg.verb {
 	case verbPing:
-		err = receiveVerbPingUDP(msg)
+		err = c.receiveVerbPingUDP(msg)
 	case verbAck:
-		err = receiveVerbAckUDP(msg)
+		err = c.receiveVerbAckUDP(msg)
 	case verbPingRequest:
-		err = receiveVerbForwardUDP(msg)
+		err = c.receiveVerbForwardUDP(msg)
+	case verbNack:
+		c.receiveVerbNackUDP(msg)
 	case verbNonForwardingPing:
-		err = receiveVerbNonForwardPingUDP(msg)
+		err = c.receiveVerbNonForwardPingUDP(msg)
+	case verbUser:
+		err = c.receiveVerbUserUDP(msg)
+	case verbUserAck:
+		c.receiveVerbUserAckUDP(msg)
 	}
 
 	if err != nil {
@@ -355,41 +290,62 @@ func receiveMessageUDP(addr *net.UDPAddr, msgBytes []byte) error {
 	return nil
 }
 
-func receiveVerbAckUDP(msg message) error {
+func (c *Cluster) receiveVerbAckUDP(msg message) error {
 	key := msg.sender.Address() + ":" + strconv.FormatInt(int64(msg.senderHeartbeat), 10)
 
-	pendingAcks.RLock()
-	_, ok := pendingAcks.m[key]
-	pendingAcks.RUnlock()
+	c.pendingAcks.RLock()
+	_, ok := c.pendingAcks.m[key]
+	c.pendingAcks.RUnlock()
 
 	if ok {
-		msg.sender.Touch()
+		c.touch(msg.sender)
 
-		pendingAcks.Lock()
+		if msg.coordinate != nil {
+			msg.sender.setCoordinate(msg.coordinate)
+		}
+
+		c.pendingAcks.Lock()
 
-		if pack, ok := pendingAcks.m[key]; ok {
+		if pack, ok := c.pendingAcks.m[key]; ok {
 			// If this is a response to a requested ping, respond to the
 			// callback node
 			if pack.callback != nil {
-				go transmitVerbAckUDP(pack.callback, pack.callbackCode)
+				callback, callbackCode := pack.callback, pack.callbackCode
+				c.spawn(func() { c.transmitVerbAckUDP(callback, callbackCode) })
+
+				// Reaching the target through a helper is as good a sign
+				// of our own health as reaching it directly.
+				if pack.packType == packPingReq {
+					c.adjustLocalHealth(healthProbeSuccess)
+				}
+
+				pack.acked = true
 			} else {
 				// Note the ping response time.
-				notePingResponseTime(pack)
+				c.notePingResponseTime(pack)
+				c.adjustLocalHealth(healthProbeSuccess)
 			}
 		}
 
-		delete(pendingAcks.m, key)
-		pendingAcks.Unlock()
+		delete(c.pendingAcks.m, key)
+		c.pendingAcks.Unlock()
 	}
 
 	return nil
 }
 
-func notePingResponseTime(pack *pendingAck) {
+func (c *Cluster) notePingResponseTime(pack *pendingAck) {
 	// Note the elapsed time
-	elapsedMillis := pack.elapsed()
+	elapsedMillis := uint32(c.nowMillis() - pack.startTime)
+
+	pack.node.setPingMillis(int(elapsedMillis))
+	c.Metrics().Observe(MetricRTT, nil, float64(elapsedMillis))
 
-	pack.node.pingMillis = int(elapsedMillis)
+	// Knowing where the node is, and now how far away it is, we can work
+	// out where we are.
+	if remote := pack.node.Coordinate(); remote != nil {
+		c.updateCoordinate(remote, float64(elapsedMillis))
+	}
 
 	// For the purposes of timeout tolerance, we treat all pings less than
 	// 10 as 10.
@@ -397,246 +353,480 @@ func notePingResponseTime(pack *pendingAck) {
 		elapsedMillis = 10
 	}
 
-	pingdata.add(elapsedMillis)
+	rtt := c.rtt(pack.node)
+	rtt.add(elapsedMillis)
 
-	mean, stddev := pingdata.data()
-	sigmas := pingdata.nSigma(timeoutToleranceSigmas)
+	mean, stddev := rtt.data()
+	sigmas := rtt.nSigma(timeoutToleranceSigmas)
 
-	logfTrace("Got ACK in %dms (mean=%.02f stddev=%.02f sigmas=%.02f)\n",
+	logfTrace("Got ACK from %s in %dms (mean=%.02f stddev=%.02f sigmas=%.02f)\n",
+		pack.node.Address(),
 		elapsedMillis,
 		mean,
 		stddev,
 		sigmas)
 }
 
-func receiveVerbForwardUDP(msg message) error {
-	// We don't forward to a node that we don't know.
+func (c *Cluster) receiveVerbForwardUDP(msg message) error {
+	// A PINGREQ without a member to forward to (or with one whose address
+	// couldn't be decoded) can't be acted on.
+	member := msg.getForwardTo()
+	if member == nil || member.node == nil {
+		return errors.New("PINGREQ from " + msg.sender.Address() + " has no forward-to member")
+	}
 
-	if len(msg.members) >= 0 &&
-		msg.members[0].status == StatusForwardTo {
+	node := member.node
+	code := member.heartbeat
+	key := node.Address() + ":" + strconv.FormatInt(int64(code), 10)
 
-		member := msg.members[0]
-		node := member.node
-		code := member.heartbeat
-		key := node.Address() + ":" + strconv.FormatInt(int64(code), 10)
+	pack := pendingAck{
+		node:         node,
+		startTime:    c.nowMillis(),
+		callback:     msg.sender,
+		callbackCode: code,
+		packType:     packNFP}
+
+	c.pendingAcks.Lock()
+	c.pendingAcks.m[key] = &pack
+	c.pendingAcks.Unlock()
+
+	// Let the requester know that we're alive, even if the target isn't
+	// answering, in good time for its own timeout.
+	delay := c.nackDelay(&pack)
+	c.spawn(func() {
+		if c.sleep(delay) {
+			c.sendNack(&pack)
+		}
+	})
 
-		pack := pendingAck{
-			node:         node,
-			startTime:    GetNowInMillis(),
-			callback:     msg.sender,
-			callbackCode: code,
-			packType:     packNFP}
+	return c.transmitVerbGenericUDP(node, nil, verbNonForwardingPing, code)
+}
 
-		pendingAcks.Lock()
-		pendingAcks.m[key] = &pack
-		pendingAcks.Unlock()
+// sendNack tells the requester of an NFP that its target hasn't answered, if
+// it still hasn't.
+func (c *Cluster) sendNack(pack *pendingAck) {
+	c.pendingAcks.RLock()
+	acked := pack.acked
+	c.pendingAcks.RUnlock()
 
-		return transmitVerbGenericUDP(node, nil, verbNonForwardingPing, code)
+	if !acked {
+		c.transmitVerbGenericUDP(pack.callback, nil, verbNack, pack.callbackCode)
 	}
+}
 
-	return nil
+// receiveVerbNackUDP notes that a member we asked to probe another on our
+// behalf couldn't reach it, but is itself alive.
+func (c *Cluster) receiveVerbNackUDP(msg message) {
+	key := msg.sender.Address() + ":" + strconv.FormatInt(int64(msg.senderHeartbeat), 10)
+
+	c.pendingAcks.Lock()
+	if pack, ok := c.pendingAcks.m[key]; ok && pack.packType == packPingReq {
+		pack.nacked = true
+	}
+	c.pendingAcks.Unlock()
 }
 
-func receiveVerbPingUDP(msg message) error {
-	return transmitVerbAckUDP(msg.sender, msg.senderHeartbeat)
+func (c *Cluster) receiveVerbPingUDP(msg message) error {
+	return c.transmitVerbAckUDP(msg.sender, msg.senderHeartbeat)
 }
 
-func receiveVerbNonForwardPingUDP(msg message) error {
-	return transmitVerbAckUDP(msg.sender, msg.senderHeartbeat)
+func (c *Cluster) receiveVerbNonForwardPingUDP(msg message) error {
+	return c.transmitVerbAckUDP(msg.sender, msg.senderHeartbeat)
 }
 
-func startTimeoutCheckLoop() {
+// startHeartbeatLoop pings every known node in turn, in random order, one
+// per heartbeat, until the cluster is stopped. If the knownNodesModifiedFlag
+// is set to true by AddNode() or RemoveNode(), then we get a fresh list and
+// start again.
+func (c *Cluster) startHeartbeatLoop() {
 	for {
-		pendingAcks.Lock()
-		for k, pack := range pendingAcks.m {
-			elapsed := pack.elapsed()
-			timeoutMillis := uint32(pingdata.nSigma(timeoutToleranceSigmas))
-
-			// Ping requests are expected to take quite a bit longer.
-			// Just call it 2x for now.
-			if pack.packType == packPingReq {
-				timeoutMillis *= 2
+		var randomAllNodes = c.knownNodes.getRandomNodes(0, c.thisHost)
+		var pingCounter int
+
+		// Exponential backoff of dead nodes, until such time as they are removed.
+		for _, node := range randomAllNodes {
+			if !c.runningFlag.IsSet() {
+				break
+			}
+			// Nodes that left on purpose aren't pinged or retried; we just
+			// remember them for a while and then forget them.
+			status := node.Status()
+
+			if status == StatusLeft {
+				if c.sinceMillis(node.touched()) > leftNodeRetentionMillis {
+					logDebug("Forgetting departed node", node.Address())
+					c.RemoveNode(node)
+				}
+
+				continue
+			}
+
+			// Exponential backoff of dead nodes, until such time as they are removed.
+			if status == StatusDead {
+				var dnc *deadNodeCounter
+				var ok bool
+
+				c.deadNodeRetries.Lock()
+				if dnc, ok = c.deadNodeRetries.m[node.Address()]; !ok {
+					dnc = &deadNodeCounter{retry: 1, retryCountdown: 2}
+					c.deadNodeRetries.m[node.Address()] = dnc
+				}
+				c.deadNodeRetries.Unlock()
+
+				dnc.retryCountdown--
+
+				if dnc.retryCountdown <= 0 {
+					dnc.retry++
+					dnc.retryCountdown = int(math.Pow(2.0, float64(dnc.retry)))
+
+					if dnc.retry > maxDeadNodeRetries {
+						logDebug("Forgetting dead node", node.Address())
+
+						c.deadNodeRetries.Lock()
+						delete(c.deadNodeRetries.m, node.Address())
+						c.deadNodeRetries.Unlock()
+
+						c.RemoveNode(node)
+						continue
+					}
+				} else {
+					continue
+				}
+			}
+
+			heartbeat := atomic.AddUint32(&c.currentHeartbeat, 1)
+
+			logfDebug("%d - hosts=%d (announce=%d forward=%d)\n",
+				heartbeat,
+				len(randomAllNodes),
+				c.emitCount(),
+				c.pingRequestCount())
+
+			c.PingNode(node)
+			pingCounter++
+
+			if !c.sleep(time.Millisecond * time.Duration(c.HeartbeatMillis())) {
+				return
 			}
 
+			if c.knownNodesModifiedFlag.SetToIf(true, false) {
+				break
+			}
+		}
+		if !c.runningFlag.IsSet() {
+			return
+		}
+
+		if pingCounter == 0 {
+			logDebug("No nodes to ping. So lonely. :(")
+
+			if !c.sleep(time.Millisecond * time.Duration(c.HeartbeatMillis())) {
+				return
+			}
+		}
+	}
+}
+
+func (c *Cluster) startTimeoutCheckLoop() {
+	for {
+		c.pendingAcks.Lock()
+		for k, pack := range c.pendingAcks.m {
+			pack := pack
+			elapsed := c.nowMillis() - pack.startTime
+			timeoutMillis := c.probeTimeoutMillis(pack)
+
 			// This pending ACK has taken longer than expected. Mark it as
-			// timed out.
+			// timed out. Nodes that fail an indirect probe are only
+			// suspected: they'll be declared dead by checkSuspicions() if
+			// they don't refute the suspicion in time.
 			if elapsed > timeoutMillis {
+				c.Metrics().IncrCounter(MetricProbeTimeouts,
+					[]Label{{"type", strings.ToLower(pack.packType.String())}}, 1)
+
 				switch pack.packType {
 				case packPing:
-					go doForwardOnTimeout(pack)
+					c.rtt(pack.node).addLoss()
+					c.adjustLocalHealth(healthProbeFailed)
+					c.spawn(func() { c.doForwardOnTimeout(pack) })
 				case packPingReq:
 					logDebug(k, "timed out after", timeoutMillis, "milliseconds (dropped PINGREQ)")
 
-					if knownNodes.contains(pack.callback) {
-						updateNodeStatus(pack.callback, StatusDead, currentHeartbeat)
-						pack.callback.pingMillis = PingTimedOut
+					// A healthy helper would have sent a NACK if it
+					// couldn't reach the target, so if it didn't, we
+					// may be the one with the problem.
+					if !pack.nacked {
+						c.adjustLocalHealth(healthMissedNack)
+					}
+
+					if c.knownNodes.contains(pack.callback) {
+						c.updateNodeStatus(pack.callback, StatusSuspected,
+							pack.callback.Heartbeat(), pack.callback.Incarnation())
+						pack.callback.setPingMillis(PingTimedOut)
 					}
 				case packNFP:
 					logDebug(k, "timed out after", timeoutMillis, "milliseconds (dropped NFP)")
 
-					if knownNodes.contains(pack.node) {
-						updateNodeStatus(pack.node, StatusDead, currentHeartbeat)
-						pack.callback.pingMillis = PingTimedOut
+					if c.knownNodes.contains(pack.node) {
+						c.updateNodeStatus(pack.node, StatusSuspected,
+							pack.node.Heartbeat(), pack.node.Incarnation())
+						pack.callback.setPingMillis(PingTimedOut)
 					}
 				}
 
-				delete(pendingAcks.m, k)
+				delete(c.pendingAcks.m, k)
 			}
 		}
-		pendingAcks.Unlock()
+		c.pendingAcks.Unlock()
 
-		time.Sleep(time.Millisecond * 100)
+		c.checkSuspicions()
+		c.checkReliableBroadcasts()
+
+		if !c.sleep(time.Millisecond * 100) {
+			return
+		}
 	}
 }
 
-func transmitVerbGenericUDP(node *Node, forwardTo *Node, verb messageVerb, code uint32) error {
-	// Transmit the ACK
-	remoteAddr, err := net.ResolveUDPAddr("udp", node.Address())
+func (c *Cluster) transmitVerbGenericUDP(node *Node, forwardTo *Node, verb messageVerb, code uint32) error {
+	return c.transmitMessageUDP(node, forwardTo, verb, code, nil)
+}
+
+// transmitMessageUDP sends a message with the specified verb to node. A
+// direct message, if any, is sent alone; otherwise whatever member updates
+// and broadcasts fit are packed in.
+func (c *Cluster) transmitMessageUDP(node *Node, forwardTo *Node, verb messageVerb, code uint32, direct *directMessage) error {
+	msg := newMessage(verb, c.thisHost, code)
+	msg.clusterHash = c.clusterHash()
+	msg.direct = direct
+
+	if verb == verbAck {
+		msg.coordinate = c.localCoordinate()
+	}
+
+	if forwardTo != nil {
+		msg.addMember(forwardTo, StatusForwardTo, code)
+	}
+
+	// A direct message is sent on its own, so that it's exactly as long as
+	// sendDirect() expects, and can't be pushed past the maximum message
+	// length by whatever else would be packed in with it.
+	if direct == nil {
+		// If we believe the recipient is suspected, dead or departed, tell
+		// it so: this gives it the chance to refute, which (for example)
+		// allows a restarted node to rejoin with a higher incarnation.
+		if status := node.Status(); status == StatusSuspected || status == StatusDead || status == StatusLeft {
+			msg.addMember(node, status, node.Heartbeat())
+		}
+
+		// While we're leaving, every message we send says so.
+		if c.thisHost.Status() == StatusLeft {
+			msg.addMember(c.thisHost, StatusLeft, c.thisHost.Heartbeat())
+		}
+
+		c.packMessage(&msg, node)
+	}
+
+	bytes, err := c.sealPayload(msg.encode())
 	if err != nil {
 		return err
 	}
 
-	c, err := net.DialUDP("udp", nil, remoteAddr)
-	if err != nil {
+	if err = c.writePacket(bytes, node); err != nil {
 		return err
 	}
-	defer c.Close()
 
-	msg := newMessage(verb, thisHost, code)
+	verbLabels := []Label{{"verb", strings.ToLower(verb.String())}}
+	c.Metrics().IncrCounter(MetricPacketsSent, verbLabels, 1)
+	c.Metrics().IncrCounter(MetricBytesSent, verbLabels, float64(len(bytes)))
 
-	if forwardTo != nil {
-		msg.addMember(forwardTo, StatusForwardTo, code)
+	// Decrement the update counters on those nodes
+	for _, m := range msg.members {
+		m.node.decrementEmitCounter()
 	}
 
-	// Add members for update.
-	nodes := getRandomUpdatedNodes(pingRequestCount(), node, thisHost)
+	logfTrace("Sent %v to %v\n", verb, node.Address())
+
+	return nil
+}
+
+// messageBudget returns the maximum length of an encoded message: the
+// maximum message length, less the overhead of encryption if it's enabled.
+func (c *Cluster) messageBudget() int {
+	budget := c.MaxMessageBytes()
+	if keyring, _ := c.getKeyring(); keyring.enabled() {
+		budget -= encryptionOverhead
+	}
+
+	return budget
+}
+
+// packMessage fills the rest of a message bound for recipient with as many
+// member updates and broadcasts as fit into the maximum message length (less
+// the overhead of encryption, if enabled), highest emitCounter first.
+func (c *Cluster) packMessage(msg *message, recipient *Node) {
+	budget := c.messageBudget()
+	size := msg.encodedLength()
+
+	// Add members for update. Otherwise, this host is only in the updated
+	// list when it's refuting a suspicion, so we don't exclude it then.
+	exclude := []*Node{recipient}
+	if c.thisHost.Status() == StatusLeft {
+		exclude = append(exclude, c.thisHost)
+	}
+
+	nodes := c.getRandomUpdatedNodes(maxMessageEntries, exclude...)
 
 	// No updates to distribute? Send out a few updates on other known nodes.
 	if len(nodes) == 0 {
-		nodes = knownNodes.getRandomNodes(pingRequestCount(), node, thisHost)
+		nodes = c.knownNodes.getRandomNodes(c.pingRequestCount(), recipient, c.thisHost)
 	}
 
 	for _, n := range nodes {
-		err = msg.addMember(n, n.status, n.heartbeat)
-		if err != nil {
-			return err
+		member := newMessageMember(n, n.Status(), n.Heartbeat())
+
+		length := member.encodedLength()
+		if size+length > budget {
+			continue
+		}
+
+		if msg.addMember(n, member.status, member.heartbeat) != nil {
+			break
 		}
 
-		n.emitCounter--
+		size += length
+		n.decrementEmitCounter()
 	}
 
 	// Emit counters for broadcasts can be less than 0. We transmit positive
 	// numbers, and decrement all the others. At some value < 0, the broadcast
-	// is removed from the map all together.
-	broadcast := getBroadcastToEmit()
-	if broadcast != nil {
-		if broadcast.emitCounter > 0 {
-			msg.addBroadcast(broadcast)
-		}
+	// is removed from the map all together. Broadcasts that don't fit wait
+	// for a later message, except that a message always carries at least one
+	// (if there is one to send) so that a large broadcast can't be starved.
+	broadcasts := c.getBroadcastsToEmit()
 
-		broadcast.emitCounter--
-	}
+	// Emit counters are only read and written under the broadcasts lock.
+	c.broadcasts.Lock()
+	defer c.broadcasts.Unlock()
 
-	_, err = c.Write(msg.encode())
-	if err != nil {
-		return err
-	}
+	for _, broadcast := range broadcasts {
+		if broadcast.emitCounter > 0 {
+			length := broadcast.encodedLength()
+			if size+length > budget && len(msg.broadcasts) > 0 {
+				continue
+			}
 
-	// Decrement the update counters on those nodes
-	for _, m := range msg.members {
-		m.node.emitCounter--
-	}
+			if msg.addBroadcast(broadcast) != nil {
+				break
+			}
 
-	logfTrace("Sent %v to %v\n", verb, node.Address())
+			size += length
+		}
 
-	return nil
+		broadcast.emitCounter--
+	}
 }
 
-func transmitVerbForwardUDP(node *Node, downstream *Node, code uint32) error {
+func (c *Cluster) transmitVerbForwardUDP(node *Node, downstream *Node, code uint32) error {
 	key := node.Address() + ":" + strconv.FormatInt(int64(code), 10)
 
 	pack := pendingAck{
 		node:      node,
-		startTime: GetNowInMillis(),
+		startTime: c.nowMillis(),
 		callback:  downstream,
 		packType:  packPingReq}
 
-	pendingAcks.Lock()
-	pendingAcks.m[key] = &pack
-	pendingAcks.Unlock()
+	c.pendingAcks.Lock()
+	c.pendingAcks.m[key] = &pack
+	c.pendingAcks.Unlock()
 
-	return transmitVerbGenericUDP(node, downstream, verbPingRequest, code)
+	return c.transmitVerbGenericUDP(node, downstream, verbPingRequest, code)
 }
 
-func transmitVerbAckUDP(node *Node, code uint32) error {
-	return transmitVerbGenericUDP(node, nil, verbAck, code)
+func (c *Cluster) transmitVerbAckUDP(node *Node, code uint32) error {
+	return c.transmitVerbGenericUDP(node, nil, verbAck, code)
 }
 
-func transmitVerbPingUDP(node *Node, code uint32) error {
+func (c *Cluster) transmitVerbPingUDP(node *Node, code uint32) error {
 	key := node.Address() + ":" + strconv.FormatInt(int64(code), 10)
 	pack := pendingAck{
 		node:      node,
-		startTime: GetNowInMillis(),
+		startTime: c.nowMillis(),
 		packType:  packPing}
 
-	pendingAcks.Lock()
-	pendingAcks.m[key] = &pack
-	pendingAcks.Unlock()
+	c.pendingAcks.Lock()
+	c.pendingAcks.m[key] = &pack
+	c.pendingAcks.Unlock()
 
-	return transmitVerbGenericUDP(node, nil, verbPing, code)
+	return c.transmitVerbGenericUDP(node, nil, verbPing, code)
 }
 
-func updateStatusesFromMessage(msg message) {
-	for _, m := range msg.members {
-		// If the heartbeat in the message is less then the heartbeat
-		// associated with the last known status, then we conclude that the
-		// message is old and we drop it.
-		if m.heartbeat < m.node.heartbeat {
-			logfDebug("Message is old (%d vs %d): dropping\n",
-				m.node.heartbeat, m.heartbeat)
+func (c *Cluster) updateStatusesFromMessage(msg message) {
+	c.mergeMembers(msg.members)
 
-			continue
-		}
+	// Obviously, we know the sender is alive. Report it as such. As with
+	// any other update, this won't override a suspicion or death at the same
+	// incarnation: the sender must refute those itself.
+	c.updateNodeStatus(msg.sender, StatusAlive, msg.senderHeartbeat, msg.senderIncarnation)
 
+	// First, if we don't know the sender, we add it.
+	if !c.knownNodes.contains(msg.sender) {
+		c.AddNode(msg.sender)
+	}
+}
+
+// mergeMembers applies a list of member status updates, received either
+// piggybacked on a message or in a full state sync, to the known nodes.
+func (c *Cluster) mergeMembers(members []*messageMember) {
+	for _, m := range members {
 		switch m.status {
-		case StatusForwardTo:
+		case StatusForwardTo, StatusUnknown:
 			// The FORWARD_TO status isn't useful here, so we ignore those
 			continue
-		case StatusDead:
-			// Don't tell ME I'm dead.
-			if m.node.Address() != thisHost.Address() {
-				updateNodeStatus(m.node, m.status, m.heartbeat)
-				AddNode(m.node)
-			}
-		default:
-			updateNodeStatus(m.node, m.status, m.heartbeat)
-			AddNode(m.node)
 		}
-	}
 
-	// Obviously, we know the sender is alive. Report it as such.
-	if msg.senderHeartbeat > msg.sender.heartbeat {
-		updateNodeStatus(msg.sender, StatusAlive, msg.senderHeartbeat)
-	}
+		if m.node == nil {
+			logDebug("Ignoring addressless member update")
+			continue
+		}
 
-	// First, if we don't know the sender, we add it.
-	if !knownNodes.contains(msg.sender) {
-		AddNode(msg.sender)
+		// Only this host may change its own status. If someone thinks
+		// we're dead, suspected or gone (and we're not in fact leaving), we
+		// refute it instead.
+		if m.node.Address() == c.thisHost.Address() {
+			if (m.status == StatusDead || m.status == StatusSuspected || m.status == StatusLeft) &&
+				m.incarnation >= c.thisHost.Incarnation() &&
+				c.thisHost.Status() != StatusLeft {
+
+				c.refute(m.incarnation)
+			}
+
+			continue
+		}
+
+		// Updates with an older incarnation (or a lower-precedence status
+		// at the same incarnation) are discarded by updateNodeStatus().
+		// Metadata is versioned independently of status.
+		c.updateNodeStatus(m.node, m.status, m.heartbeat, m.incarnation)
+		c.AddNode(m.node)
+		c.mergeMetadata(m)
 	}
 }
 
 // pendingAckType represents an expectation of a response to a previously
 // emitted PING, PINGREQ, or NFP.
 type pendingAck struct {
-	startTime    uint32
+	startTime    int64
 	node         *Node
 	callback     *Node
 	callbackCode uint32
 	packType     pendingAckType
-}
 
-func (a *pendingAck) elapsed() uint32 {
-	return GetNowInMillis() - a.startTime
+	// Set when the helper of a PINGREQ reports that it couldn't reach the
+	// target; see health.go.
+	nacked bool
+
+	// Set when the target of an NFP answers, so that no NACK is sent.
+	acked bool
 }
 
 // pendingAckType represents the type of PING that a pendingAckType is waiting
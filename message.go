@@ -18,145 +18,191 @@ package smudge
 
 import (
 	"errors"
+	"fmt"
 	"hash/adler32"
 	"net"
 )
 
+// The version of the message layout described below. Messages with any other
+// version are rejected by decodeMessage().
+const messageVersion byte = 9
+
 // Message contents
-// ---[ Base message (11 bytes)]---
+// Addresses (A) are encoded as a 1-byte address family (4 or 6) followed by
+// a 4-byte IPv4 or 16-byte IPv6 address; i.e., 5 or 17 bytes.
+// ---[ Base message (22+A bytes)]---
 // Bytes 00-03 Checksum (32-bit)
-// Bytes 04    Verb (one of {PING|ACK|PINGREQ|NFPING})
-// Bytes 05-06 Sender response port
-// Bytes 07-10 Sender current heartbeat
-// ---[ Per member (11 bytes)]---
+// Bytes 04    Message layout version
+// Bytes 05-08 Cluster name hash (32-bit FNV-1a, or 0 if unnamed)
+// Bytes 09    Verb (one of {PING|ACK|PINGREQ|NFPING|USER|USERACK|NACK})
+// Bytes 10    Member count
+// Bytes 11    Broadcast count
+// Bytes 12-XX Sender address (A)
+// Bytes +0-1  Sender response port
+// Bytes +2-5  Sender current heartbeat
+// Bytes +6-9  Sender incarnation
+// ---[ Per member (17+A+M bytes)]---
 // Bytes 00    Member status byte
-// Bytes 01-04 Member host IP
-// Bytes 05-06 Member host response port
-// Bytes 07-10 Sender current heartbeat
-// ---[ Per broadcast (1 allowed) (11+N bytes) ]
-// Bytes 00-03 Origin IP
-// Bytes 04-05 Origin response port
-// Bytes 06-09 Origin broadcast counter
-// Bytes 10-11 Payload length (bytes)
-// Bytes 12-NN Payload
+// Bytes 01-XX Member host address (A)
+// Bytes +0-1  Member host response port
+// Bytes +2-5  Member heartbeat
+// Bytes +6-9  Member incarnation
+// Bytes +10-13 Member metadata version
+// Bytes +14-15 Member metadata length (M bytes)
+// Bytes +16-MM Member metadata
+// ---[ Per broadcast (9+A+N bytes) ]
+// Bytes 00    Broadcast kind
+// Bytes 01-XX Origin address (A)
+// Bytes +0-1  Origin response port
+// Bytes +2-5  Origin broadcast counter
+// Bytes +6    Topic length (T bytes)
+// Bytes +7-TT Topic
+// Bytes +0-1  Payload length (bytes)
+// Bytes +2-NN Payload
+// ---[ Direct message (USER and USERACK only) (7+N bytes) ]
+// Bytes 00-03 Message ID
+// Bytes 04    Flags (see direct.go)
+// Bytes 05-06 Payload length (N bytes)
+// Bytes 07-NN Payload
+// ---[ Sender coordinate (ACK only) (40 bytes) ]
+// Bytes 00-31 Vector (8 32-bit floats)
+// Bytes 32-35 Height (32-bit float)
+// Bytes 36-39 Error (32-bit float)
 
 type message struct {
-	sender          *Node
-	senderHeartbeat uint32
-	verb            messageVerb
-	members         []*messageMember
-	broadcast       *Broadcast
+	clusterHash       uint32
+	sender            *Node
+	senderHeartbeat   uint32
+	senderIncarnation uint32
+	verb              messageVerb
+	members           []*messageMember
+	broadcasts        []*Broadcast
+	direct            *directMessage
+	coordinate        *Coordinate
 }
 
+// The maximum number of members, and of broadcasts, that a message can carry.
+const maxMessageEntries = 255
+
 // Represents a "member" of a message; i.e., a node that the sender knows
 // about, about which it wishes to notify the downstream recipient.
 type messageMember struct {
-	heartbeat uint32
-	node      *Node
-	status    NodeStatus
+	heartbeat       uint32
+	incarnation     uint32
+	metadata        []byte
+	metadataVersion uint32
+	node            *Node
+	status          NodeStatus
+}
+
+// Convenience function. Creates a new member for the node with the given
+// status and heartbeat; its incarnation and metadata are taken from the node.
+func newMessageMember(n *Node, status NodeStatus, heartbeat uint32) *messageMember {
+	n.mutex.RLock()
+	defer n.mutex.RUnlock()
+
+	return &messageMember{
+		heartbeat:       heartbeat,
+		incarnation:     n.incarnation,
+		metadata:        n.metadata,
+		metadataVersion: n.metadataVersion,
+		node:            n,
+		status:          status,
+	}
 }
 
-// Convenience function. Creates a new message instance.
+// Convenience function. Creates a new message instance. The sender's
+// incarnation is taken from the sender node.
 func newMessage(verb messageVerb, sender *Node, senderHeartbeat uint32) message {
-	return message{
+	m := message{
 		sender:          sender,
 		senderHeartbeat: senderHeartbeat,
 		verb:            verb,
 	}
+
+	if sender != nil {
+		m.senderIncarnation = sender.Incarnation()
+	}
+
+	return m
 }
 
-// Adds a broadcast to this message. Only one broadcast is allowed; subsequent
-// calls will replace an existing broadcast.
-func (m *message) addBroadcast(broadcast *Broadcast) {
-	m.broadcast = broadcast
+// Adds a broadcast to this message. The maximum number of allowed broadcasts
+// is 255, though in practice the number is limited by the maximum message
+// length; see Cluster.MaxMessageBytes().
+func (m *message) addBroadcast(broadcast *Broadcast) error {
+	if len(m.broadcasts) >= maxMessageEntries {
+		return errors.New("broadcast list overflow")
+	}
+
+	m.broadcasts = append(m.broadcasts, broadcast)
+
+	return nil
 }
 
-// Adds a member status update to this message. The maximum number of allowed
-// members is 2^6 - 1 = 63, though it is incredibly unlikely that this maximum
-// will be reached without an absurdly high lambda. There aren't yet many
-// 88 billion node clusters (assuming lambda of 2.5).
+// Adds a member status update to this message. The member's incarnation and
+// metadata are taken from the node. The maximum number of allowed members is
+// 255, though as with broadcasts the number is usually limited by the
+// maximum message length.
 func (m *message) addMember(n *Node, status NodeStatus, heartbeat uint32) error {
 	if m.members == nil {
 		m.members = make([]*messageMember, 0, 32)
-	} else if len(m.members) >= 63 {
+	} else if len(m.members) >= maxMessageEntries {
 		return errors.New("member list overflow")
 	}
 
-	messageMember := messageMember{
-		heartbeat: heartbeat,
-		node:      n,
-		status:    status}
-
-	m.members = append(m.members, &messageMember)
+	m.members = append(m.members, newMessageMember(n, status, heartbeat))
 
 	return nil
 }
 
-// Message contents
-// ---[ Base message (12 bytes)]---
-// Bytes 00-03 Checksum (32-bit)
-// Bytes 04    Verb (one of {PING|ACK|PINGREQ|NFPING})
-// Bytes 05-06 Sender response port
-// Bytes 07-10 Sender ID Code
-// ---[ Per member (11 bytes)]---
-// Bytes 00    Member status byte
-// Bytes 01-04 Member host IP
-// Bytes 05-06 Member host response port
-// Bytes 07-10 Member heartbeat
-
 func (m *message) encode() []byte {
-	size := 11 + (len(m.members) * 11)
-	if m.broadcast != nil {
-		size += 12 + len(m.broadcast.bytes)
-	}
+	size := m.encodedLength()
 
 	bytes := make([]byte, size, size)
 
 	// An index pointer (start at 4 to accommodate checksum)
 	p := 4
 
-	// Byte 00
-	// Rightmost 2 bits: verb (one of {P|A|F|N})
-	// Leftmost 6 bits: number of members in payload
-	verbByte := byte(len(m.members))
-	verbByte = (verbByte << 2) | byte(m.verb)
-	p += encodeByte(verbByte, bytes, p)
+	// Byte 04 Message layout version
+	p += encodeByte(messageVersion, bytes, p)
 
-	// Bytes 01-02 Sender response port
+	// Bytes 05-08 Cluster name hash
+	p += encodeUint32(m.clusterHash, bytes, p)
+
+	// Byte 09 Verb
+	p += encodeByte(byte(m.verb), bytes, p)
+
+	// Bytes 10-11 Number of members and broadcasts in payload
+	p += encodeByte(byte(len(m.members)), bytes, p)
+	p += encodeByte(byte(len(m.broadcasts)), bytes, p)
+
+	// Sender address
+	p += encodeIP(m.sender.ip, bytes, p)
+
+	// Sender response port
 	p += encodeUint16(m.sender.port, bytes, p)
 
-	// Bytes 03-06 ID Code
+	// Sender ID Code
 	p += encodeUint32(m.senderHeartbeat, bytes, p)
 
-	// Each member data requires 11 bytes.
-	for _, member := range m.members {
-		mnode := member.node
-		mstatus := member.status
-		mcode := member.heartbeat
+	// Sender incarnation
+	p += encodeUint32(m.senderIncarnation, bytes, p)
 
-		// Byte p + 00
-		bytes[p] = byte(mstatus)
-		p++
-
-		// Bytes (p + 01) to (p + 04): Originating host IP
-		ipb := mnode.ip
-		for i := 0; i < 4; i++ {
-			bytes[p+i] = ipb[i]
-		}
-		p += 4
+	for _, member := range m.members {
+		p += encodeMember(member, bytes, p)
+	}
 
-		// Bytes (p + 05) to (p + 06): Originating host response port
-		p += encodeUint16(mnode.port, bytes, p)
+	for _, broadcast := range m.broadcasts {
+		p += copy(bytes[p:], broadcast.encode())
+	}
 
-		// Bytes (p + 07) to (p + 10): Originating message code
-		p += encodeUint32(mcode, bytes, p)
+	if m.direct != nil {
+		p += m.direct.encode(bytes, p)
 	}
 
-	if m.broadcast != nil {
-		bbytes := m.broadcast.encode()
-		for i, v := range bbytes {
-			bytes[p+i] = v
-		}
+	if m.coordinate != nil {
+		p += m.coordinate.encode(bytes, p)
 	}
 
 	checksum := adler32.Checksum(bytes[4:])
@@ -165,6 +211,63 @@ func (m *message) encode() []byte {
 	return bytes
 }
 
+// encodedLength returns the number of bytes that encode() will write.
+func (m *message) encodedLength() int {
+	size := 22 + encodedIPLength(m.sender.ip)
+
+	for _, member := range m.members {
+		size += member.encodedLength()
+	}
+
+	for _, broadcast := range m.broadcasts {
+		size += broadcast.encodedLength()
+	}
+
+	if m.direct != nil {
+		size += m.direct.encodedLength()
+	}
+
+	if m.coordinate != nil {
+		size += coordinateLength
+	}
+
+	return size
+}
+
+// Encodes a single member into bytes starting at index p. Returns the number
+// of bytes written.
+func encodeMember(member *messageMember, bytes []byte, p int) int {
+	start := p
+
+	// Byte p + 00
+	bytes[p] = byte(member.status)
+	p++
+
+	// Originating host address
+	p += encodeIP(member.node.ip, bytes, p)
+
+	// Originating host response port
+	p += encodeUint16(member.node.port, bytes, p)
+
+	// Originating message code
+	p += encodeUint32(member.heartbeat, bytes, p)
+
+	// Member incarnation
+	p += encodeUint32(member.incarnation, bytes, p)
+
+	// Member metadata version, length and content
+	p += encodeUint32(member.metadataVersion, bytes, p)
+	p += encodeUint16(uint16(len(member.metadata)), bytes, p)
+	p += copy(bytes[p:], member.metadata)
+
+	return p - start
+}
+
+// encodedLength returns the number of bytes that encodeMember() will write.
+func (m *messageMember) encodedLength() int {
+	return 17 + encodedIPLength(m.node.ip) + len(m.metadata)
+}
+
 // If members exist on this message, and that message has the "forward to"
 // status, this function returns it; otherwise it returns nil.
 func (m *message) getForwardTo() *messageMember {
@@ -178,10 +281,26 @@ func (m *message) getForwardTo() *messageMember {
 // Parses the bytes received in a UDP message.
 // If the address:port from the message can't be associated with a known
 // (live) node, then an instance of message.sender will be created from
-// available data but not explicitly added to the known nodes.
-func decodeMessage(sourceIP net.IP, bytes []byte) (message, error) {
+// available data but not explicitly added to the known nodes. If the message
+// doesn't state a sender address, the source IP of the packet is assumed.
+func (c *Cluster) decodeMessage(sourceIP net.IP, bytes []byte) (message, error) {
 	var err error
 
+	// If encryption is enabled, anything that can't be authenticated is
+	// dropped here.
+	bytes, err = c.openPayload(bytes)
+	if err != nil {
+		c.noteDecodeFailure("unauthenticated")
+		return newMessage(255, nil, 0),
+			fmt.Errorf("dropped message from %s: %v", sourceIP.String(), err)
+	}
+
+	if len(bytes) < 22 {
+		c.noteDecodeFailure("short")
+		return newMessage(255, nil, 0),
+			errors.New("short message from " + sourceIP.String())
+	}
+
 	// An index pointer
 	p := 0
 
@@ -189,107 +308,204 @@ func decodeMessage(sourceIP net.IP, bytes []byte) (message, error) {
 	checksumStated, p := decodeUint32(bytes, p)
 	checksumCalculated := adler32.Checksum(bytes[4:])
 	if checksumCalculated != checksumStated {
+		c.noteDecodeFailure("checksum")
 		return newMessage(255, nil, 0),
 			errors.New("checksum failure from " + sourceIP.String())
 	}
 
-	// Byte 04
-	// Rightmost 2 bits: verb (one of {P|A|F|N})
-	// Leftmost 6 bits: number of members in payload
+	// Byte 04 Message layout version
+	version, p := decodeByte(bytes, p)
+	if version != messageVersion {
+		c.noteDecodeFailure("version")
+		return newMessage(255, nil, 0),
+			fmt.Errorf("unsupported message version %d from %s",
+				version, sourceIP.String())
+	}
+
+	// Bytes 05-08 Cluster name hash
+	clusterHash, p := decodeUint32(bytes, p)
+	if err = c.checkClusterHash(clusterHash, sourceIP.String()); err != nil {
+		c.noteDecodeFailure("cluster")
+		return newMessage(255, nil, 0), err
+	}
+
+	// Byte 09 Verb
 	v, p := decodeByte(bytes, p)
-	verb := messageVerb(v & 0x03)
+	verb := messageVerb(v)
+
+	// Bytes 10-11 Number of members and broadcasts in payload
+	memberCount, p := decodeByte(bytes, p)
+	broadcastCount, p := decodeByte(bytes, p)
+
+	// Sender address, followed by 10 bytes of port, heartbeat and
+	// incarnation. The address may be longer than the minimum length
+	// checked above allows for.
+	senderIP, p, err := decodeIP(bytes, p)
+	if err != nil || !hasBytes(bytes, p, 10) {
+		c.noteDecodeFailure("malformed")
+		return newMessage(255, nil, 0),
+			errors.New("truncated message from " + sourceIP.String())
+	}
 
-	memberCount := int(v >> 2)
+	if senderIP == nil || senderIP.IsUnspecified() {
+		senderIP = sourceIP
+	}
+	senderIP = normalizeIP(senderIP)
 
-	// Bytes 05-06 Sender response port
+	// Sender response port
 	senderPort, p := decodeUint16(bytes, p)
 
-	// Bytes 07-10 Sender ID Code
+	// Sender ID Code
 	senderHeartbeat, p := decodeUint32(bytes, p)
 
+	// Sender incarnation
+	senderIncarnation, p := decodeUint32(bytes, p)
+
 	// Now that we have the IP and port, we can find the Node.
-	sender := knownNodes.getByIP(sourceIP.To4(), senderPort)
+	sender := c.knownNodes.getByIP(senderIP, senderPort)
 
 	// We don't know this node, so create a new one!
 	if sender == nil {
-		sender, _ = CreateNodeByIP(sourceIP.To4(), senderPort)
+		sender = c.createNodeByIP(senderIP, senderPort)
 	}
 
 	// Now that we have the verb, node, and code, we can build the mesage
 	m := newMessage(verb, sender, senderHeartbeat)
+	m.clusterHash = clusterHash
+	m.senderIncarnation = senderIncarnation
 
-	memberLastIndex := p + (memberCount * 11)
-	if len(bytes) > p {
-		m.members = decodeMembers(memberCount, bytes[p:memberLastIndex])
+	m.members, p, err = c.decodeMembers(int(memberCount), bytes, p)
+	if err != nil {
+		c.noteDecodeFailure("malformed")
+		return m, err
 	}
 
-	if len(bytes) > memberLastIndex {
-		m.broadcast, err = decodeBroadcast(bytes[memberLastIndex:])
+	m.broadcasts, p, err = c.decodeBroadcasts(int(broadcastCount), bytes, p)
+	if err != nil {
+		c.noteDecodeFailure("malformed")
+		return m, err
+	}
 
-		if m.broadcast.origin.IP()[0] == 0 || m.broadcast.origin.Port() == 0 {
-			err = errors.New("Received originless broadcast!")
+	if verb == verbUser || verb == verbUserAck {
+		if m.direct, err = decodeDirectMessage(bytes, p); err != nil {
+			c.noteDecodeFailure("malformed")
 		}
 	}
 
+	if verb == verbAck {
+		m.coordinate = decodeCoordinate(bytes, p)
+	}
+
 	return m, err
 }
 
-func decodeMembers(memberCount int, bytes []byte) []*messageMember {
-	// Bytes 00    Member status byte
-	// Bytes 01-04 Member host IP
-	// Bytes 05-06 Member host response port
-	// Bytes 07-10 Member heartbeat
+// Decodes broadcastCount broadcasts starting at index p of bytes. Returns the
+// broadcasts and the index of the first byte after the last one. Decoding
+// stops at the first broadcast that can't be decoded, returning those before
+// it along with the error.
+func (c *Cluster) decodeBroadcasts(broadcastCount int, bytes []byte, p int) ([]*Broadcast, int, error) {
+	var broadcasts []*Broadcast
+
+	for i := 0; i < broadcastCount; i++ {
+		broadcast, err := c.decodeBroadcast(bytes[p:])
+		if err != nil {
+			return broadcasts, p, err
+		}
 
-	members := make([]*messageMember, 0, 1)
+		broadcasts = append(broadcasts, broadcast)
+		p += broadcast.encodedLength()
+	}
 
-	// An index pointer
-	p := 0
+	return broadcasts, p, nil
+}
+
+// Decodes memberCount members starting at index p of bytes. Returns the
+// members and the index of the first byte after the last member, or an error
+// if bytes ends before the last member does.
+func (c *Cluster) decodeMembers(memberCount int, bytes []byte, p int) ([]*messageMember, int, error) {
+	// Bytes 00    Member status byte
+	// Bytes 01-XX Member host address
+	// Bytes +0-1  Member host response port
+	// Bytes +2-5  Member heartbeat
+	// Bytes +6-9  Member incarnation
+	// Bytes +10-13 Member metadata version
+	// Bytes +14-15 Member metadata length (M bytes)
+	// Bytes +16-MM Member metadata
 
-	for p < len(bytes) {
+	var members []*messageMember
+
+	for i := 0; i < memberCount; i++ {
 		var mstatus NodeStatus
 		var mip net.IP
 		var mport uint16
 		var mcode uint32
+		var mincarnation uint32
+		var mmetaVersion uint32
+		var mmetaLength uint16
+		var mmeta []byte
 		var mnode *Node
+		var err error
 
 		// Byte 00 Member status byte
+		if !hasBytes(bytes, p, 1) {
+			return members, p, errors.New("member status is truncated")
+		}
+
 		mstatus = NodeStatus(bytes[p])
 		p++
 
-		// Bytes 01-04 member IP
-		if bytes[p] > 0 {
-			mip = net.IPv4(
-				bytes[p+0],
-				bytes[p+1],
-				bytes[p+2],
-				bytes[p+3]).To4()
+		// Member address
+		if mip, p, err = decodeIP(bytes, p); err != nil {
+			return members, p, errors.New("member address is truncated")
 		}
-		p += 4
 
-		// Bytes 05-06 member response port
+		if !hasBytes(bytes, p, 16) {
+			return members, p, errors.New("member is truncated")
+		}
+
+		// Member response port
 		mport, p = decodeUint16(bytes, p)
 
-		// Bytes 07-10 member heartbeat
+		// Member heartbeat
 		mcode, p = decodeUint32(bytes, p)
 
+		// Member incarnation
+		mincarnation, p = decodeUint32(bytes, p)
+
+		// Member metadata version, length and content
+		mmetaVersion, p = decodeUint32(bytes, p)
+		mmetaLength, p = decodeUint16(bytes, p)
+
+		if !hasBytes(bytes, p, int(mmetaLength)) {
+			return members, p, errors.New("member metadata is truncated")
+		}
+
+		if mmetaLength > 0 {
+			mmeta = make([]byte, mmetaLength)
+			p += copy(mmeta, bytes[p:p+int(mmetaLength)])
+		}
+
 		if len(mip) > 0 {
 			// Find the sender by the address associated with the message
-			mnode = knownNodes.getByIP(mip, mport)
+			mnode = c.knownNodes.getByIP(mip, mport)
 
 			// We still don't know this node, so create a new one!
 			if mnode == nil {
-				mnode, _ = CreateNodeByIP(mip, mport)
+				mnode = c.createNodeByIP(mip, mport)
 			}
 		}
 
 		member := messageMember{
-			heartbeat: mcode,
-			node:      mnode,
-			status:    mstatus,
+			heartbeat:       mcode,
+			incarnation:     mincarnation,
+			metadata:        mmeta,
+			metadataVersion: mmetaVersion,
+			node:            mnode,
+			status:          mstatus,
 		}
 
 		members = append(members, &member)
 	}
 
-	return members
+	return members, p, nil
 }
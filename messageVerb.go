@@ -35,6 +35,19 @@ const (
 	// If the ping times out, the host does not follow up with a ping request
 	// to any other hosts.
 	verbNonForwardingPing
+
+	// VerbUser represents a direct message from one member to another,
+	// carrying an application payload; see SendToNode().
+	verbUser
+
+	// VerbUserAck acknowledges receipt of a direct message whose sender
+	// asked for an acknowledgement.
+	verbUserAck
+
+	// VerbNack is sent in response to a ping request when the host to be
+	// pinged doesn't respond in time. It tells the requester that we, at
+	// least, are still alive.
+	verbNack
 )
 
 func (v messageVerb) String() string {
@@ -47,6 +60,12 @@ func (v messageVerb) String() string {
 		return "PINGREQ"
 	case verbNonForwardingPing:
 		return "NFPING"
+	case verbUser:
+		return "USER"
+	case verbUserAck:
+		return "USERACK"
+	case verbNack:
+		return "NACK"
 	default:
 		return "UNDEFINED"
 	}
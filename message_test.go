@@ -17,16 +17,18 @@ limitations under the License.
 package smudge
 
 import (
+	"hash/adler32"
 	"net"
 	"reflect"
 	"testing"
+	"time"
 )
 
 // Identical but distinct instance from node1b
 var node1a = Node{
 	ip:          net.IP([]byte{127, 0, 0, 1}),
 	port:        1234,
-	timestamp:   87878787,
+	timestamp:   time.Unix(87878, 787000000),
 	status:      StatusAlive,
 	emitCounter: 42,
 	pingMillis:  PingNoData}
@@ -35,7 +37,7 @@ var node1a = Node{
 var node1b = Node{
 	ip:          net.IP([]byte{127, 0, 0, 1}),
 	port:        1234,
-	timestamp:   87878787,
+	timestamp:   time.Unix(87878, 787000000),
 	status:      StatusAlive,
 	emitCounter: 42,
 	pingMillis:  PingNoData}
@@ -44,7 +46,7 @@ var node1b = Node{
 var node2 = Node{
 	ip:          net.IP([]byte{127, 0, 0, 1}),
 	port:        10001,
-	timestamp:   GetNowInMillis(),
+	timestamp:   time.Now(),
 	status:      StatusAlive,
 	emitCounter: 42,
 	pingMillis:  PingNoData}
@@ -81,12 +83,14 @@ func TestDeepEqualityFalse(t *testing.T) {
 // Endode and decode a simple message without any members, and see if
 // the input/output match.
 func TestEncodeDecodeBasic(t *testing.T) {
-	timestamp := uint32(87878787)
+	timestamp := time.Unix(87878, 787000000)
 
 	sender := Node{
 		ip:         net.IP([]byte{127, 0, 0, 1}),
 		port:       1234,
+		address:    "127.0.0.1:1234",
 		timestamp:  timestamp,
+		clock:      defaultCluster.clock,
 		pingMillis: PingNoData,
 	}
 
@@ -97,7 +101,7 @@ func TestEncodeDecodeBasic(t *testing.T) {
 
 	ip := net.IP([]byte{127, 0, 0, 1})
 	bytes := message.encode()
-	decoded, err := decodeMessage(ip, bytes)
+	decoded, err := defaultCluster.decodeMessage(ip, bytes)
 	decoded.sender.timestamp = timestamp
 
 	if err != nil {
@@ -117,19 +121,23 @@ func TestEncodeDecodeBasic(t *testing.T) {
 // Endode and decode a simple message without one member, and see if
 // the input/output match.
 func TestEncodeDecode1Member(t *testing.T) {
-	timestamp := uint32(87878787)
+	timestamp := time.Unix(87878, 787000000)
 
 	sender := Node{
 		ip:         net.IP([]byte{127, 0, 0, 1}),
 		port:       1234,
+		address:    "127.0.0.1:1234",
 		timestamp:  timestamp,
+		clock:      defaultCluster.clock,
 		pingMillis: PingNoData,
 	}
 
 	member := Node{
 		ip:         net.IP([]byte{127, 0, 0, 2}),
 		port:       9000,
+		address:    "127.0.0.2:9000",
 		timestamp:  timestamp,
+		clock:      defaultCluster.clock,
 		pingMillis: PingNoData,
 	}
 
@@ -145,7 +153,7 @@ func TestEncodeDecode1Member(t *testing.T) {
 
 	ip := net.IP([]byte{127, 0, 0, 1})
 	bytes := message.encode()
-	decoded, err := decodeMessage(ip, bytes)
+	decoded, err := defaultCluster.decodeMessage(ip, bytes)
 	decoded.sender.timestamp = timestamp
 	decoded.members[0].node.timestamp = timestamp
 
@@ -170,18 +178,22 @@ func TestEncodeDecode1Member(t *testing.T) {
 // Endode and decode a simple message without one member, and see if
 // the input/output match.
 func TestEncodeDecode1MemberBroadcast(t *testing.T) {
-	timestamp := uint32(87878787)
+	timestamp := time.Unix(87878, 787000000)
 
 	sender := Node{
 		ip:         net.IP([]byte{127, 0, 0, 1}),
 		port:       1234,
+		address:    "127.0.0.1:1234",
 		timestamp:  timestamp,
+		clock:      defaultCluster.clock,
 		pingMillis: PingNoData}
 
 	member := Node{
 		ip:         net.IP([]byte{127, 0, 0, 2}),
 		port:       9000,
+		address:    "127.0.0.2:9000",
 		timestamp:  timestamp,
+		clock:      defaultCluster.clock,
 		pingMillis: PingNoData}
 
 	message := message{
@@ -196,13 +208,13 @@ func TestEncodeDecode1MemberBroadcast(t *testing.T) {
 		index:  42}
 	message.addBroadcast(&broadcast)
 
-	if message.broadcast == nil {
+	if len(message.broadcasts) != 1 {
 		t.Error("Broadcast not set properly")
 	}
 
 	ip := net.IP([]byte{127, 0, 0, 1})
 	bytes := message.encode()
-	decoded, err := decodeMessage(ip, bytes)
+	decoded, err := defaultCluster.decodeMessage(ip, bytes)
 	decoded.sender.timestamp = timestamp
 	decoded.members[0].node.timestamp = timestamp
 
@@ -210,16 +222,351 @@ func TestEncodeDecode1MemberBroadcast(t *testing.T) {
 		t.Error(err)
 	}
 
-	if decoded.broadcast == nil {
-		t.Error("Broadcast not decoded")
+	if len(decoded.broadcasts) != 1 {
+		t.Fatal("Broadcast not decoded")
 	}
 
-	message.broadcast.origin = nil
-	decoded.broadcast.origin = nil
+	message.broadcasts[0].origin = nil
+	decoded.broadcasts[0].origin = nil
 
-	if !reflect.DeepEqual(message.broadcast, decoded.broadcast) {
+	if !reflect.DeepEqual(message.broadcasts[0], decoded.broadcasts[0]) {
 		t.Error("Broadcasts do not match:")
-		t.Error(" Input bcast:", message.broadcast)
-		t.Error("Output bcast:", decoded.broadcast)
+		t.Error(" Input bcast:", message.broadcasts[0])
+		t.Error("Output bcast:", decoded.broadcasts[0])
 	}
 }
+
+// Encode and decode a message whose sender, member and broadcast origin all
+// have IPv6 addresses, and see if the input/output match.
+func TestEncodeDecodeMessageIPv6(t *testing.T) {
+	timestamp := time.Unix(87878, 787000000)
+
+	sender := Node{
+		ip:         net.ParseIP("2001:db8::1"),
+		port:       1234,
+		timestamp:  timestamp,
+		clock:      defaultCluster.clock,
+		pingMillis: PingNoData}
+
+	member := Node{
+		ip:         net.ParseIP("2001:db8::2"),
+		port:       9000,
+		timestamp:  timestamp,
+		clock:      defaultCluster.clock,
+		pingMillis: PingNoData}
+
+	message := message{
+		sender:          &sender,
+		senderHeartbeat: 255,
+		verb:            verbPing}
+	message.addMember(&member, StatusAlive, 38)
+
+	broadcast := Broadcast{
+		bytes:  []byte("This is a message"),
+		origin: &sender,
+		index:  42}
+	message.addBroadcast(&broadcast)
+
+	// The source IP differs from the stated sender address; the stated
+	// address should win.
+	bytes := message.encode()
+	decoded, err := defaultCluster.decodeMessage(net.ParseIP("2001:db8::99"), bytes)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if decoded.sender.Address() != "[2001:db8::1]:1234" {
+		t.Error("Unexpected sender address:", decoded.sender.Address())
+	}
+
+	if len(decoded.members) != 1 ||
+		decoded.members[0].node.Address() != "[2001:db8::2]:9000" ||
+		decoded.members[0].heartbeat != 38 ||
+		decoded.members[0].status != StatusAlive {
+		t.Error("Members do not match:", decoded.members)
+	}
+
+	if len(decoded.broadcasts) != 1 ||
+		decoded.broadcasts[0].Label() != "[2001:db8::1]:1234:42" ||
+		string(decoded.broadcasts[0].Bytes()) != "This is a message" {
+		t.Error("Broadcasts do not match:", decoded.broadcasts)
+	}
+}
+
+// A message with an unknown layout version must be rejected.
+func TestDecodeBadVersion(t *testing.T) {
+	bytes := message1a.encode()
+	bytes[4] = messageVersion + 1
+	encodeUint32(adler32.Checksum(bytes[4:]), bytes, 0)
+
+	_, err := defaultCluster.decodeMessage(net.IP([]byte{127, 0, 0, 1}), bytes)
+	if err == nil {
+		t.Error("Expected an error for an unknown message version")
+	}
+}
+
+// Sender and member incarnations must survive an encode/decode round trip.
+func TestEncodeDecodeIncarnation(t *testing.T) {
+	sender := Node{
+		ip:          net.IP([]byte{127, 0, 0, 1}),
+		port:        1234,
+		incarnation: 7,
+		pingMillis:  PingNoData}
+
+	member := Node{
+		ip:          net.IP([]byte{127, 0, 0, 3}),
+		port:        9000,
+		incarnation: 11,
+		pingMillis:  PingNoData}
+
+	message := newMessage(verbPing, &sender, 255)
+	message.addMember(&member, StatusSuspected, 38)
+
+	bytes := message.encode()
+	decoded, err := defaultCluster.decodeMessage(net.IP([]byte{127, 0, 0, 1}), bytes)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if decoded.senderIncarnation != 7 {
+		t.Error("Unexpected sender incarnation:", decoded.senderIncarnation)
+	}
+
+	if decoded.members[0].incarnation != 11 ||
+		decoded.members[0].status != StatusSuspected {
+		t.Error("Unexpected member:", decoded.members[0])
+	}
+}
+
+// Messages from a cluster with a different name must be rejected and counted.
+func TestDecodeForeignCluster(t *testing.T) {
+	ours := NewCluster(&Config{ClusterName: "ours"})
+	theirs := NewCluster(&Config{ClusterName: "theirs"})
+
+	message := newMessage(verbPing, message1a.sender, 1)
+	message.clusterHash = theirs.clusterHash()
+	bytes := message.encode()
+
+	if _, err := theirs.decodeMessage(net.IP([]byte{127, 0, 0, 1}), bytes); err != nil {
+		t.Error("Unexpected error from own cluster:", err)
+	}
+
+	if _, err := ours.decodeMessage(net.IP([]byte{127, 0, 0, 1}), bytes); err == nil {
+		t.Error("Expected an error for a foreign cluster")
+	}
+
+	if ours.ForeignClusterPackets() != 1 {
+		t.Error("Expected 1 foreign packet, got", ours.ForeignClusterPackets())
+	}
+}
+
+// The cluster hash is worked out when the configuration is resolved, and
+// the default cluster's follows SetClusterName().
+func TestClusterHash(t *testing.T) {
+	if hash := NewCluster(&Config{}).clusterHash(); hash != 0 {
+		t.Error("expected an unnamed cluster's hash to be 0, got", hash)
+	}
+
+	if hash := NewCluster(&Config{ClusterName: "ours"}).clusterHash(); hash != hashClusterName("ours") {
+		t.Error("unexpected hash", hash)
+	}
+
+	SetClusterName("renamed")
+	defer SetClusterName(DefaultClusterName)
+
+	if hash := defaultCluster.clusterHash(); hash != hashClusterName("renamed") {
+		t.Error("default cluster's hash not updated, got", hash)
+	}
+}
+
+// A message can carry several broadcasts, and encodedLength() must agree
+// with what encode() produces.
+func TestEncodeDecodeManyBroadcasts(t *testing.T) {
+	sender, _ := CreateNodeByIP(net.ParseIP("10.0.0.1"), 9999)
+	msg := newMessage(verbAck, sender, 7)
+	msg.addMember(sender, StatusAlive, 7)
+
+	for i := uint32(1); i <= 3; i++ {
+		msg.addBroadcast(&Broadcast{
+			bytes:  []byte{byte(i), byte(i)},
+			origin: sender,
+			index:  i})
+	}
+
+	bytes := msg.encode()
+	if len(bytes) != msg.encodedLength() {
+		t.Errorf("encoded %d bytes, expected %d", len(bytes), msg.encodedLength())
+	}
+
+	decoded, err := defaultCluster.decodeMessage(sender.IP(), bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(decoded.members) != 1 || len(decoded.broadcasts) != 3 {
+		t.Fatalf("decoded %d members and %d broadcasts",
+			len(decoded.members), len(decoded.broadcasts))
+	}
+
+	for i, b := range decoded.broadcasts {
+		if b.Index() != uint32(i+1) || b.Bytes()[0] != byte(i+1) {
+			t.Error("Broadcasts do not match:", b)
+		}
+	}
+}
+
+// packMessage fills a message with as many broadcasts as fit into the
+// maximum message length, and holds the rest back for later messages.
+func TestPackMessage(t *testing.T) {
+	c := NewCluster(&Config{MaxMessageBytes: 300, SecretKeys: [][]byte{}})
+	c.thisHost, _ = CreateNodeByIP(net.ParseIP("10.0.0.1"), 9999)
+	c.AddNode(c.thisHost)
+
+	recipient, _ := CreateNodeByIP(net.ParseIP("10.0.0.2"), 9999)
+	c.AddNode(recipient)
+
+	for i := 0; i < 5; i++ {
+		c.queueBroadcast(broadcastUser, make([]byte, 100))
+	}
+
+	sent := make(map[string]bool)
+	for n := 0; len(sent) < 5; n++ {
+		if n == 5 {
+			t.Fatalf("only %d of 5 broadcasts sent", len(sent))
+		}
+
+		msg := newMessage(verbPing, c.thisHost, 1)
+		c.packMessage(&msg, recipient)
+
+		if msg.encodedLength() > 300 {
+			t.Errorf("message of %d bytes exceeds the maximum", msg.encodedLength())
+		}
+
+		if len(msg.broadcasts) != 2 {
+			t.Errorf("expected 2 broadcasts per message, got %d", len(msg.broadcasts))
+		}
+
+		for _, b := range msg.broadcasts {
+			sent[b.Label()] = true
+		}
+	}
+
+	// A broadcast too large for any message is still sent, alone.
+	c.queueBroadcast(broadcastUser, make([]byte, 400))
+
+	msg := newMessage(verbPing, c.thisHost, 1)
+	c.packMessage(&msg, recipient)
+
+	if len(msg.broadcasts) != 1 || len(msg.broadcasts[0].bytes) != 400 {
+		t.Error("oversized broadcast was not sent")
+	}
+}
+
+// Returns a copy of a (possibly truncated) encoded message with its checksum
+// recalculated, so that decoding gets past the checksum.
+func withChecksum(bytes []byte) []byte {
+	bytes = append([]byte(nil), bytes...)
+	encodeUint32(adler32.Checksum(bytes[4:]), bytes, 0)
+
+	return bytes
+}
+
+// A message from an IPv6 sender, cut short anywhere in its header, is
+// rejected rather than read past its end.
+func TestDecodeTruncatedIPv6Sender(t *testing.T) {
+	sender := Node{
+		ip:         net.ParseIP("2001:db8::1"),
+		port:       1234,
+		pingMillis: PingNoData}
+
+	message := message{
+		sender:          &sender,
+		senderHeartbeat: 255,
+		verb:            verbPing}
+
+	bytes := message.encode()
+	ip := net.IP([]byte{127, 0, 0, 1})
+
+	for n := 4; n < len(bytes); n++ {
+		if _, err := defaultCluster.decodeMessage(ip, withChecksum(bytes[:n])); err == nil {
+			t.Errorf("expected an error for a message truncated to %d bytes", n)
+		}
+	}
+
+	if _, err := defaultCluster.decodeMessage(ip, bytes); err != nil {
+		t.Error(err)
+	}
+}
+
+// A message carrying a member with metadata and a broadcast, cut short
+// anywhere, is rejected rather than read past its end.
+func TestDecodeTruncatedMessage(t *testing.T) {
+	sender := Node{ip: net.ParseIP("2001:db8::1"), port: 1234}
+	member := Node{
+		ip:              net.ParseIP("2001:db8::2"),
+		port:            9000,
+		metadata:        []byte{1, 'k', 1, 'v'},
+		metadataVersion: 2}
+
+	message := newMessage(verbPing, &sender, 255)
+	message.addMember(&member, StatusAlive, 38)
+	message.addBroadcast(&Broadcast{
+		bytes:  []byte("This is a message"),
+		topic:  "topic",
+		origin: &sender,
+		index:  42})
+
+	bytes := message.encode()
+	ip := net.IP([]byte{127, 0, 0, 1})
+
+	for n := 4; n < len(bytes); n++ {
+		if _, err := defaultCluster.decodeMessage(ip, withChecksum(bytes[:n])); err == nil {
+			t.Errorf("expected an error for a message truncated to %d bytes", n)
+		}
+	}
+
+	decoded, err := defaultCluster.decodeMessage(ip, bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(decoded.members) != 1 || len(decoded.broadcasts) != 1 {
+		t.Errorf("expected 1 member and 1 broadcast, got %d and %d",
+			len(decoded.members), len(decoded.broadcasts))
+	}
+}
+
+// Random packets that get past the checksum, version and cluster checks
+// never crash the decoder.
+func FuzzDecodeMessage(f *testing.F) {
+	SetLogThreshold(LogFatal)
+	defer SetLogThreshold(LogInfo)
+
+	sender := Node{ip: net.ParseIP("2001:db8::1"), port: 1234}
+	member := Node{ip: net.IP([]byte{10, 0, 0, 2}), port: 9000, metadata: []byte{1, 'k', 0}}
+
+	seed := newMessage(verbAck, &sender, 7)
+	seed.addMember(&member, StatusSuspected, 3)
+	seed.addBroadcast(&Broadcast{bytes: []byte("hi"), origin: &sender, index: 1})
+	seed.coordinate = NewCoordinate()
+
+	f.Add(seed.encode()[4:])
+	f.Add(message1a.encode()[4:])
+	f.Add([]byte{messageVersion, 0, 0, 0, 0, byte(verbPing), 1, 1, addressFamilyIPv6})
+
+	ip := net.IP([]byte{127, 0, 0, 1})
+
+	f.Fuzz(func(t *testing.T, body []byte) {
+		if len(body) > 0 {
+			body[0] = messageVersion
+		}
+
+		if len(body) > 4 {
+			encodeUint32(0, body, 1)
+		}
+
+		defaultCluster.decodeMessage(ip, withChecksum(append(make([]byte, 4), body...)))
+	})
+}
@@ -0,0 +1,168 @@
+/*
+Copyright 2016 The Smudge Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package smudge
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// Each node may carry a small set of key/value metadata (roles, datacenter,
+// version, service ports and so on), which is gossiped along with its status
+// in every member update and full state exchange.
+//
+// Metadata is versioned so that newer metadata always replaces older. Only a
+// node may change its own metadata, and whenever it does (or whenever it
+// refutes a suspicion) it advances its incarnation and sets its metadata
+// version to incarnation + 1. This means a restarted node's metadata will
+// replace whatever the cluster remembers from before the restart as soon as
+// it refutes its old status. A version of 0 means no metadata is known.
+
+// MaxMetadataBytes is the maximum encoded size of a node's metadata. Each key
+// and value takes its length plus one byte.
+const MaxMetadataBytes = 256
+
+/******************************************************************************
+ * Exported functions (for public consumption)
+ *****************************************************************************/
+
+// SetLocalMetadata sets the metadata of this host in the default cluster.
+// See Cluster.SetLocalMetadata().
+func SetLocalMetadata(metadata map[string]string) error {
+	return defaultCluster.SetLocalMetadata(metadata)
+}
+
+// SetLocalMetadata replaces the metadata of this host, which will be
+// propagated to the rest of the cluster. It may be called before or after
+// the server is started. An error is returned if any key or value is longer
+// than 255 bytes, or if the encoded metadata exceeds MaxMetadataBytes.
+func (c *Cluster) SetLocalMetadata(metadata map[string]string) error {
+	bytes, err := encodeMetadata(metadata)
+	if err != nil {
+		return err
+	}
+
+	c.localMetadata = bytes
+
+	if c.thisHost != nil {
+		emitCount := int8(c.emitCount())
+
+		c.thisHost.mutex.Lock()
+		c.thisHost.incarnation++
+		c.thisHost.metadata = bytes
+		c.thisHost.metadataVersion = c.thisHost.incarnation + 1
+		c.thisHost.emitCounter = emitCount
+		c.thisHost.mutex.Unlock()
+
+		if !c.updatedNodes.contains(c.thisHost) {
+			c.updatedNodes.add(c.thisHost)
+		}
+
+		c.doMetadataUpdate(c.thisHost)
+	}
+
+	return nil
+}
+
+/******************************************************************************
+ * Private functions (for internal use only)
+ *****************************************************************************/
+
+// encodeMetadata encodes a metadata map as a sequence of key/value pairs,
+// sorted by key, each encoded as a 1-byte length followed by its bytes. An
+// empty map encodes to nil.
+func encodeMetadata(metadata map[string]string) ([]byte, error) {
+	if len(metadata) == 0 {
+		return nil, nil
+	}
+
+	keys := make([]string, 0, len(metadata))
+	size := 0
+
+	for k, v := range metadata {
+		if len(k) > 255 || len(v) > 255 {
+			return nil, fmt.Errorf("metadata key or value for %q is too long", k)
+		}
+
+		keys = append(keys, k)
+		size += 2 + len(k) + len(v)
+	}
+
+	if size > MaxMetadataBytes {
+		return nil, fmt.Errorf("metadata of %d bytes exceeds maximum of %d",
+			size, MaxMetadataBytes)
+	}
+
+	sort.Strings(keys)
+
+	bytes := make([]byte, size, size)
+	p := 0
+
+	for _, k := range keys {
+		p += encodeByte(byte(len(k)), bytes, p)
+		p += copy(bytes[p:], k)
+		p += encodeByte(byte(len(metadata[k])), bytes, p)
+		p += copy(bytes[p:], metadata[k])
+	}
+
+	return bytes, nil
+}
+
+// decodeMetadata decodes metadata encoded by encodeMetadata().
+func decodeMetadata(bytes []byte) (map[string]string, error) {
+	metadata := make(map[string]string)
+
+	for p := 0; p < len(bytes); {
+		var strs []string
+		var ok bool
+
+		if strs, p, ok = decodeShortStrings(bytes, p, 2); !ok {
+			return nil, errors.New("metadata is truncated")
+		}
+
+		metadata[strs[0]] = strs[1]
+	}
+
+	return metadata, nil
+}
+
+// mergeMetadata applies a member's metadata to its node if it's newer than
+// what we already know, and notifies the metadata listeners if it changed.
+func (c *Cluster) mergeMetadata(m *messageMember) {
+	current, version := m.node.getMetadata()
+	if m.metadataVersion <= version {
+		return
+	}
+
+	if _, err := decodeMetadata(m.metadata); err != nil {
+		logfWarn("Ignoring bad metadata for %s: %v\n", m.node.Address(), err)
+		return
+	}
+
+	changed := string(m.metadata) != string(current)
+
+	m.node.setMetadata(m.metadata, m.metadataVersion)
+
+	if changed {
+		logfDebug("Updated metadata for %s at version %d\n",
+			m.node.Address(),
+			m.metadataVersion)
+
+		c.doMetadataUpdate(m.node)
+	}
+}
@@ -0,0 +1,148 @@
+/*
+Copyright 2016 The Smudge Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package smudge
+
+import (
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestEncodeDecodeMetadata(t *testing.T) {
+	metadata := map[string]string{
+		"role": "cache",
+		"dc":   "us-east-1",
+		"":     "empty key",
+		"port": "",
+	}
+
+	bytes, err := encodeMetadata(metadata)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	decoded, err := decodeMetadata(bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(metadata, decoded) {
+		t.Errorf("expected %v, got %v", metadata, decoded)
+	}
+
+	if _, err = decodeMetadata(bytes[:len(bytes)-1]); err == nil {
+		t.Error("expected an error decoding truncated metadata")
+	}
+}
+
+func TestEncodeMetadataTooLarge(t *testing.T) {
+	if _, err := encodeMetadata(map[string]string{"k": strings.Repeat("v", 256)}); err == nil {
+		t.Error("expected an error for a long value")
+	}
+
+	metadata := map[string]string{
+		"a": strings.Repeat("v", 200),
+		"b": strings.Repeat("v", 200),
+	}
+
+	if _, err := encodeMetadata(metadata); err == nil {
+		t.Error("expected an error for oversized metadata")
+	}
+}
+
+// Metadata survives a round trip through the message encoding.
+func TestEncodeDecodeMessageMetadata(t *testing.T) {
+	sender, _ := CreateNodeByIP(net.ParseIP("10.0.0.1"), 9999)
+	member, _ := CreateNodeByIP(net.ParseIP("10.0.0.2"), 9999)
+	member.metadata, _ = encodeMetadata(map[string]string{"role": "db"})
+	member.metadataVersion = 3
+
+	msg := newMessage(verbPing, sender, 1)
+	msg.addMember(member, StatusAlive, 1)
+
+	decoded, err := NewCluster(nil).decodeMessage(sender.IP(), msg.encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(decoded.members) != 1 {
+		t.Fatalf("expected 1 member, got %d", len(decoded.members))
+	}
+
+	m := decoded.members[0]
+	if m.metadataVersion != 3 {
+		t.Errorf("metadata version %d != 3", m.metadataVersion)
+	}
+
+	if string(m.metadata) != string(member.metadata) {
+		t.Errorf("metadata %v != %v", m.metadata, member.metadata)
+	}
+}
+
+// Newer metadata replaces older metadata, and subscribers are notified; older
+// metadata is ignored.
+func TestMergeMetadata(t *testing.T) {
+	c, remote := newSuspicionTestCluster()
+
+	sub := c.Subscribe(&SubscribeOptions{Types: []EventType{MetadataChanged}})
+	defer sub.Unsubscribe()
+
+	update := func(version uint32, metadata map[string]string) {
+		m := newMessageMember(remote, StatusAlive, remote.heartbeat)
+		m.metadata, _ = encodeMetadata(metadata)
+		m.metadataVersion = version
+
+		c.mergeMembers([]*messageMember{m})
+	}
+
+	update(2, map[string]string{"role": "web"})
+	update(1, map[string]string{"role": "stale"})
+
+	expected := map[string]string{"role": "web"}
+	if !reflect.DeepEqual(remote.Metadata(), expected) {
+		t.Errorf("expected %v, got %v", expected, remote.Metadata())
+	}
+
+	events := bufferedEvents(sub)
+	if len(events) != 1 || events[0].Node != remote || !reflect.DeepEqual(events[0].Metadata, expected) {
+		t.Errorf("unexpected metadata events: %+v", events)
+	}
+}
+
+// Setting local metadata advances this host's incarnation and queues it to
+// be gossiped.
+func TestSetLocalMetadata(t *testing.T) {
+	c, _ := newSuspicionTestCluster()
+
+	if err := c.SetLocalMetadata(map[string]string{"dc": "eu"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if c.thisHost.Incarnation() != 1 || c.thisHost.metadataVersion != 2 {
+		t.Errorf("incarnation=%d version=%d",
+			c.thisHost.Incarnation(), c.thisHost.metadataVersion)
+	}
+
+	if !c.updatedNodes.contains(c.thisHost) {
+		t.Error("this host not queued for gossip")
+	}
+
+	if c.thisHost.Metadata()["dc"] != "eu" {
+		t.Error("metadata not set:", c.thisHost.Metadata())
+	}
+}
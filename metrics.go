@@ -0,0 +1,156 @@
+/*
+Copyright 2016 The Smudge Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package smudge
+
+import "strings"
+
+// The names of the metrics that a cluster reports to its Metrics sink.
+const (
+	// MetricPacketsSent counts the packets sent, labeled by verb.
+	MetricPacketsSent = "smudge_packets_sent_total"
+
+	// MetricBytesSent counts the bytes sent in packets, labeled by verb.
+	MetricBytesSent = "smudge_bytes_sent_total"
+
+	// MetricPacketsReceived counts the packets received and successfully
+	// decoded, labeled by verb.
+	MetricPacketsReceived = "smudge_packets_received_total"
+
+	// MetricBytesReceived counts the bytes received in successfully decoded
+	// packets, labeled by verb.
+	MetricBytesReceived = "smudge_bytes_received_total"
+
+	// MetricDecodeFailures counts the packets that were dropped because they
+	// couldn't be decoded, labeled by reason: "unauthenticated", "short",
+	// "checksum", "version", "cluster" or "malformed".
+	MetricDecodeFailures = "smudge_decode_failures_total"
+
+	// MetricProbeTimeouts counts the probes that went unanswered, labeled by
+	// type: "ping", "pingreq" or "nfp".
+	MetricProbeTimeouts = "smudge_probe_timeouts_total"
+
+	// MetricIndirectProbes counts the PINGREQs sent to other members, asking
+	// them to probe a member that didn't answer a PING.
+	MetricIndirectProbes = "smudge_indirect_probes_total"
+
+	// MetricStatusTransitions counts the changes in known members' statuses,
+	// labeled by the previous status ("from") and the new one ("to").
+	MetricStatusTransitions = "smudge_status_transitions_total"
+
+	// MetricMembers is a gauge of the number of known members, labeled by
+	// status.
+	MetricMembers = "smudge_members"
+
+	// MetricBroadcastQueueDepth is a gauge of the number of broadcasts still
+	// being piggybacked onto outgoing messages.
+	MetricBroadcastQueueDepth = "smudge_broadcast_queue_depth"
+
+	// MetricRTT is a histogram of PING round-trip times, in milliseconds.
+	MetricRTT = "smudge_rtt_milliseconds"
+)
+
+// Label is a name/value pair that distinguishes one series of a metric from
+// another.
+type Label struct {
+	Name  string
+	Value string
+}
+
+// Metrics is the interface for a sink that receives measurements of a
+// cluster's activity, such as packet counts, probe timeouts and round-trip
+// times. Its methods are called from the cluster's goroutines, often while
+// it holds locks, so they must be safe for concurrent use and must not
+// block. See PrometheusMetrics for a built-in implementation.
+type Metrics interface {
+	// IncrCounter adds delta to the named counter.
+	IncrCounter(name string, labels []Label, delta float64)
+
+	// SetGauge sets the named gauge to value.
+	SetGauge(name string, labels []Label, value float64)
+
+	// Observe adds a sample to the named histogram.
+	Observe(name string, labels []Label, value float64)
+}
+
+// The metrics sink used by clusters that don't configure their own.
+var metrics Metrics
+
+/******************************************************************************
+ * Exported functions (for public consumption)
+ *****************************************************************************/
+
+// GetMetrics returns the metrics sink used by clusters whose Config doesn't
+// specify one, or nil if metrics are discarded.
+func GetMetrics() Metrics {
+	return metrics
+}
+
+// SetMetrics sets the metrics sink used by clusters whose Config doesn't
+// specify one. A nil sink discards all metrics. It should be called before
+// the cluster is started.
+func SetMetrics(m Metrics) {
+	metrics = m
+}
+
+// Metrics returns this cluster's metrics sink. Measurements are discarded
+// if no sink has been set, either in the Config or by SetMetrics().
+func (c *Cluster) Metrics() Metrics {
+	if c.config.Metrics != nil {
+		return c.config.Metrics
+	}
+
+	if metrics != nil {
+		return metrics
+	}
+
+	return discardMetrics{}
+}
+
+/******************************************************************************
+ * Private functions (for internal use only)
+ *****************************************************************************/
+
+// discardMetrics is a Metrics sink that discards everything.
+type discardMetrics struct{}
+
+func (discardMetrics) IncrCounter(string, []Label, float64) {}
+
+func (discardMetrics) SetGauge(string, []Label, float64) {}
+
+func (discardMetrics) Observe(string, []Label, float64) {}
+
+// noteDecodeFailure counts a received packet that was dropped for the given
+// reason.
+func (c *Cluster) noteDecodeFailure(reason string) {
+	c.Metrics().IncrCounter(MetricDecodeFailures, []Label{{"reason", reason}}, 1)
+}
+
+// reportMemberCounts sets the member count gauges. It's called whenever a
+// member is added or removed, or its status changes.
+func (c *Cluster) reportMemberCounts() {
+	m := c.Metrics()
+
+	for _, status := range []NodeStatus{StatusAlive, StatusSuspected, StatusDead, StatusLeft} {
+		m.SetGauge(MetricMembers, []Label{{"status", statusLabel(status)}},
+			float64(c.knownNodes.lengthWithStatus(status)))
+	}
+}
+
+// statusLabel returns the label value for a status: its name in lower case.
+func statusLabel(status NodeStatus) string {
+	return strings.ToLower(status.String())
+}
@@ -0,0 +1,110 @@
+/*
+Copyright 2016 The Smudge Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package smudge
+
+import (
+	"net"
+	"testing"
+)
+
+// Returns the current value of a counter or gauge series.
+func metricValue(m *PrometheusMetrics, name string, labels ...Label) float64 {
+	m.Lock()
+	defer m.Unlock()
+
+	if s, ok := m.series[name][encodePromLabels(labels)]; ok {
+		return s.value
+	}
+
+	return 0
+}
+
+// Answering a PING is reflected in the packet, status and member metrics,
+// and a packet that can't be decoded is counted by reason.
+func TestClusterMetrics(t *testing.T) {
+	SetLogThreshold(LogWarn)
+	defer SetLogThreshold(LogInfo)
+
+	m := NewPrometheusMetrics()
+	network := &chanNetwork{members: make(map[string]*chanTransport)}
+
+	c := newSyncTestCluster(19211)
+	c.config.Metrics = m
+	c.transport = &chanTransport{network: network}
+	if err := c.transport.Listen(c.thisHost.IP(), int(c.thisHost.Port())); err != nil {
+		t.Fatal(err)
+	}
+
+	remoteIP := net.IP([]byte{127, 0, 0, 2})
+	remoteTransport := &chanTransport{network: network}
+	if err := remoteTransport.Listen(remoteIP, 19211); err != nil {
+		t.Fatal(err)
+	}
+
+	remote, _ := CreateNodeByIP(remoteIP, 19211)
+	ping := newMessage(verbPing, remote, 7)
+	ping.clusterHash = c.clusterHash()
+
+	if err := c.receiveMessageUDP(remoteIP, ping.encode()); err != nil {
+		t.Fatal(err)
+	}
+
+	if v := metricValue(m, MetricPacketsReceived, Label{"verb", "ping"}); v != 1 {
+		t.Error("expected 1 PING received, got", v)
+	}
+
+	if v := metricValue(m, MetricPacketsSent, Label{"verb", "ack"}); v != 1 {
+		t.Error("expected 1 ACK sent, got", v)
+	}
+
+	if v := metricValue(m, MetricBytesSent, Label{"verb", "ack"}); v == 0 {
+		t.Error("expected ACK bytes to be counted")
+	}
+
+	transition := []Label{{"from", "unknown"}, {"to", "alive"}}
+	if v := metricValue(m, MetricStatusTransitions, transition...); v != 1 {
+		t.Error("expected 1 transition to alive, got", v)
+	}
+
+	if v := metricValue(m, MetricMembers, Label{"status", "alive"}); v != 2 {
+		t.Error("expected 2 alive members, got", v)
+	}
+
+	if err := c.receiveMessageUDP(remoteIP, []byte{1, 2, 3}); err == nil {
+		t.Error("expected an error for a short message")
+	}
+
+	if v := metricValue(m, MetricDecodeFailures, Label{"reason", "short"}); v != 1 {
+		t.Error("expected 1 short message, got", v)
+	}
+}
+
+// A cluster without a configured sink uses the package one, if set.
+func TestMetricsDefault(t *testing.T) {
+	c := NewCluster(nil)
+	if _, ok := c.Metrics().(discardMetrics); !ok {
+		t.Errorf("expected metrics to be discarded, got %T", c.Metrics())
+	}
+
+	m := NewPrometheusMetrics()
+	SetMetrics(m)
+	defer SetMetrics(nil)
+
+	if c.Metrics() != m {
+		t.Error("package metrics sink not used")
+	}
+}
@@ -17,8 +17,9 @@ limitations under the License.
 package smudge
 
 import (
-	"fmt"
 	"net"
+	"strconv"
+	"sync"
 	"time"
 )
 
@@ -32,16 +33,41 @@ const (
 	PingTimedOut int = -2
 )
 
-// Node represents a single node in the cluster.
+// Node represents a single node in the cluster. Its accessors are safe to
+// call while the cluster that knows it is running.
 type Node struct {
+	// Guards every field below except ip, port and address, which never
+	// change once the node is created.
+	mutex sync.RWMutex
+
 	ip          net.IP
 	port        uint16
-	timestamp   uint32
+	timestamp   time.Time
+	clock       Clock
 	address     string
 	pingMillis  int
+	rtt         *pingData
+	coordinate  *Coordinate
 	status      NodeStatus
 	emitCounter int8
 	heartbeat   uint32
+	incarnation uint32
+
+	metadata        []byte
+	metadataVersion uint32
+}
+
+// NodeSnapshot is a copy of a node's state, all taken at the same moment.
+type NodeSnapshot struct {
+	Address     string
+	IP          net.IP
+	Port        uint16
+	Status      NodeStatus
+	PingMillis  int
+	AgeMillis   uint32
+	Heartbeat   uint32
+	Incarnation uint32
+	Metadata    map[string]string
 }
 
 // Address rReturns the address for this node in string format, which is simply
@@ -49,63 +75,253 @@ type Node struct {
 // throughout the code base.
 func (n *Node) Address() string {
 	if n.address == "" {
-		n.address = nodeAddressString(n.ip, n.port)
+		return nodeAddressString(n.ip, n.port)
 	}
 
 	return n.address
 }
 
-// Age returns the time since we last heard from this node, in milliseconds.
+// Age returns the time since we last heard from this node, in milliseconds,
+// as measured by the clock of the cluster that knows it (or by the system
+// clock, if no cluster has touched it yet).
 func (n *Node) Age() uint32 {
-	return GetNowInMillis() - n.timestamp
+	n.mutex.RLock()
+	defer n.mutex.RUnlock()
+
+	return uint32(n.now().Sub(n.timestamp) / time.Millisecond)
 }
 
 // EmitCounter returns the number of times remaining that current status
 // will be emitted by this node to other nodes.
 func (n *Node) EmitCounter() int8 {
+	n.mutex.RLock()
+	defer n.mutex.RUnlock()
+
 	return n.emitCounter
 }
 
+// Heartbeat returns the heartbeat counter value this node last reported.
+// A node's heartbeat advances as it pings other members.
+func (n *Node) Heartbeat() uint32 {
+	n.mutex.RLock()
+	defer n.mutex.RUnlock()
+
+	return n.heartbeat
+}
+
+// Incarnation returns this node's incarnation number. Only a node may
+// increment its own incarnation, which it does to refute claims that it is
+// suspected or dead. Status updates with a higher incarnation supersede
+// those with a lower one.
+func (n *Node) Incarnation() uint32 {
+	n.mutex.RLock()
+	defer n.mutex.RUnlock()
+
+	return n.incarnation
+}
+
+// Coordinate returns a copy of this node's network coordinate, or nil if it
+// isn't known yet. See EstimateRTT().
+func (n *Node) Coordinate() *Coordinate {
+	n.mutex.RLock()
+	defer n.mutex.RUnlock()
+
+	if coordinate := n.coordinate; coordinate != nil {
+		c := *coordinate
+		return &c
+	}
+
+	return nil
+}
+
 // IP returns the IP associated with this node.
 func (n *Node) IP() net.IP {
 	return n.ip
 }
 
+// Metadata returns a copy of this node's metadata, as set by the node with
+// SetLocalMetadata(). It's empty if the node has none, or if it hasn't yet
+// reached us.
+func (n *Node) Metadata() map[string]string {
+	encoded, _ := n.getMetadata()
+
+	metadata, _ := decodeMetadata(encoded)
+	if metadata == nil {
+		metadata = make(map[string]string)
+	}
+
+	return metadata
+}
+
 // PingMillis returns the milliseconds transpired between the most recent
 // PING to this node and its responded ACK. If this node has not yet been
 // pinged, this vaue will be PingNoData (-1). If this node's last PING timed
 // out, this value will be PingTimedOut (-2).
 func (n *Node) PingMillis() int {
+	n.mutex.RLock()
+	defer n.mutex.RUnlock()
+
 	return n.pingMillis
 }
 
+// RTT returns statistics on the recent round-trip times of the PINGs sent to
+// this node, and how many of them timed out. If this node has never been
+// pinged, all of them are zero.
+func (n *Node) RTT() RTTStats {
+	n.mutex.RLock()
+	defer n.mutex.RUnlock()
+
+	if rtt := n.rtt; rtt != nil {
+		return rtt.stats()
+	}
+
+	return RTTStats{}
+}
+
 // Port returns the port associated with this node.
 func (n *Node) Port() uint16 {
 	return n.port
 }
 
+// Snapshot returns a copy of this node's state. Unlike calling each accessor
+// in turn, it can't mix values from before and after an update.
+func (n *Node) Snapshot() NodeSnapshot {
+	n.mutex.RLock()
+
+	snapshot := NodeSnapshot{
+		Address:     n.Address(),
+		IP:          n.ip,
+		Port:        n.port,
+		Status:      n.status,
+		PingMillis:  n.pingMillis,
+		AgeMillis:   uint32(n.now().Sub(n.timestamp) / time.Millisecond),
+		Heartbeat:   n.heartbeat,
+		Incarnation: n.incarnation,
+	}
+	encoded := n.metadata
+
+	n.mutex.RUnlock()
+
+	snapshot.Metadata, _ = decodeMetadata(encoded)
+	if snapshot.Metadata == nil {
+		snapshot.Metadata = make(map[string]string)
+	}
+
+	return snapshot
+}
+
 // Status returns this node's current status.
 func (n *Node) Status() NodeStatus {
+	n.mutex.RLock()
+	defer n.mutex.RUnlock()
+
 	return n.status
 }
 
 // Timestamp returns the timestamp of this node's last ping or status update,
 // in milliseconds from the epoch
 func (n *Node) Timestamp() uint32 {
-	return n.timestamp
+	n.mutex.RLock()
+	defer n.mutex.RUnlock()
+
+	return uint32(n.timestamp.UnixNano() / int64(time.Millisecond))
 }
 
-// Touch updates the timestamp to the local time in milliseconds.
+// Touch updates the timestamp to the current time, on the same clock as
+// Age().
 func (n *Node) Touch() {
-	n.timestamp = GetNowInMillis()
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	n.timestamp = n.now()
+}
+
+// getMetadata returns this node's encoded metadata and its version.
+func (n *Node) getMetadata() ([]byte, uint32) {
+	n.mutex.RLock()
+	defer n.mutex.RUnlock()
+
+	return n.metadata, n.metadataVersion
+}
+
+// setMetadata replaces this node's encoded metadata and its version.
+func (n *Node) setMetadata(metadata []byte, version uint32) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	n.metadata = metadata
+	n.metadataVersion = version
+}
+
+// setPingMillis records the outcome of the most recent PING to this node.
+func (n *Node) setPingMillis(millis int) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	n.pingMillis = millis
 }
 
+// setRTT replaces this node's round-trip time history.
+func (n *Node) setRTT(rtt *pingData) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	n.rtt = rtt
+}
+
+// setCoordinate replaces this node's network coordinate.
+func (n *Node) setCoordinate(coordinate *Coordinate) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	n.coordinate = coordinate
+}
+
+// decrementEmitCounter counts down one more emission of this node's status.
+func (n *Node) decrementEmitCounter() {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	n.emitCounter--
+}
+
+// touched returns the time of this node's last ping or status update.
+func (n *Node) touched() time.Time {
+	n.mutex.RLock()
+	defer n.mutex.RUnlock()
+
+	return n.timestamp
+}
+
+// now returns the current time on the clock of the cluster that last touched
+// this node, or the system time if none has.
+func (n *Node) now() time.Time {
+	if n.clock != nil {
+		return n.clock.Now()
+	}
+
+	return time.Now()
+}
+
+// nodeAddressString returns "ip:port" for IPv4 addresses and "[ip]:port" for
+// IPv6 addresses.
 func nodeAddressString(ip net.IP, port uint16) string {
-	return fmt.Sprintf("%s:%d", ip, port)
+	return net.JoinHostPort(ip.String(), strconv.FormatUint(uint64(port), 10))
+}
+
+// normalizeIP returns the 4-byte form of an IPv4 address (even if it's
+// stored in its 16-byte form) or the 16-byte form of an IPv6 address, so
+// that equal addresses always have equal representations.
+func normalizeIP(ip net.IP) net.IP {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4
+	}
+
+	return ip.To16()
 }
 
 // GetNowInMillis returns the current local time in milliseconds since the
-// epoch.
+// epoch. Clusters don't use it themselves: they read their own Clock.
 func GetNowInMillis() uint32 {
 	return uint32(time.Now().UnixNano() / int64(time.Millisecond))
 }
@@ -134,6 +134,9 @@ Outer:
 }
 
 func (m *nodeMap) length() int {
+	m.RLock()
+	defer m.RUnlock()
+
 	return len(m.nodes)
 }
 
@@ -142,7 +145,7 @@ func (m *nodeMap) lengthWithStatus(status NodeStatus) int {
 
 	i := 0
 	for _, v := range m.nodes {
-		if v.status == status {
+		if v.Status() == status {
 			i++
 		}
 	}
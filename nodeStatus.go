@@ -32,6 +32,15 @@ const (
 	// StatusForwardTo is a pseudo status used by message to indicate
 	// the target of a ping request.
 	StatusForwardTo
+
+	// StatusSuspected indicates that a node has failed to respond to a direct
+	// or indirect probe. If it doesn't refute the suspicion within the
+	// suspicion timeout it will be declared dead.
+	StatusSuspected
+
+	// StatusLeft indicates that a node has intentionally left the cluster
+	// (see Leave()). Unlike dead nodes, left nodes aren't retried.
+	StatusLeft
 )
 
 func (s NodeStatus) String() string {
@@ -44,7 +53,45 @@ func (s NodeStatus) String() string {
 		return "DEAD"
 	case StatusForwardTo:
 		return "FORWARD_TO"
+	case StatusSuspected:
+		return "SUSPECTED"
+	case StatusLeft:
+		return "LEFT"
 	default:
 		return "UNDEFINED"
 	}
 }
+
+// precedence ranks statuses for the purpose of resolving conflicting updates
+// about a node with the same incarnation: LEFT > DEAD > SUSPECTED > ALIVE.
+// A node that announced its departure shouldn't later be reported as dead
+// just because it stopped answering pings.
+func (s NodeStatus) precedence() int {
+	switch s {
+	case StatusLeft:
+		return 4
+	case StatusDead:
+		return 3
+	case StatusSuspected:
+		return 2
+	case StatusAlive:
+		return 1
+	default:
+		return 0
+	}
+}
+
+// statusSupersedes returns true if an update of status at incarnation should
+// replace a known status at knownIncarnation. A higher incarnation always
+// wins; at equal incarnations the status with the higher precedence wins.
+func statusSupersedes(status NodeStatus, incarnation uint32, knownStatus NodeStatus, knownIncarnation uint32) bool {
+	if knownStatus == StatusUnknown {
+		return true
+	}
+
+	if incarnation != knownIncarnation {
+		return incarnation > knownIncarnation
+	}
+
+	return status.precedence() > knownStatus.precedence()
+}
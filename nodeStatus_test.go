@@ -0,0 +1,66 @@
+/*
+Copyright 2016 The Smudge Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package smudge
+
+import (
+	"testing"
+)
+
+func TestStatusSupersedes(t *testing.T) {
+	cases := []struct {
+		status           NodeStatus
+		incarnation      uint32
+		knownStatus      NodeStatus
+		knownIncarnation uint32
+		expected         bool
+	}{
+		// Anything beats an unknown status
+		{StatusAlive, 0, StatusUnknown, 5, true},
+
+		// Higher incarnation always wins
+		{StatusAlive, 2, StatusDead, 1, true},
+		{StatusAlive, 2, StatusSuspected, 1, true},
+		{StatusDead, 1, StatusAlive, 2, false},
+
+		// At equal incarnation, DEAD > SUSPECTED > ALIVE
+		{StatusDead, 1, StatusSuspected, 1, true},
+		{StatusSuspected, 1, StatusAlive, 1, true},
+		{StatusAlive, 1, StatusSuspected, 1, false},
+		{StatusSuspected, 1, StatusDead, 1, false},
+
+		// A departure isn't overridden by failure detection
+		{StatusLeft, 1, StatusDead, 1, true},
+		{StatusDead, 1, StatusLeft, 1, false},
+		{StatusSuspected, 1, StatusLeft, 1, false},
+		{StatusAlive, 2, StatusLeft, 1, true},
+
+		// Same status and incarnation is not news
+		{StatusAlive, 1, StatusAlive, 1, false},
+	}
+
+	for _, tc := range cases {
+		actual := statusSupersedes(tc.status, tc.incarnation,
+			tc.knownStatus, tc.knownIncarnation)
+
+		if actual != tc.expected {
+			t.Errorf("%s@%d over %s@%d: expected %v",
+				tc.status, tc.incarnation,
+				tc.knownStatus, tc.knownIncarnation,
+				tc.expected)
+		}
+	}
+}
@@ -18,18 +18,51 @@ package smudge
 
 import (
 	"math"
+	"sort"
 	"sync"
 )
 
+// RTTStats summarizes the recent round-trip times of the PINGs sent to a
+// node, as returned by Node.RTT(). All times are in milliseconds.
+type RTTStats struct {
+	// The number of round-trip times actually measured, up to the history
+	// size. Until the history is full, the statistics below are partly
+	// based on the initial estimate.
+	Samples int
+
+	// The mean and standard deviation of the round-trip times.
+	Mean   float64
+	Stddev float64
+
+	// The 50th, 90th and 99th percentiles of the round-trip times.
+	P50 float64
+	P90 float64
+	P99 float64
+
+	// The fraction, from 0 to 1, of recent direct PINGs that timed out.
+	LossRate float64
+}
+
+// pingData is the recent history of round-trip times to a single node, along
+// with the outcomes (answered or timed out) of the most recent PINGs.
 type pingData struct {
 	sync.RWMutex
 
-	// The ping data. Initialized with default values by NewPingData()
+	// The ping data. Initialized with default values by newPingData()
 	pings []uint32
 
 	// The index in pings where the next datapoint will be added
 	pointer int
 
+	// The number of datapoints added, up to len(pings)
+	samples int
+
+	// Whether each recent PING timed out, the index in lost where the next
+	// outcome will be recorded, and the number recorded, up to len(lost)
+	lost         []bool
+	lostPointer  int
+	lostRecorded int
+
 	// The last calulcated mean. Recalculated if updated is true
 	lastMean float64
 
@@ -40,16 +73,25 @@ type pingData struct {
 	updated bool
 }
 
-func newPingData(initialAverage int, historyCount int) pingData {
+func newPingData(initialAverage int, historyCount int) *pingData {
+	if historyCount < 1 {
+		historyCount = 1
+	}
+
 	newPings := make([]uint32, historyCount, historyCount)
 
 	for i := 0; i < historyCount; i++ {
 		newPings[i] = uint32(initialAverage)
 	}
 
-	return pingData{pings: newPings, updated: true}
+	return &pingData{
+		pings:   newPings,
+		lost:    make([]bool, historyCount),
+		updated: true,
+	}
 }
 
+// add records the round-trip time of an answered PING.
 func (pd *pingData) add(datapoint uint32) {
 	pd.Lock()
 
@@ -59,16 +101,28 @@ func (pd *pingData) add(datapoint uint32) {
 	pd.pointer++
 	pd.pointer %= len(pd.pings)
 
+	if pd.samples < len(pd.pings) {
+		pd.samples++
+	}
+
 	pd.updated = true
+	pd.recordOutcome(false)
+
+	pd.Unlock()
+}
 
+// addLoss records a PING that timed out.
+func (pd *pingData) addLoss() {
+	pd.Lock()
+	pd.recordOutcome(true)
 	pd.Unlock()
 }
 
 // mean returns the simple mean (average) of the collected datapoints.
 func (pd *pingData) mean() float64 {
-	pd.data()
+	mean, _ := pd.data()
 
-	return pd.lastMean
+	return mean
 }
 
 // Returns the mean modified by the requested number of sigmas
@@ -80,16 +134,17 @@ func (pd *pingData) nSigma(sigmas float64) float64 {
 
 // stddev returns the standard deviation of the collected datapoints
 func (pd *pingData) stddev() float64 {
-	pd.data()
+	_, stddev := pd.data()
 
-	return pd.lastStddev
+	return stddev
 }
 
 // Returns both mean and standard deviation
 func (pd *pingData) data() (float64, float64) {
-	if pd.updated {
-		pd.Lock()
+	pd.Lock()
+	defer pd.Unlock()
 
+	if pd.updated {
 		// Calculate the mean
 		var accumulator float64
 		for _, d := range pd.pings {
@@ -109,9 +164,78 @@ func (pd *pingData) data() (float64, float64) {
 		pd.lastStddev = math.Sqrt(squareDiffMean)
 
 		pd.updated = false
-
-		pd.Unlock()
 	}
 
 	return pd.lastMean, pd.lastStddev
 }
+
+// percentile returns the smallest datapoint that's at least as large as p
+// percent of them (the nearest-rank method).
+func (pd *pingData) percentile(p float64) float64 {
+	pd.RLock()
+	sorted := make([]uint32, len(pd.pings))
+	copy(sorted, pd.pings)
+	pd.RUnlock()
+
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	rank := int(math.Ceil(p / 100 * float64(len(sorted))))
+	if rank < 1 {
+		rank = 1
+	} else if rank > len(sorted) {
+		rank = len(sorted)
+	}
+
+	return float64(sorted[rank-1])
+}
+
+// lossRate returns the fraction of recent PINGs that timed out.
+func (pd *pingData) lossRate() float64 {
+	pd.RLock()
+	defer pd.RUnlock()
+
+	if pd.lostRecorded == 0 {
+		return 0
+	}
+
+	var count int
+	for i := 0; i < pd.lostRecorded; i++ {
+		if pd.lost[i] {
+			count++
+		}
+	}
+
+	return float64(count) / float64(pd.lostRecorded)
+}
+
+// stats returns a summary of the collected datapoints.
+func (pd *pingData) stats() RTTStats {
+	mean, stddev := pd.data()
+
+	pd.RLock()
+	samples := pd.samples
+	pd.RUnlock()
+
+	return RTTStats{
+		Samples:  samples,
+		Mean:     mean,
+		Stddev:   stddev,
+		P50:      pd.percentile(50),
+		P90:      pd.percentile(90),
+		P99:      pd.percentile(99),
+		LossRate: pd.lossRate(),
+	}
+}
+
+// recordOutcome records whether a PING timed out. It must be called with
+// the lock held.
+func (pd *pingData) recordOutcome(lost bool) {
+	pd.lost[pd.lostPointer] = lost
+
+	pd.lostPointer++
+	pd.lostPointer %= len(pd.lost)
+
+	if pd.lostRecorded < len(pd.lost) {
+		pd.lostRecorded++
+	}
+}
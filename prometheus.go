@@ -0,0 +1,252 @@
+/*
+Copyright 2016 The Smudge Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package smudge
+
+import (
+	"bytes"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefaultHistogramBuckets are the upper bounds of the histogram buckets used
+// by a PrometheusMetrics, chosen to suit round-trip times in milliseconds.
+var DefaultHistogramBuckets = []float64{1, 2.5, 5, 10, 25, 50, 100, 250, 500, 1000, 2500}
+
+// The help text for each of the metrics reported by a cluster.
+var metricHelp = map[string]string{
+	MetricPacketsSent:         "Packets sent, by verb.",
+	MetricBytesSent:           "Bytes sent in packets, by verb.",
+	MetricPacketsReceived:     "Packets received and decoded, by verb.",
+	MetricBytesReceived:       "Bytes received in decoded packets, by verb.",
+	MetricDecodeFailures:      "Received packets dropped because they couldn't be decoded, by reason.",
+	MetricProbeTimeouts:       "Probes that went unanswered, by type.",
+	MetricIndirectProbes:      "Requests sent to other members to probe a member indirectly.",
+	MetricStatusTransitions:   "Changes in known members' statuses.",
+	MetricMembers:             "Known members, by status.",
+	MetricBroadcastQueueDepth: "Broadcasts still being piggybacked onto outgoing messages.",
+	MetricRTT:                 "PING round-trip times in milliseconds.",
+}
+
+// PrometheusMetrics is a Metrics sink that keeps every metric in memory, and
+// serves them over HTTP in the Prometheus text exposition format. It can be
+// shared by several clusters, although their metrics are then added
+// together (or, for gauges, overwritten by whichever reported last).
+//
+//	m := smudge.NewPrometheusMetrics()
+//	smudge.SetMetrics(m)
+//	http.Handle("/metrics", m)
+type PrometheusMetrics struct {
+	sync.Mutex
+
+	// The type of each metric, keyed by name, and its series, keyed by
+	// their encoded labels.
+	types  map[string]string
+	series map[string]map[string]*promSeries
+
+	buckets []float64
+}
+
+// promSeries is a single series of a metric: the value of a counter or
+// gauge, or the bucket counts, sum and count of a histogram.
+type promSeries struct {
+	labels string
+	value  float64
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+/******************************************************************************
+ * Exported functions (for public consumption)
+ *****************************************************************************/
+
+// NewPrometheusMetrics returns an empty PrometheusMetrics, whose histograms
+// use DefaultHistogramBuckets.
+func NewPrometheusMetrics() *PrometheusMetrics {
+	return &PrometheusMetrics{
+		types:   make(map[string]string),
+		series:  make(map[string]map[string]*promSeries),
+		buckets: append([]float64(nil), DefaultHistogramBuckets...),
+	}
+}
+
+// IncrCounter adds delta to the named counter.
+func (p *PrometheusMetrics) IncrCounter(name string, labels []Label, delta float64) {
+	p.Lock()
+	defer p.Unlock()
+
+	p.get("counter", name, labels).value += delta
+}
+
+// SetGauge sets the named gauge to value.
+func (p *PrometheusMetrics) SetGauge(name string, labels []Label, value float64) {
+	p.Lock()
+	defer p.Unlock()
+
+	p.get("gauge", name, labels).value = value
+}
+
+// Observe adds a sample to the named histogram.
+func (p *PrometheusMetrics) Observe(name string, labels []Label, value float64) {
+	p.Lock()
+	defer p.Unlock()
+
+	s := p.get("histogram", name, labels)
+	if s.counts == nil {
+		s.counts = make([]uint64, len(p.buckets))
+	}
+
+	for i, bound := range p.buckets {
+		if value <= bound {
+			s.counts[i]++
+		}
+	}
+
+	s.sum += value
+	s.count++
+}
+
+// ServeHTTP writes every metric in the Prometheus text exposition format.
+func (p *PrometheusMetrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Write(p.encode())
+}
+
+/******************************************************************************
+ * Private functions (for internal use only)
+ *****************************************************************************/
+
+// get returns the series of the named metric with the given labels, creating
+// it if necessary. The metric's type is set by the first call for its name.
+func (p *PrometheusMetrics) get(metricType string, name string, labels []Label) *promSeries {
+	m, ok := p.series[name]
+	if !ok {
+		m = make(map[string]*promSeries)
+		p.series[name] = m
+		p.types[name] = metricType
+	}
+
+	key := encodePromLabels(labels)
+
+	s, ok := m[key]
+	if !ok {
+		s = &promSeries{labels: key}
+		m[key] = s
+	}
+
+	return s
+}
+
+// encode renders every metric, sorted by name and then by labels.
+func (p *PrometheusMetrics) encode() []byte {
+	p.Lock()
+	defer p.Unlock()
+
+	var buf bytes.Buffer
+
+	names := make([]string, 0, len(p.series))
+	for name := range p.series {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if help, ok := metricHelp[name]; ok {
+			buf.WriteString("# HELP " + name + " " + help + "\n")
+		}
+		buf.WriteString("# TYPE " + name + " " + p.types[name] + "\n")
+
+		keys := make([]string, 0, len(p.series[name]))
+		for key := range p.series[name] {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		for _, key := range keys {
+			s := p.series[name][key]
+
+			if p.types[name] != "histogram" {
+				writePromSample(&buf, name, s.labels, "", s.value)
+				continue
+			}
+
+			for i, bound := range p.buckets {
+				le := `le="` + formatPromFloat(bound) + `"`
+				writePromSample(&buf, name+"_bucket", s.labels, le, float64(s.counts[i]))
+			}
+
+			writePromSample(&buf, name+"_bucket", s.labels, `le="+Inf"`, float64(s.count))
+			writePromSample(&buf, name+"_sum", s.labels, "", s.sum)
+			writePromSample(&buf, name+"_count", s.labels, "", float64(s.count))
+		}
+	}
+
+	return buf.Bytes()
+}
+
+// writePromSample writes a single sample line. The extra label, if any, is
+// appended to the series' own.
+func writePromSample(buf *bytes.Buffer, name string, labels string, extra string, value float64) {
+	if extra != "" {
+		if labels != "" {
+			labels += ","
+		}
+		labels += extra
+	}
+
+	buf.WriteString(name)
+	if labels != "" {
+		buf.WriteString("{" + labels + "}")
+	}
+	buf.WriteString(" " + formatPromFloat(value) + "\n")
+}
+
+// encodePromLabels renders labels as they appear between the braces of a
+// sample line, sorted by name so that equal sets encode identically.
+func encodePromLabels(labels []Label) string {
+	sorted := append([]Label(nil), labels...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Name < sorted[j].Name
+	})
+
+	escaper := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+	parts := make([]string, len(sorted))
+	for i, l := range sorted {
+		parts[i] = l.Name + `="` + escaper.Replace(l.Value) + `"`
+	}
+
+	return strings.Join(parts, ",")
+}
+
+// formatPromFloat formats a value as Prometheus expects.
+func formatPromFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
@@ -0,0 +1,70 @@
+/*
+Copyright 2016 The Smudge Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package smudge
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestPrometheusExposition(t *testing.T) {
+	m := NewPrometheusMetrics()
+	m.buckets = []float64{10, 100}
+
+	m.IncrCounter(MetricPacketsSent, []Label{{"verb", "ping"}}, 1)
+	m.IncrCounter(MetricPacketsSent, []Label{{"verb", "ping"}}, 2)
+	m.IncrCounter(MetricPacketsSent, []Label{{"verb", "ack"}}, 1)
+	m.SetGauge(MetricBroadcastQueueDepth, nil, 4)
+	m.SetGauge(MetricBroadcastQueueDepth, nil, 3)
+	m.IncrCounter("custom_total", []Label{{"b", "2"}, {"a", `say "hi"`}}, 1)
+
+	for _, v := range []float64{5, 50, 500} {
+		m.Observe(MetricRTT, nil, v)
+	}
+
+	recorder := httptest.NewRecorder()
+	m.ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+
+	if ct := recorder.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Error("unexpected content type:", ct)
+	}
+
+	expected := strings.Join([]string{
+		`# TYPE custom_total counter`,
+		`custom_total{a="say \"hi\"",b="2"} 1`,
+		`# HELP smudge_broadcast_queue_depth Broadcasts still being piggybacked onto outgoing messages.`,
+		`# TYPE smudge_broadcast_queue_depth gauge`,
+		`smudge_broadcast_queue_depth 3`,
+		`# HELP smudge_packets_sent_total Packets sent, by verb.`,
+		`# TYPE smudge_packets_sent_total counter`,
+		`smudge_packets_sent_total{verb="ack"} 1`,
+		`smudge_packets_sent_total{verb="ping"} 3`,
+		`# HELP smudge_rtt_milliseconds PING round-trip times in milliseconds.`,
+		`# TYPE smudge_rtt_milliseconds histogram`,
+		`smudge_rtt_milliseconds_bucket{le="10"} 1`,
+		`smudge_rtt_milliseconds_bucket{le="100"} 2`,
+		`smudge_rtt_milliseconds_bucket{le="+Inf"} 3`,
+		`smudge_rtt_milliseconds_sum 555`,
+		`smudge_rtt_milliseconds_count 3`,
+		``,
+	}, "\n")
+
+	if got := recorder.Body.String(); got != expected {
+		t.Errorf("unexpected exposition:\n%s\nexpected:\n%s", got, expected)
+	}
+}
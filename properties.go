@@ -17,11 +17,13 @@ limitations under the License.
 package smudge
 
 import (
+	"encoding/base64"
 	"net"
 	"os"
 	"regexp"
 	"strconv"
 	"strings"
+	"sync"
 )
 
 // Provides a series of methods and constants that revolve around the getting
@@ -29,6 +31,15 @@ import (
 // default values if not set.
 
 const (
+	// EnvVarClusterName is the name of the environment variable that sets
+	// the cluster name. Members only accept messages from members with the
+	// same cluster name, which keeps unrelated clusters on the same network
+	// from merging.
+	EnvVarClusterName = "SMUDGE_CLUSTER_NAME"
+
+	// DefaultClusterName is the default cluster name.
+	DefaultClusterName string = ""
+
 	// EnvVarHeartbeatMillis is the name of the environment variable that
 	// sets the heartbeat frequency (in millis).
 	EnvVarHeartbeatMillis = "SMUDGE_HEARTBEAT_MILLIS"
@@ -39,12 +50,23 @@ const (
 	// EnvVarInitialHosts is the name of the environment variable that sets
 	// the initial known hosts. The value it sets should be a comma-delimitted
 	// string of one or more IP:PORT pairs (port is optional if it matched the
-	// value of SMUDGE_LISTEN_PORT).
+	// value of SMUDGE_LISTEN_PORT). IPv6 addresses must be bracketed when a
+	// port is given, as in [::1]:9999.
 	EnvVarInitialHosts = "SMUDGE_INITIAL_HOSTS"
 
 	// DefaultInitialHosts default lists of initially known hosts.
 	DefaultInitialHosts string = ""
 
+	// EnvVarInitialRTTMillis is the name of the environment variable that
+	// sets the round-trip time (in millis) assumed for a member before any
+	// of its PINGs have been answered. Each member's RTT history is filled
+	// with this estimate, which real samples gradually replace.
+	EnvVarInitialRTTMillis = "SMUDGE_INITIAL_RTT_MILLIS"
+
+	// DefaultInitialRTTMillis is the default initial round-trip time
+	// estimate (in millis).
+	DefaultInitialRTTMillis int = 150
+
 	// EnvVarListenPort is the name of the environment variable that sets
 	// the UDP listen port.
 	EnvVarListenPort = "SMUDGE_LISTEN_PORT"
@@ -62,8 +84,68 @@ const (
 	// of 508 bytes, which must also contain status updates and additional
 	// message overhead.
 	DefaultMaxBroadcastBytes int = 256
+
+	// EnvVarMaxLocalHealth is the name of the environment variable that sets
+	// the maximum local health score. Probe and suspicion timeouts are
+	// scaled by up to (1 + this value) while this host appears to be
+	// unhealthy itself. A negative value disables this scaling.
+	EnvVarMaxLocalHealth = "SMUDGE_MAX_LOCAL_HEALTH"
+
+	// DefaultMaxLocalHealth is the default maximum local health score.
+	DefaultMaxLocalHealth int = 8
+
+	// EnvVarMaxMessageBytes is the name of the environment variable that
+	// sets the maximum byte length of each UDP message. Outgoing messages
+	// are packed with as many status updates and broadcasts as fit.
+	EnvVarMaxMessageBytes = "SMUDGE_MAX_MESSAGE_BYTES"
+
+	// DefaultMaxMessageBytes is the default maximum byte length of each UDP
+	// message. It leaves room for IP and UDP headers (and some tunnelling
+	// overhead) within a typical 1500-byte Ethernet MTU.
+	DefaultMaxMessageBytes int = 1400
+
+	// EnvVarRTTHistorySize is the name of the environment variable that sets
+	// the number of round-trip times (and probe outcomes) remembered for
+	// each member, from which its probe timeout is calculated.
+	EnvVarRTTHistorySize = "SMUDGE_RTT_HISTORY_SIZE"
+
+	// DefaultRTTHistorySize is the default number of round-trip times
+	// remembered for each member.
+	DefaultRTTHistorySize int = 50
+
+	// EnvVarSecretKey is the name of the environment variable that sets the
+	// secret keys used to encrypt and authenticate all traffic. The value
+	// should be a comma-delimitted list of one or more base64-encoded 16, 24
+	// or 32 byte AES keys. The first is the primary key, used for encryption;
+	// the rest are only accepted for decryption, which is useful while
+	// rotating keys. If unset, traffic is not encrypted.
+	EnvVarSecretKey = "SMUDGE_SECRET_KEY"
+
+	// DefaultSecretKey is the default list of secret keys (none).
+	DefaultSecretKey string = ""
+
+	// EnvVarSuspicionMultiplier is the name of the environment variable that
+	// sets the suspicion timeout multiplier. A suspected node is declared
+	// dead after (multiplier * max(1, log10(node count)) * heartbeat) millis.
+	EnvVarSuspicionMultiplier = "SMUDGE_SUSPICION_MULTIPLIER"
+
+	// DefaultSuspicionMultiplier is the default suspicion timeout multiplier.
+	DefaultSuspicionMultiplier int = 4
+
+	// EnvVarSyncMillis is the name of the environment variable that sets the
+	// interval (in millis) between full state syncs with a random member over
+	// TCP. A negative value disables periodic syncs.
+	EnvVarSyncMillis = "SMUDGE_SYNC_MILLIS"
+
+	// DefaultSyncMillis is the default interval between full state syncs.
+	DefaultSyncMillis int = 30000
 )
 
+// Guards the package properties below, which are resolved lazily.
+var propertiesMutex sync.Mutex
+
+var clusterName *string
+
 var heartbeatMillis int
 
 var listenPort int
@@ -72,12 +154,42 @@ var listenIP net.IP
 
 var initialHosts []string
 
+var initialRTTMillis int
+
 var maxBroadcastBytes int
 
+var maxLocalHealth int
+
+var maxMessageBytes int
+
+var rttHistorySize int
+
+var secretKeys [][]byte
+
+var suspicionMultiplier int
+
+var syncMillis int
+
 const stringListDelimitRegex = "\\s*((,\\s*)|(\\s+))"
 
+// GetClusterName returns the name of the cluster this host belongs to.
+func GetClusterName() string {
+	propertiesMutex.Lock()
+	defer propertiesMutex.Unlock()
+
+	if clusterName == nil {
+		name := getStringVar(EnvVarClusterName, DefaultClusterName)
+		clusterName = &name
+	}
+
+	return *clusterName
+}
+
 // GetHeartbeatMillis gets this host's heartbeat frequency in milliseconds.
 func GetHeartbeatMillis() int {
+	propertiesMutex.Lock()
+	defer propertiesMutex.Unlock()
+
 	if heartbeatMillis == 0 {
 		heartbeatMillis = getIntVar(EnvVarHeartbeatMillis, DefaultHeartbeatMillis)
 	}
@@ -87,6 +199,9 @@ func GetHeartbeatMillis() int {
 
 // GetInitialHosts returns the list of initially known hosts.
 func GetInitialHosts() []string {
+	propertiesMutex.Lock()
+	defer propertiesMutex.Unlock()
+
 	if initialHosts == nil {
 		initialHosts = getStringArrayVar(EnvVarInitialHosts, DefaultInitialHosts)
 	}
@@ -94,8 +209,24 @@ func GetInitialHosts() []string {
 	return initialHosts
 }
 
+// GetInitialRTTMillis returns the round-trip time (in millis) assumed for a
+// member before any of its PINGs have been answered.
+func GetInitialRTTMillis() int {
+	propertiesMutex.Lock()
+	defer propertiesMutex.Unlock()
+
+	if initialRTTMillis == 0 {
+		initialRTTMillis = getIntVar(EnvVarInitialRTTMillis, DefaultInitialRTTMillis)
+	}
+
+	return initialRTTMillis
+}
+
 // GetListenPort returns the port that this host will listen on.
 func GetListenPort() int {
+	propertiesMutex.Lock()
+	defer propertiesMutex.Unlock()
+
 	if listenPort == 0 {
 		listenPort = getIntVar(EnvVarListenPort, DefaultListenPort)
 	}
@@ -105,11 +236,17 @@ func GetListenPort() int {
 
 // GetListenIP returns the ip that this host will listen on.
 func GetListenIP() net.IP {
+	propertiesMutex.Lock()
+	defer propertiesMutex.Unlock()
+
 	return listenIP
 }
 
 // GetMaxBroadcastBytes returns the maximum byte length for broadcast payloads.
 func GetMaxBroadcastBytes() int {
+	propertiesMutex.Lock()
+	defer propertiesMutex.Unlock()
+
 	if maxBroadcastBytes == 0 {
 		maxBroadcastBytes = getIntVar(EnvVarMaxBroadcastBytes, DefaultMaxBroadcastBytes)
 	}
@@ -117,46 +254,242 @@ func GetMaxBroadcastBytes() int {
 	return maxBroadcastBytes
 }
 
+// GetMaxLocalHealth returns the maximum local health score.
+func GetMaxLocalHealth() int {
+	propertiesMutex.Lock()
+	defer propertiesMutex.Unlock()
+
+	if maxLocalHealth == 0 {
+		maxLocalHealth = getIntVar(EnvVarMaxLocalHealth, DefaultMaxLocalHealth)
+	}
+
+	return maxLocalHealth
+}
+
+// GetMaxMessageBytes returns the maximum byte length of each UDP message.
+func GetMaxMessageBytes() int {
+	propertiesMutex.Lock()
+	defer propertiesMutex.Unlock()
+
+	if maxMessageBytes == 0 {
+		maxMessageBytes = getIntVar(EnvVarMaxMessageBytes, DefaultMaxMessageBytes)
+	}
+
+	return maxMessageBytes
+}
+
+// GetRTTHistorySize returns the number of round-trip times remembered for
+// each member.
+func GetRTTHistorySize() int {
+	propertiesMutex.Lock()
+	defer propertiesMutex.Unlock()
+
+	if rttHistorySize == 0 {
+		rttHistorySize = getIntVar(EnvVarRTTHistorySize, DefaultRTTHistorySize)
+	}
+
+	return rttHistorySize
+}
+
+// GetSecretKeys returns the secret keys used to encrypt traffic, primary key
+// first. Keys that aren't valid base64 are ignored.
+func GetSecretKeys() [][]byte {
+	propertiesMutex.Lock()
+	defer propertiesMutex.Unlock()
+
+	if secretKeys == nil {
+		secretKeys = make([][]byte, 0)
+
+		for _, s := range getStringArrayVar(EnvVarSecretKey, DefaultSecretKey) {
+			key, err := base64.StdEncoding.DecodeString(s)
+			if err != nil {
+				logfError("Failed to parse env property %s: %v\n", EnvVarSecretKey, err)
+				continue
+			}
+
+			secretKeys = append(secretKeys, key)
+		}
+	}
+
+	return secretKeys
+}
+
+// GetSuspicionMultiplier returns the suspicion timeout multiplier.
+func GetSuspicionMultiplier() int {
+	propertiesMutex.Lock()
+	defer propertiesMutex.Unlock()
+
+	if suspicionMultiplier == 0 {
+		suspicionMultiplier = getIntVar(EnvVarSuspicionMultiplier, DefaultSuspicionMultiplier)
+	}
+
+	return suspicionMultiplier
+}
+
+// GetSyncMillis returns the interval (in millis) between full state syncs.
+func GetSyncMillis() int {
+	propertiesMutex.Lock()
+	defer propertiesMutex.Unlock()
+
+	if syncMillis == 0 {
+		syncMillis = getIntVar(EnvVarSyncMillis, DefaultSyncMillis)
+	}
+
+	return syncMillis
+}
+
+// SetClusterName sets the name of the cluster this host belongs to. Like the
+// other properties, it takes effect at once for the default cluster, which
+// then only talks to members of the newly named cluster.
+func SetClusterName(name string) {
+	setProperty(func() {
+		clusterName = &name
+	})
+}
+
 // SetHeartbeatMillis sets this nodes heartbeat frequency. Unlike
 // SetListenPort(), calling this function after Begin() has been called will
 // have an effect.
 func SetHeartbeatMillis(val int) {
-	if val == 0 {
-		heartbeatMillis = DefaultListenPort
-	} else {
+	setProperty(func() {
+		if val == 0 {
+			heartbeatMillis = DefaultListenPort
+		} else {
+			heartbeatMillis = val
+		}
+
 		heartbeatMillis = val
-	}
+	})
+}
 
-	heartbeatMillis = val
+// SetInitialRTTMillis sets the round-trip time (in millis) assumed for a
+// member before any of its PINGs have been answered.
+func SetInitialRTTMillis(val int) {
+	setProperty(func() {
+		if val == 0 {
+			initialRTTMillis = DefaultInitialRTTMillis
+		} else {
+			initialRTTMillis = val
+		}
+	})
 }
 
 // SetListenPort sets the UDP port to listen on. It has no effect once
 // Begin() has been called.
 func SetListenPort(val int) {
-	if val == 0 {
-		listenPort = DefaultListenPort
-	} else {
-		listenPort = val
-	}
+	setProperty(func() {
+		if val == 0 {
+			listenPort = DefaultListenPort
+		} else {
+			listenPort = val
+		}
+	})
 }
 
 // SetListenPort sets the UDP IP to listen on. It has no effect once
 // Begin() has been called.
 func SetListenIP(ip net.IP) {
-	if ip != nil {
-		listenIP = ip
-	}
+	setProperty(func() {
+		if ip != nil {
+			listenIP = ip
+		}
+	})
 }
 
 // SetMaxBroadcastBytes sets the maximum byte length for broadcast payloads.
 // Note that increasing this beyond the default of 256 runs the risk of packet
 // fragmentation and dropped messages.
 func SetMaxBroadcastBytes(val int) {
-	if val == 0 {
-		maxBroadcastBytes = DefaultMaxBroadcastBytes
-	} else {
-		maxBroadcastBytes = val
-	}
+	setProperty(func() {
+		if val == 0 {
+			maxBroadcastBytes = DefaultMaxBroadcastBytes
+		} else {
+			maxBroadcastBytes = val
+		}
+	})
+}
+
+// SetMaxLocalHealth sets the maximum local health score. A negative value
+// disables the scaling of timeouts by local health.
+func SetMaxLocalHealth(val int) {
+	setProperty(func() {
+		if val == 0 {
+			maxLocalHealth = DefaultMaxLocalHealth
+		} else {
+			maxLocalHealth = val
+		}
+	})
+}
+
+// SetMaxMessageBytes sets the maximum byte length of each UDP message,
+// including any encryption overhead. Messages carrying a broadcast that
+// wouldn't otherwise fit may exceed it.
+func SetMaxMessageBytes(val int) {
+	setProperty(func() {
+		if val == 0 {
+			maxMessageBytes = DefaultMaxMessageBytes
+		} else {
+			maxMessageBytes = val
+		}
+	})
+}
+
+// SetRTTHistorySize sets the number of round-trip times remembered for each
+// member. Larger histories adapt to changes in latency more slowly. It only
+// affects members that haven't been pinged yet.
+func SetRTTHistorySize(val int) {
+	setProperty(func() {
+		if val == 0 {
+			rttHistorySize = DefaultRTTHistorySize
+		} else {
+			rttHistorySize = val
+		}
+	})
+}
+
+// SetSecretKeys sets the AES keys (16, 24 or 32 bytes each) used to encrypt
+// and authenticate traffic. The first is the primary key, used for
+// encryption; all are accepted for decryption. It has no effect once Begin()
+// has been called.
+func SetSecretKeys(keys [][]byte) {
+	setProperty(func() {
+		secretKeys = keys
+	})
+}
+
+// SetSuspicionMultiplier sets the suspicion timeout multiplier. Larger values
+// reduce false positives at the cost of slower failure detection.
+func SetSuspicionMultiplier(val int) {
+	setProperty(func() {
+		if val == 0 {
+			suspicionMultiplier = DefaultSuspicionMultiplier
+		} else {
+			suspicionMultiplier = val
+		}
+	})
+}
+
+// SetSyncMillis sets the interval (in millis) between full state syncs with
+// a random member. A negative value disables periodic syncs; full state is
+// still exchanged with the initially known members when Begin() is called.
+func SetSyncMillis(val int) {
+	setProperty(func() {
+		if val == 0 {
+			syncMillis = DefaultSyncMillis
+		} else {
+			syncMillis = val
+		}
+	})
+}
+
+// setProperty sets package properties under their lock, then invalidates the
+// default cluster's configuration so that it sees them.
+func setProperty(set func()) {
+	propertiesMutex.Lock()
+	set()
+	propertiesMutex.Unlock()
+
+	defaultCluster.invalidateConfig()
 }
 
 // Gets an environmental variable "key". If it does not exist, "defaultVal" is
@@ -167,7 +500,7 @@ func getIntVar(key string, defaultVal int) int {
 	valueInt := defaultVal
 
 	if valueString != "" {
-		i, err := strconv.Atoi(key)
+		i, err := strconv.Atoi(valueString)
 
 		if err != nil {
 			logfWarn("Failed to parse env property %s: %s is not "+
@@ -180,6 +513,18 @@ func getIntVar(key string, defaultVal int) int {
 	return valueInt
 }
 
+// Gets an environmental variable "key". If it does not exist, "defaultVal" is
+// returned.
+func getStringVar(key string, defaultVal string) string {
+	valueString := os.Getenv(key)
+
+	if valueString == "" {
+		valueString = defaultVal
+	}
+
+	return valueString
+}
+
 // Gets an environmental variable "key". If it does not exist, "defaultVal" is
 // returned; if it does, it attempts to convert to a string slice, returning
 // "defaultVal" is it fails.
@@ -20,6 +20,71 @@ import (
 	"testing"
 )
 
+// Returns what a property's getter reads from the environment, with the
+// property's cached value cleared first. The cached value is restored when
+// the test ends.
+func intPropertyFromEnv(t *testing.T, key string, value string, property *int, get func() int) int {
+	t.Setenv(key, value)
+
+	propertiesMutex.Lock()
+	saved := *property
+	*property = 0
+	propertiesMutex.Unlock()
+
+	t.Cleanup(func() {
+		propertiesMutex.Lock()
+		*property = saved
+		propertiesMutex.Unlock()
+	})
+
+	return get()
+}
+
+func TestSuspicionMultiplierFromEnv(t *testing.T) {
+	got := intPropertyFromEnv(t, EnvVarSuspicionMultiplier, "7", &suspicionMultiplier, GetSuspicionMultiplier)
+	if got != 7 {
+		t.Error("expected 7, got", got)
+	}
+
+	got = intPropertyFromEnv(t, EnvVarSuspicionMultiplier, "seven", &suspicionMultiplier, GetSuspicionMultiplier)
+	if got != DefaultSuspicionMultiplier {
+		t.Errorf("expected the default of %d, got %d", DefaultSuspicionMultiplier, got)
+	}
+}
+
+func TestSyncMillisFromEnv(t *testing.T) {
+	got := intPropertyFromEnv(t, EnvVarSyncMillis, "5000", &syncMillis, GetSyncMillis)
+	if got != 5000 {
+		t.Error("expected 5000, got", got)
+	}
+}
+
+func TestMaxMessageBytesFromEnv(t *testing.T) {
+	got := intPropertyFromEnv(t, EnvVarMaxMessageBytes, "1200", &maxMessageBytes, GetMaxMessageBytes)
+	if got != 1200 {
+		t.Error("expected 1200, got", got)
+	}
+}
+
+func TestMaxLocalHealthFromEnv(t *testing.T) {
+	got := intPropertyFromEnv(t, EnvVarMaxLocalHealth, "3", &maxLocalHealth, GetMaxLocalHealth)
+	if got != 3 {
+		t.Error("expected 3, got", got)
+	}
+}
+
+func TestRTTPropertiesFromEnv(t *testing.T) {
+	got := intPropertyFromEnv(t, EnvVarInitialRTTMillis, "80", &initialRTTMillis, GetInitialRTTMillis)
+	if got != 80 {
+		t.Error("expected an initial RTT of 80, got", got)
+	}
+
+	got = intPropertyFromEnv(t, EnvVarRTTHistorySize, "20", &rttHistorySize, GetRTTHistorySize)
+	if got != 20 {
+		t.Error("expected an RTT history size of 20, got", got)
+	}
+}
+
 func TestSplitString0a(t *testing.T) {
 	str := ""
 	split := splitDelimmitedString(str, stringListDelimitRegex)
@@ -0,0 +1,325 @@
+/*
+Copyright 2016 The Smudge Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package smudge
+
+import (
+	"errors"
+	"fmt"
+	"hash/adler32"
+	"io"
+	"net"
+	"time"
+)
+
+// Gossip only carries a few member updates per message, so a new member can
+// take many heartbeats to learn about a large cluster. To speed this up (and
+// to heal partitions) members periodically exchange their complete state over
+// TCP: the initiator pushes its known nodes, the responder replies with its
+// own, and each merges the other's using the usual status ordering rules.
+//
+// Each side also sends the announcements of the reliable broadcasts whose
+// payloads it holds, so that a member which missed one while it was being
+// gossiped still fetches it (see reliable.go).
+
+// The maximum size of a TCP frame (such as a full state payload) that we're
+// willing to accept.
+const maxFrameBytes = 16 * 1024 * 1024
+
+// How long a full state exchange may take before it's abandoned.
+const stateExchangeTimeout = 10 * time.Second
+
+// Each TCP connection begins with a byte identifying what it's for.
+const (
+	// A full state exchange; see pushPull().
+	tcpStreamState byte = iota + 1
+
+	// A request for reliable broadcast chunks; see reliable.go.
+	tcpStreamChunks
+
+	// A direct message too large for UDP; see direct.go.
+	tcpStreamDirect
+)
+
+// Frame contents
+// Bytes 00-03 Payload length (bytes), not including these four bytes
+// Bytes 04-NN Payload, encrypted if encryption is enabled (see keyring.go)
+
+// State contents (sent as a single frame)
+// Bytes 00-03 Checksum (32-bit) of bytes 04-NN
+// Bytes 04    Message layout version
+// Bytes 05-08 Cluster name hash (32-bit FNV-1a, or 0 if unnamed)
+// Bytes 09-12 Member count
+// Bytes 13-NN Members, each encoded as in message.go
+// Bytes +0-1  Reliable broadcast announcement count
+// Bytes +2-NN Reliable broadcast announcements, each encoded as in broadcast.go
+
+func (c *Cluster) encodeState() ([]byte, error) {
+	members := make([]*messageMember, 0, c.knownNodes.length())
+
+	for _, n := range c.knownNodes.values() {
+		status := n.Status()
+		if status == StatusUnknown || status == StatusForwardTo {
+			continue
+		}
+
+		members = append(members, newMessageMember(n, status, n.Heartbeat()))
+	}
+
+	announcements := c.reliableAnnouncements()
+
+	size := 15
+	for _, m := range members {
+		size += m.encodedLength()
+	}
+
+	for _, b := range announcements {
+		size += b.encodedLength()
+	}
+
+	payload := make([]byte, size, size)
+
+	// An index pointer (start at 4 to accommodate checksum)
+	p := 4
+
+	p += encodeByte(messageVersion, payload, p)
+	p += encodeUint32(c.clusterHash(), payload, p)
+	p += encodeUint32(uint32(len(members)), payload, p)
+
+	for _, m := range members {
+		p += encodeMember(m, payload, p)
+	}
+
+	p += encodeUint16(uint16(len(announcements)), payload, p)
+
+	for _, b := range announcements {
+		p += copy(payload[p:], b.encode())
+	}
+
+	encodeUint32(adler32.Checksum(payload[4:]), payload, 0)
+
+	return c.encodeFrame(payload)
+}
+
+// decodeState decodes a state frame's payload; that is, everything after the
+// length prefix written by encodeState(). It returns the members and reliable
+// broadcast announcements it contains.
+func (c *Cluster) decodeState(bytes []byte) ([]*messageMember, []*Broadcast, error) {
+	bytes, err := c.openPayload(bytes)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if len(bytes) < 13 {
+		return nil, nil, errors.New("short state payload")
+	}
+
+	// An index pointer
+	p := 0
+
+	checksumStated, p := decodeUint32(bytes, p)
+	if adler32.Checksum(bytes[4:]) != checksumStated {
+		return nil, nil, errors.New("state checksum failure")
+	}
+
+	version, p := decodeByte(bytes, p)
+	if version != messageVersion {
+		return nil, nil, fmt.Errorf("unsupported state version %d", version)
+	}
+
+	clusterHash, p := decodeUint32(bytes, p)
+	if err = c.checkClusterHash(clusterHash, "state sync"); err != nil {
+		return nil, nil, err
+	}
+
+	count, p := decodeUint32(bytes, p)
+
+	members, p, err := c.decodeMembers(int(count), bytes, p)
+	if err != nil {
+		return members, nil, errors.New("state payload is truncated: " + err.Error())
+	}
+
+	if !hasBytes(bytes, p, 2) {
+		return members, nil, errors.New("state payload is truncated")
+	}
+
+	announcementCount, p := decodeUint16(bytes, p)
+
+	announcements, _, err := c.decodeBroadcasts(int(announcementCount), bytes, p)
+	if err != nil {
+		return members, nil, errors.New("state payload is truncated: " + err.Error())
+	}
+
+	return members, announcements, nil
+}
+
+// encodeFrame encrypts a payload (if encryption is enabled) and prefixes it
+// with its length.
+func (c *Cluster) encodeFrame(payload []byte) ([]byte, error) {
+	payload, err := c.sealPayload(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	bytes := make([]byte, 4, 4+len(payload))
+	encodeUint32(uint32(len(payload)), bytes, 0)
+
+	return append(bytes, payload...), nil
+}
+
+// readFrame reads a length-prefixed frame from conn, returning its payload
+// as sent (that is, still encrypted if encryption is enabled).
+func readFrame(conn net.Conn) ([]byte, error) {
+	lengthBytes := make([]byte, 4)
+	if _, err := io.ReadFull(conn, lengthBytes); err != nil {
+		return nil, err
+	}
+
+	length, _ := decodeUint32(lengthBytes, 0)
+	if length > maxFrameBytes {
+		return nil, fmt.Errorf("frame of %d bytes is too large", length)
+	}
+
+	bytes := make([]byte, length)
+	if _, err := io.ReadFull(conn, bytes); err != nil {
+		return nil, err
+	}
+
+	return bytes, nil
+}
+
+// readState reads a state frame from conn and decodes it.
+func (c *Cluster) readState(conn net.Conn) ([]*messageMember, []*Broadcast, error) {
+	bytes, err := readFrame(conn)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return c.decodeState(bytes)
+}
+
+// pushPull exchanges full state with the specified node: we send ours, then
+// read and merge theirs.
+func (c *Cluster) pushPull(node *Node) error {
+	conn, err := c.dialStream(node, stateExchangeTimeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(stateExchangeTimeout))
+
+	state, err := c.encodeState()
+	if err != nil {
+		return err
+	}
+
+	if _, err = conn.Write(append([]byte{tcpStreamState}, state...)); err != nil {
+		return err
+	}
+
+	members, announcements, err := c.readState(conn)
+	if err != nil {
+		return err
+	}
+
+	logfDebug("Synced state with %s (%d members)\n", node.Address(), len(members))
+
+	c.mergeMembers(members)
+	c.receiveReliableAnnouncements(announcements)
+
+	return nil
+}
+
+// handleTCPConn reads the stream type byte from a new connection and hands
+// it to the appropriate handler.
+func (c *Cluster) handleTCPConn(conn net.Conn) {
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(stateExchangeTimeout))
+
+	streamType := make([]byte, 1)
+	if _, err := io.ReadFull(conn, streamType); err != nil {
+		logDebug("Failed to read stream type from", conn.RemoteAddr(), "->", err)
+		return
+	}
+
+	switch streamType[0] {
+	case tcpStreamState:
+		c.handleStateConn(conn)
+	case tcpStreamChunks:
+		c.handleChunkConn(conn)
+	case tcpStreamDirect:
+		c.handleDirectConn(conn)
+	default:
+		logWarn("Unknown stream type", streamType[0], "from", conn.RemoteAddr())
+	}
+}
+
+// handleStateConn is the responding half of pushPull(): it reads and merges
+// the remote state, then replies with our own.
+func (c *Cluster) handleStateConn(conn net.Conn) {
+	members, announcements, err := c.readState(conn)
+	if err != nil {
+		logError("Failed to read state from", conn.RemoteAddr(), "->", err)
+		return
+	}
+
+	// Reply before merging so that we send the state as it was before the
+	// exchange; the initiator already knows everything it sent us.
+	state, err := c.encodeState()
+	if err == nil {
+		_, err = conn.Write(state)
+	}
+
+	if err != nil {
+		logError("Failed to send state to", conn.RemoteAddr(), "->", err)
+	}
+
+	c.mergeMembers(members)
+	c.receiveReliableAnnouncements(announcements)
+}
+
+// syncWithKnownNodes exchanges full state with every node we currently know
+// about. It's called when we join the cluster.
+func (c *Cluster) syncWithKnownNodes() {
+	for _, node := range c.knownNodes.getRandomNodes(0, c.thisHost) {
+		if err := c.pushPull(node); err != nil {
+			logDebug("Failed to sync state with", node.Address(), "->", err)
+		}
+	}
+}
+
+// startPushPullLoop periodically exchanges full state with a random healthy
+// member until the cluster is stopped.
+func (c *Cluster) startPushPullLoop() {
+	for c.runningFlag.IsSet() {
+		millis := c.SyncMillis()
+		if millis < 0 {
+			return
+		}
+
+		if !c.sleep(time.Millisecond * time.Duration(millis)) {
+			return
+		}
+
+		for _, node := range c.getTargetNodes(1, c.thisHost) {
+			if err := c.pushPull(node); err != nil {
+				logDebug("Failed to sync state with", node.Address(), "->", err)
+			}
+		}
+	}
+}
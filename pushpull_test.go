@@ -0,0 +1,226 @@
+/*
+Copyright 2016 The Smudge Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package smudge
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// Returns a cluster whose local node has been set up without opening any
+// sockets.
+func newSyncTestCluster(port uint16) *Cluster {
+	c := NewCluster(&Config{ListenPort: int(port)})
+	c.thisHost, _ = CreateNodeByIP(net.IP([]byte{127, 0, 0, 1}), port)
+	c.updateNodeStatus(c.thisHost, StatusAlive, 0, 0)
+	c.AddNode(c.thisHost)
+
+	return c
+}
+
+func TestEncodeDecodeState(t *testing.T) {
+	c := newSyncTestCluster(19201)
+
+	alive, _ := CreateNodeByIP(net.ParseIP("10.0.0.2"), 9999)
+	c.AddNode(alive)
+
+	dead, _ := CreateNodeByIP(net.ParseIP("2001:db8::3"), 9999)
+	c.updateNodeStatus(dead, StatusDead, 4, 2)
+	c.AddNode(dead)
+
+	bytes, err := c.encodeState()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	length, _ := decodeUint32(bytes, 0)
+	if int(length) != len(bytes)-4 {
+		t.Fatalf("stated length %d != %d", length, len(bytes)-4)
+	}
+
+	decoded := NewCluster(nil)
+	members, _, err := decoded.decodeState(bytes[4:])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(members) != 3 {
+		t.Fatalf("expected 3 members, got %d", len(members))
+	}
+
+	for _, m := range members {
+		if m.node.Address() == dead.Address() {
+			if m.status != StatusDead || m.incarnation != 2 || m.heartbeat != 4 {
+				t.Error("dead node decoded incorrectly:", m)
+			}
+		}
+	}
+}
+
+func TestDecodeStateBadChecksum(t *testing.T) {
+	c := newSyncTestCluster(19202)
+	bytes, _ := c.encodeState()
+	bytes[len(bytes)-1]++
+
+	if _, _, err := c.decodeState(bytes[4:]); err == nil {
+		t.Error("expected a checksum failure")
+	}
+}
+
+// A state sync carries the announcements of the reliable broadcasts whose
+// payloads the sender holds, and the receiver starts fetching those it missed.
+func TestStateCarriesReliableAnnouncements(t *testing.T) {
+	SetLogThreshold(LogWarn)
+	defer SetLogThreshold(LogInfo)
+
+	c := newSyncTestCluster(19206)
+
+	origin, _ := CreateNodeByIP(net.ParseIP("10.0.0.2"), 9999)
+	c.reliable.m["complete"] = &reliableBroadcast{origin: origin, index: 3, sequence: 1, length: 5, complete: true}
+	c.reliable.m["fetching"] = &reliableBroadcast{origin: origin, index: 4, sequence: 2, length: 5}
+
+	bytes, err := c.encodeState()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	received := newSyncTestCluster(19207)
+
+	_, announcements, err := received.decodeState(bytes[4:])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(announcements) != 1 || announcements[0].index != 3 {
+		t.Fatalf("expected only the complete broadcast to be announced, got %+v", announcements)
+	}
+
+	// The cluster isn't running, so nothing is fetched.
+	received.receiveReliableAnnouncements(announcements)
+	received.lifecycle.wg.Wait()
+
+	if rb, ok := received.reliable.m[announcements[0].Label()]; !ok || rb.sequence != 1 || rb.length != 5 {
+		t.Error("expected the announced broadcast to be pending")
+	}
+}
+
+// A push/pull over loopback TCP leaves both sides knowing each other's nodes.
+func TestPushPull(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping network test in short mode")
+	}
+
+	loopback := net.IP([]byte{127, 0, 0, 1})
+
+	a := newSyncTestCluster(19203)
+	b := newSyncTestCluster(19204)
+
+	x, _ := CreateNodeByIP(net.ParseIP("10.0.0.10"), 9999)
+	a.AddNode(x)
+
+	y, _ := CreateNodeByIP(net.ParseIP("10.0.0.11"), 9999)
+	b.updateNodeStatus(y, StatusSuspected, 0, 3)
+	b.AddNode(y)
+
+	a.transport = NewNetTransport()
+	b.transport = NewNetTransport()
+
+	if err := b.transport.Listen(loopback, 19204); err != nil {
+		t.Fatal(err)
+	}
+
+	b.lifecycle.stopping = make(chan struct{})
+	b.runningFlag.Set()
+	b.spawn(func() { b.acceptStreams(b.transport) })
+	defer b.Stop()
+
+	bNode, _ := CreateNodeByIP(loopback, 19204)
+
+	var err error
+	for i := 0; i < 50; i++ {
+		if err = a.pushPull(bNode); err == nil {
+			break
+		}
+
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n := a.knownNodes.getByAddress(y.Address()); n == nil ||
+		n.Status() != StatusSuspected || n.Incarnation() != 3 {
+		t.Error("a did not learn about y:", n)
+	}
+
+	if !a.knownNodes.containsByAddress(b.thisHost.Address()) {
+		t.Error("a did not learn about b")
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		if b.knownNodes.containsByAddress(x.Address()) &&
+			b.knownNodes.containsByAddress(a.thisHost.Address()) {
+			return
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	t.Error("b did not learn about a and x")
+}
+
+func TestDecodeStateForeignCluster(t *testing.T) {
+	c := newSyncTestCluster(19205)
+	c.config.ClusterName = "ours"
+	c.resolveConfig()
+	bytes, _ := c.encodeState()
+
+	other := NewCluster(&Config{ClusterName: "theirs"})
+	if _, _, err := other.decodeState(bytes[4:]); err == nil {
+		t.Error("expected a cluster name mismatch")
+	}
+
+	if other.ForeignClusterPackets() != 1 {
+		t.Error("expected 1 foreign payload, got", other.ForeignClusterPackets())
+	}
+}
+
+// A state payload cut short anywhere is rejected rather than read past its
+// end.
+func TestDecodeTruncatedState(t *testing.T) {
+	c := newSyncTestCluster(19203)
+
+	alive, _ := CreateNodeByIP(net.ParseIP("2001:db8::2"), 9999)
+	c.AddNode(alive)
+	c.SetLocalMetadata(map[string]string{"role": "test"})
+
+	bytes, err := c.encodeState()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	payload := bytes[4:]
+
+	for n := 4; n < len(payload); n++ {
+		if _, _, err := c.decodeState(withChecksum(payload[:n])); err == nil {
+			t.Errorf("expected an error for a payload truncated to %d bytes", n)
+		}
+	}
+}
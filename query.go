@@ -0,0 +1,579 @@
+/*
+Copyright 2016 The Smudge Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package smudge
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+// A query asks every member (or every member matching a filter) a question
+// and collects their answers. The query itself is disseminated as an internal
+// broadcast. Each member that receives it passes it to the QueryHandlers
+// registered under its name, which may respond; responses (and, if
+// requested, acknowledgements of receipt) are sent straight back to the
+// originator as direct messages. The originator collects them on channels
+// until the query's deadline, when the channels are closed.
+
+// The default query timeout, in heartbeats, before scaling by cluster size.
+const queryTimeoutMultiplier = 16
+
+// Set in a query's flags if the originator wants acknowledgements.
+const queryAckRequested byte = 1
+
+// QueryParams holds the optional parameters of a query. The zero value asks
+// every member, without acknowledgements, and waits for the default timeout.
+type QueryParams struct {
+	// Timeout is how long to collect responses for. If zero, a default that
+	// scales with the size of the cluster is used.
+	Timeout time.Duration
+
+	// FilterStatus, if not empty, limits the query to members with one of
+	// these statuses.
+	FilterStatus []NodeStatus
+
+	// FilterMetadata, if not empty, limits the query to members whose
+	// metadata contains all of these keys and values.
+	FilterMetadata map[string]string
+
+	// RequestAck asks each member to acknowledge receipt of the query as soon
+	// as it arrives, before any QueryHandler is called.
+	RequestAck bool
+}
+
+// NodeResponse is a single member's response to a query.
+type NodeResponse struct {
+	From    *Node
+	Payload []byte
+}
+
+// QueryResponse collects the responses to a query originated by this host.
+type QueryResponse struct {
+	sync.Mutex
+
+	cluster  *Cluster
+	index    uint32
+	deadline time.Time
+	expected int
+	closed   bool
+
+	acks      chan *Node
+	responses chan NodeResponse
+
+	acked     map[string]bool
+	responded map[string]bool
+}
+
+// QueryHandler is the interface that must be implemented to answer queries
+// registered with the AddQueryHandler() function.
+type QueryHandler interface {
+	// The OnQuery() function is called whenever the node receives a query
+	// with the name the handler was registered under. It may answer the
+	// query, now or later, by calling query.Respond().
+	OnQuery(query *QueryRequest)
+}
+
+// QueryRequest is a query received from another member (or from this one).
+type QueryRequest struct {
+	sync.Mutex
+
+	cluster   *Cluster
+	name      string
+	payload   []byte
+	origin    *Node
+	index     uint32
+	deadline  time.Time
+	responded bool
+}
+
+/******************************************************************************
+ * Exported functions (for public consumption)
+ *****************************************************************************/
+
+// AddQueryHandler registers a QueryHandler with the default cluster. See
+// Cluster.AddQueryHandler().
+func AddQueryHandler(name string, handler QueryHandler) {
+	defaultCluster.AddQueryHandler(name, handler)
+}
+
+// AddQueryHandler registers a QueryHandler whose OnQuery() function will be
+// called whenever the node receives a query with the given name.
+func (c *Cluster) AddQueryHandler(name string, handler QueryHandler) {
+	c.queryHandlers.Lock()
+	c.queryHandlers.m[name] = append(c.queryHandlers.m[name], handler)
+	c.queryHandlers.Unlock()
+}
+
+// Query sends a query from the default cluster. See Cluster.Query().
+func Query(name string, payload []byte, params *QueryParams) (*QueryResponse, error) {
+	return defaultCluster.Query(name, payload, params)
+}
+
+// Query asks every member matching the params (which may be nil), including
+// this one, the named query, and returns a QueryResponse on which their
+// responses are collected until the timeout. The name and payload must fit
+// into a broadcast, so their combined length is limited by
+// MaxBroadcastBytes().
+func (c *Cluster) Query(name string, payload []byte, params *QueryParams) (*QueryResponse, error) {
+	if params == nil {
+		params = &QueryParams{}
+	}
+
+	if !c.runningFlag.IsSet() {
+		return nil, errors.New("cluster is not running")
+	}
+
+	if len(name) > 255 {
+		return nil, errors.New("query name is longer than 255 bytes")
+	}
+
+	timeout := params.Timeout
+	if timeout <= 0 {
+		timeout = c.queryTimeout()
+	}
+
+	bytes, err := encodeQuery(name, payload, params, timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(bytes) > c.MaxBroadcastBytes() {
+		return nil, fmt.Errorf("query length exceeds %d bytes", c.MaxBroadcastBytes())
+	}
+
+	expected := 0
+	for _, n := range c.AllNodes() {
+		if matchesQueryFilter(n, params.FilterStatus, params.FilterMetadata) {
+			expected++
+		}
+	}
+
+	response := &QueryResponse{
+		cluster:   c,
+		deadline:  c.clock.Now().Add(timeout),
+		expected:  expected,
+		acks:      make(chan *Node, len(c.AllNodes())+1),
+		responses: make(chan NodeResponse, len(c.AllNodes())+1),
+		acked:     make(map[string]bool),
+		responded: make(map[string]bool),
+	}
+
+	// Register the query before queueing it so that no response can arrive
+	// before we're ready for it.
+	c.queries.Lock()
+	broadcast := c.queueBroadcast(broadcastQuery, bytes)
+	response.index = broadcast.index
+	c.queries.m[response.index] = response
+	c.queries.Unlock()
+
+	c.clock.AfterFunc(timeout, response.Close)
+
+	logfDebug("Sent query %s as %s\n", name, broadcast.Label())
+
+	// Broadcasts aren't delivered to their origin, so ask ourselves directly.
+	c.receiveQuery(broadcast)
+
+	return response, nil
+}
+
+// Acks returns the channel on which each member that acknowledges the query
+// is sent. Nothing is sent unless QueryParams.RequestAck was set. It's closed
+// at the deadline.
+func (r *QueryResponse) Acks() <-chan *Node {
+	return r.acks
+}
+
+// Responses returns the channel on which responses are sent. It's closed at
+// the deadline.
+func (r *QueryResponse) Responses() <-chan NodeResponse {
+	return r.responses
+}
+
+// Deadline returns the time at which the query stops collecting responses.
+func (r *QueryResponse) Deadline() time.Time {
+	return r.deadline
+}
+
+// Expected returns the number of members that this host knew of, matching
+// the query's filters, when the query was sent. It's a guide to how many
+// acknowledgements to expect, not a guarantee.
+func (r *QueryResponse) Expected() int {
+	return r.expected
+}
+
+// Finished returns true once the deadline has passed or Close() has been
+// called.
+func (r *QueryResponse) Finished() bool {
+	r.Lock()
+	defer r.Unlock()
+
+	return r.closed
+}
+
+// Close stops collecting responses before the deadline and closes the
+// channels. It's safe to call more than once.
+func (r *QueryResponse) Close() {
+	r.cluster.queries.Lock()
+	delete(r.cluster.queries.m, r.index)
+	r.cluster.queries.Unlock()
+
+	r.Lock()
+	defer r.Unlock()
+
+	if r.closed {
+		return
+	}
+
+	r.closed = true
+
+	close(r.responses)
+	close(r.acks)
+}
+
+// Name returns the name of the query.
+func (q *QueryRequest) Name() string {
+	return q.name
+}
+
+// Payload returns the query's payload.
+func (q *QueryRequest) Payload() []byte {
+	return q.payload
+}
+
+// Origin returns the member that sent the query.
+func (q *QueryRequest) Origin() *Node {
+	return q.origin
+}
+
+// Deadline returns the time after which responses are no longer accepted.
+func (q *QueryRequest) Deadline() time.Time {
+	return q.deadline
+}
+
+// Respond sends a response to the query's originator. Only one response may
+// be sent per query, and only before the deadline. Responses too large for a
+// UDP message are sent over TCP.
+func (q *QueryRequest) Respond(payload []byte) error {
+	q.Lock()
+	defer q.Unlock()
+
+	if q.responded {
+		return errors.New("query has already been responded to")
+	}
+
+	if q.cluster.clock.Now().After(q.deadline) {
+		return errors.New("query deadline has passed")
+	}
+
+	if len(payload) > MaxDirectMessageBytes {
+		return fmt.Errorf("query response length exceeds %d bytes", MaxDirectMessageBytes)
+	}
+
+	q.responded = true
+
+	c := q.cluster
+
+	if q.origin.Address() == c.thisHost.Address() {
+		c.receiveQueryResponse(c.thisHost, q.index, payload)
+		return nil
+	}
+
+	return c.sendDirect(q.origin, &directMessage{
+		id:      q.index,
+		flags:   directQueryResponse,
+		payload: payload,
+	}, 0)
+}
+
+/******************************************************************************
+ * Private functions (for internal use only)
+ *****************************************************************************/
+
+// queryTimeout returns the default query timeout. Like the suspicion timeout
+// it's scaled logarithmically by cluster size, since a query takes longer to
+// reach every member of a larger cluster.
+func (c *Cluster) queryTimeout() time.Duration {
+	scale := math.Max(1.0, math.Log10(float64(c.knownNodes.length())))
+	timeout := queryTimeoutMultiplier * scale * float64(c.HeartbeatMillis())
+
+	return time.Duration(timeout) * time.Millisecond
+}
+
+// matchesQueryFilter returns true if the node matches a query's filters. With
+// no status filter, only healthy nodes match.
+func matchesQueryFilter(n *Node, statuses []NodeStatus, metadata map[string]string) bool {
+	status := n.Status()
+
+	if len(statuses) == 0 {
+		if status != StatusAlive {
+			return false
+		}
+	} else {
+		matched := false
+		for _, s := range statuses {
+			if status == s {
+				matched = true
+				break
+			}
+		}
+
+		if !matched {
+			return false
+		}
+	}
+
+	if len(metadata) > 0 {
+		md := n.Metadata()
+		for k, v := range metadata {
+			if value, ok := md[k]; !ok || value != v {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+// Query broadcast contents
+// Bytes 00    Flags (bit 0: acknowledgement requested)
+// Bytes 01-04 Timeout (millis)
+// Bytes 05    Name length (N bytes)
+// Bytes 06-NN Name
+// Bytes +0    Status filter count (S)
+// Bytes +1-SS Status filter, one status byte each
+// Bytes +0    Metadata filter count
+// Bytes +1-MM Metadata filter, as encodeMetadata() without the count
+// Bytes +0-PP Payload (the remainder)
+func encodeQuery(name string, payload []byte, params *QueryParams, timeout time.Duration) ([]byte, error) {
+	if len(params.FilterStatus) > 255 || len(params.FilterMetadata) > 255 {
+		return nil, errors.New("too many query filters")
+	}
+
+	keys := make([]string, 0, len(params.FilterMetadata))
+	size := 8 + len(name) + len(params.FilterStatus) + len(payload)
+
+	for k, v := range params.FilterMetadata {
+		if len(k) > 255 || len(v) > 255 {
+			return nil, errors.New("query metadata filter key or value is too long")
+		}
+
+		keys = append(keys, k)
+		size += 2 + len(k) + len(v)
+	}
+
+	sort.Strings(keys)
+
+	var flags byte
+	if params.RequestAck {
+		flags |= queryAckRequested
+	}
+
+	bytes := make([]byte, size)
+
+	p := 0
+	p += encodeByte(flags, bytes, p)
+	p += encodeUint32(uint32(timeout/time.Millisecond), bytes, p)
+	p += encodeByte(byte(len(name)), bytes, p)
+	p += copy(bytes[p:], name)
+
+	p += encodeByte(byte(len(params.FilterStatus)), bytes, p)
+	for _, s := range params.FilterStatus {
+		p += encodeByte(byte(s), bytes, p)
+	}
+
+	p += encodeByte(byte(len(keys)), bytes, p)
+	for _, k := range keys {
+		v := params.FilterMetadata[k]
+
+		p += encodeByte(byte(len(k)), bytes, p)
+		p += copy(bytes[p:], k)
+		p += encodeByte(byte(len(v)), bytes, p)
+		p += copy(bytes[p:], v)
+	}
+
+	copy(bytes[p:], payload)
+
+	return bytes, nil
+}
+
+// decodeQuery decodes a query broadcast, returning the query name, its
+// params and its payload.
+func decodeQuery(bytes []byte) (string, *QueryParams, []byte, error) {
+	truncated := errors.New("query is truncated")
+
+	if len(bytes) < 6 {
+		return "", nil, nil, truncated
+	}
+
+	params := &QueryParams{}
+
+	flags, p := decodeByte(bytes, 0)
+	params.RequestAck = flags&queryAckRequested != 0
+
+	timeout, p := decodeUint32(bytes, p)
+	params.Timeout = time.Duration(timeout) * time.Millisecond
+
+	strs, p, ok := decodeShortStrings(bytes, p, 1)
+	if !ok || p >= len(bytes) {
+		return "", nil, nil, truncated
+	}
+
+	name := strs[0]
+
+	count := int(bytes[p])
+	p++
+
+	if p+count >= len(bytes) {
+		return "", nil, nil, truncated
+	}
+
+	for i := 0; i < count; i++ {
+		params.FilterStatus = append(params.FilterStatus, NodeStatus(bytes[p]))
+		p++
+	}
+
+	count = int(bytes[p])
+	p++
+
+	strs, p, ok = decodeShortStrings(bytes, p, 2*count)
+	if !ok {
+		return "", nil, nil, truncated
+	}
+
+	if count > 0 {
+		params.FilterMetadata = make(map[string]string, count)
+		for i := 0; i < count; i++ {
+			params.FilterMetadata[strs[2*i]] = strs[2*i+1]
+		}
+	}
+
+	return name, params, bytes[p:], nil
+}
+
+// receiveQuery is called by receiveBroadcast() when a query is received (and
+// by Query() for queries originated by this host). If this host matches the
+// query's filters, it acknowledges the query if asked to, then passes it to
+// the handlers registered under its name.
+func (c *Cluster) receiveQuery(broadcast *Broadcast) {
+	name, params, payload, err := decodeQuery(broadcast.bytes)
+	if err != nil {
+		logWarn("Ignoring malformed query", broadcast.Label(), "->", err)
+		return
+	}
+
+	if !matchesQueryFilter(c.thisHost, params.FilterStatus, params.FilterMetadata) {
+		return
+	}
+
+	local := broadcast.origin.Address() == c.thisHost.Address()
+
+	if params.RequestAck {
+		if local {
+			c.receiveQueryAck(c.thisHost, broadcast.index)
+		} else {
+			err = c.sendDirect(broadcast.origin, &directMessage{
+				id:    broadcast.index,
+				flags: directQueryAck,
+			}, 0)
+
+			if err != nil {
+				logWarn("Failed to acknowledge query", broadcast.Label(), "->", err)
+			}
+		}
+	}
+
+	c.queryHandlers.RLock()
+	handlers := c.queryHandlers.m[name]
+	c.queryHandlers.RUnlock()
+
+	if len(handlers) == 0 {
+		return
+	}
+
+	query := &QueryRequest{
+		cluster:  c,
+		name:     name,
+		payload:  payload,
+		origin:   broadcast.origin,
+		index:    broadcast.index,
+		deadline: c.clock.Now().Add(params.Timeout),
+	}
+
+	logfDebug("Received query %s as %s\n", name, broadcast.Label())
+
+	for _, h := range handlers {
+		h.OnQuery(query)
+	}
+}
+
+// receiveQueryAck records a member's acknowledgement of a query originated by
+// this host.
+func (c *Cluster) receiveQueryAck(sender *Node, index uint32) {
+	c.queries.Lock()
+	response, ok := c.queries.m[index]
+	c.queries.Unlock()
+
+	if !ok {
+		return
+	}
+
+	response.Lock()
+	defer response.Unlock()
+
+	if response.closed || response.acked[sender.Address()] {
+		return
+	}
+
+	response.acked[sender.Address()] = true
+
+	select {
+	case response.acks <- sender:
+	default:
+		logWarn("Dropped query acknowledgement from", sender.Address())
+	}
+}
+
+// receiveQueryResponse records a member's response to a query originated by
+// this host.
+func (c *Cluster) receiveQueryResponse(sender *Node, index uint32, payload []byte) {
+	c.queries.Lock()
+	response, ok := c.queries.m[index]
+	c.queries.Unlock()
+
+	if !ok {
+		return
+	}
+
+	response.Lock()
+	defer response.Unlock()
+
+	if response.closed || response.responded[sender.Address()] {
+		return
+	}
+
+	response.responded[sender.Address()] = true
+
+	select {
+	case response.responses <- NodeResponse{From: sender, Payload: payload}:
+	default:
+		logWarn("Dropped query response from", sender.Address())
+	}
+}
@@ -0,0 +1,187 @@
+/*
+Copyright 2016 The Smudge Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package smudge
+
+import (
+	"net"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+// Responds to every query with this host's address.
+type addressQueryHandler struct {
+	address string
+}
+
+func (h addressQueryHandler) OnQuery(query *QueryRequest) {
+	query.Respond([]byte(h.address + ":" + string(query.Payload())))
+}
+
+func TestEncodeDecodeQuery(t *testing.T) {
+	params := &QueryParams{
+		FilterStatus:   []NodeStatus{StatusAlive, StatusSuspected},
+		FilterMetadata: map[string]string{"role": "cache", "dc": "east"},
+		RequestAck:     true,
+	}
+
+	bytes, err := encodeQuery("shards", []byte("12"), params, 1500*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	name, decoded, payload, err := decodeQuery(bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	params.Timeout = 1500 * time.Millisecond
+
+	if name != "shards" || string(payload) != "12" || !reflect.DeepEqual(params, decoded) {
+		t.Errorf("unexpected query %q %q %+v", name, payload, decoded)
+	}
+
+	if _, _, _, err = decodeQuery(bytes[:10]); err == nil {
+		t.Error("expected an error decoding a truncated query")
+	}
+}
+
+func TestMatchesQueryFilter(t *testing.T) {
+	n, _ := CreateNodeByIP(net.ParseIP("10.0.0.1"), 9999)
+	n.status = StatusAlive
+	n.metadata, _ = encodeMetadata(map[string]string{"role": "cache"})
+
+	tests := []struct {
+		statuses []NodeStatus
+		metadata map[string]string
+		expected bool
+	}{
+		{nil, nil, true},
+		{[]NodeStatus{StatusDead}, nil, false},
+		{[]NodeStatus{StatusDead, StatusAlive}, nil, true},
+		{nil, map[string]string{"role": "cache"}, true},
+		{nil, map[string]string{"role": "db"}, false},
+		{nil, map[string]string{"role": "cache", "dc": "east"}, false},
+	}
+
+	for i, test := range tests {
+		if matchesQueryFilter(n, test.statuses, test.metadata) != test.expected {
+			t.Errorf("case %d: expected %v", i, test.expected)
+		}
+	}
+
+	n.status = StatusSuspected
+	if matchesQueryFilter(n, nil, nil) {
+		t.Error("only healthy nodes should match an unfiltered query")
+	}
+}
+
+// Query a two-member cluster, collecting acknowledgements and responses from
+// both members, then only from the one whose metadata matches a filter.
+func TestQuery(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping network test in short mode")
+	}
+
+	SetLogThreshold(LogWarn)
+	defer SetLogThreshold(LogInfo)
+
+	loopback := net.IP([]byte{127, 0, 0, 1})
+
+	newQueryTestCluster := func(port int) *Cluster {
+		c := NewCluster(&Config{
+			ListenIP:        loopback,
+			ListenPort:      port,
+			HeartbeatMillis: 20,
+			InitialHosts:    []string{},
+			SecretKeys:      [][]byte{testKey1},
+		})
+
+		c.AddQueryHandler("whoami", addressQueryHandler{nodeAddressString(loopback, uint16(port))})
+
+		return c
+	}
+
+	a := newQueryTestCluster(19151)
+	b := newQueryTestCluster(19152)
+
+	seed, _ := CreateNodeByIP(loopback, 19151)
+	b.AddNode(seed)
+
+	go a.Begin()
+	go b.Begin()
+	defer a.Stop()
+	defer b.Stop()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(a.HealthyNodes()) != 2 || len(b.HealthyNodes()) != 2 {
+		if time.Now().After(deadline) {
+			t.Fatal("members did not converge")
+		}
+
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	b.SetLocalMetadata(map[string]string{"role": "cache"})
+
+	for len(a.knownNodes.getByAddress("127.0.0.1:19152").Metadata()) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("metadata did not propagate")
+		}
+
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	collect := func(params *QueryParams) ([]string, int) {
+		response, err := a.Query("whoami", []byte("?"), params)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		responses := make([]string, 0)
+		for r := range response.Responses() {
+			responses = append(responses, string(r.Payload))
+		}
+
+		acks := 0
+		for range response.Acks() {
+			acks++
+		}
+
+		sort.Strings(responses)
+
+		return responses, acks
+	}
+
+	responses, acks := collect(&QueryParams{Timeout: time.Second, RequestAck: true})
+
+	expected := []string{"127.0.0.1:19151:?", "127.0.0.1:19152:?"}
+	if !reflect.DeepEqual(responses, expected) || acks != 2 {
+		t.Errorf("got responses %v and %d acks", responses, acks)
+	}
+
+	responses, acks = collect(&QueryParams{
+		Timeout:        time.Second,
+		FilterMetadata: map[string]string{"role": "cache"},
+	})
+
+	expected = []string{"127.0.0.1:19152:?"}
+	if !reflect.DeepEqual(responses, expected) || acks != 0 {
+		t.Errorf("got responses %v and %d acks", responses, acks)
+	}
+}
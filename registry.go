@@ -22,58 +22,53 @@ import (
 	"sort"
 	"strconv"
 	"strings"
-	"sync"
+	"time"
 )
 
-// All known nodes, living and dead. Dead nodes are pinged (far) less often,
-// and are eventually removed
-var knownNodes = nodeMap{}
-
-// All nodes that have been updated "recently", living and dead
-var updatedNodes = nodeMap{}
-
-var deadNodeRetries = struct {
-	sync.RWMutex
-	m map[string]*deadNodeCounter
-}{m: make(map[string]*deadNodeCounter)}
-
 const maxDeadNodeRetries = 10
 
-func init() {
-	knownNodes.init()
-	updatedNodes.init()
-}
+// How long a node that has left the cluster is remembered before it's
+// forgotten. Until then, its LEFT status keeps stale gossip from bringing it
+// back as alive.
+const leftNodeRetentionMillis = 60000
 
 /******************************************************************************
  * Exported functions (for public consumption)
  *****************************************************************************/
 
+// AddNode can be used to explicitly add a node to the default cluster's list
+// of known live nodes. See Cluster.AddNode().
+func AddNode(node *Node) (*Node, error) {
+	return defaultCluster.AddNode(node)
+}
+
 // AddNode can be used to explicitly add a node to the list of known live
 // nodes. Updates the node timestamp but DOES NOT implicitly update the node's
 // status; you need to do this explicitly.
-func AddNode(node *Node) (*Node, error) {
-	if !knownNodes.contains(node) {
-		if node.status == StatusUnknown {
+func (c *Cluster) AddNode(node *Node) (*Node, error) {
+	if !c.knownNodes.contains(node) {
+		if status := node.Status(); status == StatusUnknown {
 			logWarn(node.Address(),
 				"does not have a status! Setting to",
 				StatusAlive)
 
-			UpdateNodeStatus(node, StatusAlive)
-		} else if node.status == StatusForwardTo {
+			c.UpdateNodeStatus(node, StatusAlive)
+		} else if status == StatusForwardTo {
 			panic("invalid status: " + StatusForwardTo.String())
 		}
 
-		node.Touch()
+		c.touch(node)
 
-		_, n, err := knownNodes.add(node)
+		_, n, err := c.knownNodes.add(node)
 
 		logfInfo("Adding host: %s (total=%d live=%d dead=%d)\n",
 			node.Address(),
-			knownNodes.length(),
-			knownNodes.lengthWithStatus(StatusAlive),
-			knownNodes.lengthWithStatus(StatusDead))
+			c.knownNodes.length(),
+			c.knownNodes.lengthWithStatus(StatusAlive),
+			c.knownNodes.lengthWithStatus(StatusDead))
 
-		knownNodesModifiedFlag = true
+		c.knownNodesModifiedFlag.Set()
+		c.reportMemberCounts()
 
 		return n, err
 	}
@@ -85,10 +80,18 @@ func AddNode(node *Node) (*Node, error) {
 // node address ("ip:port" string). This doesn't add the node to the list of
 // live nodes; use AddNode().
 func CreateNodeByAddress(address string) (*Node, error) {
-	ip, port, err := parseNodeAddress(address)
+	return defaultCluster.CreateNodeByAddress(address)
+}
+
+// CreateNodeByAddress will create and return a new node when supplied with a
+// node address ("ip:port" string). If the port is omitted, this cluster's
+// listen port is assumed. This doesn't add the node to the list of live
+// nodes; use AddNode().
+func (c *Cluster) CreateNodeByAddress(address string) (*Node, error) {
+	ip, port, err := parseNodeAddress(address, uint16(c.ListenPort()))
 
 	if err == nil {
-		return CreateNodeByIP(ip, port)
+		return c.createNodeByIP(ip, port), nil
 	}
 
 	return nil, err
@@ -96,23 +99,49 @@ func CreateNodeByAddress(address string) (*Node, error) {
 
 // CreateNodeByIP will create and return a new node when supplied with an
 // IP address and port number. This doesn't add the node to the list of live
-// nodes; use AddNode().
+// nodes; use AddNode(), after which its age is measured on that cluster's
+// clock rather than the system clock.
 func CreateNodeByIP(ip net.IP, port uint16) (*Node, error) {
-	node := Node{
+	ip = normalizeIP(ip)
+
+	node := &Node{
 		ip:         ip,
 		port:       port,
-		timestamp:  GetNowInMillis(),
+		address:    nodeAddressString(ip, port),
+		timestamp:  time.Now(),
 		pingMillis: PingNoData,
 	}
 
-	return &node, nil
+	return node, nil
+}
+
+// createNodeByIP is CreateNodeByIP() for nodes the cluster creates itself,
+// whose timestamps are taken from the cluster's clock.
+func (c *Cluster) createNodeByIP(ip net.IP, port uint16) *Node {
+	node, _ := CreateNodeByIP(ip, port)
+	c.touch(node)
+
+	return node
+}
+
+// touch sets a node's timestamp to the current time on the cluster's clock,
+// against which its Age() is then measured.
+func (c *Cluster) touch(node *Node) {
+	node.mutex.Lock()
+	defer node.mutex.Unlock()
+
+	node.clock = c.clock
+	node.timestamp = c.clock.Now()
 }
 
-// GetLocalIP queries the host interface to determine the local IPv4 of this
-// machine. If a local IPv4 cannot be found, then nil is returned. If the
-// query to the underlying OS fails, an error is returned.
+// GetLocalIP queries the host interface to determine the local IP of this
+// machine. IPv4 addresses are preferred; if none can be found, the first
+// global unicast IPv6 address is used instead, which allows IPv6-only hosts.
+// If no suitable address can be found, then nil is returned. If the query to
+// the underlying OS fails, an error is returned.
 func GetLocalIP() (net.IP, error) {
 	var ip net.IP
+	var ip6 net.IP
 
 	ifaces, err := net.Interfaces()
 	if err != nil {
@@ -145,32 +174,51 @@ func GetLocalIP() (net.IP, error) {
 			case *net.IPAddr:
 				ip = v.IP
 			}
-			ip = ip.To4()
-			if ip == nil {
-				continue // not an ipv4 address
-			}
 
 			if ip == nil || ip.IsLoopback() {
 				continue
 			}
-			return ip, err
+
+			if ip.To4() == nil {
+				// Link-local IPv6 addresses need a zone to be usable, so we
+				// only consider global unicast addresses.
+				if ip6 == nil && ip.IsGlobalUnicast() {
+					ip6 = ip.To16()
+				}
+
+				continue
+			}
+
+			return ip.To4(), err
 		}
 	}
 
-	return ip, nil
+	return ip6, nil
+}
+
+// AllNodes will return a list of all nodes known to the default cluster. See
+// Cluster.AllNodes().
+func AllNodes() []*Node {
+	return defaultCluster.AllNodes()
 }
 
 // AllNodes will return a list of all nodes known at the time of the request,
 // including nodes that have been marked as "dead" but haven't yet been
 // removed from the registry.
-func AllNodes() []*Node {
-	return knownNodes.values()
+func (c *Cluster) AllNodes() []*Node {
+	return c.knownNodes.values()
+}
+
+// HealthyNodes will return a list of all nodes known to the default cluster
+// with a healthy status. See Cluster.HealthyNodes().
+func HealthyNodes() []*Node {
+	return defaultCluster.HealthyNodes()
 }
 
 // HealthyNodes will return a list of all nodes known at the time of the
 // request with a healthy status.
-func HealthyNodes() []*Node {
-	values := knownNodes.values()
+func (c *Cluster) HealthyNodes() []*Node {
+	values := c.knownNodes.values()
 	filtered := make([]*Node, 0, len(values))
 
 	for _, v := range values {
@@ -182,22 +230,30 @@ func HealthyNodes() []*Node {
 	return filtered
 }
 
+// RemoveNode can be used to explicitly remove a node from the default
+// cluster's list of known live nodes. See Cluster.RemoveNode().
+func RemoveNode(node *Node) (*Node, error) {
+	return defaultCluster.RemoveNode(node)
+}
+
 // RemoveNode can be used to explicitly remove a node from the list of known
 // live nodes. Updates the node timestamp but DOES NOT implicitly update the
 // node's status; you need to do this explicitly.
-func RemoveNode(node *Node) (*Node, error) {
-	if knownNodes.contains(node) {
-		node.Touch()
+func (c *Cluster) RemoveNode(node *Node) (*Node, error) {
+	if c.knownNodes.contains(node) {
+		c.touch(node)
 
-		_, n, err := knownNodes.delete(node)
+		_, n, err := c.knownNodes.delete(node)
+		c.noteSuspicion(node, StatusUnknown)
 
 		logfInfo("Removing host: %s (total=%d live=%d dead=%d)\n",
 			node.Address(),
-			knownNodes.length(),
-			knownNodes.lengthWithStatus(StatusAlive),
-			knownNodes.lengthWithStatus(StatusDead))
+			c.knownNodes.length(),
+			c.knownNodes.lengthWithStatus(StatusAlive),
+			c.knownNodes.lengthWithStatus(StatusDead))
 
-		knownNodesModifiedFlag = true
+		c.knownNodesModifiedFlag.Set()
+		c.reportMemberCounts()
 
 		return n, err
 	}
@@ -205,27 +261,34 @@ func RemoveNode(node *Node) (*Node, error) {
 	return node, nil
 }
 
+// UpdateNodeStatus assigns a new status for the specified node in the
+// default cluster. See Cluster.UpdateNodeStatus().
+func UpdateNodeStatus(node *Node, status NodeStatus) {
+	defaultCluster.UpdateNodeStatus(node, status)
+}
+
 // UpdateNodeStatus assigns a new status for the specified node and adds it to
 // the list of recently updated nodes. If the status is StatusDead, then the
-// node will be moved from the live nodes list to the dead nodes list.
-func UpdateNodeStatus(node *Node, status NodeStatus) {
-	updateNodeStatus(node, status, node.heartbeat)
+// node will be moved from the live nodes list to the dead nodes list. Unlike
+// gossiped updates, this is applied regardless of the node's incarnation.
+func (c *Cluster) UpdateNodeStatus(node *Node, status NodeStatus) {
+	c.setNodeStatus(node, status, node.Heartbeat(), node.Incarnation())
 }
 
 /******************************************************************************
  * Private functions (for internal use only)
  *****************************************************************************/
 
-func getRandomUpdatedNodes(size int, exclude ...*Node) []*Node {
+func (c *Cluster) getRandomUpdatedNodes(size int, exclude ...*Node) []*Node {
 	updatedNodesCopy := nodeMap{}
 	updatedNodesCopy.init()
 
 	// Prune nodes with emit counters of 0 (or less) from the map. Any
 	// others we copy into a secondary nodemap.
-	for _, n := range updatedNodes.values() {
-		if n.emitCounter <= 0 {
+	for _, n := range c.updatedNodes.values() {
+		if n.EmitCounter() <= 0 {
 			logDebug("Removing", n.Address(), "from recently updated list")
-			updatedNodes.delete(n)
+			c.updatedNodes.delete(n)
 		} else {
 			updatedNodesCopy.add(n)
 		}
@@ -248,27 +311,52 @@ func getRandomUpdatedNodes(size int, exclude ...*Node) []*Node {
 	return updatedNodesSlice[:size]
 }
 
-func parseNodeAddress(hostAndMaybePort string) (net.IP, uint16, error) {
+// parseNodeAddress accepts "host", "host:port", "ipv4", "ipv4:port", a bare
+// IPv6 literal, "[ipv6]" or "[ipv6]:port". If the port is omitted then
+// defaultPort is used. Where a hostname resolves to both IPv4 and IPv6
+// addresses, IPv4 is preferred.
+func parseNodeAddress(hostAndMaybePort string, defaultPort uint16) (net.IP, uint16, error) {
 	var host string
 	var ip net.IP
 	var port uint16
 	var err error
 
-	if strings.Contains(hostAndMaybePort, ":") {
-		splode := strings.Split(hostAndMaybePort, ":")
+	switch {
+	case strings.HasPrefix(hostAndMaybePort, "[") &&
+		strings.HasSuffix(hostAndMaybePort, "]"):
+		// "[ipv6]" with no port
+		host = hostAndMaybePort[1 : len(hostAndMaybePort)-1]
+		port = defaultPort
 
-		if len(splode) == 2 {
-			p, e := strconv.ParseUint(splode[1], 10, 16)
+	case strings.HasPrefix(hostAndMaybePort, "[") ||
+		strings.Count(hostAndMaybePort, ":") == 1:
+		// "host:port" or "[ipv6]:port"
+		var portString string
 
-			host = splode[0]
-			port = uint16(p)
-			err = e
-		} else {
-			err = errors.New("too many colons in argument " + hostAndMaybePort)
+		host, portString, err = net.SplitHostPort(hostAndMaybePort)
+		if err != nil {
+			return ip, port, err
+		}
+
+		p, e := strconv.ParseUint(portString, 10, 16)
+		if e != nil {
+			return ip, port, e
+		}
+
+		port = uint16(p)
+
+	case strings.Contains(hostAndMaybePort, ":"):
+		// A bare IPv6 literal
+		if net.ParseIP(hostAndMaybePort) == nil {
+			return ip, port, errors.New("invalid address " + hostAndMaybePort)
 		}
-	} else {
+
+		host = hostAndMaybePort
+		port = defaultPort
+
+	default:
 		host = hostAndMaybePort
-		port = uint16(GetListenPort())
+		port = defaultPort
 	}
 
 	ips, err := net.LookupIP(host)
@@ -279,6 +367,11 @@ func parseNodeAddress(hostAndMaybePort string) (net.IP, uint16, error) {
 	for _, i := range ips {
 		if i.To4() != nil {
 			ip = i.To4()
+			break
+		}
+
+		if ip == nil {
+			ip = i.To16()
 		}
 	}
 
@@ -294,41 +387,91 @@ func parseNodeAddress(hostAndMaybePort string) (net.IP, uint16, error) {
 	return ip, port, err
 }
 
-// UpdateNodeStatus assigns a new status for the specified node and adds it to
-// the list of recently updated nodes. If the status is StatusDead, then the
-// node will be moved from the live nodes list to the dead nodes list.
-func updateNodeStatus(node *Node, status NodeStatus, heartbeat uint32) {
-	if node.status != status {
-		if heartbeat < node.heartbeat {
-			logfWarn("Decreasing known node heartbeat value from %d to %d\n",
-				node.heartbeat,
-				heartbeat)
-		}
+// updateNodeStatus applies a status update about a node (typically received
+// via gossip) if it supersedes what we already know, following the SWIM
+// ordering rules: a higher incarnation always wins, and at equal incarnations
+// LEFT overrides DEAD, which overrides SUSPECTED, which overrides ALIVE.
+// Returns true if the update was applied.
+func (c *Cluster) updateNodeStatus(node *Node, status NodeStatus, heartbeat uint32, incarnation uint32) bool {
+	node.mutex.RLock()
+	currentStatus, currentIncarnation := node.status, node.incarnation
+	node.mutex.RUnlock()
+
+	if !statusSupersedes(status, incarnation, currentStatus, currentIncarnation) {
+		logfTrace("Ignoring %s for %s at incarnation %d (have %s at %d)\n",
+			status,
+			node.Address(),
+			incarnation,
+			currentStatus,
+			currentIncarnation)
 
-		node.timestamp = GetNowInMillis()
-		node.status = status
-		node.emitCounter = int8(emitCount())
-		node.heartbeat = heartbeat
+		return false
+	}
 
-		// If this isn't in the recently updated list, add it.
-		if !updatedNodes.contains(node) {
-			updatedNodes.add(node)
-		}
+	c.setNodeStatus(node, status, heartbeat, incarnation)
 
-		if status != StatusDead {
-			deadNodeRetries.Lock()
-			delete(deadNodeRetries.m, node.Address())
-			deadNodeRetries.Unlock()
-		}
+	return true
+}
+
+// setNodeStatus unconditionally assigns a new status and incarnation for the
+// specified node and adds it to the list of recently updated nodes. Status
+// events are published only if the status actually changed.
+func (c *Cluster) setNodeStatus(node *Node, status NodeStatus, heartbeat uint32, incarnation uint32) {
+	emitCount := int8(c.emitCount())
+
+	node.mutex.Lock()
+
+	if node.status == status && node.incarnation == incarnation {
+		node.mutex.Unlock()
+		return
+	}
+
+	if heartbeat < node.heartbeat {
+		logfWarn("Decreasing known node heartbeat value from %d to %d\n",
+			node.heartbeat,
+			heartbeat)
+	}
+
+	previous := node.status
+	changed := previous != status
+
+	node.clock = c.clock
+	node.timestamp = c.clock.Now()
+	node.status = status
+	node.emitCounter = emitCount
+	node.heartbeat = heartbeat
+	node.incarnation = incarnation
+
+	node.mutex.Unlock()
+
+	// If this isn't in the recently updated list, add it.
+	if !c.updatedNodes.contains(node) {
+		c.updatedNodes.add(node)
+	}
+
+	if status != StatusDead {
+		c.deadNodeRetries.Lock()
+		delete(c.deadNodeRetries.m, node.Address())
+		c.deadNodeRetries.Unlock()
+	}
 
+	c.noteSuspicion(node, status)
+
+	if changed {
 		logfInfo("Updating host: %s to %s (total=%d live=%d dead=%d)\n",
 			node.Address(),
 			status,
-			knownNodes.length(),
-			knownNodes.lengthWithStatus(StatusAlive),
-			knownNodes.lengthWithStatus(StatusDead))
+			c.knownNodes.length(),
+			c.knownNodes.lengthWithStatus(StatusAlive),
+			c.knownNodes.lengthWithStatus(StatusDead))
+
+		c.Metrics().IncrCounter(MetricStatusTransitions, []Label{
+			{"from", statusLabel(previous)},
+			{"to", statusLabel(status)},
+		}, 1)
+		c.reportMemberCounts()
 
-		doStatusUpdate(node, status)
+		c.doStatusUpdate(node, previous, status)
 	}
 }
 
@@ -350,5 +493,5 @@ func (a byNodeEmitCounter) Swap(i, j int) {
 }
 
 func (a byNodeEmitCounter) Less(i, j int) bool {
-	return a[i].emitCounter > a[j].emitCounter
+	return a[i].EmitCounter() > a[j].EmitCounter()
 }
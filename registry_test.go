@@ -0,0 +1,108 @@
+/*
+Copyright 2016 The Smudge Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package smudge
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestParseNodeAddressIPv4(t *testing.T) {
+	ip, port, err := parseNodeAddress("10.1.2.3:1234", 9999)
+
+	if err != nil || !ip.Equal(net.IP([]byte{10, 1, 2, 3})) || port != 1234 {
+		t.Errorf("ip=%v port=%d err=%v", ip, port, err)
+	}
+
+	if len(ip) != net.IPv4len {
+		t.Errorf("expected 4-byte ip, got %d bytes", len(ip))
+	}
+}
+
+func TestParseNodeAddressIPv4NoPort(t *testing.T) {
+	ip, port, err := parseNodeAddress("10.1.2.3", 9999)
+
+	if err != nil || !ip.Equal(net.IP([]byte{10, 1, 2, 3})) || port != 9999 {
+		t.Errorf("ip=%v port=%d err=%v", ip, port, err)
+	}
+}
+
+func TestParseNodeAddressIPv6(t *testing.T) {
+	ip, port, err := parseNodeAddress("[2001:db8::1]:1234", 9999)
+
+	if err != nil || !ip.Equal(net.ParseIP("2001:db8::1")) || port != 1234 {
+		t.Errorf("ip=%v port=%d err=%v", ip, port, err)
+	}
+}
+
+func TestParseNodeAddressIPv6Bracketed(t *testing.T) {
+	ip, port, err := parseNodeAddress("[2001:db8::1]", 9999)
+
+	if err != nil || !ip.Equal(net.ParseIP("2001:db8::1")) || port != 9999 {
+		t.Errorf("ip=%v port=%d err=%v", ip, port, err)
+	}
+}
+
+func TestParseNodeAddressIPv6Bare(t *testing.T) {
+	ip, port, err := parseNodeAddress("2001:db8::1", 9999)
+
+	if err != nil || !ip.Equal(net.ParseIP("2001:db8::1")) || port != 9999 {
+		t.Errorf("ip=%v port=%d err=%v", ip, port, err)
+	}
+}
+
+func TestParseNodeAddressBadPort(t *testing.T) {
+	_, _, err := parseNodeAddress("10.1.2.3:notaport", 9999)
+
+	if err == nil {
+		t.Error("expected an error for an invalid port")
+	}
+}
+
+func TestNodeAddressIPv6(t *testing.T) {
+	node, _ := CreateNodeByIP(net.ParseIP("2001:db8::1"), 1234)
+
+	if node.Address() != "[2001:db8::1]:1234" {
+		t.Error("unexpected address:", node.Address())
+	}
+}
+
+// A snapshot agrees with the accessors of a node that isn't changing.
+func TestNodeSnapshot(t *testing.T) {
+	clock := NewFakeClock(time.Unix(1000, 0))
+	c := NewCluster(&Config{Clock: clock})
+
+	node := c.createNodeByIP(net.ParseIP("10.0.0.1"), 9999)
+	c.updateNodeStatus(node, StatusSuspected, 5, 2)
+	metadata, _ := encodeMetadata(map[string]string{"k": "v"})
+	node.setMetadata(metadata, 3)
+	node.setPingMillis(12)
+
+	clock.Advance(250 * time.Millisecond)
+
+	snapshot := node.Snapshot()
+
+	if snapshot.Address != "10.0.0.1:9999" || !snapshot.IP.Equal(node.IP()) ||
+		snapshot.Port != 9999 || snapshot.Status != StatusSuspected ||
+		snapshot.PingMillis != 12 || snapshot.AgeMillis != 250 ||
+		snapshot.Heartbeat != 5 || snapshot.Incarnation != 2 ||
+		snapshot.Metadata["k"] != "v" {
+
+		t.Errorf("unexpected snapshot: %+v", snapshot)
+	}
+}
@@ -0,0 +1,684 @@
+/*
+Copyright 2016 The Smudge Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package smudge
+
+import (
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"net"
+	"sort"
+	"time"
+)
+
+// Regular broadcasts are small and best-effort. Reliable broadcasts can be
+// much larger: rather than gossiping the payload itself, the origin keeps it
+// and gossips a small announcement (an internal broadcast). Each member that
+// hears the announcement then fetches the payload over TCP in chunks, from
+// the origin or (failing that) from other members, re-requesting whichever
+// chunks it's still missing until it has them all. Once the payload is
+// complete and verified it's delivered to BroadcastListeners like any other
+// broadcast, keyed by the announcement's label.
+//
+// Announcements are gossiped like any other broadcast, which is best-effort,
+// so members also exchange the announcements of the reliable broadcasts they
+// hold whenever they sync their full state (see pushpull.go). A member that
+// missed an announcement hears of it at its next sync, as long as some member
+// it syncs with still retains the payload.
+//
+// Reliable broadcasts from each origin are delivered in the order they were
+// sent: one that completes early is held until those sent before it have been
+// delivered, or given up on.
+//
+// An origin's sequence numbers start again at 1 if it's restarted, so each
+// announcement also carries the generation of the sequence: the time at which
+// the origin's Cluster was created. When a member hears of a newer
+// generation, it forgets everything about the origin's older one.
+
+// MaxReliableBroadcastBytes is the maximum payload length of a reliable
+// broadcast.
+const MaxReliableBroadcastBytes = 8 * 1024 * 1024
+
+// The size of each chunk that a reliable broadcast is split into.
+const reliableChunkBytes = 64 * 1024
+
+// The maximum number of chunks requested at once.
+const reliableChunksPerRequest = 16
+
+// How long a member tries to fetch a reliable broadcast (or waits for an
+// earlier one before delivering a later one) before giving up.
+const reliableTimeoutMillis = 60000
+
+// How long a member keeps a reliable broadcast's payload after receiving it,
+// so that it can serve chunks to other members.
+const reliableRetentionMillis = 120000
+
+// A reliable broadcast, either sent by this host or being (or having been)
+// received from another.
+type reliableBroadcast struct {
+	origin     *Node
+	index      uint32
+	generation uint64
+	sequence   uint32
+	length     uint32
+	checksum   uint32
+	chunks     [][]byte
+	missing    int
+	started    int64
+	complete   bool
+	delivered  bool
+}
+
+/******************************************************************************
+ * Exported functions (for public consumption)
+ *****************************************************************************/
+
+// BroadcastBytesReliable emits a reliable broadcast on the default cluster.
+// See Cluster.BroadcastBytesReliable().
+func BroadcastBytesReliable(bytes []byte) error {
+	return defaultCluster.BroadcastBytesReliable(bytes)
+}
+
+// BroadcastBytesReliable emits a broadcast of up to MaxReliableBroadcastBytes
+// which, unlike BroadcastBytes(), is retried until every current member has
+// received it. Reliable broadcasts from a given member are delivered to
+// BroadcastListeners in the order they were sent, and only once the whole
+// payload has arrived. As with BroadcastBytes(), the broadcast isn't
+// delivered to the originating member.
+func (c *Cluster) BroadcastBytesReliable(bytes []byte) error {
+	if len(bytes) > MaxReliableBroadcastBytes {
+		return fmt.Errorf("reliable broadcast payload length exceeds %d bytes",
+			MaxReliableBroadcastBytes)
+	}
+
+	if c.thisHost == nil {
+		return errors.New("cluster is not running")
+	}
+
+	// The chunks are served to other members long after this returns, so
+	// they mustn't share the caller's buffer.
+	bytes = append([]byte(nil), bytes...)
+
+	rb := &reliableBroadcast{
+		origin:    c.thisHost,
+		length:    uint32(len(bytes)),
+		checksum:  crc32.ChecksumIEEE(bytes),
+		started:   c.nowMillis(),
+		complete:  true,
+		delivered: true,
+	}
+
+	for p := 0; p < len(bytes); p += reliableChunkBytes {
+		end := p + reliableChunkBytes
+		if end > len(bytes) {
+			end = len(bytes)
+		}
+
+		rb.chunks = append(rb.chunks, bytes[p:end])
+	}
+
+	c.reliable.Lock()
+	c.reliable.sequence++
+	rb.sequence = c.reliable.sequence
+	rb.generation = c.reliable.generation
+
+	announcement := c.queueBroadcast(broadcastReliable, encodeReliableAnnouncement(rb))
+	rb.index = announcement.index
+	c.reliable.m[announcement.Label()] = rb
+	c.reliable.Unlock()
+
+	return nil
+}
+
+/******************************************************************************
+ * Private functions (for internal use only)
+ *****************************************************************************/
+
+// Returns the number of chunks a payload of the given length is split into.
+func reliableChunkCount(length uint32) int {
+	return int((length + reliableChunkBytes - 1) / reliableChunkBytes)
+}
+
+// Reliable broadcast announcement contents
+// Bytes 00-03 Sequence number (per origin, starting at 1)
+// Bytes 04-07 Payload length (bytes)
+// Bytes 08-11 Payload checksum (CRC-32)
+// Bytes 12-19 Sequence generation (absent from older members' announcements)
+func encodeReliableAnnouncement(rb *reliableBroadcast) []byte {
+	bytes := make([]byte, 20)
+
+	p := 0
+	p += encodeUint32(rb.sequence, bytes, p)
+	p += encodeUint32(rb.length, bytes, p)
+	p += encodeUint32(rb.checksum, bytes, p)
+	p += encodeUint64(rb.generation, bytes, p)
+
+	return bytes
+}
+
+// receiveReliableAnnouncement is called by receiveBroadcast() when a new
+// reliable broadcast is announced. It starts fetching the payload.
+func (c *Cluster) receiveReliableAnnouncement(broadcast *Broadcast) {
+	if len(broadcast.bytes) < 12 {
+		logWarn("Ignoring malformed reliable broadcast", broadcast.Label())
+		return
+	}
+
+	rb := &reliableBroadcast{
+		origin:  broadcast.origin,
+		index:   broadcast.index,
+		started: c.nowMillis(),
+	}
+
+	p := 0
+	rb.sequence, p = decodeUint32(broadcast.bytes, p)
+	rb.length, p = decodeUint32(broadcast.bytes, p)
+	rb.checksum, p = decodeUint32(broadcast.bytes, p)
+
+	if hasBytes(broadcast.bytes, p, 8) {
+		rb.generation, _ = decodeUint64(broadcast.bytes, p)
+	}
+
+	if rb.length > MaxReliableBroadcastBytes {
+		logWarn("Ignoring oversized reliable broadcast", broadcast.Label())
+		return
+	}
+
+	rb.missing = reliableChunkCount(rb.length)
+	rb.chunks = make([][]byte, rb.missing)
+
+	label := broadcast.Label()
+	origin := broadcast.origin.Address()
+
+	c.reliable.Lock()
+
+	// Ignore stragglers from before the origin was restarted, and forget
+	// about them once we hear from after.
+	if generation, ok := c.reliable.generations[origin]; ok && rb.generation < generation {
+		c.reliable.Unlock()
+		return
+	} else if ok && rb.generation > generation {
+		logDebug("Reliable broadcast sequence of", origin, "restarted")
+		c.forgetReliableOrigin(origin)
+	}
+
+	c.reliable.generations[origin] = rb.generation
+
+	if _, ok := c.reliable.m[label]; ok {
+		c.reliable.Unlock()
+		return
+	}
+
+	// The first reliable broadcast we hear of from each origin sets where we
+	// start delivering from. Announcements may arrive out of order, so until
+	// something has been delivered, an earlier one moves the start back.
+	if last, ok := c.reliable.delivered[origin]; !ok ||
+		(c.reliable.tentative[origin] && rb.sequence <= last) {
+		c.reliable.delivered[origin] = rb.sequence - 1
+		c.reliable.tentative[origin] = true
+	}
+
+	if rb.sequence <= c.reliable.delivered[origin] {
+		c.reliable.Unlock()
+		return
+	}
+
+	c.reliable.m[label] = rb
+	c.reliable.Unlock()
+
+	logfDebug("Fetching reliable broadcast %s (%d bytes)\n", label, rb.length)
+
+	c.spawn(func() { c.fetchReliable(label, rb) })
+}
+
+// receiveReliableAnnouncements is called with the announcements received in a
+// full state sync. Any that we haven't already heard of are fetched.
+func (c *Cluster) receiveReliableAnnouncements(announcements []*Broadcast) {
+	for _, announcement := range announcements {
+		if announcement.kind != broadcastReliable ||
+			announcement.origin.Address() == c.thisHost.Address() {
+			continue
+		}
+
+		c.receiveReliableAnnouncement(announcement)
+	}
+}
+
+// reliableAnnouncements returns the announcements of every reliable
+// broadcast whose whole payload we hold, for inclusion in a full state sync.
+func (c *Cluster) reliableAnnouncements() []*Broadcast {
+	c.reliable.Lock()
+	defer c.reliable.Unlock()
+
+	announcements := make([]*Broadcast, 0)
+
+	for _, rb := range c.reliable.m {
+		if rb.complete {
+			announcements = append(announcements, &Broadcast{
+				origin: rb.origin,
+				index:  rb.index,
+				kind:   broadcastReliable,
+				bytes:  encodeReliableAnnouncement(rb),
+			})
+		}
+	}
+
+	return announcements
+}
+
+// fetchReliable requests the missing chunks of a reliable broadcast, first
+// from its origin and then from other members, until it has them all or it
+// times out. It gives up early if the cluster is stopped.
+func (c *Cluster) fetchReliable(label string, rb *reliableBroadcast) {
+	var sources []*Node
+
+	for {
+		if !c.runningFlag.IsSet() {
+			return
+		}
+
+		if c.nowMillis()-rb.started > reliableTimeoutMillis {
+			logWarn("Gave up fetching reliable broadcast", label)
+			return
+		}
+
+		if !c.reliablePending(label, rb) {
+			return
+		}
+
+		missing := c.missingChunks(rb)
+
+		if len(missing) == 0 {
+			if c.verifyReliable(label, rb) {
+				break
+			}
+
+			continue
+		}
+
+		if len(sources) == 0 {
+			sources = append([]*Node{rb.origin},
+				c.getTargetNodes(c.pingRequestCount(), rb.origin, c.thisHost)...)
+		}
+
+		source := sources[0]
+		sources = sources[1:]
+
+		chunks, err := c.requestChunks(source, label, missing)
+		if err != nil {
+			logDebug("Failed to fetch chunks of", label, "from", source.Address(), "->", err)
+		}
+
+		c.reliable.Lock()
+		for i, chunk := range chunks {
+			if int(i) < len(rb.chunks) && rb.chunks[i] == nil && len(chunk) > 0 {
+				rb.chunks[i] = chunk
+				rb.missing--
+			}
+		}
+		c.reliable.Unlock()
+
+		if len(chunks) == 0 && !c.sleep(time.Millisecond*time.Duration(c.HeartbeatMillis())) {
+			return
+		}
+	}
+
+	c.deliverReliable(rb.origin)
+}
+
+// reliablePending returns false if a reliable broadcast being fetched has
+// since been forgotten, because its origin was restarted.
+func (c *Cluster) reliablePending(label string, rb *reliableBroadcast) bool {
+	c.reliable.Lock()
+	defer c.reliable.Unlock()
+
+	return c.reliable.m[label] == rb
+}
+
+// verifyReliable checks a reliable broadcast whose chunks have all arrived
+// against its announced length and checksum, and marks it complete. If it
+// doesn't match, its chunks are discarded so that they're fetched again, in
+// case the bad ones came from one bad source, and false is returned.
+func (c *Cluster) verifyReliable(label string, rb *reliableBroadcast) bool {
+	c.reliable.Lock()
+	defer c.reliable.Unlock()
+
+	payload := make([]byte, 0, rb.length)
+	for _, chunk := range rb.chunks {
+		payload = append(payload, chunk...)
+	}
+
+	if uint32(len(payload)) != rb.length || crc32.ChecksumIEEE(payload) != rb.checksum {
+		logWarn("Reliable broadcast", label, "failed verification; refetching")
+
+		rb.chunks = make([][]byte, len(rb.chunks))
+		rb.missing = len(rb.chunks)
+
+		return false
+	}
+
+	rb.complete = true
+
+	return true
+}
+
+// forgetReliableOrigin forgets every reliable broadcast from the origin at
+// address, and where delivery from it was up to. The caller must hold the
+// reliable lock.
+func (c *Cluster) forgetReliableOrigin(address string) {
+	for label, rb := range c.reliable.m {
+		if rb.origin.Address() == address {
+			delete(c.reliable.m, label)
+		}
+	}
+
+	delete(c.reliable.delivered, address)
+	delete(c.reliable.tentative, address)
+}
+
+// missingChunks returns the indices of (up to reliableChunksPerRequest) of a
+// reliable broadcast's missing chunks.
+func (c *Cluster) missingChunks(rb *reliableBroadcast) []uint32 {
+	c.reliable.Lock()
+	defer c.reliable.Unlock()
+
+	missing := make([]uint32, 0, reliableChunksPerRequest)
+
+	for i, chunk := range rb.chunks {
+		if chunk == nil {
+			missing = append(missing, uint32(i))
+
+			if len(missing) == reliableChunksPerRequest {
+				break
+			}
+		}
+	}
+
+	return missing
+}
+
+// deliverReliable delivers, in sequence order, every complete reliable
+// broadcast from origin that isn't waiting on an earlier one.
+func (c *Cluster) deliverReliable(origin *Node) {
+	address := origin.Address()
+	deliverable := make([]*Broadcast, 0)
+
+	c.reliable.Lock()
+
+	for {
+		var next *reliableBroadcast
+
+		for _, rb := range c.reliable.m {
+			if rb.origin.Address() == address && rb.sequence == c.reliable.delivered[address]+1 {
+				next = rb
+				break
+			}
+		}
+
+		if next == nil || !next.complete {
+			break
+		}
+
+		payload := make([]byte, 0, next.length)
+		for _, chunk := range next.chunks {
+			payload = append(payload, chunk...)
+		}
+
+		deliverable = append(deliverable, &Broadcast{
+			origin: next.origin,
+			index:  next.index,
+			bytes:  payload,
+			kind:   broadcastUser,
+		})
+
+		next.delivered = true
+		c.reliable.delivered[address] = next.sequence
+		delete(c.reliable.tentative, address)
+	}
+
+	c.reliable.Unlock()
+
+	for _, broadcast := range deliverable {
+		logfInfo("Reliable broadcast [%s] (%d bytes)\n",
+			broadcast.Label(),
+			len(broadcast.bytes))
+
+		c.doBroadcastUpdate(broadcast)
+	}
+}
+
+// checkReliableBroadcasts gives up on reliable broadcasts that have been
+// incomplete for too long, so that later ones from the same origin can be
+// delivered, and forgets those that have been retained long enough. It is
+// called periodically by startTimeoutCheckLoop().
+func (c *Cluster) checkReliableBroadcasts() {
+	now := c.nowMillis()
+	waiting := make(map[string]*Node)
+
+	c.reliable.Lock()
+
+	for label, rb := range c.reliable.m {
+		age := now - rb.started
+
+		switch {
+		case rb.delivered && age > reliableRetentionMillis:
+			delete(c.reliable.m, label)
+		case !rb.complete && age > reliableTimeoutMillis:
+			delete(c.reliable.m, label)
+		case rb.complete && !rb.delivered && age > reliableTimeoutMillis:
+			waiting[rb.origin.Address()] = rb.origin
+		}
+	}
+
+	// Skip ahead to the earliest complete broadcast from each origin that's
+	// been waiting too long for an earlier one.
+	for address := range waiting {
+		sequences := make([]int, 0)
+		for _, rb := range c.reliable.m {
+			if rb.origin.Address() == address && rb.complete && !rb.delivered &&
+				rb.sequence > c.reliable.delivered[address] {
+				sequences = append(sequences, int(rb.sequence))
+			}
+		}
+
+		if len(sequences) == 0 {
+			continue
+		}
+
+		sort.Ints(sequences)
+
+		logDebug("Skipping undelivered reliable broadcasts from", address)
+		c.reliable.delivered[address] = uint32(sequences[0]) - 1
+	}
+
+	c.reliable.Unlock()
+
+	for _, origin := range waiting {
+		c.deliverReliable(origin)
+	}
+}
+
+// Chunk request contents (sent as a single frame; see pushpull.go)
+// Bytes 00-03 Cluster name hash
+// Bytes 04    Label length (L bytes)
+// Bytes 05-LL Label of the reliable broadcast
+// Bytes +0-1  Chunk count
+// Bytes +2-NN Chunk indices (32-bit each)
+//
+// Chunk response contents (sent as a single frame)
+// Bytes 00-01 Chunk count; only the chunks the responder has are included
+// ---[ Per chunk ]---
+// Bytes 00-03 Chunk index
+// Bytes 04-07 Chunk length (C bytes)
+// Bytes 08-CC Chunk
+
+// requestChunks asks node for the specified chunks of a reliable broadcast
+// over TCP. It returns whichever of them the node had.
+func (c *Cluster) requestChunks(node *Node, label string, indices []uint32) (map[uint32][]byte, error) {
+	request := make([]byte, 7+len(label)+4*len(indices))
+
+	p := 0
+	p += encodeUint32(c.clusterHash(), request, p)
+	p += encodeByte(byte(len(label)), request, p)
+	p += copy(request[p:], label)
+	p += encodeUint16(uint16(len(indices)), request, p)
+
+	for _, i := range indices {
+		p += encodeUint32(i, request, p)
+	}
+
+	frame, err := c.encodeFrame(request)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := c.dialStream(node, stateExchangeTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(stateExchangeTimeout))
+
+	if _, err = conn.Write(append([]byte{tcpStreamChunks}, frame...)); err != nil {
+		return nil, err
+	}
+
+	bytes, err := readFrame(conn)
+	if err != nil {
+		return nil, err
+	}
+
+	if bytes, err = c.openPayload(bytes); err != nil {
+		return nil, err
+	}
+
+	return decodeChunks(bytes)
+}
+
+// decodeChunks decodes a chunk response.
+func decodeChunks(bytes []byte) (map[uint32][]byte, error) {
+	truncated := errors.New("chunk response is truncated")
+
+	if len(bytes) < 2 {
+		return nil, truncated
+	}
+
+	count, p := decodeUint16(bytes, 0)
+	chunks := make(map[uint32][]byte, count)
+
+	for i := 0; i < int(count); i++ {
+		if p+8 > len(bytes) {
+			return chunks, truncated
+		}
+
+		var index, length uint32
+		index, p = decodeUint32(bytes, p)
+		length, p = decodeUint32(bytes, p)
+
+		if p+int(length) > len(bytes) {
+			return chunks, truncated
+		}
+
+		chunks[index] = bytes[p : p+int(length)]
+		p += int(length)
+	}
+
+	return chunks, nil
+}
+
+// handleChunkConn serves a request for reliable broadcast chunks, replying
+// with whichever of the requested chunks we have.
+func (c *Cluster) handleChunkConn(conn net.Conn) {
+	bytes, err := readFrame(conn)
+	if err == nil {
+		bytes, err = c.openPayload(bytes)
+	}
+
+	if err != nil {
+		logError("Failed to read chunk request from", conn.RemoteAddr(), "->", err)
+		return
+	}
+
+	if len(bytes) < 7 || len(bytes) < 7+int(bytes[4]) {
+		logWarn("Malformed chunk request from", conn.RemoteAddr())
+		return
+	}
+
+	hash, p := decodeUint32(bytes, 0)
+	if err = c.checkClusterHash(hash, conn.RemoteAddr().String()); err != nil {
+		return
+	}
+
+	labelLength := int(bytes[p])
+	p++
+
+	label := string(bytes[p : p+labelLength])
+	p += labelLength
+
+	count, p := decodeUint16(bytes, p)
+	if p+4*int(count) > len(bytes) {
+		logWarn("Malformed chunk request from", conn.RemoteAddr())
+		return
+	}
+
+	indices := make([]uint32, count)
+	for i := range indices {
+		indices[i], p = decodeUint32(bytes, p)
+	}
+
+	response := c.encodeChunks(label, indices)
+
+	frame, err := c.encodeFrame(response)
+	if err == nil {
+		_, err = conn.Write(frame)
+	}
+
+	if err != nil {
+		logError("Failed to send chunks to", conn.RemoteAddr(), "->", err)
+	}
+}
+
+// encodeChunks encodes a chunk response containing whichever of the
+// specified chunks of a reliable broadcast we have.
+func (c *Cluster) encodeChunks(label string, indices []uint32) []byte {
+	c.reliable.Lock()
+	defer c.reliable.Unlock()
+
+	chunks := make(map[uint32][]byte)
+	size := 2
+
+	if rb, ok := c.reliable.m[label]; ok {
+		for _, i := range indices {
+			if int(i) < len(rb.chunks) && rb.chunks[i] != nil {
+				chunks[i] = rb.chunks[i]
+				size += 8 + len(rb.chunks[i])
+			}
+		}
+	}
+
+	bytes := make([]byte, size)
+
+	p := encodeUint16(uint16(len(chunks)), bytes, 0)
+	for i, chunk := range chunks {
+		p += encodeUint32(i, bytes, p)
+		p += encodeUint32(uint32(len(chunk)), bytes, p)
+		p += copy(bytes[p:], chunk)
+	}
+
+	return bytes
+}
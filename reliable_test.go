@@ -0,0 +1,365 @@
+/*
+Copyright 2016 The Smudge Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package smudge
+
+import (
+	"bytes"
+	"hash/crc32"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+type recordingBroadcastListener struct {
+	sync.Mutex
+	broadcasts []*Broadcast
+}
+
+func (l *recordingBroadcastListener) OnBroadcast(b *Broadcast) {
+	l.Lock()
+	l.broadcasts = append(l.broadcasts, b)
+	l.Unlock()
+}
+
+func (l *recordingBroadcastListener) received() []*Broadcast {
+	l.Lock()
+	defer l.Unlock()
+
+	return append([]*Broadcast(nil), l.broadcasts...)
+}
+
+func TestEncodeDecodeChunks(t *testing.T) {
+	c := newSyncTestCluster(19131)
+
+	payload := bytes.Repeat([]byte("0123456789"), reliableChunkBytes/4)
+	if err := c.BroadcastBytesReliable(payload); err != nil {
+		t.Fatal(err)
+	}
+
+	var label string
+	for l := range c.reliable.m {
+		label = l
+	}
+
+	// Chunk 7 doesn't exist and should be left out.
+	chunks, err := decodeChunks(c.encodeChunks(label, []uint32{0, 2, 7}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(chunks) != 2 {
+		t.Fatalf("expected 2 chunks, got %d", len(chunks))
+	}
+
+	if !bytes.Equal(chunks[0], payload[:reliableChunkBytes]) ||
+		!bytes.Equal(chunks[2], payload[2*reliableChunkBytes:]) {
+		t.Error("decoded chunks don't match the payload")
+	}
+
+	encoded := c.encodeChunks(label, []uint32{1})
+	if _, err = decodeChunks(encoded[:len(encoded)-1]); err == nil {
+		t.Error("expected an error decoding a truncated response")
+	}
+
+	if err = c.BroadcastBytesReliable(make([]byte, MaxReliableBroadcastBytes+1)); err == nil {
+		t.Error("expected an error for an oversized payload")
+	}
+}
+
+// Reliable broadcasts are delivered in order, even if a later one completes
+// first.
+func TestReliableDeliveryOrder(t *testing.T) {
+	c := newSyncTestCluster(19133)
+	sub := c.Subscribe(nil)
+	defer sub.Unsubscribe()
+
+	origin, _ := CreateNodeByIP(net.ParseIP("10.0.0.2"), 9999)
+
+	for seq := uint32(1); seq <= 2; seq++ {
+		c.reliable.m[string(rune('a'+seq))] = &reliableBroadcast{
+			origin:   origin,
+			index:    seq,
+			sequence: seq,
+			chunks:   [][]byte{{byte(seq)}},
+			started:  c.nowMillis(),
+		}
+	}
+
+	c.reliable.delivered[origin.Address()] = 0
+
+	c.reliable.m["c"].complete = true
+	c.deliverReliable(origin)
+
+	if n := len(sub.Events()); n != 0 {
+		t.Fatalf("expected no deliveries, got %d", n)
+	}
+
+	c.reliable.m["b"].complete = true
+	c.deliverReliable(origin)
+
+	received := bufferedEvents(sub)
+	if len(received) != 2 ||
+		received[0].Broadcast.Bytes()[0] != 1 || received[1].Broadcast.Bytes()[0] != 2 {
+		t.Errorf("unexpected deliveries: %+v", received)
+	}
+}
+
+// Send a payload much larger than a UDP packet across a two-member cluster.
+func TestReliableBroadcast(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping network test in short mode")
+	}
+
+	SetLogThreshold(LogWarn)
+	defer SetLogThreshold(LogInfo)
+
+	loopback := net.IP([]byte{127, 0, 0, 1})
+
+	newReliableTestCluster := func(port int) *Cluster {
+		return NewCluster(&Config{
+			ListenIP:        loopback,
+			ListenPort:      port,
+			HeartbeatMillis: 20,
+			InitialHosts:    []string{},
+			SecretKeys:      [][]byte{testKey1},
+		})
+	}
+
+	a := newReliableTestCluster(19134)
+	b := newReliableTestCluster(19135)
+
+	listener := &recordingBroadcastListener{}
+	b.AddBroadcastListener(listener)
+
+	seed, _ := CreateNodeByIP(loopback, 19134)
+	b.AddNode(seed)
+
+	go a.Begin()
+	go b.Begin()
+	defer a.Stop()
+	defer b.Stop()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(a.HealthyNodes()) != 2 || len(b.HealthyNodes()) != 2 {
+		if time.Now().After(deadline) {
+			t.Fatal("members did not converge")
+		}
+
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	first := bytes.Repeat([]byte("smudge"), 200000)
+	second := []byte("and another")
+
+	if err := a.BroadcastBytesReliable(first); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := a.BroadcastBytesReliable(second); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline = time.Now().Add(10 * time.Second)
+	for len(listener.received()) < 2 {
+		if time.Now().After(deadline) {
+			t.Fatal("reliable broadcasts were not delivered")
+		}
+
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	received := listener.received()
+	if !bytes.Equal(received[0].Bytes(), first) || !bytes.Equal(received[1].Bytes(), second) {
+		t.Error("reliable broadcasts were corrupted or out of order")
+	}
+
+	if received[0].Origin().Address() != a.thisHost.Address() {
+		t.Error("unexpected origin:", received[0].Origin().Address())
+	}
+}
+
+// Fetching gives up, rather than retrying, once the cluster has stopped or
+// the broadcast has timed out.
+func TestFetchReliableGivesUp(t *testing.T) {
+	SetLogThreshold(LogFatal)
+	defer SetLogThreshold(LogInfo)
+
+	c := newSyncTestCluster(19136)
+	origin, _ := CreateNodeByIP(net.ParseIP("10.0.0.2"), 9999)
+
+	rb := &reliableBroadcast{
+		origin:   origin,
+		sequence: 1,
+		length:   10,
+		chunks:   make([][]byte, 1),
+		missing:  1,
+		started:  c.nowMillis(),
+	}
+
+	// Not running.
+	c.fetchReliable("a", rb)
+
+	// Running, but timed out.
+	c.runningFlag.Set()
+	defer c.runningFlag.UnSet()
+
+	rb.started = c.nowMillis() - reliableTimeoutMillis - 1
+	c.fetchReliable("a", rb)
+
+	c.lifecycle.wg.Wait()
+
+	if rb.complete || rb.missing != 1 {
+		t.Error("expected the broadcast to be left incomplete")
+	}
+}
+
+// Reliable broadcasts whose announcements arrive out of order are still all
+// delivered, in order.
+func TestReliableAnnouncementsOutOfOrder(t *testing.T) {
+	SetLogThreshold(LogWarn)
+	defer SetLogThreshold(LogInfo)
+
+	c := newSyncTestCluster(19137)
+	sub := c.Subscribe(nil)
+	defer sub.Unsubscribe()
+
+	origin, _ := CreateNodeByIP(net.ParseIP("10.0.0.2"), 9999)
+
+	payloads := map[uint32][]byte{1: []byte("first"), 2: []byte("second")}
+	labels := make(map[uint32]string)
+
+	// The cluster isn't running, so nothing is fetched.
+	for _, seq := range []uint32{2, 1} {
+		announcement := &Broadcast{
+			origin: origin,
+			index:  seq + 10,
+			kind:   broadcastReliable,
+			bytes: encodeReliableAnnouncement(&reliableBroadcast{
+				sequence: seq,
+				length:   uint32(len(payloads[seq])),
+				checksum: crc32.ChecksumIEEE(payloads[seq]),
+			}),
+		}
+
+		c.receiveReliableAnnouncement(announcement)
+		labels[seq] = announcement.Label()
+	}
+
+	c.lifecycle.wg.Wait()
+
+	if len(c.reliable.m) != 2 || c.reliable.delivered[origin.Address()] != 0 {
+		t.Fatalf("expected both broadcasts pending from sequence 1, got %d from %d",
+			len(c.reliable.m), c.reliable.delivered[origin.Address()]+1)
+	}
+
+	for _, seq := range []uint32{2, 1} {
+		rb := c.reliable.m[labels[seq]]
+		rb.chunks[0] = payloads[seq]
+
+		if !c.verifyReliable(labels[seq], rb) {
+			t.Fatal("verification failed for sequence", seq)
+		}
+
+		c.deliverReliable(origin)
+	}
+
+	received := bufferedEvents(sub)
+	if len(received) != 2 ||
+		string(received[0].Broadcast.Bytes()) != "first" ||
+		string(received[1].Broadcast.Bytes()) != "second" {
+		t.Errorf("unexpected deliveries: %+v", received)
+	}
+}
+
+// Once an origin is restarted, its sequence numbers start again at 1, and
+// announcements from before the restart are ignored.
+func TestReliableOriginRestart(t *testing.T) {
+	SetLogThreshold(LogWarn)
+	defer SetLogThreshold(LogInfo)
+
+	c := newSyncTestCluster(19138)
+
+	origin, _ := CreateNodeByIP(net.ParseIP("10.0.0.2"), 9999)
+
+	announce := func(generation uint64, seq uint32, index uint32) *Broadcast {
+		announcement := &Broadcast{
+			origin: origin,
+			index:  index,
+			kind:   broadcastReliable,
+			bytes: encodeReliableAnnouncement(&reliableBroadcast{
+				generation: generation,
+				sequence:   seq,
+				length:     1,
+			}),
+		}
+
+		c.receiveReliableAnnouncement(announcement)
+
+		return announcement
+	}
+
+	announce(1, 6, 6)
+	c.reliable.delivered[origin.Address()] = 5
+
+	restarted := announce(2, 1, 1)
+
+	if _, ok := c.reliable.m[restarted.Label()]; !ok {
+		t.Fatal("expected the restarted origin's first broadcast to be pending")
+	}
+
+	if len(c.reliable.m) != 1 || c.reliable.delivered[origin.Address()] != 0 {
+		t.Errorf("expected the old generation to be forgotten, got %d pending from %d",
+			len(c.reliable.m), c.reliable.delivered[origin.Address()]+1)
+	}
+
+	if late := announce(1, 7, 7); c.reliable.m[late.Label()] != nil {
+		t.Error("expected an announcement from before the restart to be ignored")
+	}
+}
+
+// The chunks of a reliable broadcast are its own, so the caller may reuse
+// the payload's buffer as soon as it's queued.
+func TestReliableBroadcastCopiesPayload(t *testing.T) {
+	SetLogThreshold(LogWarn)
+	defer SetLogThreshold(LogInfo)
+
+	c := newSyncTestCluster(19139)
+
+	payload := bytes.Repeat([]byte("smudge"), reliableChunkBytes)
+	original := append([]byte(nil), payload...)
+
+	if err := c.BroadcastBytesReliable(payload); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := range payload {
+		payload[i] = 0
+	}
+
+	for _, rb := range c.reliable.m {
+		if !bytes.Equal(bytes.Join(rb.chunks, nil), original) ||
+			rb.checksum != crc32.ChecksumIEEE(original) {
+
+			t.Error("reliable broadcast chunks share the caller's buffer")
+		}
+	}
+
+	if len(c.reliable.m) != 1 {
+		t.Error("expected 1 reliable broadcast, got", len(c.reliable.m))
+	}
+}
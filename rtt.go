@@ -0,0 +1,51 @@
+/*
+Copyright 2016 The Smudge Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package smudge
+
+// Each node keeps its own history of round-trip times, so that a member that
+// is far away (in another datacenter, say) gets a correspondingly longer
+// probe timeout without stretching everyone else's. A history starts out
+// filled with the initial estimate, which real samples gradually replace.
+
+// rtt returns the round-trip time history of a node, creating it if needed.
+// Nodes decoded from messages are distinct from the known nodes they
+// describe, so they share the known node's history.
+func (c *Cluster) rtt(node *Node) *pingData {
+	c.rttMutex.Lock()
+	defer c.rttMutex.Unlock()
+
+	// Every write to a node's rtt is made under rttMutex, so it can be read
+	// here without the node's own lock.
+	if node.rtt != nil {
+		return node.rtt
+	}
+
+	known := c.knownNodes.getByAddress(node.Address())
+	if known != nil && known.rtt != nil {
+		node.setRTT(known.rtt)
+		return known.rtt
+	}
+
+	rtt := newPingData(c.InitialRTTMillis(), c.RTTHistorySize())
+	node.setRTT(rtt)
+
+	if known != nil {
+		known.setRTT(rtt)
+	}
+
+	return rtt
+}
@@ -0,0 +1,94 @@
+/*
+Copyright 2016 The Smudge Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package smudge
+
+import (
+	"net"
+	"testing"
+)
+
+func TestPingDataStats(t *testing.T) {
+	pd := newPingData(100, 10)
+
+	stats := pd.stats()
+	if stats.Samples != 0 || stats.Mean != 100 || stats.Stddev != 0 ||
+		stats.P99 != 100 || stats.LossRate != 0 {
+		t.Errorf("unexpected initial stats: %+v", stats)
+	}
+
+	for i := 1; i <= 10; i++ {
+		pd.add(uint32(i * 10))
+	}
+	pd.addLoss()
+	pd.addLoss()
+
+	stats = pd.stats()
+	if stats.Samples != 10 || stats.Mean != 55 {
+		t.Errorf("unexpected stats: %+v", stats)
+	}
+
+	if stats.P50 != 50 || stats.P90 != 90 || stats.P99 != 100 {
+		t.Errorf("unexpected percentiles: %+v", stats)
+	}
+
+	// The two losses displaced the two oldest outcomes.
+	if stats.LossRate != 0.2 {
+		t.Error("expected loss rate 0.2, got", stats.LossRate)
+	}
+}
+
+// Each node's probe timeout is based on its own round-trip times, and nodes
+// decoded from messages share the history of the known node.
+func TestPerNodeProbeTimeouts(t *testing.T) {
+	c := NewCluster(&Config{InitialRTTMillis: 20, RTTHistorySize: 4})
+
+	near, _ := CreateNodeByIP(net.IP([]byte{127, 0, 0, 2}), 9999)
+	far, _ := CreateNodeByIP(net.IP([]byte{127, 0, 0, 3}), 9999)
+	c.AddNode(near)
+	c.AddNode(far)
+
+	for i := 0; i < 4; i++ {
+		c.rtt(near).add(10)
+		c.rtt(far).add(200)
+	}
+
+	nearTimeout := c.probeTimeoutMillis(&pendingAck{node: near, packType: packPing})
+	farTimeout := c.probeTimeoutMillis(&pendingAck{node: far, packType: packPing})
+
+	if nearTimeout != 10 || farTimeout != 200 {
+		t.Errorf("expected timeouts of 10 and 200, got %d and %d", nearTimeout, farTimeout)
+	}
+
+	pingReq := &pendingAck{node: near, callback: far, packType: packPingReq}
+	if timeout := c.probeTimeoutMillis(pingReq); timeout != 210 {
+		t.Error("expected PINGREQ timeout of 210, got", timeout)
+	}
+
+	decoded, _ := CreateNodeByIP(net.IP([]byte{127, 0, 0, 3}), 9999)
+	if c.rtt(decoded) != c.rtt(far) {
+		t.Error("decoded node has its own RTT history")
+	}
+
+	if rtt := far.RTT(); rtt.Samples != 4 || rtt.Mean != 200 {
+		t.Errorf("unexpected RTT stats: %+v", rtt)
+	}
+
+	unpinged, _ := CreateNodeByIP(net.IP([]byte{127, 0, 0, 4}), 9999)
+	if rtt := unpinged.RTT(); rtt != (RTTStats{}) {
+		t.Errorf("expected empty RTT stats, got %+v", rtt)
+	}
+}
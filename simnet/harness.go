@@ -0,0 +1,346 @@
+/*
+Copyright 2016 The Smudge Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package simnet
+
+import (
+	"context"
+	"errors"
+	"net"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/dotwoo/smudge"
+)
+
+// Harness runs a cluster of members on a simulated Network, and keeps count
+// of the false positives among their failure detectors: suspicions and
+// deaths of members that haven't actually been killed.
+type Harness struct {
+	// The simulated network the members are on.
+	Network *Network
+
+	// The members, in the order they were created. Member 0 is the seed
+	// that all others join through.
+	Members []*smudge.Cluster
+
+	mutex          sync.Mutex
+	killed         map[string]bool
+	subscriptions  []*smudge.Subscription
+	falseSuspicion int
+	falseDeath     int
+}
+
+// The IP address shared by every member; members differ by port.
+var memberIP = net.IP([]byte{127, 0, 0, 1})
+
+// How far the network's clock is advanced at a time.
+const step = time.Millisecond
+
+// How many times the network must be seen to be idle in a row before the
+// clock is advanced, to give goroutines spawned by handlers that have just
+// finished a chance to run.
+const idleChecks = 3
+
+/******************************************************************************
+ * Exported functions (for public consumption)
+ *****************************************************************************/
+
+// NewHarness creates, but doesn't start, n members on the network. Each gets
+// a copy of config, with its listen address, transport, clock and initial
+// hosts replaced, and knows member 0 as its seed.
+func NewHarness(network *Network, n int, config smudge.Config) *Harness {
+	h := &Harness{
+		Network: network,
+		killed:  make(map[string]bool),
+	}
+
+	for i := 0; i < n; i++ {
+		c := config
+		c.ListenIP = memberIP
+		c.ListenPort = i + 1
+		c.Transport = network.NewTransport()
+		c.Clock = network.Clock()
+		c.InitialHosts = []string{}
+
+		member := smudge.NewCluster(&c)
+
+		// Initial hosts given by address are resolved to this machine's
+		// external IP if they're loopback addresses, so the seed is added
+		// directly instead.
+		if i > 0 {
+			seed, _ := smudge.CreateNodeByIP(memberIP, 1)
+			member.AddNode(seed)
+		}
+
+		h.Members = append(h.Members, member)
+	}
+
+	return h
+}
+
+// Address returns the host:port address of the i'th member.
+func (h *Harness) Address(i int) string {
+	return address(memberIP, i+1)
+}
+
+// Start starts every member, returning once all of them are listening and
+// have finished joining. If any member can't be started, those already
+// started are stopped again and the error is returned.
+func (h *Harness) Start() error {
+	h.mutex.Lock()
+	h.subscriptions = make([]*smudge.Subscription, len(h.Members))
+	h.mutex.Unlock()
+
+	for i, member := range h.Members {
+		sub := member.Subscribe(&smudge.SubscribeOptions{
+			BufferSize: 1024,
+			Types:      []smudge.EventType{smudge.NodeStatusChanged, smudge.NodeLeft},
+		})
+
+		h.mutex.Lock()
+		h.subscriptions[i] = sub
+		h.mutex.Unlock()
+
+		if err := member.Start(context.Background()); err != nil {
+			h.Stop()
+			return err
+		}
+	}
+
+	h.settle()
+
+	return nil
+}
+
+// Stop stops every member that's still running, and waits for them to
+// finish.
+func (h *Harness) Stop() {
+	for i := range h.Members {
+		h.Kill(i)
+	}
+}
+
+// Kill stops the i'th member without it leaving the cluster, as if it had
+// crashed. From then on, the other members are right to suspect it.
+func (h *Harness) Kill(i int) {
+	h.mutex.Lock()
+	address := h.Address(i)
+	killed := h.killed[address]
+	h.killed[address] = true
+
+	var sub *smudge.Subscription
+	if i < len(h.subscriptions) {
+		sub = h.subscriptions[i]
+	}
+	h.mutex.Unlock()
+
+	if killed {
+		return
+	}
+
+	// Whatever a killed member thinks of the others isn't a false positive,
+	// but whatever it thought before it was killed is.
+	if sub != nil {
+		h.countFalsePositives(sub)
+		sub.Unsubscribe()
+	}
+
+	h.Members[i].Shutdown(context.Background())
+}
+
+// Advance runs the simulation for the specified duration on the network's
+// clock.
+func (h *Harness) Advance(d time.Duration) {
+	clock := h.Network.Clock()
+
+	for end := clock.Now().Add(d); clock.Now().Before(end); {
+		h.settle()
+		clock.Advance(step)
+	}
+
+	h.settle()
+}
+
+// Live returns the indices of the members that haven't been killed.
+func (h *Harness) Live() []int {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	live := make([]int, 0, len(h.Members))
+	for i := range h.Members {
+		if !h.killed[h.Address(i)] {
+			live = append(live, i)
+		}
+	}
+
+	return live
+}
+
+// Converged returns true if every live member sees exactly the live members
+// as healthy.
+func (h *Harness) Converged() bool {
+	live := h.Live()
+
+	expected := make(map[string]bool)
+	for _, i := range live {
+		expected[h.Address(i)] = true
+	}
+
+	for _, i := range live {
+		healthy := h.Members[i].HealthyNodes()
+		if len(healthy) != len(expected) {
+			return false
+		}
+
+		for _, node := range healthy {
+			if !expected[node.Address()] {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+// WaitForConvergence runs the simulation until Converged() becomes true, for
+// up to timeout on the network's clock, and returns how long that took.
+func (h *Harness) WaitForConvergence(timeout time.Duration) (time.Duration, error) {
+	elapsed, err := h.WaitFor(h.Converged, timeout)
+	if err != nil {
+		err = errors.New("cluster did not converge")
+	}
+
+	return elapsed, err
+}
+
+// WaitFor runs the simulation until condition returns true, for up to
+// timeout on the network's clock, and returns how long that took. The
+// condition is checked whenever every member is idle.
+func (h *Harness) WaitFor(condition func() bool, timeout time.Duration) (time.Duration, error) {
+	clock := h.Network.Clock()
+	start := clock.Now()
+
+	for {
+		h.settle()
+
+		elapsed := clock.Now().Sub(start)
+
+		if condition() {
+			return elapsed, nil
+		}
+
+		if elapsed >= timeout {
+			return elapsed, errors.New("timed out")
+		}
+
+		clock.Advance(step)
+	}
+}
+
+// FalsePositives returns the number of times any member has suspected, or
+// declared dead, a member that hadn't been killed at the time.
+func (h *Harness) FalsePositives() (suspicions, deaths int) {
+	h.countAllFalsePositives()
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	return h.falseSuspicion, h.falseDeath
+}
+
+/******************************************************************************
+ * Private functions (for internal use only)
+ *****************************************************************************/
+
+// settle waits until every live member has handled every packet and stream
+// sent to it, and is back to waiting on the clock, then counts the false
+// positives it has seen.
+func (h *Harness) settle() {
+	sleepers := 0
+	for _, member := range h.Members {
+		if member.Running() {
+			sleepers += sleepersPerMember(member)
+		}
+	}
+
+	for checks := 0; checks < idleChecks; {
+		runtime.Gosched()
+
+		if h.Network.idle(sleepers) {
+			checks++
+		} else {
+			checks = 0
+		}
+	}
+
+	h.countAllFalsePositives()
+}
+
+// sleepersPerMember returns the number of sleeps a running member always has
+// waiting on its clock: those of its heartbeat and timeout check loops, and
+// of its state sync loop unless syncing is disabled.
+func sleepersPerMember(member *smudge.Cluster) int {
+	if member.SyncMillis() < 0 {
+		return 2
+	}
+
+	return 3
+}
+
+// countAllFalsePositives counts the false positives among the events every
+// live member has seen so far.
+func (h *Harness) countAllFalsePositives() {
+	for _, i := range h.Live() {
+		h.mutex.Lock()
+		var sub *smudge.Subscription
+		if i < len(h.subscriptions) {
+			sub = h.subscriptions[i]
+		}
+		h.mutex.Unlock()
+
+		if sub != nil {
+			h.countFalsePositives(sub)
+		}
+	}
+}
+
+// countFalsePositives counts the false positives among the events buffered
+// by a member's subscription.
+func (h *Harness) countFalsePositives(sub *smudge.Subscription) {
+	for {
+		select {
+		case e, ok := <-sub.Events():
+			if !ok {
+				return
+			}
+
+			h.mutex.Lock()
+			if !h.killed[e.Node.Address()] {
+				switch e.Status {
+				case smudge.StatusSuspected:
+					h.falseSuspicion++
+				case smudge.StatusDead:
+					h.falseDeath++
+				}
+			}
+			h.mutex.Unlock()
+		default:
+			return
+		}
+	}
+}
@@ -0,0 +1,334 @@
+/*
+Copyright 2016 The Smudge Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package simnet runs Smudge members in a single process on a simulated
+// network, on which packet loss, latency and partitions can be injected.
+// Each member gets a Transport from a shared Network in place of real UDP and
+// TCP sockets, so tests don't need free ports and can't interfere with each
+// other. A Harness starts and tracks a whole cluster of such members.
+//
+// Time on the network is simulated too: latency is measured on the network's
+// FakeClock, which a Harness also gives its members, and which only moves
+// when the Harness advances it. The Harness waits for the members to finish
+// handling every packet and stream before each step, so a simulation runs
+// the same however slow the machine it runs on.
+package simnet
+
+import (
+	"errors"
+	"math/rand"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/dotwoo/smudge"
+)
+
+// The number of packets or streams queued for a member before further ones
+// are dropped (or, for streams, refused).
+const queueLength = 256
+
+// The time at which every network's clock starts.
+var epoch = time.Unix(0, 0)
+
+// Network is a simulated network connecting any number of Transports.
+type Network struct {
+	mutex      sync.Mutex
+	clock      *smudge.FakeClock
+	random     *rand.Rand
+	loss       float64
+	minLatency time.Duration
+	maxLatency time.Duration
+	groups     map[string]int
+	endpoints  map[string]*Transport
+	sent       uint64
+	dropped    uint64
+
+	// The packets delivered but not yet handled, plus the ends of streams
+	// not yet closed, and the packets still delayed by latency.
+	busy    int
+	delayed int
+}
+
+// Transport is a smudge.StreamTransport on a simulated Network. Packets are
+// subject to the network's loss, latency and partitions; streams are
+// in-memory pipes, subject only to partitions, which are checked when the
+// stream is opened.
+type Transport struct {
+	network *Network
+	addr    *net.UDPAddr
+	packets chan *smudge.Packet
+	streams chan net.Conn
+}
+
+/******************************************************************************
+ * Exported functions (for public consumption)
+ *****************************************************************************/
+
+// NewNetwork returns a new network without loss, latency or partitions.
+// The seed makes packet loss and latency reproducible.
+func NewNetwork(seed int64) *Network {
+	return &Network{
+		clock:     smudge.NewFakeClock(epoch),
+		random:    rand.New(rand.NewSource(seed)),
+		groups:    make(map[string]int),
+		endpoints: make(map[string]*Transport),
+	}
+}
+
+// Clock returns the fake clock on which the network's latency is measured.
+// Members on the network should use it as their Config.Clock.
+func (n *Network) Clock() *smudge.FakeClock {
+	return n.clock
+}
+
+// SetPacketLoss sets the probability, from 0 to 1, that any packet is lost.
+func (n *Network) SetPacketLoss(rate float64) {
+	n.mutex.Lock()
+	n.loss = rate
+	n.mutex.Unlock()
+}
+
+// SetLatency makes every packet take between min and max to be delivered.
+// Packets may be reordered as a result.
+func (n *Network) SetLatency(min, max time.Duration) {
+	n.mutex.Lock()
+	n.minLatency = min
+	n.maxLatency = max
+	n.mutex.Unlock()
+}
+
+// Partition splits the network so that members in different groups can't
+// reach each other. Each group is a list of addresses of the form host:port;
+// members not listed in any group are together in a group of their own.
+func (n *Network) Partition(groups ...[]string) {
+	n.mutex.Lock()
+	n.groups = make(map[string]int)
+	for i, group := range groups {
+		for _, address := range group {
+			n.groups[address] = i + 1
+		}
+	}
+	n.mutex.Unlock()
+}
+
+// Heal removes any partition.
+func (n *Network) Heal() {
+	n.Partition()
+}
+
+// Stats returns the number of packets sent so far, and how many of those were
+// dropped because of loss, partitions, full queues or unknown addresses.
+func (n *Network) Stats() (sent, dropped uint64) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	return n.sent, n.dropped
+}
+
+// NewTransport returns a new Transport on the network, for use as a
+// smudge.Config's Transport.
+func (n *Network) NewTransport() *Transport {
+	return &Transport{network: n}
+}
+
+// Listen attaches the transport to the network at ip:port.
+func (t *Transport) Listen(ip net.IP, port int) error {
+	if ip == nil {
+		ip = net.IP([]byte{127, 0, 0, 1})
+	}
+
+	addr := &net.UDPAddr{IP: ip, Port: port}
+
+	t.network.mutex.Lock()
+	defer t.network.mutex.Unlock()
+
+	if _, ok := t.network.endpoints[addr.String()]; ok {
+		return errors.New("address already in use: " + addr.String())
+	}
+
+	t.addr = addr
+	t.packets = make(chan *smudge.Packet, queueLength)
+	t.streams = make(chan net.Conn, queueLength)
+	t.network.endpoints[addr.String()] = t
+
+	return nil
+}
+
+// WriteTo sends a packet, which is dropped or delayed according to the
+// network's settings.
+func (t *Transport) WriteTo(bytes []byte, address string) error {
+	n := t.network
+
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	n.sent++
+
+	if t.addr == nil || !n.reachable(t.addr.String(), address) ||
+		n.random.Float64() < n.loss {
+		n.dropped++
+		return nil
+	}
+
+	packet := &smudge.Packet{
+		Bytes: append([]byte(nil), bytes...),
+		From:  t.addr,
+	}
+
+	delay := n.minLatency
+	if n.maxLatency > n.minLatency {
+		delay += time.Duration(n.random.Int63n(int64(n.maxLatency - n.minLatency)))
+	}
+
+	if delay <= 0 {
+		n.deliver(packet, address)
+		return nil
+	}
+
+	n.delayed++
+
+	n.clock.AfterFunc(delay, func() {
+		n.mutex.Lock()
+		n.delayed--
+		n.deliver(packet, address)
+		n.mutex.Unlock()
+	})
+
+	return nil
+}
+
+// Packets returns the channel of packets delivered to this transport.
+func (t *Transport) Packets() <-chan *smudge.Packet {
+	return t.packets
+}
+
+// DialStream opens an in-memory stream to the member at address.
+func (t *Transport) DialStream(address string, timeout time.Duration) (net.Conn, error) {
+	n := t.network
+
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	to, ok := n.endpoints[address]
+	if !ok || t.addr == nil || !n.reachable(t.addr.String(), address) {
+		return nil, errors.New("connection refused: " + address)
+	}
+
+	client, server := net.Pipe()
+
+	select {
+	case to.streams <- &trackedConn{Conn: server, network: n}:
+		n.busy += 2
+		return &trackedConn{Conn: client, network: n}, nil
+	default:
+		client.Close()
+		server.Close()
+
+		return nil, errors.New("connection refused: " + address)
+	}
+}
+
+// Streams returns the channel of streams opened to this transport.
+func (t *Transport) Streams() <-chan net.Conn {
+	return t.streams
+}
+
+// Shutdown detaches the transport from the network.
+func (t *Transport) Shutdown() error {
+	n := t.network
+
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	if t.addr == nil || n.endpoints[t.addr.String()] != t {
+		return errors.New("transport is not running")
+	}
+
+	delete(n.endpoints, t.addr.String())
+	close(t.packets)
+	close(t.streams)
+
+	return nil
+}
+
+/******************************************************************************
+ * Private functions (for internal use only)
+ *****************************************************************************/
+
+// reachable returns true if the two addresses are in the same partition. It
+// must be called with the network's mutex held.
+func (n *Network) reachable(from, to string) bool {
+	return n.groups[from] == n.groups[to]
+}
+
+// deliver queues a packet for the member at address, if there is one. It
+// must be called with the network's mutex held.
+func (n *Network) deliver(packet *smudge.Packet, address string) {
+	to, ok := n.endpoints[address]
+	if !ok {
+		n.dropped++
+		return
+	}
+
+	packet.Done = n.done
+
+	select {
+	case to.packets <- packet:
+		n.busy++
+	default:
+		n.dropped++
+	}
+}
+
+// done is called when a member has handled a packet, or closed its end of a
+// stream.
+func (n *Network) done() {
+	n.mutex.Lock()
+	n.busy--
+	n.mutex.Unlock()
+}
+
+// idle returns true if every packet delivered has been handled, every stream
+// has been closed, and at least the specified number of sleeps and timers
+// (besides those delaying packets) are waiting on the clock.
+func (n *Network) idle(sleepers int) bool {
+	n.mutex.Lock()
+	busy, delayed := n.busy, n.delayed
+	n.mutex.Unlock()
+
+	return busy == 0 && n.clock.Waiters() >= sleepers+delayed
+}
+
+// trackedConn is one end of a stream, which tells the network when it's
+// closed.
+type trackedConn struct {
+	net.Conn
+	network *Network
+	once    sync.Once
+}
+
+// Close closes this end of the stream.
+func (c *trackedConn) Close() error {
+	c.once.Do(c.network.done)
+	return c.Conn.Close()
+}
+
+// address returns the host:port address for an IP and port.
+func address(ip net.IP, port int) string {
+	return net.JoinHostPort(ip.String(), strconv.Itoa(port))
+}
@@ -0,0 +1,179 @@
+/*
+Copyright 2016 The Smudge Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package simnet
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/dotwoo/smudge"
+)
+
+func TestMain(m *testing.M) {
+	smudge.SetLogThreshold(smudge.LogFatal)
+	os.Exit(m.Run())
+}
+
+var testConfig = smudge.Config{HeartbeatMillis: 20, SyncMillis: 200}
+
+// Sixteen members joining through one seed all learn about each other.
+func TestConvergence(t *testing.T) {
+	h := NewHarness(NewNetwork(1), 16, testConfig)
+	if err := h.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer h.Stop()
+
+	elapsed, err := h.WaitForConvergence(5 * time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Logf("16 members converged in %v", elapsed)
+
+	if suspicions, deaths := h.FalsePositives(); suspicions != 0 || deaths != 0 {
+		t.Errorf("%d false suspicions and %d false deaths on a perfect network",
+			suspicions, deaths)
+	}
+}
+
+// A crashed member is detected and declared dead by every other member.
+func TestFailureDetection(t *testing.T) {
+	h := NewHarness(NewNetwork(2), 8, testConfig)
+	if err := h.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer h.Stop()
+
+	if _, err := h.WaitForConvergence(5 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	h.Kill(3)
+
+	dead := func() bool {
+		for _, i := range h.Live() {
+			for _, node := range h.Members[i].AllNodes() {
+				if node.Address() == h.Address(3) && node.Status() != smudge.StatusDead {
+					return false
+				}
+			}
+		}
+
+		return true
+	}
+
+	elapsed, err := h.WaitFor(dead, 5*time.Second)
+	if err != nil {
+		t.Fatal("crashed member was not declared dead by every member")
+	}
+
+	t.Logf("failure detected by all members in %v", elapsed)
+
+	if _, deaths := h.FalsePositives(); deaths != 0 {
+		t.Errorf("%d live members were declared dead", deaths)
+	}
+}
+
+// On a lossy, jittery network, live members are occasionally suspected, but
+// refute the suspicion before they're declared dead.
+func TestFalsePositiveRate(t *testing.T) {
+	network := NewNetwork(3)
+	network.SetLatency(time.Millisecond, 5*time.Millisecond)
+
+	// With a 20ms heartbeat, the default suspicion timeout is shorter than a
+	// single probe round, which leaves a suspected member no time to refute.
+	config := testConfig
+	config.SuspicionMultiplier = 20
+
+	h := NewHarness(network, 8, config)
+	if err := h.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer h.Stop()
+
+	if _, err := h.WaitForConvergence(5 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	network.SetPacketLoss(0.02)
+
+	const duration = 2 * time.Second
+	h.Advance(duration)
+
+	suspicions, deaths := h.FalsePositives()
+	rate := float64(suspicions) / float64(len(h.Members)) / duration.Seconds()
+
+	sent, dropped := network.Stats()
+	t.Logf("%d false suspicions (%.2f per member per second), %d false deaths; %d of %d packets dropped",
+		suspicions, rate, deaths, dropped, sent)
+
+	if deaths != 0 {
+		t.Errorf("%d live members were declared dead", deaths)
+	}
+
+	if rate > 10 {
+		t.Errorf("false suspicion rate %.2f per member per second is too high", rate)
+	}
+}
+
+// Each side of a partition declares the other dead, and the cluster heals
+// once the partition does.
+func TestPartition(t *testing.T) {
+	network := NewNetwork(4)
+
+	h := NewHarness(network, 6, testConfig)
+	if err := h.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer h.Stop()
+
+	if _, err := h.WaitForConvergence(5 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	network.Partition([]string{h.Address(0), h.Address(1), h.Address(2)})
+
+	split := func() bool {
+		for _, i := range h.Live() {
+			if len(h.Members[i].HealthyNodes()) != 3 {
+				return false
+			}
+		}
+
+		return true
+	}
+
+	if _, err := h.WaitFor(split, 5*time.Second); err != nil {
+		for _, i := range h.Live() {
+			t.Errorf("member %d sees %d healthy members, expected 3",
+				i, len(h.Members[i].HealthyNodes()))
+		}
+
+		t.FailNow()
+	}
+
+	network.Heal()
+
+	elapsed, err := h.WaitForConvergence(10 * time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Logf("partition healed in %v", elapsed)
+}
@@ -0,0 +1,221 @@
+/*
+Copyright 2016 The Smudge Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/dotwoo/smudge"
+)
+
+// How long POST /leave waits for the departure to propagate.
+const leaveTimeout = 5 * time.Second
+
+// memberJSON is the JSON representation of a member.
+type memberJSON struct {
+	Address     string            `json:"address"`
+	Status      string            `json:"status"`
+	PingMillis  int               `json:"ping_millis"`
+	AgeMillis   uint32            `json:"age_millis"`
+	Heartbeat   uint32            `json:"heartbeat"`
+	Incarnation uint32            `json:"incarnation"`
+	Metadata    map[string]string `json:"metadata"`
+}
+
+// healthJSON is the body of a GET /health response.
+type healthJSON struct {
+	Status  string `json:"status"`
+	Members int    `json:"members"`
+	Healthy int    `json:"healthy"`
+}
+
+// newAdminHandler returns the handler for the admin API, which inspects and
+// controls the default cluster. Metrics are served at /metrics by the given
+// handler, if it isn't nil.
+func newAdminHandler(metrics http.Handler) http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/members", allowMethod("GET", handleMembers))
+	mux.HandleFunc("/self", allowMethod("GET", handleSelf))
+	mux.HandleFunc("/broadcast", allowMethod("POST", handleBroadcast))
+	mux.HandleFunc("/join", allowMethod("POST", handleJoin))
+	mux.HandleFunc("/leave", allowMethod("POST", handleLeave))
+	mux.HandleFunc("/health", allowMethod("GET", handleHealth))
+
+	if metrics != nil {
+		mux.Handle("/metrics", metrics)
+	}
+
+	return mux
+}
+
+// GET /members lists every known member, including this one.
+func handleMembers(w http.ResponseWriter, r *http.Request) {
+	nodes := smudge.AllNodes()
+
+	members := make([]memberJSON, 0, len(nodes))
+	for _, node := range nodes {
+		members = append(members, newMemberJSON(node))
+	}
+
+	writeJSON(w, http.StatusOK, members)
+}
+
+// GET /self describes this member.
+func handleSelf(w http.ResponseWriter, r *http.Request) {
+	node := smudge.LocalNode()
+	if node == nil {
+		writeError(w, http.StatusServiceUnavailable, errors.New("not started"))
+		return
+	}
+
+	writeJSON(w, http.StatusOK, newMemberJSON(node))
+}
+
+// POST /broadcast sends {"message": "..."} to every healthy member.
+func handleBroadcast(w http.ResponseWriter, r *http.Request) {
+	if !smudge.Running() {
+		writeError(w, http.StatusServiceUnavailable, errors.New("not running"))
+		return
+	}
+
+	var body struct {
+		Message string `json:"message"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if err := smudge.BroadcastBytes([]byte(body.Message)); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	writeJSON(w, http.StatusAccepted, map[string]string{"status": "queued"})
+}
+
+// POST /join adds the member at {"address": "host:port"}, through which the
+// rest of its cluster will be discovered.
+func handleJoin(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Address string `json:"address"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	node, err := smudge.CreateNodeByAddress(body.Address)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if node, err = smudge.AddNode(node); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, newMemberJSON(node))
+}
+
+// POST /leave gracefully leaves the cluster, which also stops this member.
+func handleLeave(w http.ResponseWriter, r *http.Request) {
+	if !smudge.Running() {
+		writeError(w, http.StatusServiceUnavailable, errors.New("not running"))
+		return
+	}
+
+	if err := smudge.Leave(leaveTimeout); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]string{"status": "left"})
+}
+
+// GET /health responds with 200 if this member is running and alive, and
+// 503 otherwise, so it can serve as a readiness check. That it responds at
+// all is enough for a liveness check.
+func handleHealth(w http.ResponseWriter, r *http.Request) {
+	health := healthJSON{
+		Status:  "ok",
+		Members: len(smudge.AllNodes()),
+		Healthy: len(smudge.HealthyNodes()),
+	}
+
+	code := http.StatusOK
+
+	if node := smudge.LocalNode(); !smudge.Running() || node == nil ||
+		node.Status() != smudge.StatusAlive {
+
+		health.Status = "unavailable"
+		code = http.StatusServiceUnavailable
+	}
+
+	writeJSON(w, code, health)
+}
+
+// allowMethod wraps a handler so that it only accepts requests with the given
+// method.
+func allowMethod(method string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != method {
+			w.Header().Set("Allow", method)
+			writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+			return
+		}
+
+		handler(w, r)
+	}
+}
+
+// newMemberJSON describes a member from a snapshot of it, so that a member
+// updated by the cluster meanwhile is still described consistently.
+func newMemberJSON(node *smudge.Node) memberJSON {
+	snapshot := node.Snapshot()
+
+	return memberJSON{
+		Address:     snapshot.Address,
+		Status:      snapshot.Status.String(),
+		PingMillis:  snapshot.PingMillis,
+		AgeMillis:   snapshot.AgeMillis,
+		Heartbeat:   snapshot.Heartbeat,
+		Incarnation: snapshot.Incarnation,
+		Metadata:    snapshot.Metadata,
+	}
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Println("Failed to write response:", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, code int, err error) {
+	writeJSON(w, code, map[string]string{"error": err.Error()})
+}
@@ -0,0 +1,76 @@
+/*
+Copyright 2016 The Smudge Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/dotwoo/smudge"
+)
+
+func serveAdmin(method string, path string, body string) *httptest.ResponseRecorder {
+	recorder := httptest.NewRecorder()
+	request := httptest.NewRequest(method, path, strings.NewReader(body))
+
+	newAdminHandler(nil).ServeHTTP(recorder, request)
+
+	return recorder
+}
+
+// The admin API works on the default cluster, which these tests never start.
+func TestAdminAPI(t *testing.T) {
+	smudge.SetLogThreshold(smudge.LogWarn)
+	defer smudge.SetLogThreshold(smudge.LogInfo)
+
+	if r := serveAdmin("GET", "/health", ""); r.Code != http.StatusServiceUnavailable {
+		t.Error("expected an unstarted member to be unhealthy, got", r.Code)
+	}
+
+	if r := serveAdmin("POST", "/broadcast", `{"message":"hi"}`); r.Code != http.StatusServiceUnavailable {
+		t.Error("expected a broadcast to be refused before starting, got", r.Code)
+	}
+
+	if r := serveAdmin("POST", "/members", ""); r.Code != http.StatusMethodNotAllowed {
+		t.Error("expected POST /members to be refused, got", r.Code)
+	}
+
+	if r := serveAdmin("POST", "/join", `{"address":"bogus:address:1"}`); r.Code != http.StatusBadRequest {
+		t.Error("expected a bad address to be refused, got", r.Code)
+	}
+
+	if r := serveAdmin("POST", "/join", `{"address":"10.0.0.2:9999"}`); r.Code != http.StatusOK {
+		t.Fatal("join failed:", r.Code, r.Body.String())
+	}
+
+	r := serveAdmin("GET", "/members", "")
+	if r.Code != http.StatusOK {
+		t.Fatal("listing members failed:", r.Code)
+	}
+
+	var members []memberJSON
+	if err := json.Unmarshal(r.Body.Bytes(), &members); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(members) != 1 || members[0].Address != "10.0.0.2:9999" || members[0].Status != "ALIVE" {
+		t.Errorf("unexpected members: %+v", members)
+	}
+}
@@ -17,9 +17,11 @@ limitations under the License.
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"log"
+	"net/http"
 	"time"
 
 	"github.com/dotwoo/smudge"
@@ -27,6 +29,7 @@ import (
 
 func main() {
 	var nodeAddress string
+	var httpAddress string
 	var heartbeatMillis int
 	var listenPort int
 	var stopMinutes int
@@ -34,6 +37,9 @@ func main() {
 
 	flag.StringVar(&nodeAddress, "node", "", "Initial node")
 
+	flag.StringVar(&httpAddress, "http", "127.0.0.1:8080",
+		"The address on which to serve the unauthenticated admin API, which must not be exposed beyond this host; \"\" disables it")
+
 	flag.IntVar(&listenPort, "port",
 		int(smudge.GetListenPort()),
 		"The bind port")
@@ -66,11 +72,34 @@ func main() {
 		if stopMinutes > 0 {
 			go func() {
 				time.Sleep(time.Duration(stopMinutes*10) * time.Second)
-				log.Println("smudge stop")
-				smudge.Stop()
+				log.Println("smudge leave")
+				if err := smudge.Leave(5 * time.Second); err != nil {
+					log.Println(err)
+				}
 			}()
 		}
+		var server *http.Server
+
+		if httpAddress != "" {
+			metrics := smudge.NewPrometheusMetrics()
+			smudge.SetMetrics(metrics)
+
+			server = &http.Server{Addr: httpAddress, Handler: newAdminHandler(metrics)}
+			go func() {
+				if err := server.ListenAndServe(); err != http.ErrServerClosed {
+					log.Fatal(err)
+				}
+			}()
+		}
+
 		smudge.Begin()
+
+		// Let any request that stopped us (such as POST /leave) finish.
+		if server != nil {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			server.Shutdown(ctx)
+			cancel()
+		}
 	} else {
 		fmt.Println(err)
 	}
@@ -0,0 +1,106 @@
+/*
+Copyright 2016 The Smudge Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package smudge
+
+import "math"
+
+// Rather than declaring a node dead as soon as a probe fails, we first mark
+// it as suspected and gossip that suspicion. The suspected node has until
+// the suspicion timeout to refute it (by gossiping itself as alive with a
+// higher incarnation), after which it's declared dead. This is the
+// "suspicion subprotocol" described in section 4.2 of the SWIM paper.
+
+// suspicionTimeoutMillis returns how long a node may remain suspected before
+// it's declared dead. It's scaled logarithmically by cluster size, since a
+// refutation takes longer to reach every member of a larger cluster, and by
+// the local health multiplier, since an unhealthy host may be slow to hear
+// it.
+func (c *Cluster) suspicionTimeoutMillis() int64 {
+	scale := math.Max(1.0, math.Log10(float64(c.knownNodes.length())))
+	timeout := float64(c.SuspicionMultiplier()) * scale * float64(c.HeartbeatMillis())
+
+	return int64(timeout) * c.localHealthMultiplier()
+}
+
+// checkSuspicions declares dead every suspected node whose suspicion timeout
+// has expired. It is called periodically by startTimeoutCheckLoop().
+func (c *Cluster) checkSuspicions() {
+	timeout := c.suspicionTimeoutMillis()
+	now := c.nowMillis()
+	expired := make([]string, 0)
+
+	c.suspicions.RLock()
+	for address, since := range c.suspicions.m {
+		if now-since > timeout {
+			expired = append(expired, address)
+		}
+	}
+	c.suspicions.RUnlock()
+
+	for _, address := range expired {
+		node := c.knownNodes.getByAddress(address)
+
+		if node == nil || node.Status() != StatusSuspected {
+			c.suspicions.Lock()
+			delete(c.suspicions.m, address)
+			c.suspicions.Unlock()
+
+			continue
+		}
+
+		logDebug(address, "suspicion timed out after", timeout, "milliseconds")
+
+		c.updateNodeStatus(node, StatusDead, node.Heartbeat(), node.Incarnation())
+	}
+}
+
+// noteSuspicion records the time at which a node became suspected, or forgets
+// it if the node is no longer suspected. Called by setNodeStatus().
+func (c *Cluster) noteSuspicion(node *Node, status NodeStatus) {
+	c.suspicions.Lock()
+	if status == StatusSuspected {
+		if _, ok := c.suspicions.m[node.Address()]; !ok {
+			c.suspicions.m[node.Address()] = c.nowMillis()
+		}
+	} else {
+		delete(c.suspicions.m, node.Address())
+	}
+	c.suspicions.Unlock()
+}
+
+// refute is called when another member claims that this host is suspected
+// or dead as of the given incarnation. We advance our own incarnation beyond
+// it and queue ourselves to be gossiped as alive, which overrides the rumor
+// wherever it has spread.
+func (c *Cluster) refute(incarnation uint32) {
+	logfInfo("Refuting suspicion of this host at incarnation %d\n", incarnation)
+
+	// Others only suspect us if they haven't been hearing from us.
+	c.adjustLocalHealth(healthRefuted)
+
+	emitCount := int8(c.emitCount())
+
+	c.thisHost.mutex.Lock()
+	c.thisHost.incarnation = incarnation + 1
+	c.thisHost.metadataVersion = c.thisHost.incarnation + 1
+	c.thisHost.emitCounter = emitCount
+	c.thisHost.mutex.Unlock()
+
+	if !c.updatedNodes.contains(c.thisHost) {
+		c.updatedNodes.add(c.thisHost)
+	}
+}
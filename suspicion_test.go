@@ -0,0 +1,142 @@
+/*
+Copyright 2016 The Smudge Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package smudge
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// Returns a cluster whose local node has been set up without opening a
+// socket, plus one known remote node.
+func newSuspicionTestCluster() (*Cluster, *Node) {
+	return newSuspicionTestClusterWithClock(nil)
+}
+
+// As newSuspicionTestCluster(), but on the specified clock.
+func newSuspicionTestClusterWithClock(clock Clock) (*Cluster, *Node) {
+	c := NewCluster(&Config{HeartbeatMillis: 10, SuspicionMultiplier: 1, Clock: clock})
+	c.thisHost, _ = CreateNodeByIP(net.IP([]byte{127, 0, 0, 1}), 9999)
+	c.thisHost.status = StatusAlive
+	c.knownNodes.add(c.thisHost)
+
+	remote, _ := CreateNodeByIP(net.IP([]byte{127, 0, 0, 2}), 9999)
+	c.updateNodeStatus(remote, StatusAlive, 1, 0)
+	c.AddNode(remote)
+
+	return c, remote
+}
+
+// A suspected node that doesn't refute is declared dead once its suspicion
+// times out, and subscribers see each transition.
+func TestSuspicionTimeout(t *testing.T) {
+	clock := NewFakeClock(time.Unix(1000, 0))
+	c, remote := newSuspicionTestClusterWithClock(clock)
+
+	sub := c.Subscribe(nil)
+	defer sub.Unsubscribe()
+
+	c.updateNodeStatus(remote, StatusSuspected, 1, 0)
+
+	if _, ok := c.suspicions.m[remote.Address()]; !ok {
+		t.Fatal("suspicion not recorded")
+	}
+
+	// Not yet timed out.
+	c.checkSuspicions()
+	if remote.Status() != StatusSuspected {
+		t.Fatal("node declared dead too early:", remote.Status())
+	}
+
+	// Just before the timeout, still suspected.
+	clock.Advance(time.Duration(c.suspicionTimeoutMillis()) * time.Millisecond)
+	c.checkSuspicions()
+	if remote.Status() != StatusSuspected {
+		t.Fatal("node declared dead too early:", remote.Status())
+	}
+
+	clock.Advance(time.Millisecond)
+	c.checkSuspicions()
+
+	if remote.Status() != StatusDead {
+		t.Error("expected DEAD, got", remote.Status())
+	}
+
+	if _, ok := c.suspicions.m[remote.Address()]; ok {
+		t.Error("suspicion not cleared after death")
+	}
+
+	events := bufferedEvents(sub)
+	if len(events) != 2 ||
+		events[0].Type != NodeStatusChanged || events[0].Status != StatusSuspected ||
+		events[1].Type != NodeLeft || events[1].Status != StatusDead ||
+		events[1].PreviousStatus != StatusSuspected {
+		t.Errorf("unexpected events: %+v", events)
+	}
+}
+
+// An ALIVE rumor at the same incarnation as the suspicion must not clear it,
+// but one with a higher incarnation must.
+func TestSuspicionClearedOnlyByNewerAlive(t *testing.T) {
+	c, remote := newSuspicionTestCluster()
+	c.updateNodeStatus(remote, StatusSuspected, 1, 0)
+
+	msg := newMessage(verbAck, c.thisHost, 0)
+	msg.addMember(remote, StatusAlive, 1)
+	c.updateStatusesFromMessage(msg)
+
+	if remote.Status() != StatusSuspected {
+		t.Error("stale ALIVE cleared suspicion")
+	}
+
+	msg = newMessage(verbAck, c.thisHost, 0)
+	msg.addMember(remote, StatusAlive, 1)
+	msg.members[0].incarnation = 1
+	c.updateStatusesFromMessage(msg)
+
+	if remote.Status() != StatusAlive {
+		t.Error("newer ALIVE did not clear suspicion:", remote.Status())
+	}
+
+	if _, ok := c.suspicions.m[remote.Address()]; ok {
+		t.Error("suspicion not cleared")
+	}
+}
+
+// A node that hears it is suspected advances its incarnation and queues
+// itself to be gossiped as alive.
+func TestSuspicionRefutation(t *testing.T) {
+	c, remote := newSuspicionTestCluster()
+
+	msg := newMessage(verbPing, remote, 2)
+	msg.addMember(c.thisHost, StatusSuspected, 7)
+	msg.members[0].incarnation = 4
+	c.updateStatusesFromMessage(msg)
+
+	if c.thisHost.Status() != StatusAlive {
+		t.Error("this host's status changed to", c.thisHost.Status())
+	}
+
+	if c.thisHost.Incarnation() != 5 {
+		t.Errorf("incarnation not advanced: %d", c.thisHost.Incarnation())
+	}
+
+	if !c.updatedNodes.contains(c.thisHost) || c.thisHost.emitCounter <= 0 {
+		t.Error("this host not queued for gossip")
+	}
+}
@@ -0,0 +1,330 @@
+/*
+Copyright 2016 The Smudge Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package smudge
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/tevino/abool"
+)
+
+// A Transport is what a Cluster uses to talk to other members. Gossip is
+// carried by packets, which may be lost, duplicated or reordered; full state
+// syncs, reliable broadcasts and large direct messages need streams as well,
+// which a Transport provides by also implementing StreamTransport. Unless
+// Config.Transport is set, a Cluster uses a NetTransport, which sends
+// packets over UDP and streams over TCP.
+type Transport interface {
+	// Listen starts receiving packets (and streams, if supported) addressed
+	// to ip:port. A nil ip means all local addresses.
+	Listen(ip net.IP, port int) error
+
+	// WriteTo sends a packet to an address of the form host:port.
+	WriteTo(bytes []byte, address string) error
+
+	// Packets returns the channel on which received packets are delivered.
+	// It's closed by Shutdown().
+	Packets() <-chan *Packet
+
+	// Shutdown stops receiving and releases the transport's resources. The
+	// transport may be started again with Listen().
+	Shutdown() error
+}
+
+// StreamTransport is implemented by Transports that support streams as well
+// as packets. Without one, a Cluster can still gossip, but can't exchange
+// full state, fetch reliable broadcasts or send large direct messages.
+type StreamTransport interface {
+	Transport
+
+	// DialStream opens a stream to an address of the form host:port.
+	DialStream(address string, timeout time.Duration) (net.Conn, error)
+
+	// Streams returns the channel on which accepted streams are delivered.
+	// It's closed by Shutdown().
+	Streams() <-chan net.Conn
+}
+
+// Packet is a single message received by a Transport.
+type Packet struct {
+	// The packet's contents. The receiver owns this slice.
+	Bytes []byte
+
+	// The address the packet was sent from.
+	From net.Addr
+
+	// If not nil, Done is called once the packet has been handled. Simulated
+	// transports use it to tell when the members they connect are idle.
+	Done func()
+}
+
+// NetTransport is the default Transport, which sends packets over UDP and
+// streams over TCP, both on the same port.
+type NetTransport struct {
+	udpConn     *net.UDPConn
+	tcpListener *net.TCPListener
+	packets     chan *Packet
+	streams     chan net.Conn
+	running     *abool.AtomicBool
+	wg          sync.WaitGroup
+}
+
+// The number of received packets or streams buffered before the transport
+// stops reading from its sockets.
+const transportQueueLength = 256
+
+var errStreamsUnsupported = errors.New("transport does not support streams")
+
+/******************************************************************************
+ * Exported functions (for public consumption)
+ *****************************************************************************/
+
+// NewNetTransport returns a new, unstarted NetTransport.
+func NewNetTransport() *NetTransport {
+	return &NetTransport{running: abool.New()}
+}
+
+// Listen opens the UDP and TCP sockets, failing if either can't be bound.
+func (t *NetTransport) Listen(ip net.IP, port int) error {
+	var addr string
+	if ip == nil {
+		addr = ":" + strconv.FormatInt(int64(port), 10)
+	} else {
+		addr = nodeAddressString(ip, uint16(port))
+	}
+
+	udpAddress, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return err
+	}
+
+	tcpAddress, err := net.ResolveTCPAddr("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	udpConn, err := net.ListenUDP("udp", udpAddress)
+	if err != nil {
+		return err
+	}
+
+	tcpListener, err := net.ListenTCP("tcp", tcpAddress)
+	if err != nil {
+		udpConn.Close()
+		return err
+	}
+
+	t.udpConn = udpConn
+	t.tcpListener = tcpListener
+	t.packets = make(chan *Packet, transportQueueLength)
+	t.streams = make(chan net.Conn, transportQueueLength)
+	t.running.Set()
+
+	t.wg.Add(2)
+	go t.readPackets(udpConn, t.packets)
+	go t.acceptStreams(tcpListener, t.streams)
+
+	return nil
+}
+
+// WriteTo sends a packet over UDP. Packets are sent from the listening
+// socket, so that replies come back to the same port; if the transport isn't
+// listening, a new socket is used instead.
+func (t *NetTransport) WriteTo(bytes []byte, address string) error {
+	remoteAddr, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		return err
+	}
+
+	if conn := t.udpConn; conn != nil && t.running.IsSet() {
+		_, err = conn.WriteToUDP(bytes, remoteAddr)
+		return err
+	}
+
+	conn, err := net.DialUDP("udp", nil, remoteAddr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_, err = conn.Write(bytes)
+
+	return err
+}
+
+// Packets returns the channel of received UDP packets.
+func (t *NetTransport) Packets() <-chan *Packet {
+	return t.packets
+}
+
+// DialStream opens a TCP connection.
+func (t *NetTransport) DialStream(address string, timeout time.Duration) (net.Conn, error) {
+	return net.DialTimeout("tcp", address, timeout)
+}
+
+// Streams returns the channel of accepted TCP connections.
+func (t *NetTransport) Streams() <-chan net.Conn {
+	return t.streams
+}
+
+// Shutdown closes both sockets, and waits for the goroutines reading from
+// them to finish.
+func (t *NetTransport) Shutdown() error {
+	if !t.running.SetToIf(true, false) {
+		return errors.New("transport is not running")
+	}
+
+	udpErr := t.udpConn.Close()
+	tcpErr := t.tcpListener.Close()
+
+	t.wg.Wait()
+
+	if udpErr != nil {
+		return udpErr
+	}
+
+	return tcpErr
+}
+
+/******************************************************************************
+ * Private functions (for internal use only)
+ *****************************************************************************/
+
+func (t *NetTransport) readPackets(conn *net.UDPConn, packets chan *Packet) {
+	defer t.wg.Done()
+	defer close(packets)
+
+	buf := make([]byte, maxUDPMessageBytes)
+
+	for {
+		n, addr, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			if !t.running.IsSet() {
+				logInfo("UDP Listen closes")
+				return
+			}
+
+			logError("UDP read error: ", err)
+			continue
+		}
+
+		// The buffer is reused, so each packet gets its own copy.
+		bytes := make([]byte, n)
+		copy(bytes, buf[:n])
+
+		packets <- &Packet{Bytes: bytes, From: addr}
+	}
+}
+
+func (t *NetTransport) acceptStreams(listener *net.TCPListener, streams chan net.Conn) {
+	defer t.wg.Done()
+	defer close(streams)
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if !t.running.IsSet() {
+				logInfo("TCP Listen closes")
+				return
+			}
+
+			logError("TCP accept error: ", err)
+			continue
+		}
+
+		streams <- conn
+	}
+}
+
+// receivePackets hands each packet received by the transport to
+// receiveMessageUDP(), until the transport is shut down.
+func (c *Cluster) receivePackets(transport Transport) {
+	for packet := range transport.Packets() {
+		packet := packet
+
+		c.spawn(func() {
+			if packet.Done != nil {
+				defer packet.Done()
+			}
+
+			err := c.receiveMessageUDP(addressIP(packet.From), packet.Bytes)
+			if err != nil {
+				logError(err)
+			}
+		})
+	}
+}
+
+// acceptStreams hands each stream accepted by the transport to
+// handleTCPConn(), until the transport is shut down.
+func (c *Cluster) acceptStreams(transport Transport) {
+	st, ok := transport.(StreamTransport)
+	if !ok {
+		logWarn("Transport doesn't support streams; full state sync unavailable")
+		return
+	}
+
+	for conn := range st.Streams() {
+		conn := conn
+
+		c.spawn(func() { c.handleTCPConn(conn) })
+	}
+}
+
+// writePacket sends a packet to a node through the cluster's transport.
+func (c *Cluster) writePacket(bytes []byte, node *Node) error {
+	if c.transport == nil {
+		return errors.New("cluster is not running")
+	}
+
+	return c.transport.WriteTo(bytes, node.Address())
+}
+
+// dialStream opens a stream to a node through the cluster's transport.
+func (c *Cluster) dialStream(node *Node, timeout time.Duration) (net.Conn, error) {
+	if c.transport == nil {
+		return nil, errors.New("cluster is not running")
+	}
+
+	st, ok := c.transport.(StreamTransport)
+	if !ok {
+		return nil, errStreamsUnsupported
+	}
+
+	return st.DialStream(node.Address(), timeout)
+}
+
+// addressIP returns the IP part of a packet's source address.
+func addressIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		return a.IP
+	case *net.TCPAddr:
+		return a.IP
+	}
+
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return nil
+	}
+
+	return net.ParseIP(host)
+}
@@ -0,0 +1,180 @@
+/*
+Copyright 2016 The Smudge Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package smudge
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// A packet-only Transport that delivers packets between the members of a
+// chanNetwork through channels.
+type chanTransport struct {
+	network *chanNetwork
+	addr    *net.UDPAddr
+	packets chan *Packet
+}
+
+type chanNetwork struct {
+	sync.Mutex
+	members map[string]*chanTransport
+}
+
+func (t *chanTransport) Listen(ip net.IP, port int) error {
+	t.addr = &net.UDPAddr{IP: ip, Port: port}
+	t.packets = make(chan *Packet, 64)
+
+	t.network.Lock()
+	t.network.members[t.addr.String()] = t
+	t.network.Unlock()
+
+	return nil
+}
+
+func (t *chanTransport) WriteTo(bytes []byte, address string) error {
+	t.network.Lock()
+	defer t.network.Unlock()
+
+	to, ok := t.network.members[address]
+	if !ok {
+		return errors.New("no route to " + address)
+	}
+
+	select {
+	case to.packets <- &Packet{Bytes: append([]byte(nil), bytes...), From: t.addr}:
+	default:
+	}
+
+	return nil
+}
+
+func (t *chanTransport) Packets() <-chan *Packet {
+	return t.packets
+}
+
+func (t *chanTransport) Shutdown() error {
+	t.network.Lock()
+	delete(t.network.members, t.addr.String())
+	close(t.packets)
+	t.network.Unlock()
+
+	return nil
+}
+
+func TestNetTransport(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping network test in short mode")
+	}
+
+	SetLogThreshold(LogWarn)
+	defer SetLogThreshold(LogInfo)
+
+	loopback := net.IP([]byte{127, 0, 0, 1})
+	transport := NewNetTransport()
+
+	// Once shut down, the transport can be started again.
+	for i := 0; i < 2; i++ {
+		if err := transport.Listen(loopback, 19171); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := transport.WriteTo([]byte("hello"), "127.0.0.1:19171"); err != nil {
+			t.Fatal(err)
+		}
+
+		select {
+		case p := <-transport.Packets():
+			if string(p.Bytes) != "hello" || !addressIP(p.From).Equal(loopback) {
+				t.Errorf("unexpected packet %q from %v", p.Bytes, p.From)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("packet not received")
+		}
+
+		conn, err := transport.DialStream("127.0.0.1:19171", time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Close()
+
+		select {
+		case conn := <-transport.Streams():
+			conn.Close()
+		case <-time.After(time.Second):
+			t.Fatal("stream not accepted")
+		}
+
+		if err := transport.Shutdown(); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, ok := <-transport.Packets(); ok {
+			t.Error("packet channel not closed by Shutdown()")
+		}
+	}
+
+	if err := transport.Shutdown(); err == nil {
+		t.Error("expected an error shutting down a stopped transport")
+	}
+}
+
+// Two members converge over a custom, packet-only transport.
+func TestCustomTransport(t *testing.T) {
+	SetLogThreshold(LogFatal)
+	defer SetLogThreshold(LogInfo)
+
+	loopback := net.IP([]byte{127, 0, 0, 1})
+	network := &chanNetwork{members: make(map[string]*chanTransport)}
+
+	newChanTestCluster := func(port int) *Cluster {
+		return NewCluster(&Config{
+			ListenIP:        loopback,
+			ListenPort:      port,
+			HeartbeatMillis: 20,
+			InitialHosts:    []string{},
+			SyncMillis:      -1,
+			Transport:       &chanTransport{network: network},
+		})
+	}
+
+	a := newChanTestCluster(1)
+	b := newChanTestCluster(2)
+
+	seed, _ := CreateNodeByIP(loopback, 1)
+	b.AddNode(seed)
+
+	go a.Begin()
+	go b.Begin()
+	defer a.Stop()
+	defer b.Stop()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(a.HealthyNodes()) != 2 || len(b.HealthyNodes()) != 2 {
+		if time.Now().After(deadline) {
+			t.Fatal("members did not converge")
+		}
+
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	if _, err := a.dialStream(seed, time.Second); err != errStreamsUnsupported {
+		t.Error("expected streams to be unsupported, got", err)
+	}
+}